@@ -0,0 +1,367 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// All the supported aggregate functions
+type AggregateFunc int
+
+const (
+	COUNT AggregateFunc = iota
+	SUM
+	MIN
+	MAX
+	AVG
+)
+
+func (f AggregateFunc) String() string {
+	switch f {
+	case COUNT:
+		return "COUNT"
+	case SUM:
+		return "SUM"
+	case MIN:
+		return "MIN"
+	case MAX:
+		return "MAX"
+	case AVG:
+		return "AVG"
+	default:
+		panic("Unknown aggregate function")
+	}
+}
+
+// An aggregate function applied over a column.
+// ColName should be "*" for COUNT(*). If Distinct is
+// set, the duplicate values in the column are ignored.
+type Aggregate struct {
+	Func     AggregateFunc
+	ColName  string
+	Distinct bool
+}
+
+func (a Aggregate) String() string {
+	if a.Distinct {
+		return fmt.Sprintf("%s(DISTINCT %s)", a.Func, a.ColName)
+	}
+	return fmt.Sprintf("%s(%s)", a.Func, a.ColName)
+}
+
+// Returns the aggregate function for the given
+// name, case insensitively
+func aggregateFuncByName(name string) (AggregateFunc, bool) {
+	switch strings.ToUpper(name) {
+	case "COUNT":
+		return COUNT, true
+	case "SUM":
+		return SUM, true
+	case "MIN":
+		return MIN, true
+	case "MAX":
+		return MAX, true
+	case "AVG":
+		return AVG, true
+	}
+	return 0, false
+}
+
+// Parses the canonical name of an aggregate, as returned
+// by Aggregate.String(), back in to an Aggregate
+func aggregateByName(name string) (Aggregate, bool) {
+	open := strings.Index(name, "(")
+	if open < 1 || !strings.HasSuffix(name, ")") {
+		return Aggregate{}, false
+	}
+
+	f, ok := aggregateFuncByName(name[:open])
+	if !ok {
+		return Aggregate{}, false
+	}
+
+	agg := Aggregate{Func: f, ColName: name[open+1 : len(name)-1]}
+	if strings.HasPrefix(agg.ColName, "DISTINCT ") {
+		agg.ColName = strings.TrimPrefix(agg.ColName, "DISTINCT ")
+		agg.Distinct = true
+	}
+	return agg, true
+}
+
+// The running state of an aggregate function for a single group
+type aggState struct {
+	count int
+	sum   int
+
+	// min and max are valid only if count > 0
+	minInt, maxInt int
+	minStr, maxStr string
+
+	// keys of the values seen so far, used only for DISTINCT
+	seen map[string]bool
+}
+
+// Returns true if the value of the key is seen for the first time
+// in the group, and remembers it, so that the next call with the
+// same key returns false
+func (s *aggState) firstSeen(key []byte) bool {
+	if s.seen == nil {
+		s.seen = make(map[string]bool)
+	}
+	if s.seen[string(key)] {
+		return false
+	}
+	s.seen[string(key)] = true
+	return true
+}
+
+// Holds the running states of a single aggregate function,
+// one per group, while it is computed over a set of rows
+type aggregator struct {
+	agg       Aggregate
+	colType   ColumnType
+	collation Collation
+	colData   interface{}
+
+	states []aggState
+}
+
+// Creates an aggregator after validating that the aggregate
+// function makes sense for the column type.
+// Not threadsafe. Caller should have acquired readlock
+func newAggregator(tbl *table, agg Aggregate) (*aggregator, error) {
+	a := &aggregator{agg: agg}
+
+	if agg.ColName == "*" {
+		if agg.Func != COUNT || agg.Distinct {
+			return nil, fmt.Errorf("%s is not supported", agg)
+		}
+		return a, nil
+	}
+
+	desc, ok := tbl.colDesc(agg.ColName)
+	if !ok {
+		return nil, fmt.Errorf("Invalid column name: %s", agg.ColName)
+	}
+	a.colType = desc.ColType
+	a.collation = desc.Collation
+	a.colData = tbl.cols[agg.ColName]
+
+	switch desc.ColType {
+	case IntColumn:
+	case StringColumn:
+		if agg.Func == SUM || agg.Func == AVG {
+			return nil, fmt.Errorf("%s is not supported on string column %s",
+				agg.Func, agg.ColName)
+		}
+	default:
+		if agg.Func != COUNT {
+			return nil, fmt.Errorf("%s is not supported on column %s",
+				agg.Func, agg.ColName)
+		}
+	}
+
+	return a, nil
+}
+
+// Returns the type of the values returned by the result function
+func (a *aggregator) resultType() ColumnType {
+	switch a.agg.Func {
+	case COUNT, SUM:
+		return IntColumn
+	case MIN, MAX:
+		return a.colType
+	}
+	// AVG returns a float64, for which there is no column type
+	return CustomColumn
+}
+
+// Accumulates the values of the given rows in to the aggregator.
+// groups[i] is the index of the group to which rows[i] belongs.
+// If groups is nil, all the rows belong to the group 0.
+// Not threadsafe. Caller should have acquired readlock
+func (a *aggregator) accumulate(rows []rowID, groups []int,
+	nGroups int) error {
+
+	for len(a.states) < nGroups {
+		a.states = append(a.states, aggState{})
+	}
+
+	group := func(i int) *aggState {
+		if groups == nil {
+			return &a.states[0]
+		}
+		return &a.states[groups[i]]
+	}
+
+	if a.agg.ColName == "*" {
+		for i := range rows {
+			group(i).count++
+		}
+		return nil
+	}
+
+	var key []byte
+	var err error
+
+	switch a.colType {
+	case IntColumn:
+		for i, id := range rows {
+			v, ok := intValue(a.colData, id)
+			if !ok {
+				continue
+			}
+			s := group(i)
+			if a.agg.Distinct {
+				key, _ = appendValueKey(key[:0], v)
+				if !s.firstSeen(key) {
+					continue
+				}
+			}
+			if s.count == 0 || v < s.minInt {
+				s.minInt = v
+			}
+			if s.count == 0 || v > s.maxInt {
+				s.maxInt = v
+			}
+			s.sum += v
+			s.count++
+		}
+	case StringColumn:
+		for i, id := range rows {
+			v, ok := stringValue(a.colData, id)
+			if !ok {
+				continue
+			}
+			s := group(i)
+			if a.agg.Distinct {
+				key, _, _ = appendColumnKey(key[:0], a.colType, a.colData, id)
+				if !s.firstSeen(key) {
+					continue
+				}
+			}
+			if s.count == 0 || a.collation.compare(v, s.minStr) < 0 {
+				s.minStr = v
+			}
+			if s.count == 0 || a.collation.compare(v, s.maxStr) > 0 {
+				s.maxStr = v
+			}
+			s.count++
+		}
+	case CustomColumn:
+		data := a.colData.(map[rowID]interface{})
+		for i, id := range rows {
+			v, ok := data[id]
+			if !ok {
+				continue
+			}
+			s := group(i)
+			if a.agg.Distinct {
+				key, err = appendValueKey(key[:0], v)
+				if err != nil {
+					return err
+				}
+				if !s.firstSeen(key) {
+					continue
+				}
+			}
+			s.count++
+		}
+	}
+
+	return nil
+}
+
+// Returns the value of the aggregate for the given group. Except
+// for COUNT, nil is returned if there were no values aggregated.
+func (a *aggregator) result(g int) interface{} {
+	var s aggState
+	if g < len(a.states) {
+		s = a.states[g]
+	}
+
+	if a.agg.Func == COUNT {
+		return s.count
+	}
+
+	if s.count == 0 {
+		return nil
+	}
+
+	switch a.agg.Func {
+	case SUM:
+		return s.sum
+	case AVG:
+		return float64(s.sum) / float64(s.count)
+	case MIN:
+		if a.colType == StringColumn {
+			return s.minStr
+		}
+		return s.minInt
+	case MAX:
+		if a.colType == StringColumn {
+			return s.maxStr
+		}
+		return s.maxInt
+	}
+	panic("Not reachable")
+}
+
+// Computes the aggregates over the rows matching the cTree
+// and returns a single row with one value per aggregate.
+// If the cTree is nil, all the rows of the table are aggregated.
+func (db *Keeri) QueryAggregates(tableName string, aggs []Aggregate,
+	cTree *ConditionTree) ([]interface{}, error) {
+
+	tbl, err := db.lookupTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	tbl.dataMetaDataLock.RLock()
+	defer tbl.dataMetaDataLock.RUnlock()
+	return tbl.queryAggregates(aggs, cTree)
+}
+
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) queryAggregates(aggs []Aggregate,
+	cTree *ConditionTree) ([]interface{}, error) {
+
+	if len(aggs) < 1 {
+		return nil, errors.New("No aggregates specified")
+	}
+
+	var aggregators []*aggregator
+	for _, agg := range aggs {
+		a, err := newAggregator(t, agg)
+		if err != nil {
+			return nil, err
+		}
+		aggregators = append(aggregators, a)
+	}
+
+	var matchingRowIDs []rowID
+	if cTree != nil {
+		matchingRowIDs = cTree.evaluate(t)
+	} else {
+		matchingRowIDs = t.liveRowIDs()
+	}
+
+	row := make([]interface{}, 0, len(aggregators))
+	for _, a := range aggregators {
+		err := a.accumulate(matchingRowIDs, nil, 1)
+		if err != nil {
+			return nil, err
+		}
+		row = append(row, a.result(0))
+	}
+
+	return row, nil
+}
@@ -0,0 +1,255 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import "fmt"
+
+// Adds the column to the table, with the value def in all the existing
+// rows, where a nil def leaves the column as NULL in them, which fails for
+// a NotNull column, unless the table is empty. The def should be of the
+// type of the column, and the column's Default is used only for the rows
+// inserted after it is added. The existing rows are backfilled without
+// holding the lock of the table, so the queries and the inserts are
+// blocked only while the rows inserted during the backfill are filled in.
+// An AutoIncrement column can be added only to an empty table.
+func (db *Keeri) AddColumn(tableName string, col ColumnDesc,
+	def interface{}) error {
+
+	tbl, err := db.lookupTable(tableName)
+	if err != nil {
+		return err
+	}
+	if err = checkColumnValue(col, def); err != nil {
+		return err
+	}
+	if err = db.checkDefault(col); err != nil {
+		return err
+	}
+	if col.AutoIncrement && (col.ColType != IntColumn || def != nil) {
+		return fmt.Errorf("The AutoIncrement column '%s' should be an "+
+			"IntColumn, without a def", col.ColName)
+	}
+	data, err := tbl.newColumnData(col)
+	if err != nil {
+		return err
+	}
+
+	tbl.dataMetaDataLock.RLock()
+	_, exists := tbl.colDesc(col.ColName)
+	ids := tbl.liveRowIDs()
+	last := tbl.curRowID()
+	version := tbl.version
+	tbl.dataMetaDataLock.RUnlock()
+
+	if exists {
+		return fmt.Errorf("Column '%s' already exists", col.ColName)
+	}
+	if def != nil {
+		for _, id := range ids {
+			setColumnValue(col.ColType, data, id, def)
+		}
+	}
+
+	tbl.dataMetaDataLock.Lock()
+	defer tbl.dataMetaDataLock.Unlock()
+
+	if _, ok := tbl.colDesc(col.ColName); ok {
+		return fmt.Errorf("Column '%s' already exists", col.ColName)
+	}
+	// The sequence of the Default may have been dropped meanwhile
+	if err = db.checkDefault(col); err != nil {
+		return err
+	}
+	if col.NotNull && def == nil && len(tbl.liveRows) > 0 {
+		return tbl.notNullError(col.ColName)
+	}
+	if col.AutoIncrement && len(tbl.liveRows) > 0 {
+		return fmt.Errorf("Can not add the AutoIncrement column '%s' to "+
+			"a table with rows", col.ColName)
+	}
+
+	if def != nil {
+		// The rows may have been replaced during the backfill,
+		// and then all of them are backfilled again
+		if tbl.version != version {
+			data, _ = tbl.newColumnData(col)
+			last = 0
+		}
+
+		// As the rowIDs are taken under the writelock, the rows
+		// inserted during the backfill are all after the last one
+		cur := tbl.curRowID()
+		for id := last + 1; id <= cur; id++ {
+			if tbl.liveRows[id] {
+				setColumnValue(col.ColType, data, id, def)
+			}
+		}
+
+		// The rows deleted during the backfill are not live any more
+		for _, id := range ids {
+			if !tbl.liveRows[id] {
+				deleteColumnValue(col.ColType, data, id)
+			}
+		}
+	}
+
+	tbl.skipTruncated(data)
+	tbl.cols[col.ColName] = data
+	if z := tbl.buildZoneMap(col, data); z != nil {
+		tbl.zones[col.ColName] = z
+	}
+	tbl.colsDesc = append(append([]ColumnDesc{}, tbl.colsDesc...), col)
+	tbl.version++
+	tbl.seal()
+	return nil
+}
+
+// Drops the column and all its values from the table,
+// which should have at least one more column
+func (db *Keeri) DropColumn(tableName, colName string) error {
+	tbl, err := db.lookupTable(tableName)
+	if err != nil {
+		return err
+	}
+
+	tbl.dataMetaDataLock.Lock()
+	defer tbl.dataMetaDataLock.Unlock()
+
+	if _, ok := tbl.colDesc(colName); !ok {
+		return fmt.Errorf("Invalid column name: %s", colName)
+	}
+	for _, x := range tbl.indexes {
+		for _, c := range x.cols {
+			if c == colName {
+				return fmt.Errorf("Can not drop '%s', which is used by the "+
+					"constraint '%s'", colName, x.name)
+			}
+		}
+	}
+	if c := tbl.inCheck(colName); c != nil {
+		return fmt.Errorf("Can not drop '%s', which is used by the "+
+			"constraint '%s'", colName, c.name)
+	}
+	for _, fk := range tbl.foreignKeys {
+		for _, c := range fk.cols {
+			if c == colName {
+				return fmt.Errorf("Can not drop '%s', which is used by the "+
+					"constraint '%s'", colName, fk.name)
+			}
+		}
+	}
+	if len(tbl.colsDesc) == 1 {
+		return fmt.Errorf("Can not drop '%s', the only column of the table",
+			colName)
+	}
+
+	var descs []ColumnDesc
+	for _, i := range tbl.colsDesc {
+		if i.ColName != colName {
+			descs = append(descs, i)
+		}
+	}
+	tbl.colsDesc = descs
+	delete(tbl.cols, colName)
+	delete(tbl.autoIncrements, colName)
+	delete(tbl.zones, colName)
+	tbl.version++
+	return nil
+}
+
+// Renames a column of the table, keeping its values, along with the
+// column in the constraints of the table and of the foreign keys
+// that refer to the table
+func (db *Keeri) RenameColumn(tableName, colName, newName string) error {
+	tbl, unlock, err := db.lockRelated(tableName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, ok := tbl.colDesc(colName); !ok {
+		return fmt.Errorf("Invalid column name: %s", colName)
+	}
+	if colName == newName {
+		return nil
+	}
+	if _, ok := tbl.colDesc(newName); ok {
+		return fmt.Errorf("Column '%s' already exists", newName)
+	}
+
+	descs := append([]ColumnDesc{}, tbl.colsDesc...)
+	for i := range descs {
+		if descs[i].ColName == colName {
+			descs[i].ColName = newName
+		}
+	}
+	tbl.colsDesc = descs
+
+	// The columns of the constraints are renamed on a copy,
+	// as they are also returned by the *ConstraintErrors
+	rename := func(cols []string) []string {
+		ret := append([]string{}, cols...)
+		for k := range ret {
+			if ret[k] == colName {
+				ret[k] = newName
+			}
+		}
+		return ret
+	}
+	for _, x := range tbl.indexes {
+		x.cols = rename(x.cols)
+	}
+	for _, c := range tbl.checks {
+		rewriteExprColumns(c.cond, func(name string) string {
+			if name == colName {
+				return newName
+			}
+			return name
+		})
+		c.cols = exprColumns(c.cond)
+	}
+	for _, fk := range tbl.foreignKeys {
+		fk.cols = rename(fk.cols)
+	}
+	for _, fk := range tbl.refs {
+		fk.parentCols = rename(fk.parentCols)
+	}
+	tbl.cols[newName] = tbl.cols[colName]
+	delete(tbl.cols, colName)
+	if z, ok := tbl.zones[colName]; ok {
+		tbl.zones[newName] = z
+		delete(tbl.zones, colName)
+	}
+	if v, ok := tbl.autoIncrements[colName]; ok {
+		tbl.autoIncrements[newName] = v
+		delete(tbl.autoIncrements, colName)
+	}
+	tbl.version++
+	return nil
+}
+
+// Returns an error if the value can not be stored in the column,
+// where a nil is a NULL, which can be stored in any column
+func checkColumnValue(desc ColumnDesc, v interface{}) error {
+	switch v.(type) {
+	case nil:
+		return nil
+	case int:
+		if desc.ColType == IntColumn {
+			return nil
+		}
+	case string:
+		if desc.ColType == StringColumn {
+			return nil
+		}
+	}
+	if desc.ColType == CustomColumn {
+		return nil
+	}
+	return fmt.Errorf("Mismatched type %T of the value for the column '%s'",
+		v, desc.ColName)
+}
@@ -0,0 +1,293 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import "strconv"
+
+// The syntax tree of a SELECT query, as returned by ParseSelect.
+// Column names are kept as written in the query and are resolved
+// against the tables only when the query is run.
+type SelectStmt struct {
+	Distinct bool
+	Items    []SelectItem
+	From     []JoinTable
+	Where    Expr
+	GroupBy  []Expr
+	Having   Expr
+	OrderBy  []OrderByItem
+}
+
+// A single entry in the SELECT list, which is a *ColumnRef, an
+// *AggregateExpr or any other expression over the columns, with an
+// optional alias. The *ColumnRef of a SELECT * has the Name "*", or
+// "alias.*" for a single table.
+type SelectItem struct {
+	Expr  Expr
+	Alias string
+}
+
+// A single entry in the ORDER BY clause, which is a *ColumnRef,
+// an *AggregateExpr or an expression over the columns. An integer
+// *Literal is the position of a SELECT list item, starting from 1.
+type OrderByItem struct {
+	Expr Expr
+	Desc bool
+}
+
+// An expression in a query. Pos returns the byte
+// offset of the expression in the query string.
+type Expr interface {
+	Pos() int
+	exprNode()
+}
+
+type node struct {
+	offset int
+}
+
+func (n node) Pos() int {
+	return n.offset
+}
+
+func (node) exprNode() {}
+
+// A column name, which may be qualified as alias.col
+type ColumnRef struct {
+	node
+	Name string
+}
+
+// A string or a number. The value is kept as it is written in the
+// query, without the quotes, and is converted to the type of the
+// column it is compared with, when the query is run.
+type Literal struct {
+	node
+	Value  string
+	Quoted bool
+}
+
+// A NULL, which takes the type of the expressions
+// that it is compared with or is an alternative to
+type NullLiteral struct {
+	node
+}
+
+// An aggregate function call, like COUNT(*), which is allowed
+// only in the SELECT list, HAVING and ORDER BY clauses
+type AggregateExpr struct {
+	node
+	Aggregate
+}
+
+// Two conditions joined by AND or OR
+type BinaryExpr struct {
+	node
+	Op    LogicalOperator
+	Left  Expr
+	Right Expr
+}
+
+// A negated condition
+type NotExpr struct {
+	node
+	X Expr
+}
+
+// A comparison, including the pattern matching operators
+type ComparisonExpr struct {
+	node
+	Op    RelationalOperator
+	Left  Expr
+	Right Expr
+}
+
+// An IN or a NOT IN over a list of values
+type InExpr struct {
+	node
+	Op   RelationalOperator
+	X    Expr
+	List []Expr
+}
+
+// A BETWEEN over an inclusive range of values
+type BetweenExpr struct {
+	node
+	X  Expr
+	Lo Expr
+	Hi Expr
+}
+
+// An arithmetic operation over two integers, where the Op is
+// one of + - * / %. A division or a modulo by zero is a NULL.
+type ArithmeticExpr struct {
+	node
+	Op    string
+	Left  Expr
+	Right Expr
+}
+
+// A negation of an integer with a unary minus
+type UnaryExpr struct {
+	node
+	Op string
+	X  Expr
+}
+
+// A call to a scalar function, like LOWER(name). The Name
+// is always in upper case.
+type FuncCall struct {
+	node
+	Name string
+	Args []Expr
+}
+
+// A parameter, whose value is bound from the arguments when the query
+// is run. A ? is numbered by its position among the ?s in the query,
+// like a $1, while a :name has the Name and an Index of 0.
+type Param struct {
+	node
+	Index int
+	Name  string
+
+	// The bound value, which is either an int or a string
+	value interface{}
+
+	// The type of the value, if it is known from the
+	// expression that the parameter is a part of
+	typ   ColumnType
+	typed bool
+}
+
+// A CASE expression. For a simple CASE, with an Operand, the value of
+// every WHEN is compared with the Operand, while for a searched CASE
+// every WHEN is a condition. The value is a NULL if no WHEN matches
+// and there is no ELSE.
+type CaseExpr struct {
+	node
+	Operand Expr
+	Whens   []WhenClause
+	Else    Expr
+}
+
+// A single WHEN of a CASE expression
+type WhenClause struct {
+	Cond   Expr
+	Result Expr
+}
+
+// Calls f for the expression and, recursively,
+// for all the expressions that it is made of
+func walkExpr(e Expr, f func(Expr)) {
+	f(e)
+	switch e := e.(type) {
+	case *BinaryExpr:
+		walkExpr(e.Left, f)
+		walkExpr(e.Right, f)
+	case *NotExpr:
+		walkExpr(e.X, f)
+	case *ComparisonExpr:
+		walkExpr(e.Left, f)
+		walkExpr(e.Right, f)
+	case *InExpr:
+		walkExpr(e.X, f)
+		for _, x := range e.List {
+			walkExpr(x, f)
+		}
+	case *BetweenExpr:
+		walkExpr(e.X, f)
+		walkExpr(e.Lo, f)
+		walkExpr(e.Hi, f)
+	case *ArithmeticExpr:
+		walkExpr(e.Left, f)
+		walkExpr(e.Right, f)
+	case *UnaryExpr:
+		walkExpr(e.X, f)
+	case *FuncCall:
+		for _, x := range e.Args {
+			walkExpr(x, f)
+		}
+	case *CaseExpr:
+		if e.Operand != nil {
+			walkExpr(e.Operand, f)
+		}
+		for _, w := range e.Whens {
+			walkExpr(w.Cond, f)
+			walkExpr(w.Result, f)
+		}
+		if e.Else != nil {
+			walkExpr(e.Else, f)
+		}
+	}
+}
+
+// Returns the expression as SQL, with every operation except
+// a function call and a CASE enclosed in parentheses
+func formatExpr(e Expr) string {
+	switch e := e.(type) {
+	case *ColumnRef:
+		return e.Name
+	case *Literal:
+		if e.Quoted {
+			return "'" + e.Value + "'"
+		}
+		return e.Value
+	case *NullLiteral:
+		return "NULL"
+	case *AggregateExpr:
+		return e.Aggregate.String()
+	case *BinaryExpr:
+		return "(" + formatExpr(e.Left) + " " + e.Op.String() + " " +
+			formatExpr(e.Right) + ")"
+	case *NotExpr:
+		return "(NOT " + formatExpr(e.X) + ")"
+	case *ComparisonExpr:
+		return "(" + formatExpr(e.Left) + " " + e.Op.String() + " " +
+			formatExpr(e.Right) + ")"
+	case *InExpr:
+		return "(" + formatExpr(e.X) + " " + e.Op.String() + " (" +
+			formatExprs(e.List) + "))"
+	case *BetweenExpr:
+		return "(" + formatExpr(e.X) + " BETWEEN " + formatExpr(e.Lo) +
+			" AND " + formatExpr(e.Hi) + ")"
+	case *ArithmeticExpr:
+		return "(" + formatExpr(e.Left) + " " + e.Op + " " +
+			formatExpr(e.Right) + ")"
+	case *UnaryExpr:
+		return "(" + e.Op + formatExpr(e.X) + ")"
+	case *FuncCall:
+		return e.Name + "(" + formatExprs(e.Args) + ")"
+	case *Param:
+		if e.Name != "" {
+			return ":" + e.Name
+		}
+		return "$" + strconv.Itoa(e.Index)
+	case *CaseExpr:
+		s := "CASE"
+		if e.Operand != nil {
+			s += " " + formatExpr(e.Operand)
+		}
+		for _, w := range e.Whens {
+			s += " WHEN " + formatExpr(w.Cond) + " THEN " + formatExpr(w.Result)
+		}
+		if e.Else != nil {
+			s += " ELSE " + formatExpr(e.Else)
+		}
+		return s + " END"
+	}
+	return "?"
+}
+
+func formatExprs(list []Expr) string {
+	s := ""
+	for i, x := range list {
+		if i > 0 {
+			s += ", "
+		}
+		s += formatExpr(x)
+	}
+	return s
+}
@@ -0,0 +1,129 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The ordering of the values of a string column, used by the
+// range predicates, MIN, MAX and ORDER BY
+type Collation int
+
+const (
+	// Orders the strings by their bytes
+	BinaryCollation Collation = iota
+
+	// Orders the strings by their letters, ignoring their case and
+	// their accents, so that "apple" < "Banana" < "cherry" and
+	// "apple" < "Äpfel" < "zebra". Strings with the same letters are
+	// ordered by their accents, where a letter without an accent
+	// comes first, and then by their bytes, so that only the equal
+	// strings compare as equal. The accented Latin letters are
+	// decomposed, so that "ä" and "a\u0308" have the same letters and
+	// accents, and the ligatures are expanded, so that "ß" is "ss".
+	UnicodeCollation
+)
+
+// The levels of the UnicodeCollation, which compares
+// the letters first, and then the accents
+const (
+	letterLevel = iota
+	accentLevel
+)
+
+// Returns -1, 0 or +1 depending on whether a sorts before,
+// is the same as, or sorts after b in the collation
+func (c Collation) compare(a, b string) int {
+	if c == UnicodeCollation {
+		if r := compareLevel(a, b, letterLevel); r != 0 {
+			return r
+		}
+		if r := compareLevel(a, b, accentLevel); r != 0 {
+			return r
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// Compares the weights of the decomposed runes of the strings at the
+// level, where the letters weigh their lower case and the accents are
+// ignored, or the letters weigh the same and the accents weigh their
+// code points, which are all larger than the weight of a letter
+func compareLevel(a, b string, level int) int {
+	da, db := decomposer{s: a}, decomposer{s: b}
+	for {
+		wa, oka := da.weight(level)
+		wb, okb := db.weight(level)
+		if !oka || !okb {
+			if oka {
+				return 1
+			} else if okb {
+				return -1
+			}
+			return 0
+		}
+
+		if wa < wb {
+			return -1
+		} else if wa > wb {
+			return 1
+		}
+	}
+}
+
+// Goes over the runes of a string as if it were decomposed,
+// where a letter in the decompositions is its base letter
+// followed by its accents
+type decomposer struct {
+	s    string
+	rest string
+}
+
+// Returns the next rune, and false after the last one
+func (d *decomposer) next() (rune, bool) {
+	if d.rest == "" {
+		if d.s == "" {
+			return 0, false
+		}
+		r, w := utf8.DecodeRuneInString(d.s)
+		d.s = d.s[w:]
+		// The decompositions are all of the runes from U+00C0
+		if r < 0xC0 {
+			return r, true
+		}
+		if d.rest = decompositions[r]; d.rest == "" {
+			return r, true
+		}
+	}
+	r, w := utf8.DecodeRuneInString(d.rest)
+	d.rest = d.rest[w:]
+	return r, true
+}
+
+// Returns the weight of the next rune that is not
+// ignored at the level, and false after the last one
+func (d *decomposer) weight(level int) (rune, bool) {
+	for {
+		r, ok := d.next()
+		if !ok {
+			return 0, false
+		}
+
+		accent := r >= 0x300 && unicode.Is(unicode.Mn, r)
+		switch {
+		case level == letterLevel && !accent:
+			return unicode.ToLower(r), true
+		case level == accentLevel && accent:
+			return r, true
+		case level == accentLevel:
+			return 0, true
+		}
+	}
+}
@@ -6,24 +6,50 @@
 
 package keeri
 
-// TODO: JOINs are not supported. This struct will change.
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
+// A condition always refers to a single column. For JOINs, the
+// conditions are evaluated over a temporary table of the joined
+// rows, whose columns are named as alias.col
 type Condition struct {
 	op      RelationalOperator
 	colDesc ColumnDesc
 	colData interface{}
 
+	// The zone map of the column, which is nil for the temporary tables
+	zones *zoneMap
+
 	// NOTE:
 	// The below value could become an array of interfaces
 	// to avoid repeated checks for same LHS for different RHS
 	// when we implement support for Joins
 	value interface{}
+
+	// The value as given by the parser, which is converted in to the
+	// value, every time the condition is resolved against a table
+	raw interface{}
+
+	// A condition over expressions instead of a single column, like
+	// price * qty > 100, is kept as the predicate node of the query
+	// and is compiled in to pred when the query is run
+	expr Expr
+	pred *predicate
 }
 
+// Escapes the characters that are not allowed in a JSON string, as
+// the String() of a ConditionTree is expected to be a valid JSON
+var jsonEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"",
+	"\n", "\\n", "\r", "\\r", "\t", "\\t")
+
 func (c Condition) String() string {
-	ret := "\""
-	ret += c.colDesc.ColName
+	if c.expr != nil {
+		return "\"" + jsonEscaper.Replace(formatExpr(c.expr)) + "\""
+	}
+
+	ret := c.colDesc.ColName
 	switch c.op {
 	case LT:
 		ret += "<"
@@ -37,7 +63,25 @@ func (c Condition) String() string {
 		ret += "="
 	case NEQ:
 		ret += "!="
+	case IN, NOTIN, BETWEEN, LIKE, NOTLIKE, ILIKE, NOTILIKE, REGEXP, NOTREGEXP:
+		ret += fmt.Sprintf(" %s ", c.op)
+	}
+	ret += formatValue(c.raw)
+	return "\"" + jsonEscaper.Replace(ret) + "\""
+}
+
+// Formats the value of a condition, where a parameter is shown
+// as it is written in the query, instead of its bound value
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case *Param:
+		return formatExpr(v)
+	case []interface{}:
+		var values []string
+		for _, i := range v {
+			values = append(values, formatValue(i))
+		}
+		return "[" + strings.Join(values, " ") + "]"
 	}
-	ret += fmt.Sprintf("%v\"", c.value)
-	return ret
+	return fmt.Sprintf("%v", v)
 }
@@ -25,7 +25,14 @@ type ConditionTree struct {
 // Locks should be handled by the caller, as any panic in this
 // recursion should not cause any dangling, stale-locked locks.
 // Not threadsafe. Caller should have acquired readlock
-func (t *ConditionTree) evaluate() []rowID {
+//
+// The tbl is the table that the conditions are resolved against. A NOT
+// matches the live rows for which its operand is false, which are not
+// the rows for which it is UNKNOWN, as when comparing with a NULL.
+func (t *ConditionTree) evaluate(tbl *table) []rowID {
+	if t.op == NOT {
+		return t.operandRows(tbl, true)
+	}
 
 	var wg sync.WaitGroup
 
@@ -34,7 +41,7 @@ func (t *ConditionTree) evaluate() []rowID {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			l := t.children[i].evaluate()
+			l := t.children[i].evaluate(tbl)
 			chiRowIDs[i] = append(chiRowIDs[i], l...)
 		}(i)
 	}
@@ -44,7 +51,9 @@ func (t *ConditionTree) evaluate() []rowID {
 		wg.Add(1)
 		go func(i int, c *Condition) {
 			defer wg.Done()
-			l := evaluateCondition(c)
+			// The AND handling below expects sorted rowIDs,
+			// but the columns are not ordered by rowID
+			l := sortAndDeDup(evaluateCondition(c))
 			conRowIDs[i] = append(conRowIDs[i], l...)
 		}(i, c)
 	}
@@ -136,8 +145,98 @@ func (t *ConditionTree) evaluate() []rowID {
 	return ret
 }
 
+// Calls f for every condition in the tree, recursively
+func (t *ConditionTree) eachCondition(f func(*Condition)) {
+	for _, c := range t.conditions {
+		f(c)
+	}
+	for _, chi := range t.children {
+		chi.eachCondition(f)
+	}
+}
+
+// Returns the sorted rowIDs of the live rows for which the tree is false,
+// that is, for which an AND has a false operand, an OR has only false
+// operands, and the operand of a NOT is true.
+// Not threadsafe. Caller should have acquired readlock
+func (t *ConditionTree) evaluateFalse(tbl *table) []rowID {
+	if t.op == NOT {
+		return t.operandRows(tbl, false)
+	}
+
+	var sets [][]rowID
+	for _, chi := range t.children {
+		sets = append(sets, chi.evaluateFalse(tbl))
+	}
+	for _, c := range t.conditions {
+		sets = append(sets, falseRows(tbl, c))
+	}
+
+	if t.op == OR {
+		ret := sets[0]
+		for _, rows := range sets[1:] {
+			ret = intersect(ret, rows)
+		}
+		return ret
+	}
+	var ret []rowID
+	for _, rows := range sets {
+		ret = append(ret, rows...)
+	}
+	return sortAndDeDup(ret)
+}
+
+// Returns the sorted rowIDs of the rows for which the single operand of
+// a NOT is false, if negated, or for which it is true otherwise
+// Not threadsafe. Caller should have acquired readlock
+func (t *ConditionTree) operandRows(tbl *table, negated bool) []rowID {
+	if len(t.children)+len(t.conditions) != 1 {
+		panic("NOT should have exactly one operand")
+	}
+	switch {
+	case len(t.children) == 1 && negated:
+		return t.children[0].evaluateFalse(tbl)
+	case len(t.children) == 1:
+		return t.children[0].evaluate(tbl)
+	case negated:
+		return falseRows(tbl, t.conditions[0])
+	}
+	return sortAndDeDup(evaluateCondition(t.conditions[0]))
+}
+
+// Returns the sorted rowIDs of the live rows for which the condition
+// is false, which are the rows that neither match it nor have a NULL
+// in its column, for which it is UNKNOWN.
+// Not threadsafe. Caller should have acquired readlock
+func falseRows(tbl *table, i *Condition) []rowID {
+	if i.pred != nil {
+		return i.pred.filterFalse(i.pred.tbl.liveRowIDs())
+	}
+
+	var ret []rowID
+	matched := sortAndDeDup(evaluateCondition(i))
+	for _, id := range complement(tbl.liveRowIDs(), matched) {
+		if _, ok := columnValue(i.colDesc.ColType, i.colData, id); ok {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
 // Not threadsafe. Caller should have acquired readlock
 func evaluateCondition(i *Condition) []rowID {
+	if i.pred != nil {
+		return i.pred.filter(i.pred.tbl.liveRowIDs())
+	}
+	if s, ok := i.colData.(*segmentedColumn); ok {
+		return evaluateSegmented(i, s)
+	}
+	if i.zones != nil {
+		if ret, ok := i.zones.evaluate(i); ok {
+			return ret
+		}
+	}
+
 	var ret []rowID
 
 	switch i.colDesc.ColType {
@@ -179,13 +278,36 @@ func evaluateCondition(i *Condition) []rowID {
 					ret = append(ret, k)
 				}
 			}
+		case IN:
+			set := i.value.(map[int]bool)
+			for k, v := range i.colData.(map[rowID]int) {
+				if set[v] {
+					ret = append(ret, k)
+				}
+			}
+		case NOTIN:
+			set := i.value.(map[int]bool)
+			for k, v := range i.colData.(map[rowID]int) {
+				if !set[v] {
+					ret = append(ret, k)
+				}
+			}
+		case BETWEEN:
+			r := i.value.([2]int)
+			for k, v := range i.colData.(map[rowID]int) {
+				if v >= r[0] && v <= r[1] {
+					ret = append(ret, k)
+				}
+			}
 		default:
 			panic("Unsupported relational operation for int")
 		}
 	case StringColumn:
+		if d, ok := i.colData.(*dictColumn); ok {
+			return evaluateDictCondition(i, d)
+		}
 		switch i.op {
 		case EQ:
-			//TODO: Implement wildcard support
 			for k, v := range i.colData.(map[rowID]string) {
 				if v == i.value.(string) {
 					ret = append(ret, k)
@@ -197,6 +319,49 @@ func evaluateCondition(i *Condition) []rowID {
 					ret = append(ret, k)
 				}
 			}
+		case IN:
+			set := i.value.(map[string]bool)
+			for k, v := range i.colData.(map[rowID]string) {
+				if set[v] {
+					ret = append(ret, k)
+				}
+			}
+		case NOTIN:
+			set := i.value.(map[string]bool)
+			for k, v := range i.colData.(map[rowID]string) {
+				if !set[v] {
+					ret = append(ret, k)
+				}
+			}
+		case LT, LTE, GT, GTE:
+			c := i.colDesc.Collation
+			for k, v := range i.colData.(map[rowID]string) {
+				if matchesOrder(c.compare(v, i.value.(string)), i.op) {
+					ret = append(ret, k)
+				}
+			}
+		case BETWEEN:
+			c := i.colDesc.Collation
+			r := i.value.([2]string)
+			for k, v := range i.colData.(map[rowID]string) {
+				if c.compare(v, r[0]) >= 0 && c.compare(v, r[1]) <= 0 {
+					ret = append(ret, k)
+				}
+			}
+		case LIKE, ILIKE, REGEXP:
+			p := i.value.(*pattern)
+			for k, v := range i.colData.(map[rowID]string) {
+				if p.match(v) {
+					ret = append(ret, k)
+				}
+			}
+		case NOTLIKE, NOTILIKE, NOTREGEXP:
+			p := i.value.(*pattern)
+			for k, v := range i.colData.(map[rowID]string) {
+				if !p.match(v) {
+					ret = append(ret, k)
+				}
+			}
 		default:
 			panic("Unsupported relational operation for string")
 		}
@@ -209,6 +374,22 @@ func evaluateCondition(i *Condition) []rowID {
 	return ret
 }
 
+// Returns whether the result of a comparison,
+// which is -1, 0 or +1, satisfies the operator
+func matchesOrder(cmp int, op RelationalOperator) bool {
+	switch op {
+	case LT:
+		return cmp < 0
+	case LTE:
+		return cmp <= 0
+	case GT:
+		return cmp > 0
+	case GTE:
+		return cmp >= 0
+	}
+	panic("Not an ordered relational operator")
+}
+
 // TODO: Should evaluate if using the
 // `json: tag will help remove some code
 // below and thus making json.(Un)Marshal
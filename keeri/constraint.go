@@ -0,0 +1,590 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Returned, wrapped in a *ConstraintError, when a row would have the
+// same values as another row in a primary key or a unique constraint
+var ErrUniqueViolation = errors.New("Unique constraint violation")
+
+// Returned, wrapped in a *ConstraintError, when a row would have a NULL
+// in a NotNull column or in a column of the primary key
+var ErrNotNullViolation = errors.New("Not null constraint violation")
+
+// Returned, wrapped in a *ConstraintError, when
+// the condition of a CHECK is false for a row
+var ErrCheckViolation = errors.New("Check constraint violation")
+
+// The error returned when a row violates a constraint of a table.
+// The Err is one of the ErrUniqueViolation, ErrNotNullViolation,
+// ErrCheckViolation and ErrForeignKeyViolation, so that
+// errors.Is(err, ErrUniqueViolation) finds out the kind of violation.
+// The Constraint of a NotNull column is <table>.<column> NOT NULL.
+type ConstraintError struct {
+	Err error
+
+	// The name of the violated constraint and the columns it refers to
+	Constraint string
+	Columns    []string
+
+	// The row that has the same values, for an ErrUniqueViolation
+	row rowID
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("%v: '%s' on (%s)", e.Err, e.Constraint,
+		strings.Join(e.Columns, ", "))
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.Err
+}
+
+// A hash index over the columns of a primary key or a unique
+// constraint, which maps the values of the columns in a row to its
+// rowID. The rows with a NULL in any of the columns are not indexed,
+// as such a row is never a duplicate of another row.
+type index struct {
+	name    string
+	cols    []string
+	primary bool
+	entries map[string]rowID
+}
+
+// Creates the indexes for the primary key and the unique constraints
+// of the spec, after checking that they refer to the columns of the spec
+func newIndexes(tableName string, spec TableSpec) ([]*index, error) {
+	newIndex := func(cols []string, primary bool) (*index, error) {
+		if len(cols) == 0 {
+			return nil, errors.New("No columns in the unique constraint")
+		}
+		for k, colName := range cols {
+			found := false
+			for _, i := range spec.Columns {
+				found = found || i.ColName == colName
+			}
+			if !found {
+				return nil, fmt.Errorf("Invalid column name: %s", colName)
+			}
+			for _, c := range cols[:k] {
+				if c == colName {
+					return nil, fmt.Errorf("Duplicate column '%s' in the "+
+						"unique constraint", colName)
+				}
+			}
+		}
+
+		x := &index{
+			name:    tableName + "_" + strings.Join(cols, "_") + "_key",
+			cols:    append([]string{}, cols...),
+			primary: primary,
+			entries: make(map[string]rowID),
+		}
+		if primary {
+			x.name = tableName + "_pkey"
+		}
+		return x, nil
+	}
+
+	var ret []*index
+	if spec.PrimaryKey != nil {
+		x, err := newIndex(spec.PrimaryKey, true)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, x)
+	}
+	for _, cols := range spec.Unique {
+		x, err := newIndex(cols, false)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, x)
+	}
+	return ret, nil
+}
+
+// Returns the key of the row in the index, with ok set to false for
+// a row that is not indexed, as it has a NULL in the columns of the index.
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) indexKey(x *index, row []interface{}) (key string, ok bool,
+	err error) {
+
+	return t.rowKey(x.cols, row)
+}
+
+// Returns the key of the values of the columns in the row, in the order
+// of the columns, with ok set to false if any of the values is a NULL.
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) rowKey(cols []string, row []interface{}) (key string, ok bool,
+	err error) {
+
+	var buf []byte
+	for _, colName := range cols {
+		v := row[t.colPos(colName)]
+		if v == nil {
+			return "", false, nil
+		}
+		if buf, err = appendValueKey(buf, v); err != nil {
+			return "", false, err
+		}
+	}
+	return string(buf), true, nil
+}
+
+// Not threadsafe. Caller should have acquired writelock
+func (t *table) indexRow(id rowID, row []interface{}) {
+	for _, x := range t.indexes {
+		if key, ok, _ := t.indexKey(x, row); ok {
+			x.entries[key] = id
+		}
+	}
+	for _, fk := range t.foreignKeys {
+		if key, ok, _ := t.rowKey(fk.cols, row); ok {
+			if fk.rows[key] == nil {
+				fk.rows[key] = make(map[rowID]bool)
+			}
+			fk.rows[key][id] = true
+		}
+	}
+}
+
+// Not threadsafe. Caller should have acquired writelock
+func (t *table) unindexRow(id rowID) {
+	row := t.row(id)
+	for _, x := range t.indexes {
+		if key, ok, _ := t.indexKey(x, row); ok && x.entries[key] == id {
+			delete(x.entries, key)
+		}
+	}
+	for _, fk := range t.foreignKeys {
+		if key, ok, _ := t.rowKey(fk.cols, row); ok {
+			delete(fk.rows[key], id)
+			if len(fk.rows[key]) == 0 {
+				delete(fk.rows, key)
+			}
+		}
+	}
+}
+
+// Returns the live row, other than the row with the given rowID,
+// that has the same values as the row in the columns of the index
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) duplicateRow(x *index, id rowID, row []interface{}) (rowID,
+	bool, error) {
+
+	key, ok, err := t.indexKey(x, row)
+	if !ok {
+		return 0, false, err
+	}
+	other, found := x.entries[key]
+	return other, found && other != id, nil
+}
+
+// Returns the error for a NULL in the NotNull column of the table
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) notNullError(colName string) *ConstraintError {
+	return &ConstraintError{Err: ErrNotNullViolation,
+		Constraint: t.name + "." + colName + " NOT NULL",
+		Columns:    []string{colName}}
+}
+
+// Checks the row, that is to be stored with the given rowID, against the
+// constraints of the table, returning a *ConstraintError for the first
+// constraint that it violates, where the NOT NULLs are checked first,
+// then the CHECKs and then the unique constraints. The rowID is 0 for a
+// row to be inserted. Not threadsafe. Caller should have acquired writelock
+func (t *table) checkRow(id rowID, row []interface{}) error {
+	for k, desc := range t.colsDesc {
+		if desc.NotNull && row[k] == nil {
+			return t.notNullError(desc.ColName)
+		}
+	}
+	for _, x := range t.indexes {
+		for _, colName := range x.cols {
+			if x.primary && row[t.colPos(colName)] == nil {
+				return &ConstraintError{Err: ErrNotNullViolation,
+					Constraint: x.name, Columns: []string{colName}}
+			}
+		}
+	}
+
+	for _, c := range t.checks {
+		violated, err := c.violatedBy(t, row)
+		if err != nil {
+			return err
+		}
+		if violated {
+			return &ConstraintError{Err: ErrCheckViolation,
+				Constraint: c.name, Columns: c.cols}
+		}
+	}
+
+	for _, x := range t.indexes {
+		other, found, err := t.duplicateRow(x, id, row)
+		if err != nil {
+			return err
+		}
+		if found {
+			return &ConstraintError{Err: ErrUniqueViolation,
+				Constraint: x.name, Columns: x.cols, row: other}
+		}
+	}
+	return nil
+}
+
+// Writes the rows of a statement to a table, and to the tables that
+// refer to it, for the foreign keys that delete or update the rows
+// referring to a deleted row. The rows that were there before are kept,
+// so that all the writes can be undone, if the statement fails on any
+// of its rows. Not threadsafe. Caller should have acquired the locks of
+// all the tables, as lockForWrite does.
+type rowWriter struct {
+	t *table
+
+	// The writes, in the order they were done
+	writes []rowWrite
+}
+
+// A row that was written, with the row that was
+// there before, or a nil for a new row
+type rowWrite struct {
+	t   *table
+	id  rowID
+	old []interface{}
+}
+
+func (w *rowWriter) save(t *table, id rowID) []interface{} {
+	var old []interface{}
+	if t.liveRows[id] {
+		old = t.row(id)
+	}
+	w.writes = append(w.writes, rowWrite{t, id, old})
+	return old
+}
+
+// Inserts the row as a new row, after filling in its AutoIncrement
+// columns, and returns its rowID
+func (w *rowWriter) insert(row []interface{}) (rowID, error) {
+	w.t.fillAutoIncrements(row)
+	if err := w.t.checkRow(0, row); err != nil {
+		return 0, err
+	}
+
+	// The rowID is taken under the writelock, so that the rows
+	// are always made live in the order of their rowIDs
+	id := w.t.newRowID()
+	w.save(w.t, id)
+	w.t.putRow(id, row)
+	w.t.chooseEncodings()
+
+	// A row can refer to itself, so it is checked once it is stored
+	return id, w.t.checkReferences(nil, row)
+}
+
+// Replaces the live row with the given rowID
+func (w *rowWriter) update(id rowID, row []interface{}) error {
+	return w.updateRow(w.t, id, row)
+}
+
+func (w *rowWriter) updateRow(t *table, id rowID, row []interface{}) error {
+	if t.appendOnly {
+		return ErrAppendOnly
+	}
+	if err := t.checkRow(id, row); err != nil {
+		return err
+	}
+	old := w.save(t, id)
+	t.putRow(id, row)
+
+	if err := t.checkReferences(old, row); err != nil {
+		return err
+	}
+	return t.checkReferenced(old, row)
+}
+
+// Removes the live row with the given rowID, along with the
+// rows that refer to it, as their foreign keys say
+func (w *rowWriter) remove(id rowID) error {
+	return w.removeRow(w.t, id)
+}
+
+func (w *rowWriter) removeRow(t *table, id rowID) error {
+	if t.appendOnly {
+		return ErrAppendOnly
+	}
+	old := w.save(t, id)
+	t.removeRow(id)
+
+	for _, fk := range t.refs {
+		key, ok, err := t.rowKey(fk.parentCols, old)
+		if err != nil {
+			return err
+		}
+		if !ok || len(fk.rows[key]) == 0 {
+			continue
+		}
+		ids := fk.childRows(key)
+
+		switch fk.onDelete {
+		case Restrict:
+			return fk.violation()
+
+		case Cascade:
+			for _, i := range ids {
+				// A row may have been removed already, through a cycle
+				if !fk.child.liveRows[i] {
+					continue
+				}
+				if err = w.removeRow(fk.child, i); err != nil {
+					return err
+				}
+			}
+
+		case SetNull:
+			for _, i := range ids {
+				row := fk.child.row(i)
+				for _, colName := range fk.cols {
+					row[fk.child.colPos(colName)] = nil
+				}
+				if err = w.updateRow(fk.child, i, row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Undoes all the writes, in the reverse order
+func (w *rowWriter) rollback() {
+	for i := len(w.writes) - 1; i >= 0; i-- {
+		if j := w.writes[i]; j.old == nil {
+			j.t.removeRow(j.id)
+		} else {
+			j.t.putRow(j.id, j.old)
+		}
+	}
+	w.writes = nil
+}
+
+// Returns the index of the primary key or the unique
+// constraint over exactly the given columns, in any order
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) indexOn(cols []string) (*index, error) {
+	for _, x := range t.indexes {
+		if len(x.cols) != len(cols) {
+			continue
+		}
+		matched := 0
+		for _, c := range x.cols {
+			for _, d := range cols {
+				if c == d {
+					matched++
+				}
+			}
+		}
+		if matched == len(cols) {
+			return x, nil
+		}
+	}
+	return nil, fmt.Errorf("No unique constraint on (%s)",
+		strings.Join(cols, ", "))
+}
+
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) inPrimaryKey(colName string) bool {
+	for _, x := range t.indexes {
+		for _, c := range x.cols {
+			if x.primary && c == colName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A CHECK constraint of a table. The rows that violate it are found
+// with its condition negated, so that a row for which the condition
+// is neither true nor false, due to a NULL, does not violate it.
+type check struct {
+	name string
+	cond Expr
+
+	// The columns that the condition refers to
+	cols []string
+
+	// The negated condition, compiled over src, which is a table with
+	// the columns of the table and only the row that is being checked.
+	// It is compiled again if the columns change after the version.
+	eval    condEval
+	src     *table
+	version uint64
+}
+
+// Creates the CHECK constraints of the spec, after checking that their
+// conditions are valid over the columns of the spec. A check without a
+// name is named <table>_check, followed by a number if it is taken.
+func newChecks(tableName string, spec TableSpec) ([]*check, error) {
+	src, err := newTable(spec.Columns)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*check
+	names := make(map[string]bool)
+	taken := func(name string) bool {
+		for _, i := range spec.Checks {
+			if i.Name == name {
+				return true
+			}
+		}
+		return names[name]
+	}
+	for _, i := range spec.Checks {
+		e, err := parseCheck(i.Cond)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = compileCond(src, negateCond(e)); err != nil {
+			return nil, err
+		}
+
+		c := &check{name: i.Name, cond: e, cols: exprColumns(e)}
+		if c.name == "" {
+			c.name = tableName + "_check"
+			for n := 1; taken(c.name); n++ {
+				c.name = fmt.Sprintf("%s_check%d", tableName, n)
+			}
+		}
+		if names[c.name] {
+			return nil, fmt.Errorf("Duplicate constraint '%s'", c.name)
+		}
+		names[c.name] = true
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
+
+// Parses the condition of a CHECK, which is written like a
+// WHERE, but can not have any aggregates or parameters
+func parseCheck(sql string) (Expr, error) {
+	toks, err := tokenize(sql)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{sql: sql, toks: toks}
+
+	e, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != eofToken {
+		return nil, p.errorf(tok, "Unexpected '%s'", tok.text)
+	}
+	if err = p.noAggregates(e, "CHECK"); err != nil {
+		return nil, err
+	}
+	if params := exprParams([]Expr{e}); params != nil {
+		return nil, p.errorAt(params[0], "Unexpected parameter in CHECK")
+	}
+	return e, nil
+}
+
+// Returns the distinct names of the columns in the expression
+func exprColumns(e Expr) []string {
+	var ret []string
+	walkExpr(e, func(x Expr) {
+		if c, ok := x.(*ColumnRef); ok {
+			for _, name := range ret {
+				if name == c.Name {
+					return
+				}
+			}
+			ret = append(ret, c.Name)
+		}
+	})
+	return ret
+}
+
+// Returns the negation of a condition, where the negation of a
+// comparison is the opposite comparison, so that, like a NOT of
+// the comparison, it is not true for a NULL operand
+func negateCond(e Expr) Expr {
+	switch e := e.(type) {
+	case *BinaryExpr:
+		op := AND
+		if e.Op == AND {
+			op = OR
+		}
+		return &BinaryExpr{e.node, op, negateCond(e.Left), negateCond(e.Right)}
+
+	case *NotExpr:
+		return e.X
+
+	case *ComparisonExpr:
+		ops := map[RelationalOperator]RelationalOperator{
+			EQ: NEQ, NEQ: EQ, LT: GTE, GTE: LT, GT: LTE, LTE: GT,
+			LIKE: NOTLIKE, NOTLIKE: LIKE, ILIKE: NOTILIKE, NOTILIKE: ILIKE,
+			REGEXP: NOTREGEXP, NOTREGEXP: REGEXP,
+		}
+		return &ComparisonExpr{e.node, ops[e.Op], e.Left, e.Right}
+
+	case *InExpr:
+		op := IN
+		if e.Op == IN {
+			op = NOTIN
+		}
+		return &InExpr{e.node, op, e.X, e.List}
+
+	case *BetweenExpr:
+		return &BinaryExpr{e.node, OR,
+			&ComparisonExpr{e.node, LT, e.X, e.Lo},
+			&ComparisonExpr{e.node, GT, e.X, e.Hi}}
+	}
+
+	// Not a condition, which fails to compile
+	return e
+}
+
+// Returns true if the condition of the check is false for the row
+// Not threadsafe. Caller should have acquired writelock
+func (c *check) violatedBy(t *table, row []interface{}) (bool, error) {
+	if c.eval == nil || c.version != t.version {
+		src, err := newTable(t.colsDesc)
+		if err != nil {
+			return false, err
+		}
+		if c.eval, err = compileCond(src, negateCond(c.cond)); err != nil {
+			c.eval = nil
+			return false, err
+		}
+		c.src, c.version = src, t.version
+	}
+
+	c.src.putRow(1, row)
+	out := make([]bool, 1)
+	c.eval.test([]rowID{1}, out)
+	return out[0], nil
+}
+
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) inCheck(colName string) *check {
+	for _, c := range t.checks {
+		for _, name := range c.cols {
+			if name == colName {
+				return c
+			}
+		}
+	}
+	return nil
+}
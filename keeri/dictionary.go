@@ -0,0 +1,281 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import "strconv"
+
+// How the values of a StringColumn are stored
+type Encoding int
+
+const (
+	// The values are stored as plain strings, until the column has
+	// at least 1024 rows, with one distinct value in every 8 rows or
+	// fewer, when they are stored with a dictionary. The encoding is
+	// chosen again every time that the number of rows doubles.
+	AutoEncoding Encoding = iota
+
+	// Every row has its own string
+	PlainEncoding
+
+	// Every distinct value is stored once, in a dictionary, and every
+	// row has the uint32 code of its value in the dictionary, which
+	// takes less memory for the columns with few distinct values, and
+	// is compared faster than a string
+	DictionaryEncoding
+)
+
+// The number of rows, and the number of rows per distinct value,
+// after which an AutoEncoding column is stored with a dictionary
+const (
+	dictMinRows     = 1024
+	dictRowsPerCode = 8
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case AutoEncoding:
+		return "AUTO"
+	case PlainEncoding:
+		return "PLAIN"
+	case DictionaryEncoding:
+		return "DICTIONARY"
+	}
+	return strconv.Itoa(int(e))
+}
+
+// The values of a dictionary encoded string column. The codes of the
+// values that are not in any row any more are given to the new values.
+// Not threadsafe. Protected by the dataMetaDataLock of the table.
+type dictColumn struct {
+	codes map[rowID]uint32
+
+	// The value of every code, with the number of rows that have it,
+	// and the codes that are not used by any row
+	values []string
+	refs   []int
+	free   []uint32
+
+	lookup map[string]uint32
+}
+
+func newDictColumn() *dictColumn {
+	return &dictColumn{
+		codes:  make(map[rowID]uint32),
+		lookup: make(map[string]uint32),
+	}
+}
+
+// Returns the value of the given row, with ok set
+// to false if the row has no value in the column
+func (d *dictColumn) get(id rowID) (v string, ok bool) {
+	code, ok := d.codes[id]
+	if !ok {
+		return "", false
+	}
+	return d.values[code], true
+}
+
+func (d *dictColumn) set(id rowID, v string) {
+	code, ok := d.lookup[v]
+	if !ok {
+		if n := len(d.free); n > 0 {
+			code = d.free[n-1]
+			d.free = d.free[:n-1]
+			d.values[code] = v
+		} else {
+			code = uint32(len(d.values))
+			d.values = append(d.values, v)
+			d.refs = append(d.refs, 0)
+		}
+		d.lookup[v] = code
+	}
+
+	d.delete(id)
+	d.codes[id] = code
+	d.refs[code]++
+}
+
+func (d *dictColumn) delete(id rowID) {
+	code, ok := d.codes[id]
+	if !ok {
+		return
+	}
+	delete(d.codes, id)
+
+	if d.refs[code]--; d.refs[code] == 0 {
+		delete(d.lookup, d.values[code])
+		d.values[code] = ""
+		d.free = append(d.free, code)
+	}
+}
+
+// Returns the value of the given row in a string column, which is
+// stored as a map[rowID]string, a *dictColumn or a *segmentedColumn
+func stringValue(colData interface{}, id rowID) (string, bool) {
+	switch data := colData.(type) {
+	case *dictColumn:
+		return data.get(id)
+	case *segmentedColumn:
+		v, ok := data.get(StringColumn, id)
+		if !ok {
+			return "", false
+		}
+		return v.(string), true
+	}
+	v, ok := colData.(map[rowID]string)[id]
+	return v, ok
+}
+
+// Returns the value of the given row in an int column, which
+// is stored as a map[rowID]int or as a *segmentedColumn
+func intValue(colData interface{}, id rowID) (int, bool) {
+	if s, ok := colData.(*segmentedColumn); ok {
+		v, ok := s.get(IntColumn, id)
+		if !ok {
+			return 0, false
+		}
+		return v.(int), true
+	}
+	v, ok := colData.(map[rowID]int)[id]
+	return v, ok
+}
+
+// Evaluates a condition over a dictionary encoded column, where an EQ
+// compares the codes with the code of its value, and every other
+// condition is evaluated once for every value in the dictionary, by
+// evaluating it over a map from the codes to the values, as rowIDs
+// Not threadsafe. Caller should have acquired readlock
+func evaluateDictCondition(i *Condition, d *dictColumn) []rowID {
+	var ret []rowID
+	if i.op == EQ {
+		code, ok := d.lookup[i.value.(string)]
+		if !ok {
+			return nil
+		}
+		for k, v := range d.codes {
+			if v == code {
+				ret = append(ret, k)
+			}
+		}
+		return ret
+	}
+
+	byCode := make(map[rowID]string, len(d.lookup))
+	for v, code := range d.lookup {
+		byCode[rowID(code)] = v
+	}
+	c := *i
+	c.colData = byCode
+	c.zones = nil
+	matches := make([]bool, len(d.values))
+	for _, code := range evaluateCondition(&c) {
+		matches[code] = true
+	}
+
+	for k, v := range d.codes {
+		if matches[v] {
+			ret = append(ret, k)
+		}
+	}
+	return ret
+}
+
+// Stores the AutoEncoding string columns of the table with a dictionary
+// if they have few enough distinct values, or as plain strings if they
+// have too many, once the table has at least dictMinRows rows. Called
+// every time that the number of rows doubles, so that the values are
+// copied only a few times.
+// Not threadsafe. Caller should have acquired writelock
+func (t *table) chooseEncodings() {
+	n := len(t.liveRows)
+	if n < dictMinRows || n&(n-1) != 0 {
+		return
+	}
+
+	changed := false
+	for _, desc := range t.colsDesc {
+		if desc.ColType != StringColumn || desc.Encoding != AutoEncoding {
+			continue
+		}
+
+		switch data := t.cols[desc.ColName].(type) {
+		case map[rowID]string:
+			distinct := make(map[string]bool)
+			for _, v := range data {
+				distinct[v] = true
+				if len(distinct)*dictRowsPerCode > n {
+					break
+				}
+			}
+			if len(distinct)*dictRowsPerCode > n {
+				continue
+			}
+			d := newDictColumn()
+			for id, v := range data {
+				d.set(id, v)
+			}
+			t.cols[desc.ColName] = d
+			changed = true
+
+		case *dictColumn:
+			// A column whose values are mostly different is taken
+			// back to plain strings, with some slack, so that it is
+			// not encoded again every time the number of rows doubles
+			if len(data.lookup)*dictRowsPerCode <= 2*n {
+				continue
+			}
+			plain := make(map[rowID]string, len(data.codes))
+			for id, code := range data.codes {
+				plain[id] = data.values[code]
+			}
+			t.cols[desc.ColName] = plain
+			changed = true
+		}
+	}
+
+	// The plans of the prepared queries, which hold on to the columns
+	// that were replaced, are made again when they are next run, and
+	// only if the encoding of a column has changed
+	if changed {
+		t.version++
+	}
+}
+
+// Returns the encoding in which the values of the column are stored,
+// which is PlainEncoding for the columns that are not strings.
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) encodingOf(desc ColumnDesc) Encoding {
+	data := t.cols[desc.ColName]
+	if s, ok := data.(*segmentedColumn); ok {
+		data = s.tail
+	}
+	if _, ok := data.(*dictColumn); ok {
+		return DictionaryEncoding
+	}
+	return PlainEncoding
+}
+
+// Same as appendKey, except that the value of a dictionary encoded
+// column is encoded as its code, which is faster, but can be compared
+// only with the keys of the same column, as when grouping the rows of
+// a table by the values of its columns. Not threadsafe. Caller should
+// have acquired readlock
+func appendColumnKey(key []byte, colType ColumnType, colData interface{},
+	id rowID) ([]byte, interface{}, error) {
+
+	d, ok := colData.(*dictColumn)
+	if !ok {
+		return appendKey(key, colType, colData, id)
+	}
+	code, ok := d.codes[id]
+	if !ok {
+		return append(key, 'n'), nil, nil
+	}
+	key = append(key, 'd')
+	key = strconv.AppendUint(key, uint64(code), 10)
+	return append(key, ';'), d.values[code], nil
+}
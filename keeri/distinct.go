@@ -0,0 +1,231 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// The values of a CustomColumn that implement Hashable are considered
+// equal, in DISTINCT, GROUP BY, COUNT(DISTINCT), JOINs and the unique
+// constraints, if and only if they are of the same type and their
+// HashKeys are equal. The other values are equal if they are ==, and
+// can not be used there if their type is not comparable.
+type Hashable interface {
+	HashKey() string
+}
+
+// Appends an encoding of the value to the key, such that
+// two values get the same encoding only if they are equal
+func appendValueKey(key []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(key, 'n'), nil
+	case int:
+		key = append(key, 'i')
+		key = strconv.AppendInt(key, int64(v), 10)
+		return append(key, ';'), nil
+	case float64:
+		key = append(key, 'f')
+		key = strconv.AppendFloat(key, v, 'g', -1, 64)
+		return append(key, ';'), nil
+	case string:
+		key = append(key, 's')
+		key = strconv.AppendInt(key, int64(len(v)), 10)
+		key = append(key, ':')
+		return append(key, v...), nil
+	case Hashable:
+		h := v.HashKey()
+		t := reflect.TypeOf(v).String()
+		key = append(key, 'c')
+		key = strconv.AppendInt(key, int64(len(t)), 10)
+		key = append(key, ':')
+		key = append(key, t...)
+		key = strconv.AppendInt(key, int64(len(h)), 10)
+		key = append(key, ':')
+		return append(key, h...), nil
+	}
+
+	t := reflect.TypeOf(v)
+	key = append(key, 'v')
+	key = strconv.AppendInt(key, int64(len(t.String())), 10)
+	key = append(key, ':')
+	key = append(key, t.String()...)
+	return appendComparableKey(key, reflect.ValueOf(v))
+}
+
+// Appends an encoding of a value that does not implement Hashable, such
+// that two values of the same type get the same encoding only if they
+// are ==, except that a NaN gets the same encoding as any other NaN.
+// Returns an error if the value, or what it holds, is not comparable.
+func appendComparableKey(key []byte, v reflect.Value) ([]byte, error) {
+	if !v.Type().Comparable() {
+		return nil, fmt.Errorf("Value of type %s is not comparable and "+
+			"does not implement Hashable", v.Type())
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(key, '1'), nil
+		}
+		return append(key, '0'), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		key = strconv.AppendInt(key, v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		key = strconv.AppendUint(key, v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		key = appendFloatKey(key, v.Float())
+	case reflect.Complex64, reflect.Complex128:
+		key = appendFloatKey(key, real(v.Complex()))
+		key = appendFloatKey(append(key, ';'), imag(v.Complex()))
+	case reflect.String:
+		key = strconv.AppendInt(key, int64(v.Len()), 10)
+		key = append(key, ':')
+		return append(key, v.String()...), nil
+	case reflect.Ptr, reflect.Chan, reflect.UnsafePointer:
+		key = strconv.AppendUint(key, uint64(v.Pointer()), 16)
+	case reflect.Array:
+		key = append(key, '[')
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if key, err = appendComparableKey(key, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return append(key, ']'), nil
+	case reflect.Struct:
+		key = append(key, '{')
+		for i := 0; i < v.NumField(); i++ {
+			var err error
+			if key, err = appendComparableKey(key, v.Field(i)); err != nil {
+				return nil, err
+			}
+		}
+		return append(key, '}'), nil
+	case reflect.Interface:
+		if v.IsNil() {
+			return append(key, 'n'), nil
+		}
+		e := v.Elem()
+		key = strconv.AppendInt(key, int64(len(e.Type().String())), 10)
+		key = append(key, ':')
+		key = append(key, e.Type().String()...)
+		return appendComparableKey(key, e)
+	}
+	return append(key, ';'), nil
+}
+
+// Appends a float, where the -0 is encoded like the 0, as they are ==
+func appendFloatKey(key []byte, f float64) []byte {
+	if f == 0 {
+		f = 0
+	}
+	return strconv.AppendFloat(key, f, 'g', -1, 64)
+}
+
+// Appends an encoding of the value of the given column in the given
+// row to the key, such that two rows get the same key only if their
+// values are equal. The value is also returned and will be nil for
+// a missing value. Not threadsafe. Caller should have acquired readlock
+func appendKey(key []byte, colType ColumnType, colData interface{},
+	id rowID) ([]byte, interface{}, error) {
+
+	v, _ := columnValue(colType, colData, id)
+	key, err := appendValueKey(key, v)
+	return key, v, err
+}
+
+// Removes the duplicate rows from the given rows, keeping
+// the first occurrence of every row in its position
+func distinctRows(rows []interface{}) ([]interface{}, error) {
+	seen := make(map[string]bool)
+
+	var ret []interface{}
+	var key []byte
+	for _, row := range rows {
+		key = key[:0]
+		for _, v := range row.([]interface{}) {
+			var err error
+			key, err = appendValueKey(key, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !seen[string(key)] {
+			seen[string(key)] = true
+			ret = append(ret, row)
+		}
+	}
+
+	return ret, nil
+}
+
+// Similar to Query, but returns only the distinct rows,
+// by hashing the values of the asked columns in every row
+func (db *Keeri) QueryDistinct(tableName string, colNames []string,
+	cTree *ConditionTree) ([]interface{}, error) {
+
+	tbl, err := db.lookupTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	tbl.dataMetaDataLock.RLock()
+	defer tbl.dataMetaDataLock.RUnlock()
+	return tbl.queryDistinct(colNames, cTree)
+}
+
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) queryDistinct(colNames []string,
+	cTree *ConditionTree) ([]interface{}, error) {
+
+	var descs []ColumnDesc
+	for _, colName := range colNames {
+		desc, ok := t.colDesc(colName)
+		if !ok {
+			return nil, fmt.Errorf("Invalid column name: %s", colName)
+		}
+		descs = append(descs, desc)
+	}
+
+	var matchingRowIDs []rowID
+	if cTree != nil {
+		matchingRowIDs = cTree.evaluate(t)
+	} else {
+		matchingRowIDs = t.liveRowIDs()
+	}
+
+	seen := make(map[string]bool)
+
+	var results []interface{}
+	var key []byte
+	for _, id := range matchingRowIDs {
+		key = key[:0]
+		row := make([]interface{}, len(descs))
+		for i, desc := range descs {
+			var err error
+			key, row[i], err = appendColumnKey(key, desc.ColType,
+				t.cols[desc.ColName], id)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !seen[string(key)] {
+			seen[string(key)] = true
+			results = append(results, row)
+		}
+	}
+
+	return results, nil
+}
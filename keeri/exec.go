@@ -0,0 +1,1372 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The result of a statement run with Exec
+type Result struct {
+	// The number of rows inserted, updated or deleted, which is 0
+	// for the statements that do not change any rows. The rows
+	// deleted or updated through the foreign keys are not counted.
+	RowsAffected int
+
+	// The rows of an INSERT with a RETURNING, which
+	// is nil for the statements without a RETURNING
+	Returning *ResultSet
+}
+
+// The column types of the CREATE TABLE statement
+var columnTypes = map[string]ColumnType{
+	"INT":     IntColumn,
+	"INTEGER": IntColumn,
+	"TEXT":    StringColumn,
+	"STRING":  StringColumn,
+	"VARCHAR": StringColumn,
+	"SERIAL":  IntColumn,
+}
+
+// The encodings of the string columns of the CREATE TABLE statement
+var encodings = map[string]Encoding{
+	"AUTO":       AutoEncoding,
+	"PLAIN":      PlainEncoding,
+	"DICTIONARY": DictionaryEncoding,
+}
+
+// The collations of the CREATE TABLE statement
+var collations = map[string]Collation{
+	"BINARY":  BinaryCollation,
+	"UNICODE": UnicodeCollation,
+}
+
+// CREATE TABLE [IF NOT EXISTS] name (col type [COLLATE collation]
+// [constraints], ..., [PRIMARY KEY (cols)], [UNIQUE (cols)],
+// [[CONSTRAINT name] CHECK (condition)], [[CONSTRAINT name] FOREIGN KEY
+// (cols) REFERENCES table [(cols)] [ON DELETE action]], ...) [APPEND ONLY]
+type createTableStmt struct {
+	name        string
+	ifNotExists bool
+	spec        TableSpec
+
+	// The DEFAULT of every column, which is an expression
+	// without any columns, or a nil for a NULL
+	defaults []Expr
+	params   []*Param
+}
+
+// DROP TABLE [IF EXISTS] name
+type dropTableStmt struct {
+	name     string
+	ifExists bool
+}
+
+// TRUNCATE [TABLE] name [RESTART IDENTITY]
+type truncateStmt struct {
+	name    string
+	restart bool
+}
+
+// CREATE SEQUENCE [IF NOT EXISTS] name [START [WITH] n] [INCREMENT [BY] n]
+type createSequenceStmt struct {
+	name        string
+	ifNotExists bool
+	start       int
+	increment   int
+}
+
+// DROP SEQUENCE [IF EXISTS] name
+type dropSequenceStmt struct {
+	name     string
+	ifExists bool
+}
+
+// ALTER TABLE name ADD [COLUMN] col type [COLLATE collation] [NOT NULL]
+// [DEFAULT value],
+// ALTER TABLE name DROP [COLUMN] col,
+// ALTER TABLE name RENAME [COLUMN] col TO newCol or
+// ALTER TABLE name RENAME TO newName
+type alterTableStmt struct {
+	name string
+
+	// One of ADD, DROP or RENAME, where the RENAME of the
+	// table itself has an empty col.ColName
+	action  string
+	col     ColumnDesc
+	newName string
+
+	// The DEFAULT of an ADD, which is an expression
+	// without any columns, or a nil for a NULL
+	def    Expr
+	params []*Param
+}
+
+// INSERT INTO name [(cols)] VALUES (values), (values), ...
+// [ON CONFLICT [(cols)] DO NOTHING | DO UPDATE SET col = value, ...]
+// [RETURNING * | col, ...]
+type insertStmt struct {
+	table string
+	cols  []string
+
+	// Every value is a *Literal, a *Param, a NEXTVAL('name')
+	// *FuncCall or a nil for a NULL
+	rows   [][]Expr
+	params []*Param
+
+	// The ON CONFLICT, with the columns of its unique constraint, if
+	// any, and the SET of a DO UPDATE, where a value is an expression
+	// over the columns of the table and the excluded.cols, or a nil
+	// for a NULL
+	onConflict   bool
+	conflictCols []string
+	doUpdate     bool
+	setCols      []string
+	setValues    []Expr
+
+	// The columns of the RETURNING, where a "*" is all
+	// the columns of the table, or nil if there is none
+	returning []string
+}
+
+// UPDATE name SET col = value, ... [WHERE condition]
+type updateStmt struct {
+	table string
+
+	// Every value is an expression over the columns, or a nil for a NULL
+	cols   []string
+	values []Expr
+	where  *ConditionTree
+	params []*Param
+}
+
+// DELETE FROM name [WHERE condition]
+type deleteStmt struct {
+	table  string
+	where  *ConditionTree
+	params []*Param
+}
+
+// Runs a statement that changes the database, which is one of
+//
+//	CREATE TABLE [IF NOT EXISTS] name (col type [COLLATE collation]
+//		[constraints], ..., [PRIMARY KEY (cols)], [UNIQUE (cols)],
+//		[[CONSTRAINT name] CHECK (condition)],
+//		[[CONSTRAINT name] FOREIGN KEY (cols) REFERENCES table [(cols)]
+//		[ON DELETE action]], ...) [APPEND ONLY]
+//	DROP TABLE [IF EXISTS] name
+//	CREATE SEQUENCE [IF NOT EXISTS] name [START [WITH] n]
+//		[INCREMENT [BY] n]
+//	DROP SEQUENCE [IF EXISTS] name
+//	ALTER TABLE name ADD [COLUMN] col type [COLLATE collation] [NOT NULL]
+//		[DEFAULT value]
+//	ALTER TABLE name DROP [COLUMN] col
+//	ALTER TABLE name RENAME [COLUMN] col TO newCol
+//	ALTER TABLE name RENAME TO newName
+//	TRUNCATE [TABLE] name [RESTART IDENTITY]
+//	INSERT INTO name [(cols)] VALUES (values), (values), ...
+//		[ON CONFLICT [(cols)] DO NOTHING | DO UPDATE SET col = value, ...]
+//		[RETURNING * | col, ...]
+//	UPDATE name SET col = value, ... [WHERE condition]
+//	DELETE FROM name [WHERE condition]
+//
+// The column types are INT or INTEGER for an IntColumn, SERIAL for an
+// AutoIncrement IntColumn, and TEXT, STRING or VARCHAR[(n)] for a
+// StringColumn, with the collation either BINARY, which is the default,
+// or UNICODE. The constraints of a column are NOT NULL, PRIMARY KEY,
+// UNIQUE, [CONSTRAINT name] CHECK (condition), [CONSTRAINT name]
+// REFERENCES table [(col)] [ON DELETE action], AUTO_INCREMENT or
+// AUTOINCREMENT, ENCODING encoding, for a string column, where the
+// encoding is AUTO, the default, PLAIN or DICTIONARY, and DEFAULT
+// value, in any order, where the value is an expression without any
+// columns, like 'none' or 60 * 60, or is a NEXTVAL('name') of a
+// sequence. The action of a foreign key is RESTRICT, which is the
+// default, CASCADE or SET NULL.
+// The rows affected by a DELETE do not include the rows deleted or
+// updated through the foreign keys that refer to the table. A column
+// that is not in the column list of an INSERT has its DEFAULT, which is
+// a NULL if it has none. A column that is added is backfilled with its
+// DEFAULT, the same way as AddColumn does, except for a NEXTVAL, which
+// is only for the rows inserted after it is added. A TRUNCATE keeps the
+// rowIDs and the AUTO_INCREMENTs going on from the last row, unless it
+// has a RESTART IDENTITY. A sequence starts from 1 and goes up by 1,
+// unless it has a START or an INCREMENT, and a value of an INSERT can be
+// a NEXTVAL('name') for its next value. A NEXTVAL can not be in the
+// other expressions, such as of an UPDATE or a SELECT, and a sequence
+// can not be dropped while it is the DEFAULT of a column. The RETURNING
+// of an INSERT returns the rows inserted and the rows updated, with
+// their values as they were written, in the Returning of the Result.
+//
+// A row of an INSERT or an UPDATE that violates a constraint fails the
+// statement with a *ConstraintError. A row that has the same values as
+// an existing row, in the primary key or a unique constraint, does not
+// fail an INSERT that has an ON CONFLICT for the constraint. Then, the
+// existing row is either left as it is, for a DO NOTHING, or is updated
+// with the SET of the DO UPDATE, whose values can refer to the columns of
+// the existing row, and to excluded.col for the value of col in the row
+// that was to be inserted. A DO UPDATE fails the INSERT if two of its
+// rows conflict with the same row, as the row would be updated twice.
+// The rows affected by an INSERT are the rows inserted and the rows
+// updated. The values of the SET of an UPDATE are
+// expressions over the columns, like in a SELECT. A statement that fails
+// leaves all the rows as they were.
+//
+// The args are bound to the parameters of the values of an INSERT or
+// an UPDATE, or of a DEFAULT, the same way as Select does.
+func (db *Keeri) Exec(sql string, args ...interface{}) (Result, error) {
+	stmt, err := parseExec(sql)
+	if err != nil {
+		return Result{}, err
+	}
+
+	switch s := stmt.(type) {
+	case *createTableStmt:
+		if err = bindParams(s.params, args); err != nil {
+			return Result{}, err
+		}
+		return Result{}, db.execCreateTable(s)
+	case *dropTableStmt:
+		if err = bindParams(nil, args); err != nil {
+			return Result{}, err
+		}
+		return Result{}, db.execDropTable(s)
+	case *createSequenceStmt:
+		if err = bindParams(nil, args); err != nil {
+			return Result{}, err
+		}
+		err = db.CreateSequence(s.name, s.start, s.increment)
+		if s.ifNotExists && errors.Is(err, ErrSequenceExists) {
+			err = nil
+		}
+		return Result{}, err
+	case *dropSequenceStmt:
+		if err = bindParams(nil, args); err != nil {
+			return Result{}, err
+		}
+		err = db.DropSequence(s.name)
+		if s.ifExists && errors.Is(err, ErrSequenceNotFound) {
+			err = nil
+		}
+		return Result{}, err
+	case *truncateStmt:
+		if err = bindParams(nil, args); err != nil {
+			return Result{}, err
+		}
+		return Result{}, db.Truncate(s.name, s.restart)
+	case *alterTableStmt:
+		if err = bindParams(s.params, args); err != nil {
+			return Result{}, err
+		}
+		return Result{}, db.execAlterTable(s)
+	case *updateStmt:
+		if err = bindParams(s.params, args); err != nil {
+			return Result{}, err
+		}
+		n, err := db.execUpdate(s)
+		return Result{RowsAffected: n}, err
+	case *deleteStmt:
+		if err = bindParams(s.params, args); err != nil {
+			return Result{}, err
+		}
+		n, err := db.Delete(s.table, s.where)
+		return Result{RowsAffected: n}, err
+	}
+
+	s := stmt.(*insertStmt)
+	if err = bindParams(s.params, args); err != nil {
+		return Result{}, err
+	}
+	return db.execInsert(s)
+}
+
+func (db *Keeri) execCreateTable(s *createTableStmt) error {
+	spec := s.spec
+	spec.Columns = append([]ColumnDesc{}, s.spec.Columns...)
+	for k, e := range s.defaults {
+		var err error
+		if spec.Columns[k].Default, err = defaultValue(spec.Columns[k],
+			e); err != nil {
+			return err
+		}
+	}
+
+	err := db.CreateTableFromSpec(s.name, spec)
+	if s.ifNotExists && errors.Is(err, ErrTableExists) {
+		return nil
+	}
+	return err
+}
+
+func (db *Keeri) execDropTable(s *dropTableStmt) error {
+	err := db.DropTable(s.name)
+	if s.ifExists && errors.Is(err, ErrTableNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (db *Keeri) execAlterTable(s *alterTableStmt) error {
+	switch s.action {
+	case "ADD":
+		def, err := defaultValue(s.col, s.def)
+		if err != nil {
+			return err
+		}
+		s.col.Default = def
+		if _, ok := def.(NextVal); ok {
+			def = nil
+		}
+		return db.AddColumn(s.name, s.col, def)
+	case "DROP":
+		return db.DropColumn(s.name, s.col.ColName)
+	}
+	if s.col.ColName == "" {
+		return db.RenameTable(s.name, s.newName)
+	}
+	return db.RenameColumn(s.name, s.col.ColName, s.newName)
+}
+
+// Inserts the rows and returns the number of rows inserted,
+// with the rows of the RETURNING, if any
+func (db *Keeri) execInsert(s *insertStmt) (Result, error) {
+	tbl, unlock, err := db.lockForWrite(s.table)
+	if err != nil {
+		return Result{}, err
+	}
+	defer unlock()
+
+	var positions []int
+	if s.cols == nil {
+		for k := range tbl.colsDesc {
+			positions = append(positions, k)
+		}
+	}
+	for _, colName := range s.cols {
+		k := tbl.colPos(colName)
+		if k < 0 {
+			return Result{}, fmt.Errorf("Invalid column name: %s", colName)
+		}
+		positions = append(positions, k)
+	}
+
+	// All the values are converted before any row is inserted
+	var rows [][]interface{}
+	for _, values := range s.rows {
+		if len(values) != len(positions) {
+			return Result{}, fmt.Errorf("Expected %d values, got %d", len(positions),
+				len(values))
+		}
+
+		row := make([]interface{}, len(tbl.colsDesc))
+		for k, desc := range tbl.colsDesc {
+			row[k] = desc.Default
+		}
+		for k, v := range values {
+			pos := positions[k]
+			if row[pos], err = insertValue(tbl.colsDesc[pos], v); err != nil {
+				return Result{}, err
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	var ret *ResultSet
+	var retPositions []int
+	if s.returning != nil {
+		ret = &ResultSet{}
+		for _, colName := range s.returning {
+			if colName == "*" {
+				for k, desc := range tbl.colsDesc {
+					retPositions = append(retPositions, k)
+					ret.Columns = append(ret.Columns,
+						ResultColumn{desc.ColName, desc.ColType})
+				}
+				continue
+			}
+			k := tbl.colPos(colName)
+			if k < 0 {
+				return Result{}, fmt.Errorf("Invalid column name: %s", colName)
+			}
+			retPositions = append(retPositions, k)
+			ret.Columns = append(ret.Columns,
+				ResultColumn{colName, tbl.colsDesc[k].ColType})
+		}
+	}
+
+	w := &rowWriter{t: tbl}
+	var h *conflictHandler
+	if s.onConflict {
+		if h, err = newConflictHandler(w, s.table, s); err != nil {
+			return Result{}, err
+		}
+	}
+
+	n := 0
+	for _, row := range rows {
+		// The NEXTVALs are taken just before every row is written
+		if err = db.nextValues(tbl, row); err != nil {
+			w.rollback()
+			return Result{}, err
+		}
+
+		var id rowID
+		written := true
+		if h != nil {
+			id, written, err = h.insert(row)
+		} else {
+			id, err = w.insert(row)
+		}
+		if err != nil {
+			w.rollback()
+			return Result{}, err
+		}
+		if !written {
+			continue
+		}
+		n++
+
+		if ret != nil {
+			values := tbl.row(id)
+			out := make([]interface{}, len(retPositions))
+			for k, pos := range retPositions {
+				out[k] = values[pos]
+			}
+			ret.Rows = append(ret.Rows, out)
+		}
+	}
+	tbl.seal()
+	return Result{RowsAffected: n, Returning: ret}, nil
+}
+
+// Converts a value of an INSERT in to the type of the column,
+// where a literal is converted the same way as in a condition,
+// and a NEXTVAL is a NextVal, which is taken when the row is written
+func insertValue(desc ColumnDesc, e Expr) (interface{}, error) {
+	switch e := e.(type) {
+	case nil:
+		return nil, nil
+	case *FuncCall:
+		return nextValOf(desc, e)
+	case *Param:
+		return e.valueFor(desc.ColType, desc.ColName)
+	case *Literal:
+		switch desc.ColType {
+		case IntColumn:
+			v, err := strconv.Atoi(e.Value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid integer '%s' for the column '%s'",
+					e.Value, desc.ColName)
+			}
+			return v, nil
+		case StringColumn:
+			return e.Value, nil
+		}
+	}
+	return nil, fmt.Errorf("Values of the custom column '%s' can not be "+
+		"inserted with SQL", desc.ColName)
+}
+
+// Returns the NextVal of a NEXTVAL('name'), which is
+// allowed only for an integer column
+func nextValOf(desc ColumnDesc, f *FuncCall) (interface{}, error) {
+	if desc.ColType != IntColumn {
+		return nil, fmt.Errorf("Mismatched type of the value for the "+
+			"column '%s'", desc.ColName)
+	}
+	return NextVal(f.Args[0].(*Literal).Value), nil
+}
+
+// Evaluates the DEFAULT of a column, which is an expression without
+// any columns, in to a value of the type of the column, or a NextVal
+func defaultValue(desc ColumnDesc, e Expr) (interface{}, error) {
+	if f, ok := e.(*FuncCall); ok && f.Name == "NEXTVAL" {
+		return nextValOf(desc, f)
+	}
+	src, err := newTable(nil)
+	if err != nil {
+		return nil, err
+	}
+	ev, err := compileValue(src, desc, e)
+	if err != nil || ev == nil {
+		return nil, err
+	}
+
+	var vec vector
+	ev.eval([]rowID{1}, &vec)
+	return vec.value(0), nil
+}
+
+// Parses a statement for Exec, returning a *createTableStmt,
+// a *dropTableStmt, a *createSequenceStmt, a *dropSequenceStmt,
+// a *truncateStmt, an *alterTableStmt, an *insertStmt,
+// an *updateStmt or a *deleteStmt
+func parseExec(sql string) (interface{}, error) {
+	toks, err := tokenize(sql)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{sql: sql, toks: toks}
+
+	var stmt interface{}
+	tok := p.peek()
+	switch {
+	case tok.kind != wordToken:
+		return nil, p.errorf(tok, "Expected CREATE, DROP, ALTER, TRUNCATE, "+
+			"INSERT, UPDATE or DELETE")
+	case strings.ToUpper(tok.text) == "CREATE" && p.ofSequence():
+		stmt, err = p.parseCreateSequence()
+	case strings.ToUpper(tok.text) == "DROP" && p.ofSequence():
+		stmt, err = p.parseDropSequence()
+	case strings.ToUpper(tok.text) == "CREATE":
+		stmt, err = p.parseCreateTable()
+	case strings.ToUpper(tok.text) == "DROP":
+		stmt, err = p.parseDropTable()
+	case strings.ToUpper(tok.text) == "TRUNCATE":
+		stmt, err = p.parseTruncate()
+	case strings.ToUpper(tok.text) == "ALTER":
+		stmt, err = p.parseAlterTable()
+	case strings.ToUpper(tok.text) == "INSERT":
+		stmt, err = p.parseInsert()
+	case strings.ToUpper(tok.text) == "UPDATE":
+		stmt, err = p.parseUpdate()
+	case strings.ToUpper(tok.text) == "DELETE":
+		stmt, err = p.parseDelete()
+	default:
+		return nil, p.errorf(tok, "Expected CREATE, DROP, ALTER, TRUNCATE, "+
+			"INSERT, UPDATE or DELETE")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != eofToken {
+		return nil, p.errorf(tok, "Unexpected '%s'", tok.text)
+	}
+	return stmt, nil
+}
+
+// Parses the name of a table or a column to be created, which
+// can not have a '.', as it would be taken for a qualified name
+func (p *parser) parseNewName(what string) (string, error) {
+	tok, err := p.parseName(what)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(tok.text, ".") {
+		return "", p.errorf(tok, "Unexpected '.' in %s", what)
+	}
+	return tok.text, nil
+}
+
+func (p *parser) parseCreateTable() (*createTableStmt, error) {
+	p.next()
+	if err := p.expectKeyword("TABLE"); err != nil {
+		return nil, err
+	}
+
+	s := &createTableStmt{}
+	if p.keyword("IF") {
+		if err := p.expectKeyword("NOT"); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("EXISTS"); err != nil {
+			return nil, err
+		}
+		s.ifNotExists = true
+	}
+
+	var err error
+	if s.name, err = p.parseNewName("a table name"); err != nil {
+		return nil, err
+	}
+	if err = p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		switch {
+		case p.keyword("PRIMARY"):
+			if s.spec.PrimaryKey != nil {
+				return nil, p.errorf(tok, "Duplicate primary key")
+			}
+			if err = p.expectKeyword("KEY"); err != nil {
+				return nil, err
+			}
+			if s.spec.PrimaryKey, err = p.parseNameList(); err != nil {
+				return nil, err
+			}
+
+		case p.keyword("UNIQUE"):
+			cols, err := p.parseNameList()
+			if err != nil {
+				return nil, err
+			}
+			s.spec.Unique = append(s.spec.Unique, cols)
+
+		case strings.EqualFold(tok.text, "CONSTRAINT") ||
+			strings.EqualFold(tok.text, "CHECK") ||
+			strings.EqualFold(tok.text, "FOREIGN"):
+			if err = p.parseConstraint(s, ""); err != nil {
+				return nil, err
+			}
+
+		default:
+			desc, def, err := p.parseColumnDef(s)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range s.spec.Columns {
+				if c.ColName == desc.ColName {
+					return nil, p.errorf(tok, "Duplicate column '%s'",
+						desc.ColName)
+				}
+			}
+			s.spec.Columns = append(s.spec.Columns, desc)
+			s.defaults = append(s.defaults, def)
+		}
+
+		if !p.symbol(",") {
+			break
+		}
+	}
+
+	if err = p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	if p.keyword("APPEND") {
+		if err = p.expectKeyword("ONLY"); err != nil {
+			return nil, err
+		}
+		s.spec.AppendOnly = true
+	}
+	s.params = exprParams(s.defaults)
+	return s, nil
+}
+
+// Parses a column of a CREATE TABLE or an ALTER TABLE ADD, as the name
+// and the type, with an optional collation, followed by the constraints
+// of the column and its DEFAULT, in any order. The constraints are NOT
+// NULL, and only in a CREATE TABLE, PRIMARY KEY, UNIQUE, CHECK and
+// REFERENCES, which are added to the spec of the s. Returns the column
+// with its DEFAULT.
+func (p *parser) parseColumnDef(s *createTableStmt) (ColumnDesc, Expr,
+	error) {
+
+	desc := ColumnDesc{}
+	var err error
+	if desc.ColName, err = p.parseNewName("a column name"); err != nil {
+		return desc, nil, err
+	}
+
+	tok := p.next()
+	typ, ok := columnTypes[strings.ToUpper(tok.text)]
+	if tok.kind != wordToken || !ok {
+		return desc, nil, p.errorf(tok, "Expected a column type")
+	}
+	desc.ColType = typ
+	desc.AutoIncrement = strings.ToUpper(tok.text) == "SERIAL"
+
+	// The length of a VARCHAR is not enforced
+	if strings.ToUpper(tok.text) == "VARCHAR" && p.symbol("(") {
+		if tok := p.next(); !isNumber(tok.text) {
+			return desc, nil, p.errorf(tok, "Expected the length of the VARCHAR")
+		}
+		if err = p.expectSymbol(")"); err != nil {
+			return desc, nil, err
+		}
+	}
+
+	if p.keyword("COLLATE") {
+		tok := p.next()
+		c, ok := collations[strings.ToUpper(tok.text)]
+		if tok.kind != wordToken || !ok {
+			return desc, nil, p.errorf(tok, "Expected BINARY or UNICODE")
+		}
+		if typ != StringColumn {
+			return desc, nil, p.errorf(tok, "Unexpected collation for an "+
+				"integer column")
+		}
+		desc.Collation = c
+	}
+
+	var def Expr
+	seen := make(map[string]bool)
+	for {
+		tok := p.peek()
+		word := strings.ToUpper(tok.text)
+		if tok.kind != wordToken || seen[word] {
+			break
+		}
+
+		switch {
+		case word == "NOT":
+			p.next()
+			if err = p.expectKeyword("NULL"); err != nil {
+				return desc, nil, err
+			}
+			desc.NotNull = true
+
+		case word == "ENCODING":
+			p.next()
+			tok := p.next()
+			e, ok := encodings[strings.ToUpper(tok.text)]
+			if tok.kind != wordToken || !ok {
+				return desc, nil, p.errorf(tok, "Expected AUTO, PLAIN or "+
+					"DICTIONARY")
+			}
+			if typ != StringColumn {
+				return desc, nil, p.errorf(tok, "Unexpected encoding for an "+
+					"integer column")
+			}
+			desc.Encoding = e
+
+		case word == "AUTO_INCREMENT" || word == "AUTOINCREMENT":
+			p.next()
+			desc.AutoIncrement = true
+			seen["AUTO_INCREMENT"] = true
+			seen["AUTOINCREMENT"] = true
+
+		case word == "DEFAULT":
+			p.next()
+			if p.keyword("NULL") {
+				break
+			}
+			if tok := p.peek(); p.keyword("NEXTVAL") {
+				if def, err = p.parseNextVal(tok); err != nil {
+					return desc, nil, err
+				}
+				break
+			}
+			if def, err = p.parseSum(); err != nil {
+				return desc, nil, err
+			}
+			if err = p.noAggregates(def, "DEFAULT"); err != nil {
+				return desc, nil, err
+			}
+			var col *ColumnRef
+			walkExpr(def, func(x Expr) {
+				if c, ok := x.(*ColumnRef); ok && col == nil {
+					col = c
+				}
+			})
+			if col != nil {
+				return desc, nil, p.errorAt(col, "Unexpected column '%s' in "+
+					"DEFAULT", col.Name)
+			}
+
+		case s != nil && word == "PRIMARY":
+			p.next()
+			if s.spec.PrimaryKey != nil {
+				return desc, nil, p.errorf(tok, "Duplicate primary key")
+			}
+			if err = p.expectKeyword("KEY"); err != nil {
+				return desc, nil, err
+			}
+			s.spec.PrimaryKey = []string{desc.ColName}
+
+		case s != nil && word == "UNIQUE":
+			p.next()
+			s.spec.Unique = append(s.spec.Unique, []string{desc.ColName})
+
+		case s != nil && (word == "CHECK" || word == "CONSTRAINT" ||
+			word == "REFERENCES"):
+			if err = p.parseConstraint(s, desc.ColName); err != nil {
+				return desc, nil, err
+			}
+
+		default:
+			return desc, def, nil
+		}
+
+		// The CHECKs and the REFERENCES of a column can be repeated
+		seen[word] = word != "CHECK" && word != "CONSTRAINT" &&
+			word != "REFERENCES"
+	}
+	return desc, def, nil
+}
+
+// Parses a constraint of a CREATE TABLE, that can have a name, which is
+// one of [CONSTRAINT name] CHECK (condition) or [CONSTRAINT name] FOREIGN
+// KEY (cols) REFERENCES table [(cols)] [ON DELETE action], and adds it to
+// the spec of the s. The col is the column of a constraint that follows
+// a column, with just a REFERENCES instead of the FOREIGN KEY, or is
+// empty for a constraint of the table.
+func (p *parser) parseConstraint(s *createTableStmt, col string) error {
+	name := ""
+	if p.keyword("CONSTRAINT") {
+		var err error
+		if name, err = p.parseNewName("a constraint name"); err != nil {
+			return err
+		}
+	}
+
+	tok := p.peek()
+	switch {
+	case p.keyword("CHECK"):
+		return p.parseCheck(s, name)
+
+	case col == "" && p.keyword("FOREIGN"):
+		if err := p.expectKeyword("KEY"); err != nil {
+			return err
+		}
+		cols, err := p.parseNameList()
+		if err != nil {
+			return err
+		}
+		if err = p.expectKeyword("REFERENCES"); err != nil {
+			return err
+		}
+		return p.parseReferences(s, name, cols)
+
+	case col != "" && p.keyword("REFERENCES"):
+		return p.parseReferences(s, name, []string{col})
+	}
+
+	if col == "" {
+		return p.errorf(tok, "Expected CHECK or FOREIGN KEY")
+	}
+	return p.errorf(tok, "Expected CHECK or REFERENCES")
+}
+
+// The actions of the ON DELETE of a foreign key
+var foreignKeyActions = map[string]ForeignKeyAction{
+	"RESTRICT": Restrict,
+	"CASCADE":  Cascade,
+	"SET":      SetNull,
+}
+
+// Parses the table [(cols)] [ON DELETE action] that follows the
+// REFERENCES of a foreign key over the cols, and adds it to the spec
+func (p *parser) parseReferences(s *createTableStmt, name string,
+	cols []string) error {
+
+	fk := ForeignKey{Name: name, Columns: cols}
+	var err error
+	if fk.RefTable, err = p.parseNewName("a table name"); err != nil {
+		return err
+	}
+	if tok := p.peek(); tok.kind == symbolToken && tok.text == "(" {
+		if fk.RefColumns, err = p.parseNameList(); err != nil {
+			return err
+		}
+	}
+
+	if p.keyword("ON") {
+		if err = p.expectKeyword("DELETE"); err != nil {
+			return err
+		}
+		tok := p.next()
+		action, ok := foreignKeyActions[strings.ToUpper(tok.text)]
+		if tok.kind != wordToken || !ok {
+			return p.errorf(tok, "Expected RESTRICT, CASCADE or SET NULL")
+		}
+		if action == SetNull {
+			if err = p.expectKeyword("NULL"); err != nil {
+				return err
+			}
+		}
+		fk.OnDelete = action
+	}
+
+	s.spec.ForeignKeys = append(s.spec.ForeignKeys, fk)
+	return nil
+}
+
+// Parses the CHECK (condition) of a CREATE TABLE, after
+// the CHECK, and adds it to the spec of the s
+func (p *parser) parseCheck(s *createTableStmt, name string) error {
+	c := Check{Name: name}
+	if err := p.expectSymbol("("); err != nil {
+		return err
+	}
+
+	start := p.peek().offset
+	e, err := p.parseExpr()
+	if err != nil {
+		return err
+	}
+	if err = p.noAggregates(e, "CHECK"); err != nil {
+		return err
+	}
+	if params := exprParams([]Expr{e}); params != nil {
+		return p.errorAt(params[0], "Unexpected parameter in CHECK")
+	}
+
+	// The condition is kept as it is written, and parsed again
+	// when the table is created, like the Cond of any Check
+	end := p.peek()
+	if err = p.expectSymbol(")"); err != nil {
+		return err
+	}
+	c.Cond = strings.TrimSpace(p.sql[start:end.offset])
+	s.spec.Checks = append(s.spec.Checks, c)
+	return nil
+}
+
+// Parses a list of column names in parentheses
+func (p *parser) parseNameList() ([]string, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for {
+		tok := p.peek()
+		name, err := p.parseNewName("a column name")
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			if n == name {
+				return nil, p.errorf(tok, "Duplicate column '%s'", name)
+			}
+		}
+		names = append(names, name)
+
+		if !p.symbol(",") {
+			break
+		}
+	}
+
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (p *parser) parseDropTable() (*dropTableStmt, error) {
+	p.next()
+	if err := p.expectKeyword("TABLE"); err != nil {
+		return nil, err
+	}
+
+	s := &dropTableStmt{}
+	if p.keyword("IF") {
+		if err := p.expectKeyword("EXISTS"); err != nil {
+			return nil, err
+		}
+		s.ifExists = true
+	}
+
+	var err error
+	if s.name, err = p.parseNewName("a table name"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Returns true if the CREATE or the DROP is of a SEQUENCE
+func (p *parser) ofSequence() bool {
+	tok := p.toks[p.pos+1]
+	return tok.kind == wordToken && strings.ToUpper(tok.text) == "SEQUENCE"
+}
+
+func (p *parser) parseCreateSequence() (*createSequenceStmt, error) {
+	p.next()
+	p.next()
+
+	s := &createSequenceStmt{start: 1, increment: 1}
+	if p.keyword("IF") {
+		if err := p.expectKeyword("NOT"); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("EXISTS"); err != nil {
+			return nil, err
+		}
+		s.ifNotExists = true
+	}
+
+	var err error
+	if s.name, err = p.parseNewName("a sequence name"); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for {
+		tok := p.peek()
+		word := strings.ToUpper(tok.text)
+		if tok.kind != wordToken || seen[word] {
+			break
+		}
+
+		switch word {
+		case "START":
+			p.next()
+			p.keyword("WITH")
+			if s.start, err = p.parseInteger(); err != nil {
+				return nil, err
+			}
+		case "INCREMENT":
+			p.next()
+			p.keyword("BY")
+			if s.increment, err = p.parseInteger(); err != nil {
+				return nil, err
+			}
+			if s.increment == 0 {
+				return nil, p.errorf(tok, "The INCREMENT can not be 0")
+			}
+		default:
+			return s, nil
+		}
+		seen[word] = true
+	}
+	return s, nil
+}
+
+// Parses an integer, with an optional sign
+func (p *parser) parseInteger() (int, error) {
+	tok := p.peek()
+	v, err := p.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+	if l, ok := v.(*Literal); ok && !l.Quoted {
+		if n, err := strconv.Atoi(l.Value); err == nil {
+			return n, nil
+		}
+	}
+	return 0, p.errorf(tok, "Expected an integer")
+}
+
+func (p *parser) parseDropSequence() (*dropSequenceStmt, error) {
+	p.next()
+	p.next()
+
+	s := &dropSequenceStmt{}
+	if p.keyword("IF") {
+		if err := p.expectKeyword("EXISTS"); err != nil {
+			return nil, err
+		}
+		s.ifExists = true
+	}
+
+	var err error
+	if s.name, err = p.parseNewName("a sequence name"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (p *parser) parseTruncate() (*truncateStmt, error) {
+	p.next()
+	p.keyword("TABLE")
+
+	s := &truncateStmt{}
+	var err error
+	if s.name, err = p.parseNewName("a table name"); err != nil {
+		return nil, err
+	}
+	if p.keyword("RESTART") {
+		if err = p.expectKeyword("IDENTITY"); err != nil {
+			return nil, err
+		}
+		s.restart = true
+	}
+	return s, nil
+}
+
+func (p *parser) parseAlterTable() (*alterTableStmt, error) {
+	p.next()
+	if err := p.expectKeyword("TABLE"); err != nil {
+		return nil, err
+	}
+
+	s := &alterTableStmt{}
+	var err error
+	if s.name, err = p.parseNewName("a table name"); err != nil {
+		return nil, err
+	}
+
+	tok := p.next()
+	s.action = strings.ToUpper(tok.text)
+	if tok.kind != wordToken ||
+		(s.action != "ADD" && s.action != "DROP" && s.action != "RENAME") {
+		return nil, p.errorf(tok, "Expected ADD, DROP or RENAME")
+	}
+	if s.action == "RENAME" && p.keyword("TO") {
+		if s.newName, err = p.parseNewName("a table name"); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	p.keyword("COLUMN")
+
+	if s.action == "ADD" {
+		if s.col, s.def, err = p.parseColumnDef(nil); err != nil {
+			return nil, err
+		}
+		s.params = exprParams([]Expr{s.def})
+		return s, nil
+	}
+
+	if s.col.ColName, err = p.parseNewName("a column name"); err != nil {
+		return nil, err
+	}
+	if s.action == "RENAME" {
+		if err = p.expectKeyword("TO"); err != nil {
+			return nil, err
+		}
+		if s.newName, err = p.parseNewName("a column name"); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Parses a value of an INSERT, which is a literal, with an
+// optional sign, a parameter, a NEXTVAL or a nil for a NULL
+func (p *parser) parseValue() (Expr, error) {
+	if p.keyword("NULL") {
+		return nil, nil
+	}
+	if tok := p.peek(); p.keyword("NEXTVAL") {
+		return p.parseNextVal(tok)
+	}
+
+	v, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	switch v.(type) {
+	case *Literal, *Param:
+		return v, nil
+	}
+	return nil, p.errorAt(v, "Expected a value")
+}
+
+// Parses the ('name') of a NEXTVAL, after the NEXTVAL
+// itself, which is the tok, in to a *FuncCall
+func (p *parser) parseNextVal(tok token) (Expr, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	name := p.next()
+	if name.kind != stringToken {
+		return nil, p.errorf(name, "Expected the name of a sequence")
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	return &FuncCall{node{tok.offset}, "NEXTVAL",
+		[]Expr{&Literal{node{name.offset}, name.text, true}}}, nil
+}
+
+func (p *parser) parseInsert() (*insertStmt, error) {
+	p.next()
+	if err := p.expectKeyword("INTO"); err != nil {
+		return nil, err
+	}
+
+	s := &insertStmt{}
+	var err error
+	if s.table, err = p.parseNewName("a table name"); err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind == symbolToken && tok.text == "(" {
+		if s.cols, err = p.parseNameList(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	for {
+		if err = p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+
+		var row []Expr
+		for {
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			if param, ok := v.(*Param); ok {
+				s.params = append(s.params, param)
+			}
+			row = append(row, v)
+
+			if !p.symbol(",") {
+				break
+			}
+		}
+		if err = p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		s.rows = append(s.rows, row)
+
+		if !p.symbol(",") {
+			break
+		}
+	}
+
+	if p.keyword("ON") {
+		if err = p.parseOnConflict(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if !p.keyword("RETURNING") {
+		return s, nil
+	}
+	if p.symbol("*") {
+		s.returning = []string{"*"}
+		return s, nil
+	}
+	for {
+		colName, err := p.parseNewName("a column name")
+		if err != nil {
+			return nil, err
+		}
+		s.returning = append(s.returning, colName)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	return s, nil
+}
+
+// Parses the ON CONFLICT of an INSERT, after the ON
+func (p *parser) parseOnConflict(s *insertStmt) error {
+	if err := p.expectKeyword("CONFLICT"); err != nil {
+		return err
+	}
+	s.onConflict = true
+
+	var err error
+	if tok := p.peek(); tok.kind == symbolToken && tok.text == "(" {
+		if s.conflictCols, err = p.parseNameList(); err != nil {
+			return err
+		}
+	}
+
+	if err = p.expectKeyword("DO"); err != nil {
+		return err
+	}
+	if p.keyword("NOTHING") {
+		return nil
+	}
+	if err = p.expectKeyword("UPDATE"); err != nil {
+		return err
+	}
+	s.doUpdate = true
+
+	if s.setCols, s.setValues, err = p.parseSet(); err != nil {
+		return err
+	}
+	s.params = append(s.params, exprParams(s.setValues)...)
+	return nil
+}
+
+// Parses the SET of an UPDATE or of an ON CONFLICT DO UPDATE, where
+// every value is an expression, or a nil for a NULL
+func (p *parser) parseSet() ([]string, []Expr, error) {
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, nil, err
+	}
+
+	var cols []string
+	var values []Expr
+	for {
+		tok := p.peek()
+		colName, err := p.parseNewName("a column name")
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, c := range cols {
+			if c == colName {
+				return nil, nil, p.errorf(tok, "Duplicate column '%s'", colName)
+			}
+		}
+		if err = p.expectSymbol("="); err != nil {
+			return nil, nil, err
+		}
+
+		var v Expr
+		if !p.keyword("NULL") {
+			if v, err = p.parseSum(); err != nil {
+				return nil, nil, err
+			}
+			if err = p.noAggregates(v, "SET"); err != nil {
+				return nil, nil, err
+			}
+		}
+		cols = append(cols, colName)
+		values = append(values, v)
+
+		if !p.symbol(",") {
+			break
+		}
+	}
+	return cols, values, nil
+}
+
+func (p *parser) parseUpdate() (*updateStmt, error) {
+	p.next()
+
+	s := &updateStmt{}
+	var err error
+	if s.table, err = p.parseNewName("a table name"); err != nil {
+		return nil, err
+	}
+	if s.cols, s.values, err = p.parseSet(); err != nil {
+		return nil, err
+	}
+	s.params = exprParams(s.values)
+
+	where, params, err := p.parseWhere()
+	if err != nil {
+		return nil, err
+	}
+	s.where = where
+	s.params = append(s.params, params...)
+	return s, nil
+}
+
+func (p *parser) parseDelete() (*deleteStmt, error) {
+	p.next()
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+
+	s := &deleteStmt{}
+	var err error
+	if s.table, err = p.parseNewName("a table name"); err != nil {
+		return nil, err
+	}
+	if s.where, s.params, err = p.parseWhere(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Parses the optional WHERE of an UPDATE or a DELETE,
+// returning the condition with its parameters
+func (p *parser) parseWhere() (*ConditionTree, []*Param, error) {
+	if !p.keyword("WHERE") {
+		return nil, nil, nil
+	}
+
+	where, err := p.parseExpr()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = p.noAggregates(where, "WHERE"); err != nil {
+		return nil, nil, err
+	}
+	cTree, err := p.condTree(where, "WHERE")
+	if err != nil {
+		return nil, nil, err
+	}
+	return cTree, exprParams([]Expr{where}), nil
+}
@@ -0,0 +1,1056 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Number of rows over which an expression is evaluated in one go
+const exprBatchSize = 1024
+
+// The scalar functions with their minimum and maximum
+// number of arguments, where -1 is for any number
+var scalarFuncs = map[string][2]int{
+	"LOWER":    {1, 1},
+	"UPPER":    {1, 1},
+	"LENGTH":   {1, 1},
+	"SUBSTR":   {2, 3},
+	"ABS":      {1, 1},
+	"COALESCE": {1, -1},
+}
+
+// The values of an expression for a batch of rows. Only the slice
+// for the colType is used, and nulls[i] is true if the value of the
+// i-th row is a NULL.
+type vector struct {
+	colType ColumnType
+	ints    []int
+	strs    []string
+	values  []interface{}
+	nulls   []bool
+}
+
+// Resizes the vector for n values of the colType,
+// reusing the slices of the previous batches
+func (v *vector) resize(n int, colType ColumnType) {
+	v.colType = colType
+	if cap(v.nulls) < n {
+		v.nulls = make([]bool, n)
+	}
+	v.nulls = v.nulls[:n]
+
+	switch colType {
+	case IntColumn:
+		if cap(v.ints) < n {
+			v.ints = make([]int, n)
+		}
+		v.ints = v.ints[:n]
+	case StringColumn:
+		if cap(v.strs) < n {
+			v.strs = make([]string, n)
+		}
+		v.strs = v.strs[:n]
+	default:
+		if cap(v.values) < n {
+			v.values = make([]interface{}, n)
+		}
+		v.values = v.values[:n]
+	}
+}
+
+// Returns the i-th value, which is nil for a NULL
+func (v *vector) value(i int) interface{} {
+	if v.nulls[i] {
+		return nil
+	}
+	switch v.colType {
+	case IntColumn:
+		return v.ints[i]
+	case StringColumn:
+		return v.strs[i]
+	}
+	return v.values[i]
+}
+
+// A compiled expression, which computes the values of
+// the expression for a batch of rows of a table. Not
+// threadsafe, as the evaluators reuse their vectors.
+type evaluator interface {
+	colType() ColumnType
+	eval(ids []rowID, out *vector)
+}
+
+// The values of a column
+type columnEval struct {
+	desc ColumnDesc
+	data interface{}
+}
+
+func (c *columnEval) colType() ColumnType {
+	return c.desc.ColType
+}
+
+func (c *columnEval) eval(ids []rowID, out *vector) {
+	out.resize(len(ids), c.desc.ColType)
+
+	var ok bool
+	switch data := c.data.(type) {
+	case map[rowID]int:
+		for i, id := range ids {
+			out.ints[i], ok = data[id]
+			out.nulls[i] = !ok
+		}
+	case map[rowID]string:
+		for i, id := range ids {
+			out.strs[i], ok = data[id]
+			out.nulls[i] = !ok
+		}
+	case *dictColumn:
+		for i, id := range ids {
+			out.strs[i], ok = data.get(id)
+			out.nulls[i] = !ok
+		}
+	case *segmentedColumn:
+		for i, id := range ids {
+			if c.desc.ColType == IntColumn {
+				out.ints[i], ok = intValue(data, id)
+			} else {
+				out.strs[i], ok = stringValue(data, id)
+			}
+			out.nulls[i] = !ok
+		}
+	case map[rowID]interface{}:
+		for i, id := range ids {
+			out.values[i], ok = data[id]
+			out.nulls[i] = !ok
+		}
+	}
+}
+
+// A literal value, which is the same for every row, and is a NULL if nil
+type constEval struct {
+	typ   ColumnType
+	value interface{}
+}
+
+func (c *constEval) colType() ColumnType {
+	return c.typ
+}
+
+func (c *constEval) eval(ids []rowID, out *vector) {
+	out.resize(len(ids), c.typ)
+	for i := range ids {
+		out.nulls[i] = c.value == nil
+		switch {
+		case c.value == nil:
+		case c.typ == IntColumn:
+			out.ints[i] = c.value.(int)
+		case c.typ == StringColumn:
+			out.strs[i] = c.value.(string)
+		}
+	}
+}
+
+// An arithmetic operation over two integers
+type arithEval struct {
+	op     string
+	l, r   evaluator
+	lv, rv vector
+}
+
+func (a *arithEval) colType() ColumnType {
+	return IntColumn
+}
+
+func (a *arithEval) eval(ids []rowID, out *vector) {
+	a.l.eval(ids, &a.lv)
+	a.r.eval(ids, &a.rv)
+	out.resize(len(ids), IntColumn)
+
+	for i := range ids {
+		out.nulls[i] = a.lv.nulls[i] || a.rv.nulls[i]
+		if out.nulls[i] {
+			continue
+		}
+
+		l, r := a.lv.ints[i], a.rv.ints[i]
+		switch a.op {
+		case "+":
+			out.ints[i] = l + r
+		case "-":
+			out.ints[i] = l - r
+		case "*":
+			out.ints[i] = l * r
+		case "/", "%":
+			if r == 0 {
+				out.nulls[i] = true
+			} else if a.op == "/" {
+				out.ints[i] = l / r
+			} else {
+				out.ints[i] = l % r
+			}
+		}
+	}
+}
+
+// A unary minus over an integer
+type negEval struct {
+	x  evaluator
+	xv vector
+}
+
+func (n *negEval) colType() ColumnType {
+	return IntColumn
+}
+
+func (n *negEval) eval(ids []rowID, out *vector) {
+	n.x.eval(ids, &n.xv)
+	out.resize(len(ids), IntColumn)
+	for i := range ids {
+		out.nulls[i] = n.xv.nulls[i]
+		out.ints[i] = -n.xv.ints[i]
+	}
+}
+
+// A call to a scalar function. A NULL argument makes
+// the result a NULL, except for COALESCE.
+type funcEval struct {
+	name string
+	typ  ColumnType
+	args []evaluator
+	argv []vector
+}
+
+func (f *funcEval) colType() ColumnType {
+	return f.typ
+}
+
+func (f *funcEval) eval(ids []rowID, out *vector) {
+	for k, a := range f.args {
+		a.eval(ids, &f.argv[k])
+	}
+	out.resize(len(ids), f.typ)
+
+	if f.name == "COALESCE" {
+		for i := range ids {
+			out.nulls[i] = true
+			for k := range f.argv {
+				if !f.argv[k].nulls[i] {
+					out.nulls[i] = false
+					switch f.typ {
+					case IntColumn:
+						out.ints[i] = f.argv[k].ints[i]
+					case StringColumn:
+						out.strs[i] = f.argv[k].strs[i]
+					default:
+						out.values[i] = f.argv[k].values[i]
+					}
+					break
+				}
+			}
+		}
+		return
+	}
+
+	for i := range ids {
+		out.nulls[i] = false
+		for k := range f.argv {
+			if f.argv[k].nulls[i] {
+				out.nulls[i] = true
+			}
+		}
+		if out.nulls[i] {
+			continue
+		}
+
+		switch f.name {
+		case "LOWER":
+			out.strs[i] = strings.ToLower(f.argv[0].strs[i])
+		case "UPPER":
+			out.strs[i] = strings.ToUpper(f.argv[0].strs[i])
+		case "LENGTH":
+			out.ints[i] = utf8.RuneCountInString(f.argv[0].strs[i])
+		case "SUBSTR":
+			length := -1
+			if len(f.argv) == 3 {
+				length = f.argv[2].ints[i]
+			}
+			out.strs[i] = substr(f.argv[0].strs[i], f.argv[1].ints[i], length)
+		case "ABS":
+			out.ints[i] = f.argv[0].ints[i]
+			if out.ints[i] < 0 {
+				out.ints[i] = -out.ints[i]
+			}
+		}
+	}
+}
+
+// Returns the length runes of s from the start-th rune, counting
+// from 1, or all the runes from the start if length is negative
+func substr(s string, start, length int) string {
+	runes := []rune(s)
+	if start < 1 {
+		if length >= 0 {
+			length += start - 1
+			if length < 0 {
+				length = 0
+			}
+		}
+		start = 1
+	}
+	if start > len(runes) {
+		return ""
+	}
+	runes = runes[start-1:]
+	if length >= 0 && length < len(runes) {
+		runes = runes[:length]
+	}
+	return string(runes)
+}
+
+// Compiles the expression in to an evaluator over the table. An
+// aggregate refers to the column named after it, which exists only
+// in the temporary table of the groups, that HAVING is run over.
+// Not threadsafe. Caller should have acquired readlock
+func compileExpr(tbl *table, e Expr) (evaluator, error) {
+	switch e := e.(type) {
+	case *ColumnRef, *AggregateExpr:
+		var name string
+		if c, ok := e.(*ColumnRef); ok {
+			name = c.Name
+		} else {
+			name = e.(*AggregateExpr).Aggregate.String()
+		}
+		desc, ok := tbl.colDesc(name)
+		if !ok {
+			return nil, fmt.Errorf("Invalid column name: %s", name)
+		}
+		return &columnEval{desc, tbl.cols[name]}, nil
+
+	case *Literal:
+		if e.Quoted {
+			return &constEval{StringColumn, e.Value}, nil
+		}
+		return compileLiteral(e, IntColumn)
+
+	case *NullLiteral:
+		return &constEval{CustomColumn, nil}, nil
+
+	case *Param:
+		return compileParam(e, unRecognizedColumn)
+
+	case *ArithmeticExpr:
+		evals, err := compileExprs(tbl, IntColumn, e.Left, e.Right)
+		if err != nil {
+			return nil, err
+		}
+		l, r := evals[0], evals[1]
+		if l.colType() != IntColumn || r.colType() != IntColumn {
+			return nil, fmt.Errorf("'%s' is supported only on integers", e.Op)
+		}
+		return &arithEval{op: e.Op, l: l, r: r}, nil
+
+	case *UnaryExpr:
+		evals, err := compileExprs(tbl, IntColumn, e.X)
+		if err != nil {
+			return nil, err
+		}
+		x := evals[0]
+		if x.colType() != IntColumn {
+			return nil, fmt.Errorf("Unary '%s' is supported only on integers",
+				e.Op)
+		}
+		if e.Op == "+" {
+			return x, nil
+		}
+		return &negEval{x: x}, nil
+
+	case *FuncCall:
+		return compileFuncCall(tbl, e)
+
+	case *CaseExpr:
+		return compileCase(tbl, e)
+	}
+
+	return nil, fmt.Errorf("Expected a value instead of '%s'", formatExpr(e))
+}
+
+// Compiles a literal as a value of the colType, so
+// that col1 = '5' works the same as col1 = 5
+func compileLiteral(l *Literal, colType ColumnType) (evaluator, error) {
+	switch colType {
+	case IntColumn:
+		v, err := strconv.Atoi(l.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid integer '%s'", l.Value)
+		}
+		return &constEval{IntColumn, v}, nil
+	case StringColumn:
+		return &constEval{StringColumn, l.Value}, nil
+	}
+	return nil, fmt.Errorf("Unexpected value '%s' for a custom column",
+		l.Value)
+}
+
+// Compiles the expressions, where the literals and the parameters
+// among them take the type of the first expression that is neither.
+// If there is no such expression, the literals keep their own types,
+// and the parameters and the NULLs take the type of the first literal,
+// or the hint.
+func compileExprs(tbl *table, hint ColumnType,
+	exprs ...Expr) ([]evaluator, error) {
+
+	ret := make([]evaluator, len(exprs))
+
+	var typ, litType ColumnType = unRecognizedColumn, unRecognizedColumn
+	for k, e := range exprs {
+		switch e.(type) {
+		case *Literal, *Param, *NullLiteral:
+			continue
+		}
+		var err error
+		if ret[k], err = compileExpr(tbl, e); err != nil {
+			return nil, err
+		}
+		if typ == unRecognizedColumn {
+			typ = ret[k].colType()
+		}
+	}
+
+	for k, e := range exprs {
+		l, ok := e.(*Literal)
+		if !ok {
+			continue
+		}
+		var err error
+		if typ == unRecognizedColumn {
+			ret[k], err = compileExpr(tbl, l)
+		} else {
+			ret[k], err = compileLiteral(l, typ)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if litType == unRecognizedColumn {
+			litType = ret[k].colType()
+		}
+	}
+
+	if typ == unRecognizedColumn {
+		typ = litType
+	}
+	if typ == unRecognizedColumn {
+		typ = hint
+	}
+	for k, e := range exprs {
+		if p, ok := e.(*Param); ok {
+			var err error
+			if ret[k], err = compileParam(p, typ); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The NULLs take the type, if there is any
+	for k, e := range exprs {
+		if _, ok := e.(*NullLiteral); ok {
+			ret[k] = &constEval{typ, nil}
+			if typ == unRecognizedColumn {
+				ret[k] = &constEval{CustomColumn, nil}
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// The value of a parameter, which is read every time the
+// expression is evaluated, as it is bound after the compiling
+type paramEval struct {
+	p *Param
+}
+
+func (e *paramEval) colType() ColumnType {
+	return e.p.typ
+}
+
+func (e *paramEval) eval(ids []rowID, out *vector) {
+	out.resize(len(ids), e.p.typ)
+	for i := range ids {
+		out.nulls[i] = false
+		switch e.p.typ {
+		case IntColumn:
+			out.ints[i] = e.p.value.(int)
+		case StringColumn:
+			out.strs[i] = e.p.value.(string)
+		}
+	}
+}
+
+// Compiles the parameter as a value of the typ, which should
+// be known from the expression that the parameter is a part of
+func compileParam(p *Param, typ ColumnType) (evaluator, error) {
+	if typ != IntColumn && typ != StringColumn {
+		return nil, fmt.Errorf("Could not find out the type of the "+
+			"parameter '%s'", formatExpr(p))
+	}
+	p.typ, p.typed = typ, true
+	if p.value != nil {
+		if _, err := p.valueFor(typ, ""); err != nil {
+			return nil, err
+		}
+	}
+	return &paramEval{p}, nil
+}
+
+func compileFuncCall(tbl *table, e *FuncCall) (evaluator, error) {
+	f := &funcEval{name: e.Name}
+
+	// The types of the arguments and the result
+	var argTypes []ColumnType
+	switch e.Name {
+	case "LOWER", "UPPER":
+		argTypes = []ColumnType{StringColumn}
+		f.typ = StringColumn
+	case "LENGTH":
+		argTypes = []ColumnType{StringColumn}
+		f.typ = IntColumn
+	case "SUBSTR":
+		argTypes = []ColumnType{StringColumn, IntColumn, IntColumn}
+		f.typ = StringColumn
+	case "ABS":
+		argTypes = []ColumnType{IntColumn}
+		f.typ = IntColumn
+	}
+
+	var err error
+	if e.Name == "COALESCE" {
+		f.args, err = compileExprs(tbl, unRecognizedColumn, e.Args...)
+		if err != nil {
+			return nil, err
+		}
+		f.typ = f.args[0].colType()
+		for range f.args {
+			argTypes = append(argTypes, f.typ)
+		}
+	} else {
+		for k, a := range e.Args {
+			evals, err := compileExprs(tbl, argTypes[k], a)
+			if err != nil {
+				return nil, err
+			}
+			f.args = append(f.args, evals[0])
+		}
+	}
+	f.argv = make([]vector, len(f.args))
+
+	for k, a := range f.args {
+		if a.colType() != argTypes[k] {
+			return nil, fmt.Errorf("Invalid type of argument %d of %s",
+				k+1, e.Name)
+		}
+	}
+	return f, nil
+}
+
+// A compiled condition, which finds out for which rows of a batch it is
+// true, and for which rows it is false. A NULL operand makes it neither
+// true nor false, but UNKNOWN, so that its NOT is UNKNOWN too.
+type condEval interface {
+	test(ids []rowID, out []bool)
+	testFalse(ids []rowID, out []bool)
+}
+
+// An AND or an OR of conditions
+type logicEval struct {
+	op    LogicalOperator
+	xs    []condEval
+	masks [][]bool
+}
+
+func (l *logicEval) test(ids []rowID, out []bool) {
+	l.combine(ids, out, false)
+}
+
+func (l *logicEval) testFalse(ids []rowID, out []bool) {
+	l.combine(ids, out, true)
+}
+
+// Sets out to whether the AND or the OR of the conditions is true, or,
+// if negated, to whether it is false, which is when any condition of an
+// AND is false, or when all the conditions of an OR are false
+func (l *logicEval) combine(ids []rowID, out []bool, negated bool) {
+	for k, x := range l.xs {
+		if cap(l.masks[k]) < len(ids) {
+			l.masks[k] = make([]bool, len(ids))
+		}
+		l.masks[k] = l.masks[k][:len(ids)]
+		if negated {
+			x.testFalse(ids, l.masks[k])
+		} else {
+			x.test(ids, l.masks[k])
+		}
+	}
+
+	and := (l.op == AND) != negated
+	for i := range ids {
+		out[i] = and
+		for k := range l.xs {
+			if l.masks[k][i] != and {
+				out[i] = !out[i]
+				break
+			}
+		}
+	}
+}
+
+// A negated condition, which is true for the rows where the condition
+// is false, and UNKNOWN for the rows where the condition is UNKNOWN
+type notEval struct {
+	x condEval
+}
+
+func (n *notEval) test(ids []rowID, out []bool) {
+	n.x.testFalse(ids, out)
+}
+
+func (n *notEval) testFalse(ids []rowID, out []bool) {
+	n.x.test(ids, out)
+}
+
+// Compiles a condition, like the WHEN of a CASE
+// Not threadsafe. Caller should have acquired readlock
+func compileCond(tbl *table, e Expr) (condEval, error) {
+	switch e := e.(type) {
+	case *BinaryExpr:
+		l, err := compileCond(tbl, e.Left)
+		if err != nil {
+			return nil, err
+		}
+		r, err := compileCond(tbl, e.Right)
+		if err != nil {
+			return nil, err
+		}
+		return &logicEval{op: e.Op, xs: []condEval{l, r},
+			masks: make([][]bool, 2)}, nil
+
+	case *NotExpr:
+		x, err := compileCond(tbl, e.X)
+		if err != nil {
+			return nil, err
+		}
+		return &notEval{x}, nil
+	}
+
+	return compilePredicate(tbl, e)
+}
+
+// A CASE, whose value for a row is the result of the
+// first WHEN that is true, or the ELSE if none are
+type caseEval struct {
+	typ     ColumnType
+	conds   []condEval
+	results []evaluator
+	masks   [][]bool
+	vecs    []vector
+}
+
+func (c *caseEval) colType() ColumnType {
+	return c.typ
+}
+
+func (c *caseEval) eval(ids []rowID, out *vector) {
+	for k, cond := range c.conds {
+		if cap(c.masks[k]) < len(ids) {
+			c.masks[k] = make([]bool, len(ids))
+		}
+		c.masks[k] = c.masks[k][:len(ids)]
+		cond.test(ids, c.masks[k])
+	}
+	for k, r := range c.results {
+		r.eval(ids, &c.vecs[k])
+	}
+	out.resize(len(ids), c.typ)
+
+	for i := range ids {
+		// The result of the ELSE, if any, follows those of the WHENs
+		k := 0
+		for k < len(c.conds) && !c.masks[k][i] {
+			k++
+		}
+		if k == len(c.results) {
+			out.nulls[i] = true
+			continue
+		}
+
+		out.nulls[i] = c.vecs[k].nulls[i]
+		switch c.typ {
+		case IntColumn:
+			out.ints[i] = c.vecs[k].ints[i]
+		case StringColumn:
+			out.strs[i] = c.vecs[k].strs[i]
+		default:
+			out.values[i] = c.vecs[k].values[i]
+		}
+	}
+}
+
+// Compiles a CASE, where a simple CASE is compiled as a searched
+// CASE, with a comparison of the operand for every WHEN. All the
+// results should have the same type, to which the literals among
+// them are converted.
+func compileCase(tbl *table, e *CaseExpr) (evaluator, error) {
+	c := &caseEval{}
+
+	var results []Expr
+	for _, w := range e.Whens {
+		cond := w.Cond
+		if e.Operand != nil {
+			cond = &ComparisonExpr{node{w.Cond.Pos()}, EQ, e.Operand, w.Cond}
+		}
+		ce, err := compileCond(tbl, cond)
+		if err != nil {
+			return nil, err
+		}
+		c.conds = append(c.conds, ce)
+		results = append(results, w.Result)
+	}
+	if e.Else != nil {
+		results = append(results, e.Else)
+	}
+
+	var err error
+	if c.results, err = compileExprs(tbl, unRecognizedColumn, results...); err != nil {
+		return nil, err
+	}
+	c.typ = c.results[0].colType()
+	for _, r := range c.results {
+		if r.colType() != c.typ {
+			return nil, fmt.Errorf("Incompatible types in the results of '%s'",
+				formatExpr(e))
+		}
+	}
+
+	c.masks = make([][]bool, len(c.conds))
+	c.vecs = make([]vector, len(c.results))
+	return c, nil
+}
+
+// A condition whose operands are expressions, like price * qty > 100,
+// which is evaluated in batches over all the rows of the table
+type predicate struct {
+	tbl       *table
+	op        RelationalOperator
+	x         evaluator
+	args      []evaluator
+	pattern   *pattern
+	collation Collation
+
+	// A pattern given as a parameter is compiled when the
+	// query is run, and again only if the value changes
+	patternParam *Param
+	patternText  string
+
+	// The values of x followed by the values of the args
+	vecs []vector
+}
+
+// Compiles a ComparisonExpr, an InExpr or a BetweenExpr
+// Not threadsafe. Caller should have acquired readlock
+func compilePredicate(tbl *table, e Expr) (*predicate, error) {
+	p := &predicate{tbl: tbl}
+
+	var operands []Expr
+	switch e := e.(type) {
+	case *ComparisonExpr:
+		p.op = e.Op
+		operands = []Expr{e.Left, e.Right}
+	case *InExpr:
+		p.op = e.Op
+		operands = append([]Expr{e.X}, e.List...)
+	case *BetweenExpr:
+		p.op = BETWEEN
+		operands = []Expr{e.X, e.Lo, e.Hi}
+	default:
+		return nil, fmt.Errorf("Expected a condition instead of '%s'",
+			formatExpr(e))
+	}
+
+	switch p.op {
+	case LIKE, NOTLIKE, ILIKE, NOTILIKE, REGEXP, NOTREGEXP:
+		x, err := compileExpr(tbl, operands[0])
+		if err != nil {
+			return nil, err
+		}
+		if x.colType() != StringColumn {
+			return nil, fmt.Errorf("%s is supported only on strings", p.op)
+		}
+
+		switch v := operands[1].(type) {
+		case *Literal:
+			if v.Quoted {
+				p.pattern, err = compilePattern(p.op, v.Value)
+			}
+		case *Param:
+			_, err = compileParam(v, StringColumn)
+			p.patternParam = v
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p.pattern == nil && p.patternParam == nil {
+			return nil, fmt.Errorf("The pattern of %s should be a string", p.op)
+		}
+		p.x = x
+		p.vecs = make([]vector, 1)
+		return p, nil
+	}
+
+	evals, err := compileExprs(tbl, unRecognizedColumn, operands...)
+	if err != nil {
+		return nil, err
+	}
+	for _, ev := range evals {
+		if ev.colType() != evals[0].colType() {
+			return nil, fmt.Errorf("Mismatched types in '%s'", formatExpr(e))
+		}
+		if ev.colType() == CustomColumn {
+			return nil, fmt.Errorf("Custom columns can not be compared in '%s'",
+				formatExpr(e))
+		}
+		if c, ok := ev.(*columnEval); ok && c.desc.Collation != BinaryCollation {
+			p.collation = c.desc.Collation
+		}
+	}
+
+	p.x, p.args = evals[0], evals[1:]
+	p.vecs = make([]vector, len(evals))
+	return p, nil
+}
+
+// Returns the rowIDs among the ids for which the condition is true.
+// A NULL operand never matches. Not threadsafe, as the vectors are
+// reused. Caller should have acquired readlock
+func (p *predicate) filter(ids []rowID) []rowID {
+	return filterRows(ids, p.test)
+}
+
+// Returns the rowIDs in ids for which the predicate is false, which
+// are not the ones for which it is UNKNOWN, due to a NULL
+// Not threadsafe. Caller should have acquired readlock
+func (p *predicate) filterFalse(ids []rowID) []rowID {
+	return filterRows(ids, p.testFalse)
+}
+
+// Returns the rowIDs in ids for which the test sets the mask,
+// testing them in batches of exprBatchSize
+func filterRows(ids []rowID, test func(ids []rowID, out []bool)) []rowID {
+	var ret []rowID
+	mask := make([]bool, exprBatchSize)
+	for lo := 0; lo < len(ids); lo += exprBatchSize {
+		hi := lo + exprBatchSize
+		if hi > len(ids) {
+			hi = len(ids)
+		}
+		batch := ids[lo:hi]
+
+		test(batch, mask[:len(batch)])
+		for i, id := range batch {
+			if mask[i] {
+				ret = append(ret, id)
+			}
+		}
+	}
+	return ret
+}
+
+func (p *predicate) test(ids []rowID, out []bool) {
+	if v := p.patternParam; v != nil &&
+		(p.pattern == nil || p.patternText != v.value.(string)) {
+		var err error
+		if p.pattern, err = compilePattern(p.op, v.value.(string)); err != nil {
+			panic(err)
+		}
+		p.patternText = v.value.(string)
+	}
+
+	p.x.eval(ids, &p.vecs[0])
+	for k, a := range p.args {
+		a.eval(ids, &p.vecs[k+1])
+	}
+	for i := range ids {
+		out[i] = p.matches(i)
+	}
+}
+
+func (p *predicate) testFalse(ids []rowID, out []bool) {
+	p.test(ids, out)
+	for i := range ids {
+		out[i] = !out[i] && !p.unknown(i)
+	}
+}
+
+// Returns true if the predicate is neither true nor false for the i-th
+// values, as a value that it compares is a NULL. An IN with a NULL in
+// its list is true if the value is in the list, and UNKNOWN if not.
+func (p *predicate) unknown(i int) bool {
+	if p.vecs[0].nulls[i] {
+		return true
+	}
+	inList := p.op == IN || p.op == NOTIN
+	for k := 1; k < len(p.vecs); k++ {
+		if p.vecs[k].nulls[i] {
+			return !inList || !p.inList(i)
+		}
+	}
+	return false
+}
+
+// Returns true if the i-th value of x is one of the values of the list
+func (p *predicate) inList(i int) bool {
+	for k := 1; k < len(p.vecs); k++ {
+		if !p.vecs[k].nulls[i] && p.compare(0, k, i) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Compares the i-th values of the k-th and the l-th vectors
+func (p *predicate) compare(k, l, i int) int {
+	a, b := &p.vecs[k], &p.vecs[l]
+	if a.colType == StringColumn {
+		return p.collation.compare(a.strs[i], b.strs[i])
+	}
+	switch {
+	case a.ints[i] < b.ints[i]:
+		return -1
+	case a.ints[i] > b.ints[i]:
+		return 1
+	}
+	return 0
+}
+
+func (p *predicate) matches(i int) bool {
+	if p.unknown(i) {
+		return false
+	}
+
+	switch p.op {
+	case LIKE, ILIKE, REGEXP:
+		return p.pattern.match(p.vecs[0].strs[i])
+	case NOTLIKE, NOTILIKE, NOTREGEXP:
+		return !p.pattern.match(p.vecs[0].strs[i])
+	case EQ:
+		return p.compare(0, 1, i) == 0
+	case NEQ:
+		return p.compare(0, 1, i) != 0
+	case IN, NOTIN:
+		return p.inList(i) == (p.op == IN)
+	case BETWEEN:
+		return p.compare(0, 1, i) >= 0 && p.compare(0, 2, i) <= 0
+	}
+	return matchesOrder(p.compare(0, 1, i), p.op)
+}
+
+// Evaluates the exprs for every row matching the cTree, in batches,
+// and returns the rows of their values. If the cTree is nil, all the
+// rows of the table are used.
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) queryExprs(exprs []Expr,
+	cTree *ConditionTree) ([]interface{}, error) {
+
+	var evals []evaluator
+	for _, e := range exprs {
+		ev, err := compileExpr(t, e)
+		if err != nil {
+			return nil, err
+		}
+		evals = append(evals, ev)
+	}
+
+	var matchingRowIDs []rowID
+	if cTree != nil {
+		matchingRowIDs = cTree.evaluate(t)
+	} else {
+		matchingRowIDs = t.liveRowIDs()
+	}
+
+	var results []interface{}
+	vecs := make([]vector, len(evals))
+	for lo := 0; lo < len(matchingRowIDs); lo += exprBatchSize {
+		hi := lo + exprBatchSize
+		if hi > len(matchingRowIDs) {
+			hi = len(matchingRowIDs)
+		}
+		batch := matchingRowIDs[lo:hi]
+
+		for k, ev := range evals {
+			ev.eval(batch, &vecs[k])
+		}
+
+		for i := range batch {
+			row := make([]interface{}, len(evals))
+			for k := range vecs {
+				row[k] = vecs[k].value(i)
+			}
+			results = append(results, row)
+		}
+	}
+
+	return results, nil
+}
+
+// Evaluates the exprs for every row matching the cTree and loads their
+// values in to a temporary table, with a column for every expr, named
+// by the names. A column that is copied keeps its collation.
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) computeTable(names []string, exprs []Expr,
+	cTree *ConditionTree) (*table, error) {
+
+	var descs []ColumnDesc
+	for k, e := range exprs {
+		ev, err := compileExpr(t, e)
+		if err != nil {
+			return nil, err
+		}
+		desc := ColumnDesc{ColName: names[k], ColType: ev.colType()}
+		if c, ok := ev.(*columnEval); ok {
+			desc.Collation = c.desc.Collation
+		}
+		descs = append(descs, desc)
+	}
+
+	rows, err := t.queryExprs(exprs, cTree)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := newTable(descs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, row := range rows {
+		id := rowID(i + 1)
+		for k, desc := range descs {
+			v := row.([]interface{})[k]
+			if v == nil {
+				continue
+			}
+			setColumnValue(desc.ColType, tmp.cols[desc.ColName], id, v)
+		}
+		tmp.liveRows[id] = true
+	}
+	tmp.rowCounter = rowID(len(rows))
+
+	return tmp, nil
+}
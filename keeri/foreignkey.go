@@ -0,0 +1,371 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Returned, wrapped in a *ConstraintError, when a row would refer to a
+// row that does not exist in the parent table of a foreign key, or when
+// a row that is referred to would be deleted or changed
+var ErrForeignKeyViolation = errors.New("Foreign key constraint violation")
+
+// What is done to the rows of the child table of a foreign key,
+// when the row of the parent table that they refer to is deleted
+type ForeignKeyAction int
+
+const (
+	// The row that is referred to can not be deleted
+	Restrict ForeignKeyAction = iota
+
+	// The rows that refer to the deleted row are deleted too
+	Cascade
+
+	// The columns of the foreign key are set to NULL
+	// in the rows that refer to the deleted row
+	SetNull
+)
+
+func (a ForeignKeyAction) String() string {
+	switch a {
+	case Restrict:
+		return "RESTRICT"
+	case Cascade:
+		return "CASCADE"
+	case SetNull:
+		return "SET NULL"
+	default:
+		panic("Unknown foreign key action")
+	}
+}
+
+// A foreign key, whose columns in every row either have a NULL, or have
+// the same values as the RefColumns in a row of the RefTable. The
+// RefColumns should be the primary key or a unique constraint of the
+// RefTable, and default to its primary key. The values of the RefColumns
+// in a row that is referred to can not be changed, and the OnDelete says
+// what happens when the row is deleted. The Name is <table>_<cols>_fkey
+// by default. A table can refer to itself.
+type ForeignKey struct {
+	Name       string
+	Columns    []string
+	RefTable   string
+	RefColumns []string
+	OnDelete   ForeignKeyAction
+}
+
+// A foreign key from the child table to the parent table, with an
+// index of the rows of the child, by the values of their columns
+type foreignKey struct {
+	name     string
+	onDelete ForeignKeyAction
+
+	child *table
+	cols  []string
+
+	// The columns of the parent in the order of the cols, with
+	// the index of the primary key or the unique constraint
+	parent      *table
+	parentName  string
+	parentCols  []string
+	parentIndex *index
+
+	// The rowIDs of the rows of the child, by the key of the values
+	// of their cols, where a row with a NULL in the cols is not indexed.
+	// Protected by the dataMetaDataLock of the child
+	rows map[string]map[rowID]bool
+}
+
+// Creates the foreign keys of the spec, for the table t that is being
+// created with the given name, after checking that they refer to the
+// columns of a unique constraint of the parents, with the same types.
+// Not threadsafe. Caller should have acquired the writelock of tblNamesLock
+func (db *Keeri) newForeignKeys(tableName string, t *table,
+	spec TableSpec) ([]*foreignKey, error) {
+
+	var ret []*foreignKey
+	for _, i := range spec.ForeignKeys {
+		if len(i.Columns) == 0 {
+			return nil, errors.New("No columns in the foreign key")
+		}
+
+		parent := db.tables[i.RefTable]
+		if i.RefTable == tableName {
+			parent = t
+		}
+		if parent == nil {
+			return nil, fmt.Errorf("%w: '%s'", ErrTableNotFound, i.RefTable)
+		}
+
+		// The parent may be locked by the writes to its other children
+		if parent != t {
+			parent.dataMetaDataLock.RLock()
+		}
+		fk, err := newForeignKey(tableName, t, parent, i)
+		if parent != t {
+			parent.dataMetaDataLock.RUnlock()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, j := range ret {
+			if j.name == fk.name {
+				return nil, fmt.Errorf("Duplicate constraint '%s'", fk.name)
+			}
+		}
+		ret = append(ret, fk)
+	}
+	return ret, nil
+}
+
+// Not threadsafe. Caller should have acquired the readlock of the parent
+func newForeignKey(tableName string, t, parent *table,
+	spec ForeignKey) (*foreignKey, error) {
+
+	fk := &foreignKey{
+		name:       spec.Name,
+		onDelete:   spec.OnDelete,
+		child:      t,
+		cols:       append([]string{}, spec.Columns...),
+		parent:     parent,
+		parentName: spec.RefTable,
+		parentCols: append([]string{}, spec.RefColumns...),
+		rows:       make(map[string]map[rowID]bool),
+	}
+	if fk.name == "" {
+		fk.name = tableName + "_" + strings.Join(fk.cols, "_") + "_fkey"
+	}
+	if fk.onDelete < Restrict || fk.onDelete > SetNull {
+		return nil, fmt.Errorf("Invalid action %d of the foreign key '%s'",
+			fk.onDelete, fk.name)
+	}
+
+	if spec.RefColumns == nil {
+		for _, x := range parent.indexes {
+			if x.primary {
+				fk.parentCols = append([]string{}, x.cols...)
+			}
+		}
+		if fk.parentCols == nil {
+			return nil, fmt.Errorf("No primary key in the table '%s'",
+				spec.RefTable)
+		}
+	}
+	if len(fk.parentCols) != len(fk.cols) {
+		return nil, fmt.Errorf("Expected %d columns in the foreign key '%s', "+
+			"got %d", len(fk.parentCols), fk.name, len(fk.cols))
+	}
+
+	var err error
+	if fk.parentIndex, err = parent.indexOn(fk.parentCols); err != nil {
+		return nil, err
+	}
+	for k, colName := range fk.cols {
+		desc, ok := t.colDesc(colName)
+		if !ok {
+			return nil, fmt.Errorf("Invalid column name: %s", colName)
+		}
+		for _, c := range fk.cols[:k] {
+			if c == colName {
+				return nil, fmt.Errorf("Duplicate column '%s' in the "+
+					"foreign key", colName)
+			}
+		}
+		if ref, _ := parent.colDesc(fk.parentCols[k]); ref.ColType != desc.ColType {
+			return nil, fmt.Errorf("Mismatched types of '%s' and '%s.%s' "+
+				"in the foreign key '%s'", colName, spec.RefTable, ref.ColName,
+				fk.name)
+		}
+	}
+	return fk, nil
+}
+
+func (fk *foreignKey) violation() error {
+	return &ConstraintError{Err: ErrForeignKeyViolation,
+		Constraint: fk.name, Columns: fk.cols}
+}
+
+// Returns the sorted rowIDs of the rows of the child with the given key
+// Not threadsafe. Caller should have acquired the readlock of the child
+func (fk *foreignKey) childRows(key string) []rowID {
+	ids := make([]rowID, 0, len(fk.rows[key]))
+	for id := range fk.rows[key] {
+		ids = append(ids, id)
+	}
+	return sortAndDeDup(ids)
+}
+
+// Returns true if the row of the child refers to a live row of the parent
+// Not threadsafe. Caller should have acquired the readlocks of both tables
+func (fk *foreignKey) parentExists(row []interface{}) (bool, error) {
+	ref := make([]interface{}, len(fk.parent.colsDesc))
+	for k, colName := range fk.cols {
+		ref[fk.parent.colPos(fk.parentCols[k])] = row[fk.child.colPos(colName)]
+	}
+	_, found, err := fk.parent.duplicateRow(fk.parentIndex, 0, ref)
+	return found, err
+}
+
+// Checks that the row, which was stored in place of the old row, or as
+// a new row if the old is nil, refers to the live rows of the parents.
+// Not threadsafe. Caller should have acquired the locks, as lockForWrite does
+func (t *table) checkReferences(old, row []interface{}) error {
+	for _, fk := range t.foreignKeys {
+		key, ok, err := t.rowKey(fk.cols, row)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if old != nil {
+			if oldKey, _, _ := t.rowKey(fk.cols, old); oldKey == key {
+				continue
+			}
+		}
+
+		found, err := fk.parentExists(row)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fk.violation()
+		}
+	}
+	return nil
+}
+
+// Checks that the row, which was stored in place of the old row, has the
+// same values as the old row in the columns that the rows of the children
+// refer to. Not threadsafe. Caller should have acquired the locks, as
+// lockForWrite does
+func (t *table) checkReferenced(old, row []interface{}) error {
+	for _, fk := range t.refs {
+		oldKey, ok, err := t.rowKey(fk.parentCols, old)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if key, _, _ := t.rowKey(fk.parentCols, row); key == oldKey {
+			continue
+		}
+		if len(fk.rows[oldKey]) > 0 {
+			return fk.violation()
+		}
+	}
+	return nil
+}
+
+// Adds the tables that a write to the table t can reach through the
+// foreign keys to the modes, where the tables that are true in the modes
+// are written to, and the others are only read. The parents are read,
+// to find the rows referred to, and the children are written to, if the
+// rows that refer to a deleted row are deleted or updated, or else read.
+// Not threadsafe. Caller should have acquired the readlock of tblNamesLock
+func (t *table) writeSet(modes map[*table]bool) {
+	if modes[t] {
+		return
+	}
+	modes[t] = true
+
+	for _, fk := range t.foreignKeys {
+		if _, ok := modes[fk.parent]; !ok {
+			modes[fk.parent] = false
+		}
+	}
+	for _, fk := range t.refs {
+		if fk.onDelete != Restrict {
+			fk.child.writeSet(modes)
+		} else if _, ok := modes[fk.child]; !ok {
+			modes[fk.child] = false
+		}
+	}
+}
+
+// Looks up the table and locks it for writing, along with the tables
+// that the write can reach through the foreign keys, as writeSet says.
+// Returns the table and the function that unlocks all the tables.
+func (db *Keeri) lockForWrite(tableName string) (*table, func(), error) {
+	db.tblNamesLock.RLock()
+	defer db.tblNamesLock.RUnlock()
+
+	tbl := db.tables[tableName]
+	if tbl == nil {
+		return nil, nil, fmt.Errorf("%w: '%s'", ErrTableNotFound, tableName)
+	}
+
+	modes := make(map[*table]bool)
+	tbl.writeSet(modes)
+	return tbl, lockTables(modes), nil
+}
+
+// Looks up the table and locks it for writing, along with all the
+// tables that it refers to, or that refer to it, so that the columns
+// of their foreign keys can be changed. Returns the table and the
+// function that unlocks all the tables.
+func (db *Keeri) lockRelated(tableName string) (*table, func(), error) {
+	db.tblNamesLock.RLock()
+	defer db.tblNamesLock.RUnlock()
+
+	tbl := db.tables[tableName]
+	if tbl == nil {
+		return nil, nil, fmt.Errorf("%w: '%s'", ErrTableNotFound, tableName)
+	}
+
+	modes := map[*table]bool{tbl: true}
+	for _, fk := range tbl.foreignKeys {
+		modes[fk.parent] = true
+	}
+	for _, fk := range tbl.refs {
+		modes[fk.child] = true
+	}
+	return tbl, lockTables(modes), nil
+}
+
+// Returns a foreign key of another table that refers to the table t,
+// or a nil if there is none.
+// Not threadsafe. Caller should have acquired the readlock of tblNamesLock
+func (t *table) referredBy() *foreignKey {
+	for _, fk := range t.refs {
+		if fk.child != t {
+			return fk
+		}
+	}
+	return nil
+}
+
+// Adds the foreign keys of the table t to the refs of their parents,
+// or removes them from the refs, if the table is dropped.
+// Not threadsafe. Caller should have acquired the writelock of tblNamesLock
+func (t *table) linkForeignKeys(link bool) {
+	for _, fk := range t.foreignKeys {
+		if fk.parent != t {
+			fk.parent.dataMetaDataLock.Lock()
+		}
+
+		var refs []*foreignKey
+		for _, i := range fk.parent.refs {
+			if i != fk {
+				refs = append(refs, i)
+			}
+		}
+		if link {
+			refs = append(refs, fk)
+		}
+		fk.parent.refs = refs
+
+		if fk.parent != t {
+			fk.parent.dataMetaDataLock.Unlock()
+		}
+	}
+}
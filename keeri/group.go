@@ -0,0 +1,188 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import "fmt"
+
+// Number of rows whose groups are found, before the
+// aggregators are run over them in a tight loop
+const groupBatchSize = 1024
+
+// Groups the rows matching the cTree by the values of the groupCols,
+// using a hash table that has one entry per group, and computes the
+// aggregates for every group. Each of the returned rows has the values
+// of the groupCols followed by the values of the aggs. If the cTree is
+// nil, all the rows of the table are grouped.
+//
+// The having tree, if not nil, filters the groups. Its conditions can
+// refer to the groupCols, or to any of the aggs by their names as
+// returned by Aggregate.String(), for example "COUNT(*)"
+func (db *Keeri) QueryGroups(tableName string, groupCols []string,
+	aggs []Aggregate, cTree *ConditionTree,
+	having *ConditionTree) (ret []interface{}, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			ret = nil
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+
+	tbl, err := db.lookupTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	tbl.dataMetaDataLock.RLock()
+	defer tbl.dataMetaDataLock.RUnlock()
+	return tbl.queryGroups(groupCols, aggs, cTree, having)
+}
+
+// Not threadsafe for the having tree, as it gets resolved
+// against the groups. Panics in case of errors in the having
+// tree, which should be recovered by the caller.
+// Caller should have acquired readlock
+func (t *table) queryGroups(groupCols []string, aggs []Aggregate,
+	cTree *ConditionTree, having *ConditionTree) (ret []interface{}, err error) {
+
+	var groupDescs []ColumnDesc
+	var groupData []interface{}
+	for _, colName := range groupCols {
+		desc, ok := t.colDesc(colName)
+		if !ok {
+			return nil, fmt.Errorf("Invalid column name: %s", colName)
+		}
+		groupDescs = append(groupDescs, desc)
+		groupData = append(groupData, t.cols[colName])
+	}
+
+	var aggregators []*aggregator
+	for _, agg := range aggs {
+		a, err := newAggregator(t, agg)
+		if err != nil {
+			return nil, err
+		}
+		aggregators = append(aggregators, a)
+	}
+
+	var matchingRowIDs []rowID
+	if cTree != nil {
+		matchingRowIDs = cTree.evaluate(t)
+	} else {
+		matchingRowIDs = t.liveRowIDs()
+	}
+
+	// Maps the key of a group to its index in the groups
+	groupIndex := make(map[string]int)
+	var groups [][]interface{}
+
+	var key []byte
+	values := make([]interface{}, len(groupDescs))
+	batchGroups := make([]int, groupBatchSize)
+	for lo := 0; lo < len(matchingRowIDs); lo += groupBatchSize {
+		hi := lo + groupBatchSize
+		if hi > len(matchingRowIDs) {
+			hi = len(matchingRowIDs)
+		}
+		batch := matchingRowIDs[lo:hi]
+
+		for i, id := range batch {
+			key = key[:0]
+			for j, desc := range groupDescs {
+				key, values[j], err = appendColumnKey(key, desc.ColType,
+					groupData[j], id)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			g, ok := groupIndex[string(key)]
+			if !ok {
+				g = len(groups)
+				groupIndex[string(key)] = g
+				groups = append(groups, append([]interface{}{}, values...))
+			}
+			batchGroups[i] = g
+		}
+
+		for _, a := range aggregators {
+			err = a.accumulate(batch, batchGroups[:len(batch)], len(groups))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for g, values := range groups {
+		row := make([]interface{}, 0, len(values)+len(aggregators))
+		row = append(row, values...)
+		for _, a := range aggregators {
+			row = append(row, a.result(g))
+		}
+		ret = append(ret, row)
+	}
+
+	if having != nil {
+		ret, err = filterGroups(ret, groupDescs, aggregators, having)
+	}
+
+	return ret, err
+}
+
+// Filters the rows of groups with the having tree, by loading them
+// in to a temporary table, so that the having tree can be evaluated
+// the same way as the conditions in a WHERE clause
+func filterGroups(groups []interface{}, groupDescs []ColumnDesc,
+	aggregators []*aggregator, having *ConditionTree) ([]interface{}, error) {
+
+	cols := append([]ColumnDesc{}, groupDescs...)
+	for _, a := range aggregators {
+		cols = append(cols, ColumnDesc{
+			ColName: a.agg.String(),
+			ColType: a.resultType(),
+		})
+	}
+
+	groupTbl, err := newTable(cols)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, g := range groups {
+		id := rowID(i + 1)
+		for j, col := range cols {
+			v := g.([]interface{})[j]
+			if v == nil {
+				continue
+			}
+			setColumnValue(col.ColType, groupTbl.cols[col.ColName], id, v)
+		}
+		groupTbl.liveRows[id] = true
+	}
+
+	resolveColDetails(groupTbl, having)
+
+	having.eachCondition(func(c *Condition) {
+		if c.colDesc.ColType == CustomColumn && err == nil {
+			err = fmt.Errorf("Unsupported column '%s' in HAVING",
+				c.colDesc.ColName)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []interface{}
+	for _, id := range having.evaluate(groupTbl) {
+		ret = append(ret, groups[id-1])
+	}
+	return ret, nil
+}
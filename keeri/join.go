@@ -0,0 +1,434 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// All the supported types of joins
+type JoinType int
+
+const (
+	InnerJoin JoinType = iota
+	LeftOuterJoin
+)
+
+// A table taking part in a join. Every table, except the first one,
+// is joined with the tables before it, on the equality of LeftCol and
+// RightCol. The column names in a join are qualified as alias.col,
+// where the alias defaults to the table name if it is empty, or to
+// the last part of the name, like columns for information_schema.columns.
+type JoinTable struct {
+	TableName string
+	Alias     string
+
+	// The fields below are ignored for the first table
+	Type     JoinType
+	LeftCol  string
+	RightCol string
+}
+
+func (j JoinTable) alias() string {
+	if j.Alias == "" {
+		return j.TableName[strings.LastIndex(j.TableName, ".")+1:]
+	}
+	return j.Alias
+}
+
+// Splits a qualified column name of the form alias.col
+func splitQualifiedName(name string) (alias, colName string) {
+	dot := strings.Index(name, ".")
+	if dot == -1 {
+		return "", name
+	}
+	return name[:dot], name[dot+1:]
+}
+
+// Acquires the locks of all the given tables, always in the order in
+// which the tables were created, so that two statements over the same
+// tables can never wait on each other. The tables that are true in the
+// modes are locked for writing, and the others for reading. The
+// returned function unlocks them.
+func lockTables(modes map[*table]bool) func() {
+	sorted := make([]*table, 0, len(modes))
+	for t := range modes {
+		sorted = append(sorted, t)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].seq < sorted[j].seq
+	})
+
+	for _, t := range sorted {
+		if modes[t] {
+			t.dataMetaDataLock.Lock()
+		} else {
+			t.dataMetaDataLock.RLock()
+		}
+	}
+
+	return func() {
+		for i := len(sorted) - 1; i >= 0; i-- {
+			if modes[sorted[i]] {
+				sorted[i].dataMetaDataLock.Unlock()
+			} else {
+				sorted[i].dataMetaDataLock.RUnlock()
+			}
+		}
+	}
+}
+
+// Joins the tables and returns a temporary table that has one row per
+// joined row. The temporary table has only the colNames, which have to
+// be qualified, and will have no value for the columns of the tables
+// that had no matching row in a left outer join. Only the rows of a
+// table that match its pushed conditions, if it has any, are joined,
+// where the pushed are by the position of the table, as returned by
+// pushDownConditions.
+func (db *Keeri) joinTables(from []JoinTable, colNames []string,
+	pushed []*ConditionTree) (*table, error) {
+
+	if len(from) < 1 {
+		return nil, errors.New("No tables to join")
+	}
+
+	names := make([]string, len(from))
+	aliases := make(map[string]int)
+	for i, j := range from {
+		names[i] = j.TableName
+	}
+
+	tbls, err := db.lookupTables(names)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := range from {
+		if _, ok := aliases[j.alias()]; ok {
+			return nil, fmt.Errorf("Duplicate table alias '%s'", j.alias())
+		}
+		aliases[j.alias()] = i
+	}
+
+	// A table is locked only once, even if it appears
+	// more than once in a self join
+	modes := make(map[*table]bool)
+	for _, t := range tbls {
+		modes[t] = false
+	}
+	unlock := lockTables(modes)
+	defer unlock()
+
+	// Finds the table and the column for a qualified column name
+	resolve := func(name string) (int, ColumnDesc, error) {
+		alias, colName := splitQualifiedName(name)
+		i, ok := aliases[alias]
+		if !ok {
+			return 0, ColumnDesc{}, fmt.Errorf("Invalid table alias in '%s'", name)
+		}
+		desc, ok := tbls[i].colDesc(colName)
+		if !ok {
+			return 0, ColumnDesc{}, fmt.Errorf("Invalid column name: %s", name)
+		}
+		return i, desc, nil
+	}
+
+	// Returns the rows of the table at the position i that are to be
+	// joined, as the pushed conditions are resolved against the table
+	// itself, before the hash table is built or probed with its rows
+	rows := func(i int) []rowID {
+		if i >= len(pushed) || pushed[i] == nil {
+			return tbls[i].liveRowIDs()
+		}
+		resolveColDetails(tbls[i], pushed[i])
+		return pushed[i].evaluate(tbls[i])
+	}
+
+	// Every joined row has one rowID per table, and
+	// a rowID of 0 for a table that had no matching row
+	var joined [][]rowID
+	for _, id := range rows(0) {
+		joined = append(joined, []rowID{id})
+	}
+
+	for i := 1; i < len(from); i++ {
+		left, leftDesc, err := resolve(from[i].LeftCol)
+		if err != nil {
+			return nil, err
+		}
+		right, rightDesc, err := resolve(from[i].RightCol)
+		if err != nil {
+			return nil, err
+		}
+
+		// The right column should always belong to the table being joined
+		if left == i {
+			left, right = right, left
+			leftDesc, rightDesc = rightDesc, leftDesc
+		}
+		if right != i || left > i {
+			return nil, fmt.Errorf("Join condition '%s = %s' should refer to '%s'"+
+				" and a table before it", from[i].LeftCol, from[i].RightCol,
+				from[i].alias())
+		}
+		if leftDesc.ColType != rightDesc.ColType {
+			return nil, fmt.Errorf("Mismatched column types in '%s = %s'",
+				from[i].LeftCol, from[i].RightCol)
+		}
+
+		joined, err = hashJoin(joined, from[i].Type,
+			tbls[left], left, leftDesc, tbls[right], rightDesc, rows(right))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Copy the values of the asked columns in to the temporary table
+	var descs []ColumnDesc
+	var srcs []int
+	for _, name := range colNames {
+		i, desc, err := resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		desc.ColName = name
+		descs = append(descs, desc)
+		srcs = append(srcs, i)
+	}
+
+	tmp, err := newTable(descs)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, desc := range descs {
+		_, colName := splitQualifiedName(desc.ColName)
+		src := tbls[srcs[k]]
+		for n, ids := range joined {
+			v, ok := columnValue(desc.ColType, src.cols[colName], ids[srcs[k]])
+			if !ok {
+				continue
+			}
+			setColumnValue(desc.ColType, tmp.cols[desc.ColName], rowID(n+1), v)
+		}
+	}
+
+	for n := range joined {
+		tmp.liveRows[rowID(n+1)] = true
+	}
+	tmp.rowCounter = rowID(len(joined))
+
+	return tmp, nil
+}
+
+// Joins the rightRows of the right table with the already joined rows
+// using a hash table built over the right table's column. The left
+// column belongs to the table at the position left in the joined rows.
+// A NULL never matches.
+// Not threadsafe. Caller should have acquired readlocks on both tables
+func hashJoin(joined [][]rowID, joinType JoinType,
+	leftTbl *table, left int, leftDesc ColumnDesc,
+	rightTbl *table, rightDesc ColumnDesc,
+	rightRows []rowID) ([][]rowID, error) {
+
+	rightData := rightTbl.cols[rightDesc.ColName]
+	leftData := leftTbl.cols[leftDesc.ColName]
+
+	// Build
+	hash := make(map[string][]rowID)
+	var key []byte
+	var err error
+	for _, id := range rightRows {
+		var v interface{}
+		key, v, err = appendKey(key[:0], rightDesc.ColType, rightData, id)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			hash[string(key)] = append(hash[string(key)], id)
+		}
+	}
+
+	// Probe
+	var ret [][]rowID
+	for _, ids := range joined {
+		var matches []rowID
+		var v interface{}
+		key, v, err = appendKey(key[:0], leftDesc.ColType, leftData, ids[left])
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			matches = hash[string(key)]
+		}
+
+		for _, id := range matches {
+			ret = append(ret, append(append([]rowID{}, ids...), id))
+		}
+		if len(matches) == 0 && joinType == LeftOuterJoin {
+			ret = append(ret, append(append([]rowID{}, ids...), 0))
+		}
+	}
+
+	return ret, nil
+}
+
+// Queries the rows obtained by joining the tables. The colNames
+// and the column names in the cTree should be qualified as
+// alias.col and the cTree will be resolved against the joined rows.
+func (db *Keeri) QueryJoin(from []JoinTable, colNames []string,
+	cTree *ConditionTree) (ret []interface{}, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			ret = nil
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+
+	needed := append([]string{}, colNames...)
+	if cTree != nil {
+		cTree.eachCondition(func(c *Condition) {
+			if c.expr == nil {
+				needed = append(needed, c.colDesc.ColName)
+				return
+			}
+			rewriteExprColumns(c.expr, func(name string) string {
+				needed = append(needed, name)
+				return name
+			})
+		})
+	}
+
+	tbl, err := db.joinTables(from, uniqueNames(needed), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if cTree != nil {
+		resolveColDetails(tbl, cTree)
+	}
+	return tbl.query(colNames, cTree)
+}
+
+// Splits the conditions that are ANDed at the top of the WHERE of a
+// join, whose column names are qualified, in to the conditions that
+// use the columns of only one table, which are returned by the
+// position of that table, with their column names unqualified, and the
+// rest, which are returned as a tree that is nil if there are none.
+// The conditions on the right table of a LEFT JOIN are never pushed,
+// as they have to see the NULLs of the rows that had no match.
+func pushDownConditions(from []JoinTable,
+	t *ConditionTree) (*ConditionTree, []*ConditionTree) {
+
+	aliases := make(map[string]int)
+	for i, j := range from {
+		aliases[j.alias()] = i
+	}
+
+	// Returns the position of the only table whose columns are used
+	// in the tree, or -1 if that table can not be filtered before the
+	// join, or the tree uses no columns or the columns of many tables
+	tableOf := func(t *ConditionTree) int {
+		pos := -1
+		use := func(name string) string {
+			alias, _ := splitQualifiedName(name)
+			i, ok := aliases[alias]
+			if !ok || pos != -1 && pos != i {
+				i = len(from)
+			}
+			pos = i
+			return name
+		}
+		t.eachCondition(func(c *Condition) {
+			if c.expr != nil {
+				rewriteExprColumns(c.expr, use)
+			} else {
+				use(c.colDesc.ColName)
+			}
+		})
+		if pos == len(from) || pos > 0 && from[pos].Type != InnerJoin {
+			return -1
+		}
+		return pos
+	}
+
+	pushed := make([]*ConditionTree, len(from))
+	push := func(i int) *ConditionTree {
+		if pushed[i] == nil {
+			pushed[i] = &ConditionTree{op: AND}
+		}
+		return pushed[i]
+	}
+
+	rest := &ConditionTree{op: AND}
+	if t.op != AND {
+		if i := tableOf(t); i != -1 {
+			pushed[i] = t
+		} else {
+			rest = t
+		}
+	} else {
+		for _, c := range t.conditions {
+			lone := &ConditionTree{op: AND, conditions: []*Condition{c}}
+			if i := tableOf(lone); i != -1 {
+				push(i).conditions = append(push(i).conditions, c)
+			} else {
+				rest.conditions = append(rest.conditions, c)
+			}
+		}
+		for _, chi := range t.children {
+			if i := tableOf(chi); i != -1 {
+				push(i).children = append(push(i).children, chi)
+			} else {
+				rest.children = append(rest.children, chi)
+			}
+		}
+	}
+
+	unqualify := func(name string) string {
+		_, colName := splitQualifiedName(name)
+		return colName
+	}
+	for _, p := range pushed {
+		if p == nil {
+			continue
+		}
+		p.eachCondition(func(c *Condition) {
+			if c.expr != nil {
+				rewriteExprColumns(c.expr, unqualify)
+			} else {
+				c.colDesc.ColName = unqualify(c.colDesc.ColName)
+			}
+		})
+	}
+
+	if len(rest.conditions) == 0 && len(rest.children) == 0 {
+		rest = nil
+	}
+	return rest, pushed
+}
+
+// Returns the names without any duplicates, in their order
+func uniqueNames(names []string) []string {
+	var ret []string
+	found := make(map[string]bool)
+	for _, name := range names {
+		if !found[name] {
+			found[name] = true
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
@@ -7,12 +7,10 @@
 package keeri
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -21,82 +19,368 @@ type Keeri struct {
 	tables map[string]*table
 
 	tblNamesLock sync.RWMutex
+
+	// The sequences, with their values, protected by the seqLock,
+	// which is never held while acquiring any other lock
+	sequences map[string]*sequence
+	seqLock   sync.Mutex
+
+	// The statements prepared for the recent Select calls
+	stmts stmtCache
 }
 
-// Creates a new table, with one or more columns
+var (
+	// Returned when a table is created or renamed
+	// with the name of an existing table
+	ErrTableExists = errors.New("Table already exists")
+
+	// Returned when there is no table with the given name
+	ErrTableNotFound = errors.New("Table not found")
+)
+
+// Creates a new table, with one or more columns. Returns
+// ErrTableExists if there is a table with the same name.
 func (db *Keeri) CreateTable(tableName string, cols ...ColumnDesc) error {
+	return db.createTable(tableName, TableSpec{Columns: cols}, false)
+}
+
+// Creates a new table, with one or more columns,
+// replacing any table with the same name
+func (db *Keeri) ReplaceTable(tableName string, cols ...ColumnDesc) error {
+	return db.createTable(tableName, TableSpec{Columns: cols}, true)
+}
+
+// The columns and the constraints of a table
+type TableSpec struct {
+	Columns []ColumnDesc
+
+	// The columns of the primary key, if any, which can not be NULL,
+	// and whose values together are different in every row
+	PrimaryKey []string
+
+	// The sets of columns whose values together are different in every
+	// row, where a row with a NULL in the columns is never a duplicate
+	Unique [][]string
+
+	Checks      []Check
+	ForeignKeys []ForeignKey
+
+	// The rows of an AppendOnly table can only be inserted, and removed
+	// by truncating the table, while updating or deleting them fails with
+	// ErrAppendOnly. Then, every chunk of 1024 rows of its int
+	// and string columns is sealed in to a segment, compressed in the
+	// encoding that takes the least memory, once the table has the last
+	// row of the chunk. The int columns are encoded as runs of the same
+	// value, as the differences of the values from the value before them,
+	// or as the differences from the min of the values, which are
+	// bit-packed, and the string columns are encoded with a dictionary, or
+	// as the prefix shared with the value before, with the rest of the
+	// value. The conditions skip the segments that have none of the
+	// values that they are looking for.
+	AppendOnly bool
+}
+
+// A CHECK constraint, whose condition is written like a WHERE over the
+// columns of the table, as in "price > 0 AND discount <= price". A row
+// violates the constraint if the condition is false for it, but not if
+// the condition is NULL, as when comparing with a NULL. The Name is
+// <table>_check by default.
+type Check struct {
+	Name string
+	Cond string
+}
+
+// Creates a new table, with the columns and the constraints of the
+// spec. Returns ErrTableExists if there is a table with the same name.
+func (db *Keeri) CreateTableFromSpec(tableName string, spec TableSpec) error {
+	return db.createTable(tableName, spec, false)
+}
+
+func (db *Keeri) createTable(tableName string, spec TableSpec,
+	replace bool) error {
 
 	db.tblNamesLock.Lock()
 	defer db.tblNamesLock.Unlock()
 
-	if len(cols) < 1 {
+	if len(spec.Columns) < 1 {
 		return errors.New("Empty table")
 	}
 
-	dbCols := make(map[string]interface{})
-	for _, col := range cols {
-		switch col.ColType {
-		case IntColumn:
-			dbCols[col.ColName] = make(map[rowID]int)
-		case StringColumn:
-			dbCols[col.ColName] = make(map[rowID]string)
-		case CustomColumn:
-			dbCols[col.ColName] = make(map[rowID]interface{})
-		default:
-			return errors.New("Invalid column type specified")
+	old, ok := db.tables[tableName]
+	if ok && !replace {
+		return fmt.Errorf("%w: '%s'", ErrTableExists, tableName)
+	}
+	if ok {
+		if fk := old.referredBy(); fk != nil {
+			return fmt.Errorf("Can not drop '%s', which is referred to by "+
+				"the foreign key '%s'", tableName, fk.name)
 		}
+	}
+	if strings.HasPrefix(tableName, infoSchemaPrefix) {
+		return fmt.Errorf("Reserved table name '%s'", tableName)
+	}
 
+	for _, i := range spec.Columns {
+		if i.AutoIncrement && i.ColType != IntColumn {
+			return fmt.Errorf("The AutoIncrement column '%s' should be an "+
+				"IntColumn", i.ColName)
+		}
+		if err := db.checkDefault(i); err != nil {
+			return err
+		}
+	}
+
+	t, err := newTable(spec.Columns)
+	if err != nil {
+		return err
+	}
+	t.name = tableName
+	if spec.AppendOnly {
+		t.appendOnly = true
+		for _, i := range spec.Columns {
+			if t.cols[i.ColName], err = t.newColumnData(i); err != nil {
+				return err
+			}
+		}
+	}
+	t.zones = newZoneMaps(spec.Columns)
+	if t.indexes, err = newIndexes(tableName, spec); err != nil {
+		return err
+	}
+	if t.checks, err = newChecks(tableName, spec); err != nil {
+		return err
+	}
+	if t.foreignKeys, err = db.newForeignKeys(tableName, t, spec); err != nil {
+		return err
 	}
 
 	if db.tables == nil {
 		db.tables = make(map[string]*table)
 	}
 
-	t := &table{
-		cols:       dbCols,
-		colsDesc:   cols,
-		rowCounter: rowID(0),
+	if old != nil {
+		old.linkForeignKeys(false)
 	}
-
+	t.linkForeignKeys(true)
 	db.tables[tableName] = t
 	return nil
 }
 
-func (db *Keeri) Insert(tableName string, values ...interface{}) (err error) {
+// Drops the table and all its rows. A table that is referred to
+// by a foreign key of another table can not be dropped.
+func (db *Keeri) DropTable(tableName string) error {
+	db.tblNamesLock.Lock()
+	defer db.tblNamesLock.Unlock()
+
+	t, ok := db.tables[tableName]
+	if !ok {
+		return fmt.Errorf("%w: '%s'", ErrTableNotFound, tableName)
+	}
+	if fk := t.referredBy(); fk != nil {
+		return fmt.Errorf("Can not drop '%s', which is referred to by the "+
+			"foreign key '%s'", tableName, fk.name)
+	}
+	t.linkForeignKeys(false)
+	delete(db.tables, tableName)
+	return nil
+}
+
+// Renames the table, which should not take the name of an existing table
+func (db *Keeri) RenameTable(tableName, newName string) error {
+	db.tblNamesLock.Lock()
+	defer db.tblNamesLock.Unlock()
+
+	t, ok := db.tables[tableName]
+	if !ok {
+		return fmt.Errorf("%w: '%s'", ErrTableNotFound, tableName)
+	}
+	if tableName == newName {
+		return nil
+	}
+	if _, ok := db.tables[newName]; ok {
+		return fmt.Errorf("%w: '%s'", ErrTableExists, newName)
+	}
+	if strings.HasPrefix(newName, infoSchemaPrefix) {
+		return fmt.Errorf("Reserved table name '%s'", newName)
+	}
+
+	// The table, and the foreign keys that refer to
+	// it, are described with its name
+	modes := map[*table]bool{t: true}
+	for _, fk := range t.refs {
+		modes[fk.child] = true
+	}
+	unlock := lockTables(modes)
+	t.name = newName
+	for _, fk := range t.refs {
+		fk.parentName = newName
+	}
+	unlock()
+
+	db.tables[newName] = t
+	delete(db.tables, tableName)
+	return nil
+}
+
+// Deletes all the rows of the table, keeping its columns. The rowIDs of
+// the new rows, and the values of the AutoIncrement columns, start again
+// from 1, if resetRowIDs is true, or else they continue from the last
+// row that was inserted. A table that is referred to by a foreign key
+// of another table can not be truncated, even if none of its rows are
+// referred to.
+func (db *Keeri) Truncate(tableName string, resetRowIDs bool) error {
+	tbl, unlock, err := db.lockForWrite(tableName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if fk := tbl.referredBy(); fk != nil {
+		return fmt.Errorf("Can not truncate '%s', which is referred to by "+
+			"the foreign key '%s'", tableName, fk.name)
+	}
+
+	tbl.truncated = 0
+	if !resetRowIDs {
+		tbl.truncated = tbl.curRowID()
+	}
+
+	for _, i := range tbl.colsDesc {
+		tbl.cols[i.ColName], _ = tbl.newColumnData(i)
+		tbl.skipTruncated(tbl.cols[i.ColName])
+	}
+	tbl.liveRows = make(map[rowID]bool)
+	tbl.zones = newZoneMaps(tbl.colsDesc)
+	for _, z := range tbl.zones {
+		z.base = int(tbl.truncated / zoneRows)
+	}
+	for _, x := range tbl.indexes {
+		x.entries = make(map[string]rowID)
+	}
+	for _, fk := range tbl.foreignKeys {
+		fk.rows = make(map[string]map[rowID]bool)
+	}
+
+	if resetRowIDs {
+		tbl.rowCounterLock.Lock()
+		tbl.rowCounter = 0
+		tbl.rowCounterLock.Unlock()
+		tbl.autoIncrements = nil
+	}
+
+	// The prepared queries hold on to the columns that were replaced
+	tbl.version++
+	return nil
+}
+
+// Returns the table with the given name, or ErrTableNotFound
+func (db *Keeri) lookupTable(tableName string) (*table, error) {
+	db.tblNamesLock.RLock()
 	tbl := db.tables[tableName]
+	db.tblNamesLock.RUnlock()
+	if tbl == nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrTableNotFound, tableName)
+	}
+	return tbl, nil
+}
+
+// Inserts a row with a value for every column of the table, in the
+// order of the columns, where a nil is a NULL. An AutoIncrement column
+// that is NULL takes its next value, and a NextVal takes the next value
+// of its sequence. Returns ErrTableNotFound if there is no table with the
+// given name, and a *ConstraintError if the row violates a constraint of
+// the table, in which case nothing is inserted.
+func (db *Keeri) Insert(tableName string, values ...interface{}) error {
+	_, err := db.insert(tableName, values, nil, false)
+	return err
+}
 
-	if len(tbl.colsDesc) != len(values) {
-		return errors.New("Column count mismatch")
+// Same as Insert, but returns the row as it was inserted, with the values
+// generated for its AutoIncrement columns and its NextVals
+func (db *Keeri) InsertReturning(tableName string,
+	values ...interface{}) ([]interface{}, error) {
+
+	return db.insert(tableName, values, nil, false)
+}
+
+// Inserts a row with the values of the given columns, where a nil is a
+// NULL, and every other column has its Default value. Returns the same
+// errors as Insert.
+func (db *Keeri) InsertNamed(tableName string,
+	values map[string]interface{}) error {
+
+	if values == nil {
+		values = map[string]interface{}{}
 	}
+	_, err := db.insert(tableName, nil, values, false)
+	return err
+}
+
+// Same as Insert, except that the rows which have the same values as the
+// row in the primary key or in a unique constraint are deleted first, the
+// same way as Delete does, which can fail for their foreign keys
+func (db *Keeri) InsertOrReplace(tableName string,
+	values ...interface{}) error {
 
-	id := tbl.newRowID()
+	_, err := db.insert(tableName, values, nil, true)
+	return err
+}
 
-	tbl.dataMetaDataLock.Lock()
-	defer tbl.dataMetaDataLock.Unlock()
+// Inserts either the values, or the named values if they are not nil,
+// and returns the row that was inserted
+func (db *Keeri) insert(tableName string, values []interface{},
+	named map[string]interface{}, replace bool) ([]interface{}, error) {
 
-	defer func() {
-		// TODO: Atomicity yet to be implemented.
-		// Partial inserts will exist in case of errors
-		if r := recover(); r != nil {
-			err = r.(error)
+	tbl, unlock, err := db.lockForWrite(tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if named != nil {
+		if values, err = tbl.namedRow(named); err != nil {
+			return nil, err
 		}
-	}()
+	} else if len(tbl.colsDesc) != len(values) {
+		return nil, errors.New("Column count mismatch")
+	}
 
+	// The values of the caller are not changed
+	values = append([]interface{}{}, values...)
+	if err = db.nextValues(tbl, values); err != nil {
+		return nil, err
+	}
 	for i, j := range tbl.colsDesc {
-		switch j.ColType {
-		case IntColumn:
-			col := tbl.cols[j.ColName].(map[rowID]int)
-			col[id] = values[i].(int)
-		case StringColumn:
-			col := tbl.cols[j.ColName].(map[rowID]string)
-			col[id] = values[i].(string)
-		case CustomColumn:
-			col := tbl.cols[j.ColName].(map[rowID]interface{})
-			col[id] = values[i]
+		if err = checkColumnValue(j, values[i]); err != nil {
+			return nil, err
 		}
 	}
 
-	return nil
+	w := &rowWriter{t: tbl}
+	if replace {
+		for _, x := range tbl.indexes {
+			other, found, err := tbl.duplicateRow(x, 0, values)
+			if err != nil {
+				return nil, err
+			}
+			// The same row may have been removed for another index
+			if found && tbl.liveRows[other] {
+				if err = w.remove(other); err != nil {
+					w.rollback()
+					return nil, err
+				}
+			}
+		}
+	}
+
+	id, err := w.insert(values)
+	if err != nil {
+		w.rollback()
+		return nil, err
+	}
+	row := tbl.row(id)
+	tbl.seal()
+	return row, nil
 }
 
 func (db *Keeri) String() interface{} {
@@ -117,13 +401,20 @@ func (db *Keeri) String() interface{} {
 func (db *Keeri) Query(tableName string, colNames []string,
 	cTree *ConditionTree) ([]interface{}, error) {
 
-	db.tblNamesLock.RLock()
-	tbl := db.tables[tableName]
-	db.tblNamesLock.RUnlock()
-	if tbl == nil {
-		return nil, errors.New("Table not found")
+	tbl, err := db.lookupTable(tableName)
+	if err != nil {
+		return nil, err
 	}
 
+	tbl.dataMetaDataLock.RLock()
+	defer tbl.dataMetaDataLock.RUnlock()
+	return tbl.query(colNames, cTree)
+}
+
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) query(colNames []string,
+	cTree *ConditionTree) ([]interface{}, error) {
+
 	type resultsColsDesc struct {
 		colType    ColumnType
 		mapPointer interface{}
@@ -132,58 +423,31 @@ func (db *Keeri) Query(tableName string, colNames []string,
 	var resultsDesc []resultsColsDesc
 	// Validate asked column names and get their data pointers
 	for _, outColName := range colNames {
-		found := false
-		for _, i := range tbl.colsDesc {
-			if i.ColName == outColName {
-				found = true
-				resultsDesc = append(resultsDesc,
-					resultsColsDesc{
-						colType:    i.ColType,
-						mapPointer: tbl.cols[outColName],
-					})
-				break
-			}
-		}
+		i, found := t.colDesc(outColName)
 		if found != true {
-			return nil, fmt.Errorf("Invalid column name", outColName)
+			return nil, fmt.Errorf("Invalid column name: %s", outColName)
 		}
+		resultsDesc = append(resultsDesc,
+			resultsColsDesc{
+				colType:    i.ColType,
+				mapPointer: t.cols[outColName],
+			})
 	}
 
-	tbl.dataMetaDataLock.RLock()
-	defer tbl.dataMetaDataLock.RUnlock()
-
 	var matchingRowIDs []rowID
 	if cTree != nil {
-		matchingRowIDs = cTree.evaluate()
+		matchingRowIDs = cTree.evaluate(t)
+	} else {
+		matchingRowIDs = t.liveRowIDs()
 	}
 
 	var results []interface{}
 	for _, rID := range matchingRowIDs {
 		var row []interface{}
 		for _, i := range resultsDesc {
-			switch i.colType {
-			case IntColumn:
-				field, ok := (i.mapPointer.(map[rowID]int))[rID]
-				if ok != true {
-					return nil,
-						fmt.Errorf("Data corruption. No data found for rowID [%v] in a column", rID)
-				}
-				row = append(row, field)
-			case StringColumn:
-				field, ok := (i.mapPointer.(map[rowID]string))[rID]
-				if ok != true {
-					return nil,
-						fmt.Errorf("Data corruption. No data found for rowID [%v] in a column", rID)
-				}
-				row = append(row, field)
-			case CustomColumn:
-				field, ok := (i.mapPointer.(map[rowID]interface{}))[rID]
-				if ok != true {
-					return nil,
-						fmt.Errorf("Data corruption. No data found for rowID [%v] in a column", rID)
-				}
-				row = append(row, field)
-			}
+			// A missing value is a NULL, which is returned as nil
+			field, _ := columnValue(i.colType, i.mapPointer, rID)
+			row = append(row, field)
 		}
 		results = append(results, row)
 	}
@@ -191,62 +455,362 @@ func (db *Keeri) Query(tableName string, colNames []string,
 	return results, nil
 }
 
-func (db *Keeri) Select(sql string, args ...interface{}) (ret []interface{}, err error) {
+// Runs the SELECT query and returns its result. The args are bound to
+// the parameters of the query, which are either positional, as ? or as
+// $1, $2 and so on, or named, as :name, with a map[string]interface{}
+// of their values as the only arg. A parameter is never converted in
+// to the type of its column, so its value should be either an int or
+// a string, matching the column. The query is prepared only the first
+// time and is reused from a cache of the recently run queries.
+func (db *Keeri) Select(sql string, args ...interface{}) (*ResultSet, error) {
+	s, err := db.stmts.get(db, sql)
+	if err != nil {
+		return nil, err
+	}
+	return s.Query(args...)
+}
+
+// Runs the query over the table, which is either the table
+// in the query or a temporary table of the joined rows.
+// Not threadsafe. Caller should have acquired readlock
+func selectRows(tbl *table, q *selectQuery) (ret []interface{}, err error) {
+	condTree := q.condTree
+
+	// Returns the collation to be used for ordering by the column
+	collation := func(colName string) Collation {
+		desc, _ := tbl.colDesc(colName)
+		return desc.Collation
+	}
+
+	hasExprs := false
+	for _, i := range q.items {
+		hasExprs = hasExprs || i.expr != nil
+	}
+	for _, o := range q.orderBy {
+		hasExprs = hasExprs || o.expr != nil
+	}
+
+	aggs := q.aggregates()
+	if len(aggs) == 0 && len(q.groupBy) == 0 {
+		var cols []string
+		var exprs []Expr
+		for _, i := range q.items {
+			cols = append(cols, i.colName)
+			exprs = append(exprs, i.valueExpr())
+		}
+
+		// Columns that are used only in the ORDER BY are
+		// fetched too, and are removed after the sorting
+		nItems := len(cols)
+		var keys []sortKey
+		for _, o := range q.orderBy {
+			pos := q.itemPos(o)
+			if pos == -1 {
+				if q.distinct {
+					return nil, fmt.Errorf("ORDER BY column '%s' must appear "+
+						"in the SELECT list of a DISTINCT query", o.name)
+				}
+				cols = append(cols, o.name)
+				if o.expr != nil {
+					exprs = append(exprs, o.expr)
+				} else {
+					exprs = append(exprs, &ColumnRef{Name: o.name})
+				}
+				pos = len(cols) - 1
+			}
+
+			// Expressions are ordered by their values as they are
+			c := BinaryCollation
+			if !o.alias && o.expr == nil {
+				c = collation(o.name)
+			}
+			keys = append(keys, sortKey{pos, o.desc, c})
+		}
+
+		switch {
+		case hasExprs:
+			ret, err = tbl.queryExprs(exprs, condTree)
+			if err == nil && q.distinct {
+				ret, err = distinctRows(ret)
+			}
+		case q.distinct:
+			ret, err = tbl.queryDistinct(cols, condTree)
+		default:
+			ret, err = tbl.query(cols, condTree)
+		}
+		if err != nil || keys == nil {
+			return ret, err
+		}
+
+		sortRows(ret, keys)
+		for k, row := range ret {
+			ret[k] = row.([]interface{})[:nItems]
+		}
+		return ret, nil
+	}
+
+	// Expressions in the GROUP BY are computed in to the columns of
+	// a temporary table, which is then grouped like any other table
+	for k, e := range q.groupExprs {
+		if e != nil {
+			q.groupBy[k] = exprName(e)
+			hasExprs = true
+		}
+	}
+	if hasExprs {
+		if tbl, err = groupSource(tbl, q, aggs); err != nil {
+			return nil, err
+		}
+		condTree = nil
+	}
+
+	// Returns the position of the named GROUP BY column or the
+	// aggregate in the rows returned for the groups, which will
+	// have the values of the GROUP BY columns followed by the
+	// values of the aggs, or -1 if it could not be found
+	groupPos := func(name string) int {
+		if agg, ok := aggregateByName(name); ok {
+			for k, i := range aggs {
+				if i == agg {
+					return len(q.groupBy) + k
+				}
+			}
+			return -1
+		}
+		for k, colName := range q.groupBy {
+			if colName == name {
+				return k
+			}
+		}
+		return -1
+	}
 
-	defer func() {
-		// TODO: Atomicity yet to be implemented.
-		// Partial inserts will exist in case of errors
-		if r := recover(); r != nil {
-			ret = nil
-			err = r.(error)
+	// Find the position of every SELECT list item
+	var positions []int
+	for _, i := range q.items {
+		name := i.colName
+		if i.agg != nil {
+			name = i.agg.String()
+		} else if i.expr != nil {
+			name = exprName(i.expr)
+		}
+		pos := groupPos(name)
+		if pos == -1 {
+			return nil, fmt.Errorf("Column '%s' must appear in the GROUP BY "+
+				"clause or be used in an aggregate function", name)
 		}
-	}()
+		positions = append(positions, pos)
+	}
 
-	tblName, cols, condTree := parseQuery(sql)
+	var keys []sortKey
+	for _, o := range q.orderBy {
+		if o.expr != nil {
+			o.name = exprName(o.expr)
+		} else if k := q.itemPos(o); o.alias && k != -1 {
+			o.name = exprName(q.items[k].expr)
+		}
+		pos := groupPos(o.name)
+		if pos == -1 {
+			return nil, fmt.Errorf("ORDER BY column '%s' must appear in the "+
+				"GROUP BY clause or be used in an aggregate function", o.name)
+		}
+		colName := o.name
+		if agg, ok := aggregateByName(o.name); ok {
+			colName = agg.ColName
+		}
+		keys = append(keys, sortKey{pos, o.desc, collation(colName)})
+	}
 
-	if condTree != nil {
-		buf := new(bytes.Buffer)
-		err = json.Indent(buf, []byte(condTree.String()), "", "  ")
+	var groups []interface{}
+	if len(q.groupBy) == 0 && q.having == nil {
+		// Aggregates without groups always return a single row
+		row, err := tbl.queryAggregates(aggs, condTree)
 		if err != nil {
-			return nil, errors.New("Error converting condTree into a JSON string")
+			return nil, err
+		}
+		groups = []interface{}{row}
+	} else {
+		groups, err = tbl.queryGroups(q.groupBy, aggs, condTree, q.having)
+		if err != nil {
+			return nil, err
 		}
-		log.Println(buf)
 	}
 
-	db.tblNamesLock.RLock()
-	tbl := db.tables[tblName]
-	db.tblNamesLock.RUnlock()
+	sortRows(groups, keys)
 
-	if tbl == nil {
-		return nil, fmt.Errorf("Invalid table name '%s'", tblName)
+	for _, g := range groups {
+		row := make([]interface{}, 0, len(positions))
+		for _, k := range positions {
+			row = append(row, g.([]interface{})[k])
+		}
+		ret = append(ret, row)
+	}
+
+	if q.distinct {
+		return distinctRows(ret)
 	}
+	return ret, nil
+}
 
-	if condTree != nil {
-		tbl.dataMetaDataLock.RLock()
-		resolveColDetails(tbl, condTree)
-		tbl.dataMetaDataLock.RUnlock()
+// Returns the position of the SELECT list item that the
+// ORDER BY item refers to, or -1 if there is no such item
+func (q *selectQuery) itemPos(o orderItem) int {
+	for k, i := range q.items {
+		switch {
+		case o.alias:
+			if i.name == o.name {
+				return k
+			}
+		case o.expr != nil:
+			if i.expr != nil && exprName(i.expr) == exprName(o.expr) {
+				return k
+			}
+		case i.expr == nil && i.agg == nil && i.colName == o.name:
+			return k
+		}
 	}
+	return -1
+}
 
-	ret, err = db.Query(tblName, cols, condTree)
-	return
+// Returns a temporary table of the rows matching the WHERE of the
+// query, with a column for every GROUP BY expression, named after
+// the expression, and for every other column that the grouping
+// needs, so that the groups can be found the same way as for a table
+func groupSource(tbl *table, q *selectQuery, aggs []Aggregate) (*table, error) {
+	var names []string
+	var exprs []Expr
+	add := func(name string, e Expr) {
+		for _, n := range names {
+			if n == name {
+				return
+			}
+		}
+		names = append(names, name)
+		exprs = append(exprs, e)
+	}
+
+	for k, name := range q.groupBy {
+		if q.groupExprs[k] != nil {
+			add(name, q.groupExprs[k])
+		} else {
+			add(name, &ColumnRef{Name: name})
+		}
+	}
+	for _, agg := range aggs {
+		if agg.ColName != "*" {
+			add(agg.ColName, &ColumnRef{Name: agg.ColName})
+		}
+	}
+
+	return tbl.computeTable(names, exprs, q.condTree)
+}
+
+// Returns the tables in the FROM of the query
+func (db *Keeri) fromTables(q *selectQuery) ([]*table, error) {
+	names := make([]string, len(q.from))
+	for i, j := range q.from {
+		names[i] = j.TableName
+	}
+	return db.lookupTables(names)
+}
+
+// Rewrites the column names in the query to match its tables. For a
+// join, which is run over a temporary table holding the joined rows,
+// the columns are named as alias.col, and all the columns that are
+// used in the query are returned, to be copied in to that table.
+func resolveColumns(q *selectQuery, tbls []*table) ([]string, error) {
+	if err := q.expandStars(tbls); err != nil {
+		return nil, err
+	}
+	if err := q.resolvePositions(); err != nil {
+		return nil, err
+	}
+
+	if len(q.from) == 1 {
+		// Qualified column names are allowed, but not needed
+		q.rewriteColumns(func(name string) string {
+			alias, colName := splitQualifiedName(name)
+			if alias != "" && alias != q.from[0].alias() {
+				panic(fmt.Errorf("Invalid table alias in '%s'", name))
+			}
+			return colName
+		})
+		return nil, nil
+	}
+
+	// Qualify the column names which are not qualified
+	q.rewriteColumns(func(name string) string {
+		alias, _ := splitQualifiedName(name)
+		if alias != "" {
+			return name
+		}
+
+		qualified := ""
+		for i, t := range tbls {
+			t.dataMetaDataLock.RLock()
+			_, ok := t.colDesc(name)
+			t.dataMetaDataLock.RUnlock()
+			if !ok {
+				continue
+			}
+			if qualified != "" {
+				panic(fmt.Errorf("Ambiguous column name: %s", name))
+			}
+			qualified = q.from[i].alias() + "." + name
+		}
+
+		if qualified == "" {
+			panic(fmt.Errorf("Invalid column name: %s", name))
+		}
+		return qualified
+	})
+
+	for i := 1; i < len(q.from); i++ {
+		j := &q.from[i]
+		if alias, _ := splitQualifiedName(j.LeftCol); alias == "" {
+			return nil, fmt.Errorf("Column '%s' in 'ON' should be qualified",
+				j.LeftCol)
+		}
+		if alias, _ := splitQualifiedName(j.RightCol); alias == "" {
+			return nil, fmt.Errorf("Column '%s' in 'ON' should be qualified",
+				j.RightCol)
+		}
+	}
+
+	var needed []string
+	q.rewriteColumns(func(name string) string {
+		needed = append(needed, name)
+		return name
+	})
+
+	return uniqueNames(needed), nil
 }
 
 func resolveColDetails(tbl *table, i *ConditionTree) {
 	for _, j := range i.conditions {
+		if j.expr != nil {
+			pred, err := compilePredicate(tbl, j.expr)
+			if err != nil {
+				panic(err)
+			}
+			j.pred = pred
+			continue
+		}
+
 		colName := j.colDesc.ColName
 		for _, k := range tbl.colsDesc {
 			if k.ColName == colName {
 				j.colDesc.ColType = k.ColType
+				j.colDesc.Collation = k.Collation
 				j.colData = tbl.cols[colName]
+				j.zones = tbl.zones[colName]
 
 				switch k.ColType {
-				case StringColumn: // Do Nothing
-				case IntColumn:
-					t, e := strconv.Atoi(j.value.(string))
-					if e != nil {
-						panic(e)
+				case StringColumn, IntColumn:
+					// The parameters may be bound later, by bindConditions
+					if isBound(j.raw) {
+						j.value = resolveValue(k, j.op, j.raw)
 					}
-					j.value = t
 				default:
 					panic("Unsupported column type")
 				}
@@ -262,3 +826,123 @@ func resolveColDetails(tbl *table, i *ConditionTree) {
 		resolveColDetails(tbl, i)
 	}
 }
+
+// Converts the values of the conditions that have parameters, after
+// the parameters are bound, as the conditions are resolved only once
+// for a prepared query
+func bindConditions(t *ConditionTree) {
+	t.eachCondition(func(c *Condition) {
+		if c.expr == nil && hasParams(c.raw) {
+			c.value = resolveValue(c.colDesc, c.op, c.raw)
+		}
+	})
+}
+
+// Returns true if the value from the parser has any parameters
+func hasParams(raw interface{}) bool {
+	switch v := raw.(type) {
+	case *Param:
+		return true
+	case []interface{}:
+		for _, i := range v {
+			if _, ok := i.(*Param); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns true if the value from the parser has
+// no parameters, or if all of them are bound
+func isBound(raw interface{}) bool {
+	switch v := raw.(type) {
+	case *Param:
+		return v.value != nil
+	case []interface{}:
+		for _, i := range v {
+			if !isBound(i) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Converts the value of a condition from the parser, which is either
+// a value or a list of values, in to the type of the column. A value
+// is a string for a literal, which is converted, or a *Param, whose
+// value should already be of the type of the column. The list of
+// values of IN and NOT IN is converted in to a set, so that the
+// membership can be checked in a single pass over the column.
+func resolveValue(desc ColumnDesc, op RelationalOperator,
+	value interface{}) interface{} {
+
+	convert := func(v interface{}) interface{} {
+		if p, ok := v.(*Param); ok {
+			t, err := p.valueFor(desc.ColType, desc.ColName)
+			if err != nil {
+				panic(err)
+			}
+			return t
+		}
+		if desc.ColType != IntColumn {
+			return v
+		}
+		t, e := strconv.Atoi(v.(string))
+		if e != nil {
+			panic(e)
+		}
+		return t
+	}
+
+	switch op {
+	case LIKE, NOTLIKE, ILIKE, NOTILIKE, REGEXP, NOTREGEXP:
+		if desc.ColType != StringColumn {
+			panic(fmt.Errorf("%s is supported only on string columns", op))
+		}
+		switch value.(type) {
+		case string, *Param:
+		default:
+			return value
+		}
+		p, err := compilePattern(op, convert(value).(string))
+		if err != nil {
+			panic(err)
+		}
+		return p
+	case IN, NOTIN:
+		values, ok := value.([]interface{})
+		if !ok {
+			return value
+		}
+		if desc.ColType == IntColumn {
+			set := make(map[int]bool)
+			for _, v := range values {
+				set[convert(v).(int)] = true
+			}
+			return set
+		}
+		set := make(map[string]bool)
+		for _, v := range values {
+			set[convert(v).(string)] = true
+		}
+		return set
+	case BETWEEN:
+		values, ok := value.([]interface{})
+		if !ok {
+			return value
+		}
+		if desc.ColType == IntColumn {
+			return [2]int{convert(values[0]).(int), convert(values[1]).(int)}
+		}
+		return [2]string{convert(values[0]).(string),
+			convert(values[1]).(string)}
+	default:
+		switch value.(type) {
+		case string, *Param:
+			return convert(value)
+		}
+		return value
+	}
+}
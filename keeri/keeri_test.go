@@ -7,7 +7,11 @@
 package keeri
 
 import (
+	"errors"
 	"fmt"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -267,3 +271,2844 @@ func TestNestedQuery(t *testing.T) {
 	_, err := db.Select(input)
 	t.Log(err)
 }
+
+func TestAggregates(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("table1",
+		ColumnDesc{ColName: "col1", ColType: IntColumn},
+		ColumnDesc{ColName: "col2", ColType: StringColumn},
+		ColumnDesc{ColName: "col3", ColType: CustomColumn})
+
+	_ = db.Insert("table1", 1, "b", point{0, 0})
+	_ = db.Insert("table1", 2, "c", point{1, 1})
+	_ = db.Insert("table1", 3, "a", point{2, 2})
+	_ = db.Insert("table1", 10, "d", point{3, 3})
+
+	row, err := db.QueryAggregates("table1", []Aggregate{
+		{Func: COUNT, ColName: "*"},
+		{Func: COUNT, ColName: "col3"},
+		{Func: SUM, ColName: "col1"},
+		{Func: MIN, ColName: "col1"},
+		{Func: MAX, ColName: "col1"},
+		{Func: AVG, ColName: "col1"},
+		{Func: MIN, ColName: "col2"},
+		{Func: MAX, ColName: "col2"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []interface{}{4, 4, 16, 1, 10, 4.0, "a", "d"}
+	if fmt.Sprint(row) != fmt.Sprint(want) {
+		t.Errorf("Want: %v Got: %v", want, row)
+	}
+
+	_, err = db.QueryAggregates("table1", []Aggregate{{Func: SUM, ColName: "col2"}}, nil)
+	if err == nil {
+		t.Error("No error message for SUM over a string column")
+	}
+
+	input := "SELECT count(*), SUM(col1), MAX( col2 ) FROM table1 WHERE col1 > 1"
+	t.Log(input)
+	rs, err := db.Select(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []interface{}{[]interface{}{3, 15, "d"}}
+	if fmt.Sprint(rs.Rows) != fmt.Sprint(want) {
+		t.Errorf("Want: %v Got: %v", want, rs.Rows)
+	}
+
+	input = "SELECT COUNT(*), AVG(col1) FROM table1 WHERE col1 > 100"
+	t.Log(input)
+	rs, err = db.Select(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []interface{}{[]interface{}{0, nil}}
+	if fmt.Sprint(rs.Rows) != fmt.Sprint(want) {
+		t.Errorf("Want: %v Got: %v", want, rs.Rows)
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("orders",
+		ColumnDesc{ColName: "country", ColType: StringColumn},
+		ColumnDesc{ColName: "city", ColType: StringColumn},
+		ColumnDesc{ColName: "amount", ColType: IntColumn})
+
+	_ = db.Insert("orders", "IN", "Chennai", 10)
+	_ = db.Insert("orders", "IN", "Chennai", 20)
+	_ = db.Insert("orders", "US", "Austin", 5)
+	_ = db.Insert("orders", "IN", "Madurai", 30)
+	_ = db.Insert("orders", "FR", "Paris", 500)
+	_ = db.Insert("orders", "US", "Austin", 7)
+
+	res, err := db.QueryGroups("orders", []string{"country", "city"},
+		[]Aggregate{{Func: COUNT, ColName: "*"}, {Func: SUM, ColName: "amount"}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[[IN Chennai 2 30] [US Austin 2 12] [IN Madurai 1 30] [FR Paris 1 500]]"
+	if fmt.Sprint(res) != want {
+		t.Errorf("Want: %v Got: %v", want, res)
+	}
+
+	input := `SELECT SUM(amount), country, COUNT(*) FROM orders
+	WHERE amount < 100 GROUP BY country HAVING COUNT(*) > 1`
+	t.Log(input)
+	rs, err := db.Select(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "[[60 IN 3] [12 US 2]]"
+	if fmt.Sprint(rs.Rows) != want {
+		t.Errorf("Want: %v Got: %v", want, rs.Rows)
+	}
+
+	input = `SELECT country FROM orders GROUP BY country
+	HAVING MAX(amount) >= 30 AND country != 'FR'`
+	t.Log(input)
+	rs, err = db.Select(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "[[IN]]"
+	if fmt.Sprint(rs.Rows) != want {
+		t.Errorf("Want: %v Got: %v", want, rs.Rows)
+	}
+
+	input = "SELECT city, COUNT(*) FROM orders GROUP BY country"
+	t.Log(input)
+	_, err = db.Select(input)
+	if err == nil {
+		t.Error("No error message for a column that is not grouped")
+	}
+}
+
+func (p point) HashKey() string {
+	return fmt.Sprintf("%d,%d", p.x, p.y)
+}
+
+func TestDistinct(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("table1",
+		ColumnDesc{ColName: "col1", ColType: IntColumn},
+		ColumnDesc{ColName: "col2", ColType: StringColumn},
+		ColumnDesc{ColName: "col3", ColType: CustomColumn})
+
+	_ = db.Insert("table1", 1, "a", point{0, 0})
+	_ = db.Insert("table1", 1, "a", point{0, 0})
+	_ = db.Insert("table1", 2, "a", point{1, 1})
+	_ = db.Insert("table1", 1, "b", point{0, 0})
+	_ = db.Insert("table1", 2, "a", point{1, 1})
+
+	res, err := db.QueryDistinct("table1", []string{"col1", "col3"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[[1 Point{0, 0}] [2 Point{1, 1}]]"
+	if fmt.Sprint(res) != want {
+		t.Errorf("Want: %v Got: %v", want, res)
+	}
+
+	input := "SELECT DISTINCT col1, col2 FROM table1"
+	t.Log(input)
+	rs, err := db.Select(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "[[1 a] [2 a] [1 b]]"
+	if fmt.Sprint(rs.Rows) != want {
+		t.Errorf("Want: %v Got: %v", want, rs.Rows)
+	}
+
+	input = `SELECT col2, COUNT(DISTINCT col1), COUNT(DISTINCT col3), COUNT(*)
+	FROM table1 GROUP BY col2 HAVING COUNT(DISTINCT col1) > 1`
+	t.Log(input)
+	rs, err = db.Select(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "[[a 2 2 4]]"
+	if fmt.Sprint(rs.Rows) != want {
+		t.Errorf("Want: %v Got: %v", want, rs.Rows)
+	}
+
+	input = "SELECT DISTINCT MIN(col2) FROM table1 GROUP BY col1"
+	t.Log(input)
+	rs, err = db.Select(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "[[a]]"
+	if fmt.Sprint(rs.Rows) != want {
+		t.Errorf("Want: %v Got: %v", want, rs.Rows)
+	}
+
+	_ = db.Insert("table1", 3, "c", []int{1})
+	_, err = db.QueryDistinct("table1", []string{"col3"}, nil)
+	if err == nil {
+		t.Error("No error message for a value that is not comparable")
+	}
+}
+
+// A comparable type that does not implement Hashable
+type cell struct {
+	row, col int
+	tag      interface{}
+}
+
+func TestDistinctComparable(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("table1",
+		ColumnDesc{ColName: "id", ColType: IntColumn},
+		ColumnDesc{ColName: "c", ColType: CustomColumn})
+
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	_ = db.Insert("table1", 1, cell{1, 2, "a"})
+	_ = db.Insert("table1", 2, cell{1, 2, "a"})
+	_ = db.Insert("table1", 3, cell{2, 1, "a"})
+	_ = db.Insert("table1", 4, cell{1, 2, 1})
+	_ = db.Insert("table1", 5, cell{1, 2, nil})
+	_ = db.Insert("table1", 6, at)
+	_ = db.Insert("table1", 7, at)
+	_ = db.Insert("table1", 8, [2]float64{0, 1})
+
+	rs, err := db.Select("SELECT COUNT(DISTINCT c), COUNT(*) FROM table1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[[6 8]]"; fmt.Sprint(rs.Rows) != want {
+		t.Errorf("Want: %v Got: %v", want, rs.Rows)
+	}
+
+	rs, err = db.Select("SELECT MIN(id), COUNT(*) FROM table1 GROUP BY c " +
+		"ORDER BY MIN(id)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[[1 2] [3 1] [4 1] [5 1] [6 2] [8 1]]"
+	if fmt.Sprint(rs.Rows) != want {
+		t.Errorf("Want: %v Got: %v", want, rs.Rows)
+	}
+
+	// A value that holds a value that is not comparable can not be hashed
+	_ = db.Insert("table1", 9, cell{0, 0, []int{1}})
+	if _, err = db.QueryDistinct("table1", []string{"c"}, nil); err == nil {
+		t.Error("No error message for a value that is not comparable")
+	}
+}
+
+func TestJoins(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("customers",
+		ColumnDesc{ColName: "id", ColType: IntColumn},
+		ColumnDesc{ColName: "name", ColType: StringColumn})
+	_ = db.CreateTable("orders",
+		ColumnDesc{ColName: "customer", ColType: IntColumn},
+		ColumnDesc{ColName: "amount", ColType: IntColumn})
+
+	_ = db.Insert("customers", 1, "Arun")
+	_ = db.Insert("customers", 2, "Bala")
+	_ = db.Insert("customers", 3, "Chitra")
+	_ = db.Insert("orders", 1, 100)
+	_ = db.Insert("orders", 3, 300)
+	_ = db.Insert("orders", 1, 150)
+	_ = db.Insert("orders", 4, 400)
+
+	res, err := db.QueryJoin([]JoinTable{
+		{TableName: "customers", Alias: "c"},
+		{TableName: "orders", Alias: "o", Type: InnerJoin,
+			LeftCol: "c.id", RightCol: "o.customer"},
+	}, []string{"c.name", "o.amount"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[[Arun 100] [Arun 150] [Chitra 300]]"
+	if fmt.Sprint(res) != want {
+		t.Errorf("Want: %v Got: %v", want, res)
+	}
+
+	input := `SELECT c.name, amount FROM customers AS c
+	LEFT OUTER JOIN orders o ON o.customer = c.id WHERE c.id > 1`
+	t.Log(input)
+	rs, err := db.Select(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "[[Bala <nil>] [Chitra 300]]"
+	if fmt.Sprint(rs.Rows) != want {
+		t.Errorf("Want: %v Got: %v", want, rs.Rows)
+	}
+
+	input = `SELECT name, COUNT(amount), SUM(orders.amount) FROM customers
+	LEFT JOIN orders ON customers.id = orders.customer GROUP BY name`
+	t.Log(input)
+	rs, err = db.Select(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "[[Arun 2 250] [Bala 0 <nil>] [Chitra 1 300]]"
+	if fmt.Sprint(rs.Rows) != want {
+		t.Errorf("Want: %v Got: %v", want, rs.Rows)
+	}
+
+	input = `SELECT a.name, b.name FROM customers a JOIN customers b
+	ON a.id = b.id WHERE b.id < 3`
+	t.Log(input)
+	rs, err = db.Select(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "[[Arun Arun] [Bala Bala]]"
+	if fmt.Sprint(rs.Rows) != want {
+		t.Errorf("Want: %v Got: %v", want, rs.Rows)
+	}
+
+	input = "SELECT id FROM customers a JOIN customers b ON a.id = b.id"
+	t.Log(input)
+	_, err = db.Select(input)
+	if err == nil {
+		t.Error("No error message for an ambiguous column name")
+	}
+
+	// Joins in opposite orders, running along with inserts,
+	// should not deadlock on the locks of the tables
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			for k := 0; k < 50; k++ {
+				if i%2 == 0 {
+					_, _ = db.Select(`SELECT amount FROM orders
+					JOIN customers ON orders.customer = customers.id`)
+					_ = db.Insert("customers", 10+k, "New")
+				} else {
+					_, _ = db.Select(`SELECT amount FROM customers
+					JOIN orders ON orders.customer = customers.id`)
+					_ = db.Insert("orders", 10+k, k)
+				}
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Concurrent joins did not complete")
+		}
+	}
+}
+
+func TestJoinPushDown(t *testing.T) {
+	db := &Keeri{}
+	mustExec(t, db, "CREATE TABLE customers (id INT, name TEXT, city TEXT)")
+	mustExec(t, db, "CREATE TABLE orders (customer INT, amount INT)")
+	mustExec(t, db, `INSERT INTO customers VALUES (1, 'Arun', 'Chennai'),
+		(2, 'Bala', 'Madurai'), (3, 'Chitra', 'Chennai')`)
+	mustExec(t, db, `INSERT INTO orders VALUES (1, 100), (3, 300), (1, 150),
+		(4, 400), (2, 50)`)
+
+	// The number of conditions pushed to every table, and left over
+	pushed := func(query string) string {
+		stmt, err := db.stmts.get(db, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var counts []int
+		count := func(c *ConditionTree) int {
+			n := 0
+			if c != nil {
+				c.eachCondition(func(*Condition) { n++ })
+			}
+			return n
+		}
+		p := stmt.plans[0]
+		for _, c := range p.pushed {
+			counts = append(counts, count(c))
+		}
+		return fmt.Sprint(counts, count(p.q.condTree))
+	}
+
+	cases := []struct {
+		query  string
+		pushed string
+		rows   string
+	}{
+		{`SELECT c.name, o.amount FROM customers c JOIN orders o
+		ON o.customer = c.id WHERE city = 'Chennai' AND o.amount > 120
+		AND c.id * 100 != o.amount ORDER BY amount`,
+			"[1 1] 1", "[[Arun 150]]"},
+		{`SELECT c.name, o.amount FROM customers c JOIN orders o
+		ON o.customer = c.id WHERE (amount < 120 OR amount > 250)
+		AND NOT c.name = 'Chitra' ORDER BY amount`,
+			"[1 2] 0", "[[Bala 50] [Arun 100]]"},
+		{`SELECT c.name, o.amount FROM customers c JOIN orders o
+		ON o.customer = c.id WHERE c.name = 'Arun' OR o.amount = 300
+		ORDER BY amount`,
+			"[0 0] 2", "[[Arun 100] [Arun 150] [Chitra 300]]"},
+		{`SELECT c.name, o.amount FROM customers c LEFT JOIN orders o
+		ON o.customer = c.id WHERE COALESCE(o.amount, 0) < 120
+		AND c.city = 'Chennai' ORDER BY name`,
+			"[1 0] 1", "[[Arun 100]]"},
+		{`SELECT a.name, b.name FROM customers a JOIN customers b
+		ON a.city = b.city WHERE a.id = 1 AND b.id != 1`,
+			"[1 1] 0", "[[Arun Chitra]]"},
+	}
+
+	for _, i := range cases {
+		t.Log(i.query)
+		checkRows(t, db, i.query, i.rows)
+		if got := pushed(i.query); got != i.pushed {
+			t.Errorf("Want: %v Got: %v", i.pushed, got)
+		}
+	}
+
+	// The pushed conditions are bound again on every run
+	stmt, err := db.Prepare(`SELECT c.name, o.amount FROM customers c
+	JOIN orders o ON o.customer = c.id WHERE c.city = ? AND o.amount > ?
+	ORDER BY amount`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []struct {
+		args []interface{}
+		rows string
+	}{
+		{[]interface{}{"Chennai", 120}, "[[Arun 150] [Chitra 300]]"},
+		{[]interface{}{"Madurai", 0}, "[[Bala 50]]"},
+		{[]interface{}{"Madurai", 50}, "[]"},
+	} {
+		rs, err := stmt.Query(i.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(rs.Rows) != i.rows {
+			t.Errorf("Want: %v Got: %v", i.rows, rs.Rows)
+		}
+	}
+}
+
+func TestInAndBetween(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("table1",
+		ColumnDesc{ColName: "col1", ColType: IntColumn},
+		ColumnDesc{ColName: "status", ColType: StringColumn})
+
+	_ = db.Insert("table1", 1, "a")
+	_ = db.Insert("table1", 5, "b")
+	_ = db.Insert("table1", 10, "c")
+	_ = db.Insert("table1", 15, "d")
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT col1 FROM table1 WHERE status IN ('a', 'c','x')",
+			"[[1] [10]]"},
+		{"SELECT col1 FROM table1 WHERE status not in ('a', 'c')",
+			"[[5] [15]]"},
+		{"SELECT status FROM table1 WHERE col1 IN (5)",
+			"[[b]]"},
+		{"SELECT status FROM table1 WHERE col1 BETWEEN 5 AND 10",
+			"[[b] [c]]"},
+		{"SELECT status FROM table1 WHERE col1 between 2 and 12 AND status != 'c'",
+			"[[b]]"},
+		{"SELECT status FROM table1 WHERE (col1 BETWEEN 1 AND 5) OR col1 IN (15, 10)",
+			"[[a] [b] [c] [d]]"},
+	}
+
+	for _, i := range cases {
+		t.Log(i.query)
+		rs, err := db.Select(i.query)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fmt.Sprint(rs.Rows) != i.want {
+			t.Errorf("Want: %v Got: %v", i.want, rs.Rows)
+		}
+	}
+
+	for _, query := range []string{
+		"SELECT col1 FROM table1 WHERE col1 IN ()",
+		"SELECT col1 FROM table1 WHERE col1 IN (1, 2",
+		"SELECT col1 FROM table1 WHERE col1 BETWEEN 1 OR 2",
+	} {
+		t.Log(query)
+		if _, err := db.Select(query); err == nil {
+			t.Error("No error message for a malformed query")
+		}
+	}
+}
+
+func TestNotAndPrecedence(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("table1",
+		ColumnDesc{ColName: "col1", ColType: IntColumn},
+		ColumnDesc{ColName: "status", ColType: StringColumn})
+
+	_ = db.Insert("table1", 1, "a")
+	_ = db.Insert("table1", 2, "b")
+	_ = db.Insert("table1", 3, "a")
+	_ = db.Insert("table1", 4, "c")
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT col1 FROM table1 WHERE NOT status = 'a'", "[[2] [4]]"},
+		{"SELECT col1 FROM table1 WHERE not (status = 'a' or col1 = 4)",
+			"[[2]]"},
+		{"SELECT col1 FROM table1 WHERE NOT NOT col1 > 2", "[[3] [4]]"},
+		{"SELECT col1 FROM table1 WHERE NOT status = 'a' AND col1 > 2",
+			"[[4]]"},
+		{"SELECT col1 FROM table1 WHERE col1 = 1 or col1 = 2 and status = 'a'",
+			"[[1]]"},
+		{"SELECT col1 FROM table1 WHERE NOT col1 IN (1, 4) And status NOT IN ('b')",
+			"[[3]]"},
+		{"SELECT col1 FROM table1 WHERE NOT (NOT (col1 < 3) OR status = 'b')",
+			"[[1]]"},
+	}
+
+	for _, i := range cases {
+		t.Log(i.query)
+		rs, err := db.Select(i.query)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fmt.Sprint(rs.Rows) != i.want {
+			t.Errorf("Want: %v Got: %v", i.want, rs.Rows)
+		}
+	}
+
+	for _, query := range []string{
+		"SELECT col1 FROM table1 WHERE NOT",
+		"SELECT col1 FROM table1 WHERE col1 = 1 NOT",
+	} {
+		t.Log(query)
+		if _, err := db.Select(query); err == nil {
+			t.Error("No error message for a malformed query")
+		}
+	}
+}
+
+// A NOT of a condition that is UNKNOWN, due to a NULL, is UNKNOWN too,
+// and so does not match the row, like the opposite condition
+func TestNotWithNulls(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("table1",
+		ColumnDesc{ColName: "id", ColType: IntColumn},
+		ColumnDesc{ColName: "a", ColType: IntColumn},
+		ColumnDesc{ColName: "s", ColType: StringColumn})
+
+	_ = db.Insert("table1", 1, 1, "x")
+	_ = db.Insert("table1", 2, nil, "y")
+	_ = db.Insert("table1", 3, 3, nil)
+	_ = db.Insert("table1", 4, 2, "x")
+	_ = db.Insert("table1", 5, 0, "z")
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT id FROM table1 WHERE NOT (a = 1) ORDER BY id",
+			"[[3] [4] [5]]"},
+		{"SELECT id FROM table1 WHERE a != 1 ORDER BY id", "[[3] [4] [5]]"},
+		{"SELECT id FROM table1 WHERE NOT a IN (1, 3) ORDER BY id",
+			"[[4] [5]]"},
+		{"SELECT id FROM table1 WHERE a NOT IN (1, 3) ORDER BY id",
+			"[[4] [5]]"},
+		{"SELECT id FROM table1 WHERE NOT s LIKE 'x%' ORDER BY id",
+			"[[2] [5]]"},
+		{"SELECT id FROM table1 WHERE NOT (a = 1 OR s = 'y') ORDER BY id",
+			"[[4] [5]]"},
+		{"SELECT id FROM table1 WHERE NOT (a = 1 AND s = 'x') ORDER BY id",
+			"[[2] [3] [4] [5]]"},
+		{"SELECT id FROM table1 WHERE NOT NOT a > 1 ORDER BY id",
+			"[[3] [4]]"},
+		{"SELECT id FROM table1 WHERE NOT (a + 0 = 1) ORDER BY id",
+			"[[3] [4] [5]]"},
+		{"SELECT id FROM table1 WHERE NOT (a + 0 IN (1, 3)) ORDER BY id",
+			"[[4] [5]]"},
+		{"SELECT id, CASE WHEN NOT (a = 1) THEN 'y' ELSE 'n' END " +
+			"FROM table1 ORDER BY id",
+			"[[1 n] [2 n] [3 y] [4 y] [5 y]]"},
+		{"SELECT s, SUM(a) FROM table1 WHERE s != 'x' GROUP BY s " +
+			"HAVING NOT SUM(a) > 1 ORDER BY s",
+			"[[z 0]]"},
+	}
+
+	for _, i := range cases {
+		t.Log(i.query)
+		rs, err := db.Select(i.query)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fmt.Sprint(rs.Rows) != i.want {
+			t.Errorf("Want: %v Got: %v", i.want, rs.Rows)
+		}
+	}
+}
+
+func TestPatternMatching(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("table1",
+		ColumnDesc{ColName: "col1", ColType: IntColumn},
+		ColumnDesc{ColName: "name", ColType: StringColumn})
+
+	_ = db.Insert("table1", 1, "Sankar")
+	_ = db.Insert("table1", 2, "sangeetha")
+	_ = db.Insert("table1", 3, "Kumar")
+	_ = db.Insert("table1", 4, "100%")
+	_ = db.Insert("table1", 5, "San.ta")
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT col1 FROM table1 WHERE name LIKE 'San%'", "[[1] [5]]"},
+		{"SELECT col1 FROM table1 WHERE name ILIKE 'san%'", "[[1] [2] [5]]"},
+		{"SELECT col1 FROM table1 WHERE name like '%a_'", "[[1] [3]]"},
+		{"SELECT col1 FROM table1 WHERE name NOT LIKE '%a%'", "[[4]]"},
+		{"SELECT col1 FROM table1 WHERE name LIKE '%\\%'", "[[4]]"},
+		{"SELECT col1 FROM table1 WHERE name LIKE 'San._a'", "[[5]]"},
+		{"SELECT col1 FROM table1 WHERE name NOT ILIKE 'S%' AND col1 < 4", "[[3]]"},
+		{"SELECT col1 FROM table1 WHERE name ~ '^[A-Z][a-z]+$'", "[[1] [3]]"},
+		{"SELECT col1 FROM table1 WHERE name REGEXP 'ee' OR name~'^1'", "[[2] [4]]"},
+		{"SELECT col1 FROM table1 WHERE name NOT REGEXP 'a'", "[[4]]"},
+	}
+
+	for _, i := range cases {
+		t.Log(i.query)
+		rs, err := db.Select(i.query)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fmt.Sprint(rs.Rows) != i.want {
+			t.Errorf("Want: %v Got: %v", i.want, rs.Rows)
+		}
+	}
+
+	for _, query := range []string{
+		"SELECT col1 FROM table1 WHERE name ~ '('",
+		"SELECT col1 FROM table1 WHERE col1 LIKE '1%'",
+	} {
+		t.Log(query)
+		if _, err := db.Select(query); err == nil {
+			t.Error("No error message for an invalid pattern")
+		}
+	}
+}
+
+func TestStringRangesAndOrderBy(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("table1",
+		ColumnDesc{ColName: "col1", ColType: IntColumn},
+		ColumnDesc{ColName: "bin", ColType: StringColumn},
+		ColumnDesc{ColName: "uni", ColType: StringColumn,
+			Collation: UnicodeCollation})
+
+	for i, name := range []string{"banana", "Apple", "cherry", "apple", "Éclair", "date"} {
+		_ = db.Insert("table1", i+1, name, name)
+	}
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT bin FROM table1 WHERE bin >= 'a' AND bin < 'c' ORDER BY bin",
+			"[[apple] [banana]]"},
+		{"SELECT uni FROM table1 WHERE uni >= 'a' AND uni < 'c' ORDER BY uni",
+			"[[Apple] [apple] [banana]]"},
+		{"SELECT bin FROM table1 ORDER BY bin DESC",
+			"[[Éclair] [date] [cherry] [banana] [apple] [Apple]]"},
+		{"SELECT uni FROM table1 WHERE uni BETWEEN 'b' AND 'd' ORDER BY uni",
+			"[[banana] [cherry]]"},
+		{"SELECT col1 FROM table1 WHERE bin <= 'Apple' OR uni > 'd' ORDER BY uni ASC",
+			"[[2] [6] [5]]"},
+		{"SELECT MIN(bin), MAX(bin), MIN(uni), MAX(uni) FROM table1",
+			"[[Apple Éclair Apple Éclair]]"},
+		{"SELECT uni, COUNT(*) FROM table1 GROUP BY uni ORDER BY COUNT(*) DESC, uni",
+			"[[Apple 1] [apple 1] [banana 1] [cherry 1] [date 1] [Éclair 1]]"},
+	}
+
+	for _, i := range cases {
+		t.Log(i.query)
+		rs, err := db.Select(i.query)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fmt.Sprint(rs.Rows) != i.want {
+			t.Errorf("Want: %v Got: %v", i.want, rs.Rows)
+		}
+	}
+}
+
+func TestUnicodeCollation(t *testing.T) {
+	db := &Keeri{}
+
+	mustExec(t, db, "CREATE TABLE words (id INT, w TEXT COLLATE UNICODE)")
+	words := []string{"zebra", "äpfel", "Apfel", "apfel", "Äpfel", "a\u0308pfel",
+		"Straße", "strasse", "Strasse", "Øre", "ore", "Zürich", "zurich", "able"}
+	for i, w := range words {
+		if err := db.Insert("words", i+1, w); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The accents are compared after the letters, and the case last
+	checkRows(t, db, "SELECT id FROM words ORDER BY w",
+		"[[14] [3] [4] [6] [5] [2] [11] [10] [9] [7] [8] [1] [13] [12]]")
+	checkRows(t, db, "SELECT id FROM words WHERE w > 'a' AND w < 'b' ORDER BY w DESC",
+		"[[2] [5] [6] [4] [3] [14]]")
+	checkRows(t, db, "SELECT MIN(w), MAX(w) FROM words WHERE w >= 'ore'",
+		"[[ore Zürich]]")
+
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"ä", "z", -1},
+		{"Ä", "b", -1},
+		{"äpfel", "apfelz", -1},
+		{"apfel", "äpfel", -1},
+		{"äb", "ab\u0308", 1},
+		{"résumé", "resume", 1},
+		{"Straße", "strasse", -1},
+		{"straße", "strasse", 1},
+		{"ø", "o", 1},
+		{"ø", "p", -1},
+		{"œuvre", "oeuvre", 1},
+		{"ä", "ä", 0},
+	}
+	for _, i := range cases {
+		if got := UnicodeCollation.compare(i.a, i.b); got != i.want {
+			t.Errorf("%q, %q: Want: %d Got: %d", i.a, i.b, i.want, got)
+		}
+		if got := UnicodeCollation.compare(i.b, i.a); got != -i.want {
+			t.Errorf("%q, %q: Want: %d Got: %d", i.b, i.a, -i.want, got)
+		}
+	}
+}
+
+func TestSelectStarAndAliases(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("customers",
+		ColumnDesc{ColName: "id", ColType: IntColumn},
+		ColumnDesc{ColName: "name", ColType: StringColumn})
+	_ = db.CreateTable("orders",
+		ColumnDesc{ColName: "customer", ColType: IntColumn},
+		ColumnDesc{ColName: "amount", ColType: IntColumn})
+
+	_ = db.Insert("customers", 1, "Sankar")
+	_ = db.Insert("customers", 2, "Kumar")
+	_ = db.Insert("orders", 1, 10)
+	_ = db.Insert("orders", 2, 30)
+	_ = db.Insert("orders", 1, 5)
+
+	cases := []struct {
+		query   string
+		columns string
+		rows    string
+	}{
+		{"SELECT * FROM customers",
+			"[{id 0} {name 1}]", "[[1 Sankar] [2 Kumar]]"},
+		{"SELECT name AS who, id FROM customers ORDER BY who",
+			"[{who 1} {id 0}]", "[[Kumar 2] [Sankar 1]]"},
+		{`SELECT customer c, SUM(amount) AS total, AVG(amount) FROM orders
+		GROUP BY customer ORDER BY total DESC`,
+			"[{c 0} {total 0} {AVG(amount) 2}]", "[[2 30 30] [1 15 7.5]]"},
+		{`SELECT o.*, c.name FROM customers c JOIN orders o
+		ON o.customer = c.id WHERE o.amount > 5`,
+			"[{customer 0} {amount 0} {c.name 1}]", "[[1 10 Sankar] [2 30 Kumar]]"},
+		{"SELECT * FROM customers c JOIN orders o ON o.customer = c.id WHERE amount = 5",
+			"[{id 0} {name 1} {customer 0} {amount 0}]", "[[1 Sankar 1 5]]"},
+		{"SELECT * FROM customers ORDER BY 2",
+			"[{id 0} {name 1}]", "[[2 Kumar] [1 Sankar]]"},
+		{"SELECT name, id * 10 FROM customers ORDER BY 2 DESC",
+			"[{name 1} {id * 10 0}]", "[[Kumar 20] [Sankar 10]]"},
+		{`SELECT customer, SUM(amount) FROM orders
+		GROUP BY customer ORDER BY 2 DESC, 1`,
+			"[{customer 0} {SUM(amount) 0}]", "[[2 30] [1 15]]"},
+		{`SELECT c.name, o.amount FROM customers c JOIN orders o
+		ON o.customer = c.id ORDER BY 2`,
+			"[{c.name 1} {o.amount 0}]", "[[Sankar 5] [Sankar 10] [Kumar 30]]"},
+	}
+
+	for _, i := range cases {
+		t.Log(i.query)
+		rs, err := db.Select(i.query)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fmt.Sprint(rs.Columns) != i.columns {
+			t.Errorf("Want: %v Got: %v", i.columns, rs.Columns)
+		}
+		if fmt.Sprint(rs.Rows) != i.rows {
+			t.Errorf("Want: %v Got: %v", i.rows, rs.Rows)
+		}
+	}
+
+	rs, err := db.Select("SELECT name AS who FROM customers WHERE id = 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k := rs.ColumnIndex("who"); k != 0 || rs.Rows[0][k] != "Kumar" {
+		t.Errorf("Want: Kumar Got: %v", rs.Rows)
+	}
+
+	for _, query := range []string{
+		"SELECT * AS everything FROM customers",
+		"SELECT x.* FROM customers",
+		"SELECT name AS FROM customers",
+		"SELECT id, name FROM customers ORDER BY 0",
+		"SELECT id, name FROM customers ORDER BY 3",
+		"SELECT * FROM customers ORDER BY 1, 3",
+	} {
+		t.Log(query)
+		if _, err := db.Select(query); err == nil {
+			t.Error("No error message for a malformed query")
+		}
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("items",
+		ColumnDesc{ColName: "name", ColType: StringColumn},
+		ColumnDesc{ColName: "price", ColType: IntColumn},
+		ColumnDesc{ColName: "qty", ColType: IntColumn})
+	_ = db.CreateTable("notes",
+		ColumnDesc{ColName: "item", ColType: StringColumn},
+		ColumnDesc{ColName: "note", ColType: StringColumn})
+
+	_ = db.Insert("items", "Pen", 10, 5)
+	_ = db.Insert("items", "Book", 150, 1)
+	_ = db.Insert("items", "Bag", 40, 3)
+	_ = db.Insert("items", "Ink", 25, 0)
+	_ = db.Insert("notes", "Pen", "blue")
+	_ = db.Insert("notes", "Bag", "Leather")
+
+	cases := []struct {
+		query   string
+		columns string
+		rows    string
+	}{
+		{"SELECT name, price * qty FROM items WHERE price * qty > 100",
+			"[{name 1} {price * qty 0}]", "[[Book 150] [Bag 120]]"},
+		{"SELECT name FROM items WHERE price + qty = 13 OR qty > price",
+			"[{name 1}]", "[]"},
+		{"SELECT name FROM items WHERE qty * 10 >= price",
+			"[{name 1}]", "[[Pen]]"},
+		{"SELECT name, -price, price / qty, price % qty FROM items",
+			"[{name 1} {-price 0} {price / qty 0} {price % qty 0}]",
+			"[[Pen -10 2 0] [Book -150 150 0] [Bag -40 13 1] [Ink -25 <nil> <nil>]]"},
+		{"SELECT LOWER(name), UPPER(name), LENGTH(name) FROM items WHERE qty = 1",
+			"[{LOWER(name) 1} {UPPER(name) 1} {LENGTH(name) 0}]",
+			"[[book BOOK 4]]"},
+		{"SELECT SUBSTR(name, 2), SUBSTR(name, 1, 2) FROM items WHERE price = 40",
+			"[{SUBSTR(name, 2) 1} {SUBSTR(name, 1, 2) 1}]", "[[ag Ba]]"},
+		{"SELECT name FROM items WHERE ABS(qty - 4) = 1",
+			"[{name 1}]", "[[Pen] [Bag]]"},
+		{`SELECT COALESCE(note, name, 'none') AS label FROM items i
+		LEFT JOIN notes n ON n.item = i.name ORDER BY label`,
+			"[{label 1}]", "[[Book] [Ink] [Leather] [blue]]"},
+		{`SELECT name FROM items i LEFT JOIN notes n ON n.item = i.name
+		WHERE LOWER(note) LIKE 'l%' OR LENGTH(note) < 5`,
+			"[{name 1}]", "[[Pen] [Bag]]"},
+		{"SELECT name, price * qty AS total FROM items ORDER BY total DESC",
+			"[{name 1} {total 0}]",
+			"[[Book 150] [Bag 120] [Pen 50] [Ink 0]]"},
+		{"SELECT DISTINCT qty * 0 FROM items", "[{qty * 0 0}]", "[[0]]"},
+		{"SELECT name FROM items WHERE LENGTH(name) IN (4, qty + 2) AND NOT qty = 0",
+			"[{name 1}]", "[[Book]]"},
+		{"SELECT abs(price-3), price+qty*2, Lower(name) FROM items WHERE qty = 1",
+			"[{ABS((price - 3)) 0} {price + (qty * 2) 0} {LOWER(name) 1}]",
+			"[[147 152 book]]"},
+	}
+
+	for _, i := range cases {
+		t.Log(i.query)
+		rs, err := db.Select(i.query)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fmt.Sprint(rs.Columns) != i.columns {
+			t.Errorf("Want: %v Got: %v", i.columns, rs.Columns)
+		}
+		if fmt.Sprint(rs.Rows) != i.rows {
+			t.Errorf("Want: %v Got: %v", i.rows, rs.Rows)
+		}
+	}
+
+	for _, query := range []string{
+		"SELECT name + 1 FROM items",
+		"SELECT LOWER(price) FROM items",
+		"SELECT name FROM items WHERE name = price",
+		"SELECT name FROM items WHERE price + 1",
+		"SELECT price * 2, COUNT(*) FROM items",
+		"SELECT SUM(price * qty) FROM items",
+		"SELECT note FROM notes WHERE note LIKE item",
+	} {
+		t.Log(query)
+		if _, err := db.Select(query); err == nil {
+			t.Error("No error message for a malformed query")
+		}
+	}
+}
+
+func TestCase(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("orders",
+		ColumnDesc{ColName: "id", ColType: IntColumn},
+		ColumnDesc{ColName: "amount", ColType: IntColumn},
+		ColumnDesc{ColName: "status", ColType: StringColumn})
+
+	_ = db.Insert("orders", 1, 50, "new")
+	_ = db.Insert("orders", 2, 1500, "paid")
+	_ = db.Insert("orders", 3, 700, "paid")
+	_ = db.Insert("orders", 4, 2000, "void")
+	_ = db.Insert("orders", 5, 20, "new")
+
+	cases := []struct {
+		query   string
+		columns string
+		rows    string
+	}{
+		{`SELECT id, CASE WHEN amount > 1000 THEN 'large'
+		WHEN amount > 100 THEN 'medium' ELSE 'small' END AS size FROM orders`,
+			"[{id 0} {size 1}]",
+			"[[1 small] [2 large] [3 medium] [4 large] [5 small]]"},
+		{"SELECT id, CASE status WHEN 'new' THEN 0 WHEN 'paid' THEN amount END FROM orders",
+			"[{id 0} {CASE status WHEN 'new' THEN 0 WHEN 'paid' THEN amount END 0}]",
+			"[[1 0] [2 1500] [3 700] [4 <nil>] [5 0]]"},
+		{`SELECT id FROM orders WHERE CASE WHEN status = 'void' THEN 0
+		ELSE amount END > 600`,
+			"[{id 0}]", "[[2] [3]]"},
+		{`SELECT CASE WHEN amount >= 1000 THEN 'large' ELSE 'small' END AS size,
+		COUNT(*), SUM(amount) FROM orders GROUP BY size ORDER BY size`,
+			"[{size 1} {COUNT(*) 0} {SUM(amount) 0}]",
+			"[[large 2 3500] [small 3 770]]"},
+		{`SELECT status, COUNT(*) FROM orders
+		GROUP BY status, CASE WHEN amount > 100 THEN 1 END ORDER BY status`,
+			"[{status 1} {COUNT(*) 0}]", "[[new 2] [paid 2] [void 1]]"},
+		{`SELECT id FROM orders ORDER BY CASE status WHEN 'paid' THEN 0
+		WHEN 'new' THEN 1 ELSE 2 END, amount DESC`,
+			"[{id 0}]", "[[2] [3] [1] [5] [4]]"},
+		{`SELECT id FROM orders WHERE CASE WHEN NOT (status = 'new' OR id > 3)
+		THEN 'y' END = 'y'`,
+			"[{id 0}]", "[[2] [3]]"},
+
+		// A NULL is a value of the type of the other values
+		{"SELECT id, CASE amount WHEN NULL THEN 'none' ELSE 'some' END FROM orders WHERE id < 3",
+			"[{id 0} {CASE amount WHEN NULL THEN 'none' ELSE 'some' END 1}]",
+			"[[1 some] [2 some]]"},
+		{"SELECT id, CASE WHEN amount > 1000 THEN NULL ELSE amount END AS small FROM orders",
+			"[{id 0} {small 0}]", "[[1 50] [2 <nil>] [3 700] [4 <nil>] [5 20]]"},
+		{"SELECT COALESCE(NULL, status), NULL FROM orders WHERE id = 1",
+			"[{COALESCE(NULL, status) 1} {NULL 2}]", "[[new <nil>]]"},
+		{"SELECT id FROM orders WHERE amount = NULL OR NOT amount != NULL",
+			"[{id 0}]", "[]"},
+	}
+
+	for _, i := range cases {
+		t.Log(i.query)
+		rs, err := db.Select(i.query)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fmt.Sprint(rs.Columns) != i.columns {
+			t.Errorf("Want: %v Got: %v", i.columns, rs.Columns)
+		}
+		if fmt.Sprint(rs.Rows) != i.rows {
+			t.Errorf("Want: %v Got: %v", i.rows, rs.Rows)
+		}
+	}
+
+	for _, query := range []string{
+		"SELECT CASE WHEN amount > 10 THEN 'x' ELSE 1 END FROM orders",
+		"SELECT CASE WHEN amount > 10 THEN status ELSE amount END FROM orders",
+		"SELECT CASE amount WHEN 'big' THEN 'x' END FROM orders",
+		"SELECT CASE WHEN amount THEN 'x' END FROM orders",
+		"SELECT CASE WHEN amount > 10 THEN 'x' FROM orders",
+		"SELECT CASE END FROM orders",
+		"SELECT CASE WHEN amount > 10 THEN 1 END, COUNT(*) FROM orders",
+	} {
+		t.Log(query)
+		if _, err := db.Select(query); err == nil {
+			t.Error("No error message for a malformed query")
+		}
+	}
+}
+
+func TestBindParameters(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("users",
+		ColumnDesc{ColName: "id", ColType: IntColumn},
+		ColumnDesc{ColName: "name", ColType: StringColumn})
+
+	_ = db.Insert("users", 1, "Sankar")
+	_ = db.Insert("users", 2, "Kumar")
+	_ = db.Insert("users", 3, "Robert'); DROP TABLE users;--")
+
+	cases := []struct {
+		query string
+		args  []interface{}
+		want  string
+	}{
+		{"SELECT name FROM users WHERE id = ?", []interface{}{2}, "[[Kumar]]"},
+		{"SELECT id FROM users WHERE id > ? AND name != ?",
+			[]interface{}{int64(1), "Kumar"}, "[[3]]"},
+		{"SELECT id FROM users WHERE name = $1 OR id = $2 OR name = $1",
+			[]interface{}{"Robert'); DROP TABLE users;--", 1}, "[[1] [3]]"},
+		{"SELECT id FROM users WHERE id IN (?, 3) OR id BETWEEN ? AND ?",
+			[]interface{}{1, 7, 9}, "[[1] [3]]"},
+		{"SELECT id FROM users WHERE name LIKE ?", []interface{}{"%ar"},
+			"[[1] [2]]"},
+		{"SELECT id, id * :n AS x FROM users WHERE id + :n > :min",
+			[]interface{}{map[string]interface{}{"n": 10, "min": 12}},
+			"[[3 30]]"},
+		{"SELECT id FROM users WHERE name = '?'", nil, "[]"},
+	}
+
+	for _, i := range cases {
+		t.Log(i.query)
+		rs, err := db.Select(i.query, i.args...)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fmt.Sprint(rs.Rows) != i.want {
+			t.Errorf("Want: %v Got: %v", i.want, rs.Rows)
+		}
+	}
+
+	for _, i := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{"SELECT id FROM users WHERE id = ?", nil},
+		{"SELECT id FROM users WHERE id = ?", []interface{}{1, 2}},
+		{"SELECT id FROM users WHERE id = $2", []interface{}{1}},
+		{"SELECT id FROM users", []interface{}{1}},
+		{"SELECT id FROM users WHERE id = ?", []interface{}{"1"}},
+		{"SELECT id FROM users WHERE name = ?", []interface{}{1}},
+		{"SELECT id FROM users WHERE id IN (1, ?)", []interface{}{"2"}},
+		{"SELECT id FROM users WHERE id + 1 = ?", []interface{}{"2"}},
+		{"SELECT id FROM users WHERE id = ?", []interface{}{2.5}},
+		{"SELECT id FROM users WHERE id = :id", []interface{}{1}},
+		{"SELECT id FROM users WHERE id = :id",
+			[]interface{}{map[string]interface{}{"name": 1}}},
+	} {
+		t.Log(i.query, i.args)
+		if _, err := db.Select(i.query, i.args...); err == nil {
+			t.Error("No error message for wrong arguments")
+		}
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("users",
+		ColumnDesc{ColName: "id", ColType: IntColumn},
+		ColumnDesc{ColName: "name", ColType: StringColumn})
+	_ = db.CreateTable("orders",
+		ColumnDesc{ColName: "user", ColType: IntColumn},
+		ColumnDesc{ColName: "amount", ColType: IntColumn})
+
+	_ = db.Insert("users", 1, "Sankar")
+	_ = db.Insert("users", 2, "Kumar")
+	_ = db.Insert("orders", 1, 10)
+	_ = db.Insert("orders", 2, 30)
+
+	if _, err := db.Prepare("SELECT id FROM users WHERE"); err == nil {
+		t.Error("No error message for a malformed query")
+	}
+	if _, err := db.Prepare("SELECT id FROM nousers"); err == nil {
+		t.Error("No error message for a missing table")
+	}
+
+	s, err := db.Prepare("SELECT name FROM users WHERE id = ? OR name LIKE ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	join, err := db.Prepare(`SELECT u.name, SUM(o.amount) FROM users u
+	JOIN orders o ON o.user = u.id WHERE o.amount > ? GROUP BY u.name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(s *Stmt, want string, args ...interface{}) {
+		t.Helper()
+		rs, err := s.Query(args...)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if fmt.Sprint(rs.Rows) != want {
+			t.Errorf("Want: %v Got: %v", want, rs.Rows)
+		}
+	}
+
+	run(s, "[[Sankar]]", 1, "x%")
+	run(s, "[[Sankar] [Kumar]]", 1, "K%")
+	run(join, "[[Kumar 30]]", 20)
+	run(join, "[[Sankar 10] [Kumar 30]]", 5)
+
+	// New rows are seen by the prepared statements
+	_ = db.Insert("users", 3, "Kannan")
+	_ = db.Insert("orders", 3, 50)
+	run(s, "[[Kumar] [Kannan]]", 0, "K%")
+	run(join, "[[Kumar 30] [Kannan 50]]", 20)
+
+	if _, err := s.Query("1", "K%"); err == nil {
+		t.Error("No error message for a wrong type of argument")
+	}
+
+	// Runs of the same statement do not share their state
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				rs, err := join.Query(i % 3 * 20)
+				if err != nil || len(rs.Rows) != 3-i%3 {
+					t.Errorf("Want: %d rows Got: %v %v", 3-i%3, rs, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// A statement is prepared again for a replaced table
+	_ = db.ReplaceTable("users",
+		ColumnDesc{ColName: "name", ColType: StringColumn},
+		ColumnDesc{ColName: "id", ColType: IntColumn})
+	_ = db.Insert("users", "Robert", 1)
+	run(s, "[[Robert]]", 1, "x%")
+
+	stale := s.plans[0]
+	db.tables["users"].version++
+	run(s, "[[Robert]]", 1, "x%")
+	if len(s.plans) != 1 || s.plans[0] == stale {
+		t.Error("Want: the statement prepared again for a changed table")
+	}
+
+	_ = db.ReplaceTable("users",
+		ColumnDesc{ColName: "id", ColType: IntColumn})
+	if _, err := s.Query(1, "x%"); err == nil {
+		t.Error("No error message for a missing column")
+	}
+
+	// The statements of the Select calls are cached
+	for i := 0; i < stmtCacheSize+10; i++ {
+		if _, err := db.Select(fmt.Sprint("SELECT user FROM orders WHERE amount > ",
+			i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := db.stmts.lru.Len(); n != stmtCacheSize {
+		t.Errorf("Want: %d cached statements Got: %d", stmtCacheSize, n)
+	}
+	a, _ := db.stmts.get(db, "SELECT user FROM orders WHERE amount > 100")
+	b, _ := db.stmts.get(db, "SELECT user FROM orders WHERE amount > 100")
+	if a != b {
+		t.Error("Want: the same cached statement")
+	}
+	if _, ok := db.stmts.entries["SELECT user FROM orders WHERE amount > 0"]; ok {
+		t.Error("Want: the least recently used statement evicted")
+	}
+}
+
+// The prepared and the cached queries see the columns of a table as
+// they are when they are run, while its rows are replaced by Truncate
+// and its columns are added and dropped
+func TestPrepareConcurrency(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("t",
+		ColumnDesc{ColName: "a", ColType: IntColumn},
+		ColumnDesc{ColName: "b", ColType: StringColumn})
+	fill := func() {
+		for i := 1; i <= 10; i++ {
+			if err := db.Insert("t", i, fmt.Sprint("b", i)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	fill()
+
+	stmt, err := db.Prepare("SELECT a, b FROM t WHERE a > ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := []func() (*ResultSet, error){
+		func() (*ResultSet, error) {
+			return db.Select("SELECT a, b FROM t WHERE a > 0")
+		},
+		func() (*ResultSet, error) {
+			return db.Select("SELECT a + 1, UPPER(b) FROM t WHERE a > 0 ORDER BY a")
+		},
+		func() (*ResultSet, error) { return stmt.Query(0) },
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	for _, query := range queries {
+		wg.Add(1)
+		go func(query func() (*ResultSet, error)) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rs, err := query()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, row := range rs.Rows {
+					if row[0] == nil || row[1] == nil {
+						t.Errorf("Want: a row that exists Got: %v", row)
+						return
+					}
+				}
+			}
+		}(query)
+	}
+
+	for i := 0; i < 200; i++ {
+		if err = db.Truncate("t", false); err != nil {
+			t.Error(err)
+		}
+		fill()
+		if err = db.AddColumn("t", ColumnDesc{ColName: "c",
+			ColType: IntColumn}, 1); err != nil {
+			t.Error(err)
+		}
+		if err = db.DropColumn("t", "c"); err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// Runs the statement, failing the test if it returns an error
+func mustExec(t *testing.T, db *Keeri, sql string,
+	args ...interface{}) Result {
+
+	t.Helper()
+	res, err := db.Exec(sql, args...)
+	if err != nil {
+		t.Error(err)
+	}
+	return res
+}
+
+// Runs the statement, failing the test unless it changes the want rows
+func wantRowsAffected(t *testing.T, db *Keeri, sql string, want int,
+	args ...interface{}) {
+
+	t.Helper()
+	res, err := db.Exec(sql, args...)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if res.RowsAffected != want {
+		t.Errorf("Want: %d rows affected Got: %d", want, res.RowsAffected)
+	}
+}
+
+// Runs the query, failing the test unless it returns the want rows
+func checkRows(t *testing.T, db *Keeri, query, want string) {
+	t.Helper()
+	rs, err := db.Select(query)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if fmt.Sprint(rs.Rows) != want {
+		t.Errorf("Want: %v Got: %v", want, rs.Rows)
+	}
+}
+
+// Fails the test unless the error is a *ConstraintError
+// of the given kind, for the given constraint
+func wantConstraintViolation(t *testing.T, err, kind error,
+	constraint string) {
+
+	t.Helper()
+	var ce *ConstraintError
+	if !errors.As(err, &ce) || !errors.Is(err, kind) ||
+		ce.Constraint != constraint {
+		t.Errorf("Want: a violation of %s Got: %v", constraint, err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	db := &Keeri{}
+
+	wantRowsAffected(t, db, `CREATE TABLE users (id INT, name VARCHAR(20) COLLATE UNICODE,
+	city text)`, 0)
+	wantRowsAffected(t, db, "CREATE TABLE IF NOT EXISTS users (id INT)", 0)
+	wantRowsAffected(t, db, "INSERT INTO users VALUES (1, 'Sankar', 'Chennai'), (2, 'Élan', NULL)", 2)
+	wantRowsAffected(t, db, "insert into users (name, id) values (?, ?)", 1, "arun", 3)
+	wantRowsAffected(t, db, "INSERT INTO users (id, city) VALUES (:id, :city), (-4, :city)", 2,
+		map[string]interface{}{"id": 5, "city": "Madurai"})
+
+	rs, err := db.Select("SELECT id, name, city FROM users ORDER BY name, id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[[3 arun <nil>] [2 Élan <nil>] [1 Sankar Chennai] " +
+		"[-4 <nil> Madurai] [5 <nil> Madurai]]"
+	if fmt.Sprint(rs.Rows) != want {
+		t.Errorf("Want: %v Got: %v", want, rs.Rows)
+	}
+
+	wantRowsAffected(t, db, "DROP TABLE users", 0)
+	wantRowsAffected(t, db, "DROP TABLE IF EXISTS users", 0)
+	if _, err := db.Select("SELECT id FROM users"); err == nil {
+		t.Error("No error message for a dropped table")
+	}
+
+	wantRowsAffected(t, db, "CREATE TABLE users (id INTEGER, name STRING)", 0)
+	wantRowsAffected(t, db, "INSERT INTO users VALUES (1, 'Sankar')", 1)
+
+	for _, i := range []struct {
+		sql  string
+		args []interface{}
+	}{
+		{"CREATE TABLE users (id INT)", nil},
+		{"CREATE TABLE t (id INT)", []interface{}{1}},
+		{"DROP TABLE nousers", nil},
+		{"INSERT INTO nousers VALUES (1)", nil},
+		{"INSERT INTO users (id, age) VALUES (1, 2)", nil},
+		{"INSERT INTO users VALUES (1)", nil},
+		{"INSERT INTO users VALUES (2, 'Kumar'), (3)", nil},
+		{"INSERT INTO users VALUES ('two', 'Kumar')", nil},
+		{"INSERT INTO users VALUES (?, ?)", []interface{}{"2", "Kumar"}},
+		{"INSERT INTO users VALUES (?, ?)", []interface{}{2}},
+	} {
+		t.Log(i.sql, i.args)
+		if _, err := db.Exec(i.sql, i.args...); err == nil {
+			t.Error("No error message for a wrong statement")
+		}
+	}
+
+	// None of the rows of a failed INSERT are inserted
+	rs, err = db.Select("SELECT COUNT(*) FROM users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(rs.Rows) != "[[1]]" {
+		t.Errorf("Want: [[1]] Got: %v", rs.Rows)
+	}
+}
+
+func TestAlterTable(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("users",
+		ColumnDesc{ColName: "id", ColType: IntColumn},
+		ColumnDesc{ColName: "name", ColType: StringColumn})
+	_ = db.Insert("users", 1, "Sankar")
+	_ = db.Insert("users", 2, "Kumar")
+
+	// The cached statement is prepared again after every change
+	checkRows(t, db, "SELECT * FROM users", "[[1 Sankar] [2 Kumar]]")
+
+	if err := db.AddColumn("users",
+		ColumnDesc{ColName: "age", ColType: IntColumn}, 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddColumn("users",
+		ColumnDesc{ColName: "city", ColType: StringColumn}, nil); err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Insert("users", 3, "Robert", 40, "Chennai")
+	checkRows(t, db, "SELECT * FROM users", "[[1 Sankar 30 <nil>] [2 Kumar 30 <nil>] "+
+		"[3 Robert 40 Chennai]]")
+
+	if err := db.RenameColumn("users", "age", "years"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropColumn("users", "name"); err != nil {
+		t.Fatal(err)
+	}
+	checkRows(t, db, "SELECT * FROM users WHERE years > 30", "[[3 40 Chennai]]")
+	if _, err := db.Select("SELECT name FROM users"); err == nil {
+		t.Error("No error message for a dropped column")
+	}
+
+	for _, sql := range []string{
+		"ALTER TABLE users ADD COLUMN score INT DEFAULT -1",
+		"ALTER TABLE users ADD nick TEXT COLLATE UNICODE DEFAULT 'none'",
+		"ALTER TABLE users RENAME COLUMN city TO town",
+		"ALTER TABLE users DROP years",
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := db.Exec("ALTER TABLE users ADD level INT DEFAULT ?", 7); err != nil {
+		t.Error(err)
+	}
+	checkRows(t, db, "SELECT * FROM users", "[[1 <nil> -1 none 7] [2 <nil> -1 none 7] "+
+		"[3 Chennai -1 none 7]]")
+
+	for _, f := range []func() error{
+		func() error {
+			return db.AddColumn("nousers", ColumnDesc{ColName: "x"}, nil)
+		},
+		func() error { return db.AddColumn("users", ColumnDesc{ColName: "id"}, nil) },
+		func() error {
+			return db.AddColumn("users",
+				ColumnDesc{ColName: "x", ColType: IntColumn}, "1")
+		},
+		func() error {
+			return db.AddColumn("users",
+				ColumnDesc{ColName: "x", ColType: unRecognizedColumn}, nil)
+		},
+		func() error { return db.DropColumn("users", "name") },
+		func() error { return db.RenameColumn("users", "id", "town") },
+		func() error { return db.RenameColumn("users", "name", "x") },
+		func() error {
+			_, err := db.Exec("ALTER TABLE users ADD x INT DEFAULT 'one'")
+			return err
+		},
+	} {
+		if err := f(); err == nil {
+			t.Error("No error message for a wrong change")
+		}
+	}
+
+	_ = db.CreateTable("single", ColumnDesc{ColName: "id", ColType: IntColumn})
+	if err := db.DropColumn("single", "id"); err == nil {
+		t.Error("No error message for dropping the only column")
+	}
+
+	// The rows inserted while a column is backfilled get the default too
+	_ = db.CreateTable("events", ColumnDesc{ColName: "id", ColType: IntColumn})
+	for i := 1; i <= 1000; i++ {
+		_ = db.Insert("events", i)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1001; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := db.Insert("events", i); err != nil {
+				// The column has been added
+				_ = db.Insert("events", i, 0)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := db.Select("SELECT COUNT(*) FROM events"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	if err := db.AddColumn("events",
+		ColumnDesc{ColName: "kind", ColType: IntColumn}, 5); err != nil {
+		t.Error(err)
+	}
+	close(stop)
+	wg.Wait()
+
+	checkRows(t, db, "SELECT COUNT(*) FROM events WHERE COALESCE(kind, -1) = -1", "[[0]]")
+}
+
+func TestTableManagement(t *testing.T) {
+	db := &Keeri{}
+
+	if err := db.Insert("users", 1); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("Want: ErrTableNotFound Got: %v", err)
+	}
+
+	_ = db.CreateTable("users",
+		ColumnDesc{ColName: "id", ColType: IntColumn},
+		ColumnDesc{ColName: "name", ColType: StringColumn})
+	_ = db.Insert("users", 1, "Sankar")
+	_ = db.Insert("users", 2, "Kumar")
+
+	err := db.CreateTable("users", ColumnDesc{ColName: "id", ColType: IntColumn})
+	if !errors.Is(err, ErrTableExists) {
+		t.Errorf("Want: ErrTableExists Got: %v", err)
+	}
+
+	s, err := db.Prepare("SELECT name FROM users WHERE id > 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(want string) {
+		t.Helper()
+		rs, err := s.Query()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if fmt.Sprint(rs.Rows) != want {
+			t.Errorf("Want: %v Got: %v", want, rs.Rows)
+		}
+	}
+	run("[[Sankar] [Kumar]]")
+
+	// The rowIDs go on from the last row, unless they are reset
+	if err = db.Truncate("users", false); err != nil {
+		t.Fatal(err)
+	}
+	run("[]")
+	_ = db.Insert("users", 3, "Robert")
+	run("[[Robert]]")
+	if id := db.tables["users"].curRowID(); id != 3 {
+		t.Errorf("Want: rowID 3 Got: %d", id)
+	}
+
+	if _, err = db.Exec("TRUNCATE users RESTART IDENTITY"); err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Insert("users", 4, "Arun")
+	run("[[Arun]]")
+	if id := db.tables["users"].curRowID(); id != 1 {
+		t.Errorf("Want: rowID 1 Got: %d", id)
+	}
+
+	if err = db.RenameTable("users", "people"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Query(); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("Want: ErrTableNotFound Got: %v", err)
+	}
+	if _, err = db.Exec("ALTER TABLE people RENAME TO users"); err != nil {
+		t.Fatal(err)
+	}
+	run("[[Arun]]")
+
+	_ = db.CreateTable("orders", ColumnDesc{ColName: "id", ColType: IntColumn})
+	if err = db.RenameTable("users", "orders"); !errors.Is(err, ErrTableExists) {
+		t.Errorf("Want: ErrTableExists Got: %v", err)
+	}
+
+	if err = db.DropTable("users"); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		db.DropTable("users"),
+		db.RenameTable("users", "people"),
+		db.Truncate("users", true),
+	} {
+		if !errors.Is(err, ErrTableNotFound) {
+			t.Errorf("Want: ErrTableNotFound Got: %v", err)
+		}
+	}
+
+	if err = db.ReplaceTable("orders",
+		ColumnDesc{ColName: "user", ColType: IntColumn}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Select("SELECT user FROM orders"); err != nil {
+		t.Error(err)
+	}
+}
+
+// Truncate replaces the rows of a table while they are being inserted,
+// deleted and queried, by the prepared and the cached queries
+func TestTruncateConcurrency(t *testing.T) {
+	db := &Keeri{}
+
+	mustExec(t, db, "CREATE TABLE users (id INT PRIMARY KEY, name TEXT)")
+	stmt, err := db.Prepare("SELECT id, name FROM users WHERE id > ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	worker := func(work func(i int) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 1; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := work(i); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	worker(func(i int) error {
+		return db.Insert("users", i, fmt.Sprint("user", i))
+	})
+	worker(func(i int) error {
+		_, err := db.Exec("DELETE FROM users WHERE id = ?", i/2)
+		return err
+	})
+	worker(func(i int) error {
+		rs, err := stmt.Query(0)
+		if err == nil {
+			for _, row := range rs.Rows {
+				if row[0] == nil || row[1] == nil {
+					return fmt.Errorf("Want: a row that exists Got: %v", row)
+				}
+			}
+		}
+		return err
+	})
+	worker(func(i int) error {
+		rs, err := db.Select("SELECT COUNT(*), MIN(name) FROM users WHERE id > 0")
+		if err == nil && (rs.Rows[0][0] == 0) != (rs.Rows[0][1] == nil) {
+			return fmt.Errorf("Want: the MIN of the rows Got: %v", rs.Rows)
+		}
+		return err
+	})
+
+	for end, i := time.Now().Add(100*time.Millisecond), 0; time.Now().Before(end); i++ {
+		if err = db.Truncate("users", i%2 == 0); err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// The primary key has an entry for every row, and only for them
+	tbl := db.tables["users"]
+	if n, m := len(tbl.indexes[0].entries), len(tbl.liveRows); n != m {
+		t.Errorf("Want: %d entries in the primary key Got: %d", m, n)
+	}
+	if err = db.Truncate("users", true); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, db, "INSERT INTO users VALUES (1, 'a')")
+	checkRows(t, db, "SELECT id, name FROM users WHERE id > 0", "[[1 a]]")
+	if id := tbl.curRowID(); id != 1 {
+		t.Errorf("Want: rowID 1 Got: %d", id)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	db := &Keeri{}
+
+	_ = db.CreateTable("users",
+		ColumnDesc{ColName: "id", ColType: IntColumn},
+		ColumnDesc{ColName: "name", ColType: StringColumn,
+			Collation: UnicodeCollation})
+	_ = db.CreateTable("orders",
+		ColumnDesc{ColName: "user", ColType: IntColumn},
+		ColumnDesc{ColName: "item", ColType: CustomColumn})
+	_ = db.Insert("users", 1, "Sankar")
+	_ = db.Insert("users", 2, "Kumar")
+
+	if tables := fmt.Sprint(db.Tables()); tables != "[orders users]" {
+		t.Errorf("Want: [orders users] Got: %v", tables)
+	}
+
+	s, err := db.Describe("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{users [{id 0 0 true <nil> PLAIN false [] [{2 0 1 2}]} " +
+		"{name 1 1 true <nil> PLAIN false [] [{2 0 Kumar Sankar}]}] " +
+		"[] [] [] false 2}"
+	if fmt.Sprint(s) != want {
+		t.Errorf("Want: %v Got: %v", want, s)
+	}
+	if _, err = db.Describe("nousers"); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("Want: ErrTableNotFound Got: %v", err)
+	}
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT * FROM information_schema.tables",
+			"[[orders BASE TABLE 2 0] [users BASE TABLE 2 2]]"},
+		{`SELECT column_name, data_type, collation_name, is_nullable
+		FROM information_schema.columns WHERE table_name = 'users'
+		ORDER BY ordinal_position DESC`,
+			"[[name TEXT UNICODE YES] [id INT <nil> YES]]"},
+		{`SELECT t.table_name, COUNT(*) FROM information_schema.tables t
+		JOIN information_schema.columns c ON c.table_name = t.table_name
+		WHERE c.data_type != 'CUSTOM' GROUP BY t.table_name`,
+			"[[orders 1] [users 2]]"},
+		{`SELECT columns.column_name FROM information_schema.columns
+		WHERE columns.table_name = 'orders'`, "[[user] [item]]"},
+	}
+
+	for _, i := range cases {
+		t.Log(i.query)
+		rs, err := db.Select(i.query)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fmt.Sprint(rs.Rows) != i.want {
+			t.Errorf("Want: %v Got: %v", i.want, rs.Rows)
+		}
+	}
+
+	// The virtual tables always show the current tables
+	_ = db.DropTable("orders")
+	rs, err := db.Select("SELECT table_name FROM information_schema.tables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(rs.Rows) != "[[users]]" {
+		t.Errorf("Want: [[users]] Got: %v", rs.Rows)
+	}
+
+	if _, err = db.Select("SELECT * FROM information_schema.views"); err == nil {
+		t.Error("No error message for a missing virtual table")
+	}
+	if err = db.CreateTable("information_schema.tables",
+		ColumnDesc{ColName: "id", ColType: IntColumn}); err == nil {
+		t.Error("No error message for a reserved table name")
+	}
+	if err = db.RenameTable("users", "information_schema.users"); err == nil {
+		t.Error("No error message for a reserved table name")
+	}
+}
+
+func TestConstraints(t *testing.T) {
+	db := &Keeri{}
+
+	err := db.CreateTableFromSpec("users", TableSpec{
+		Columns: []ColumnDesc{
+			{ColName: "id", ColType: IntColumn},
+			{ColName: "email", ColType: StringColumn},
+			{ColName: "first", ColType: StringColumn},
+			{ColName: "last", ColType: StringColumn},
+		},
+		PrimaryKey: []string{"id"},
+		Unique:     [][]string{{"email"}, {"first", "last"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = db.Insert("users", 1, "a@x", "Sankar", "S")
+	_ = db.Insert("users", 2, nil, "Kumar", nil)
+	wantConstraintViolation(t, db.Insert("users", 1, "b@x", "Arun", "A"),
+		ErrUniqueViolation, "users_pkey")
+	wantConstraintViolation(t, db.Insert("users", 3, "a@x", "Arun", "A"),
+		ErrUniqueViolation, "users_email_key")
+	wantConstraintViolation(t, db.Insert("users", 3, "b@x", "Sankar", "S"),
+		ErrUniqueViolation, "users_first_last_key")
+	if err = db.Insert("users", nil, "b@x", "Arun", "A"); err == nil {
+		t.Error("No error message for a NULL primary key")
+	}
+	if err = db.Insert("users", 3, "b@x", 5, "A"); err == nil {
+		t.Error("No error message for a mismatched type")
+	}
+
+	// The NULLs are never duplicates
+	if err = db.Insert("users", 3, nil, "Kumar", nil); err != nil {
+		t.Error(err)
+	}
+	checkRows(t, db, "SELECT id FROM users", "[[1] [2] [3]]")
+
+	n, err := db.Update("users", map[string]interface{}{"email": "c@x"}, nil)
+	wantConstraintViolation(t, err, ErrUniqueViolation, "users_email_key")
+	if n != 0 {
+		t.Errorf("Want: 0 rows updated Got: %d", n)
+	}
+	checkRows(t, db, "SELECT email FROM users", "[[a@x] [<nil>] [<nil>]]")
+
+	if err = db.InsertOrReplace("users", 4, "a@x", "Kumar", nil); err != nil {
+		t.Error(err)
+	}
+	checkRows(t, db, "SELECT id, email, first FROM users",
+		"[[2 <nil> Kumar] [3 <nil> Kumar] [4 a@x Kumar]]")
+
+	s, err := db.Describe("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[{users_pkey [id] true} {users_email_key [email] true} " +
+		"{users_first_last_key [first last] true}]"
+	if fmt.Sprint(s.Indexes) != want {
+		t.Errorf("Want: %v Got: %v", want, s.Indexes)
+	}
+	if s.Columns[0].Nullable || !s.Columns[1].Nullable {
+		t.Error("Want: only the primary key column as not nullable")
+	}
+	if err = db.DropColumn("users", "email"); err == nil {
+		t.Error("No error message for dropping a column of a constraint")
+	}
+
+	// The constraints follow a renamed column
+	if err = db.RenameColumn("users", "email", "mail"); err != nil {
+		t.Fatal(err)
+	}
+	wantConstraintViolation(t, db.Insert("users", 5, "a@x", nil, nil),
+		ErrUniqueViolation, "users_email_key")
+
+	if err = db.Truncate("users", false); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Insert("users", 4, "a@x", "Kumar", nil); err != nil {
+		t.Error(err)
+	}
+
+	// Concurrent inserts of the same keys succeed only once per key
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	inserted := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := 100; id < 150; id++ {
+				if db.Insert("users", id, nil, nil, nil) == nil {
+					lock.Lock()
+					inserted++
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if inserted != 50 {
+		t.Errorf("Want: 50 rows inserted Got: %d", inserted)
+	}
+}
+
+func TestUpsertAndUpdate(t *testing.T) {
+	db := &Keeri{}
+
+	wantRowsAffected(t, db, `CREATE TABLE counters (name TEXT PRIMARY KEY, hits INT, note TEXT,
+	UNIQUE (note))`, 0)
+	wantRowsAffected(t, db, "INSERT INTO counters VALUES ('a', 1, NULL), ('b', 2, 'x')", 2)
+
+	// None of the rows of a failing INSERT are inserted
+	if _, err := db.Exec("INSERT INTO counters VALUES ('c', 1, NULL), ('a', 1, NULL)"); !errors.Is(err, ErrUniqueViolation) {
+		t.Errorf("Want: ErrUniqueViolation Got: %v", err)
+	}
+	checkRows(t, db, "SELECT COUNT(*) FROM counters", "[[2]]")
+
+	wantRowsAffected(t, db, "INSERT INTO counters VALUES ('a', 5, NULL), ('c', 1, NULL) "+
+		"ON CONFLICT DO NOTHING", 1)
+	wantRowsAffected(t, db, `INSERT INTO counters (name, hits) VALUES ('a', 5), ('d', 3)
+	ON CONFLICT (name) DO UPDATE SET hits = counters.hits + EXCLUDED.hits,
+	note = UPPER(excluded.name)`, 2)
+	checkRows(t, db, "SELECT name, hits, note FROM counters ORDER BY name",
+		"[[a 6 A] [b 2 x] [c 1 <nil>] [d 3 <nil>]]")
+
+	// A DO UPDATE does not update a row that the INSERT has already
+	// inserted or updated, and fails the INSERT instead
+	for _, values := range []string{"('b', 1), ('e', 1), ('b', 2)", "('e', 1), ('e', 2)"} {
+		_, err := db.Exec("INSERT INTO counters (name, hits) VALUES " + values +
+			" ON CONFLICT (name) DO UPDATE SET hits = counters.hits + excluded.hits")
+		if err == nil || !strings.Contains(err.Error(), "row a second time") {
+			t.Errorf("Want: cannot affect row a second time Got: %v", err)
+		}
+	}
+	checkRows(t, db, "SELECT name, hits, note FROM counters ORDER BY name",
+		"[[a 6 A] [b 2 x] [c 1 <nil>] [d 3 <nil>]]")
+
+	// A conflict on another constraint than the one in the ON CONFLICT
+	if _, err := db.Exec("INSERT INTO counters VALUES ('e', 1, 'x') " +
+		"ON CONFLICT (name) DO NOTHING"); !errors.Is(err, ErrUniqueViolation) {
+		t.Errorf("Want: ErrUniqueViolation Got: %v", err)
+	}
+
+	wantRowsAffected(t, db, "UPDATE counters SET hits = hits * 10, note = NULL WHERE hits > ?", 2, 2)
+	wantRowsAffected(t, db, "UPDATE counters SET hits = LENGTH(name) WHERE name = :n", 1,
+		map[string]interface{}{"n": "b"})
+	checkRows(t, db, "SELECT name, hits, note FROM counters ORDER BY name",
+		"[[a 60 <nil>] [b 1 x] [c 1 <nil>] [d 30 <nil>]]")
+
+	// An UPDATE that fails on any row updates none of them
+	if _, err := db.Exec("UPDATE counters SET name = 'z' WHERE hits < 50"); !errors.Is(err, ErrUniqueViolation) {
+		t.Errorf("Want: ErrUniqueViolation Got: %v", err)
+	}
+	checkRows(t, db, "SELECT name FROM counters ORDER BY name", "[[a] [b] [c] [d]]")
+
+	// A prepared query sees the updated rows
+	checkRows(t, db, "SELECT name FROM counters WHERE hits = 1", "[[b] [c]]")
+	wantRowsAffected(t, db, "UPDATE counters SET hits = 2", 4)
+	checkRows(t, db, "SELECT name FROM counters WHERE hits = 1", "[]")
+
+	for _, sql := range []string{
+		"UPDATE counters SET hits = 'many'",
+		"UPDATE counters SET nohits = 1",
+		"UPDATE counters SET hits = 1 WHERE nohits = 1",
+		"UPDATE nocounters SET hits = 1",
+		"INSERT INTO counters VALUES ('a', 1, NULL) ON CONFLICT (hits) DO NOTHING",
+		"INSERT INTO counters VALUES ('a', 1, NULL) ON CONFLICT DO UPDATE SET hits = excluded.nohits",
+		"CREATE TABLE t (id INT, UNIQUE (noid))",
+	} {
+		t.Log(sql)
+		if _, err := db.Exec(sql); err == nil {
+			t.Error("No error message for a wrong statement")
+		}
+	}
+}
+
+func TestCheckAndNotNull(t *testing.T) {
+	db := &Keeri{}
+
+	err := db.CreateTableFromSpec("items", TableSpec{
+		Columns: []ColumnDesc{
+			{ColName: "name", ColType: StringColumn, NotNull: true},
+			{ColName: "price", ColType: IntColumn, Default: 10},
+			{ColName: "discount", ColType: IntColumn},
+		},
+		Checks: []Check{
+			{Cond: "price > 0"},
+			{Name: "fair", Cond: "discount BETWEEN 0 AND price"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A NULL in the condition of a check does not violate it
+	if err = db.InsertNamed("items", map[string]interface{}{"name": "pen"}); err != nil {
+		t.Error(err)
+	}
+	if err = db.Insert("items", "ink", 5, 5); err != nil {
+		t.Error(err)
+	}
+	wantConstraintViolation(t, db.InsertNamed("items", nil),
+		ErrNotNullViolation, "items.name NOT NULL")
+	wantConstraintViolation(t, db.Insert("items", "cap", 0, nil),
+		ErrCheckViolation, "items_check")
+	wantConstraintViolation(t, db.Insert("items", "cap", 5, 6),
+		ErrCheckViolation, "fair")
+	if err = db.InsertNamed("items", map[string]interface{}{"nonname": 1}); err == nil {
+		t.Error("No error message for an invalid column name")
+	}
+	checkRows(t, db, "SELECT name, price, discount FROM items", "[[pen 10 <nil>] [ink 5 5]]")
+
+	// An update that violates a check on any row updates none of them
+	n, err := db.Update("items", map[string]interface{}{"price": 3}, nil)
+	wantConstraintViolation(t, err, ErrCheckViolation, "fair")
+	if n != 0 {
+		t.Errorf("Want: 0 rows updated Got: %d", n)
+	}
+	checkRows(t, db, "SELECT price FROM items", "[[10] [5]]")
+
+	// The checks follow a renamed column
+	if err = db.RenameColumn("items", "discount", "off"); err != nil {
+		t.Fatal(err)
+	}
+	wantConstraintViolation(t, db.Insert("items", "cap", 5, -1),
+		ErrCheckViolation, "fair")
+	if err = db.DropColumn("items", "off"); err == nil {
+		t.Error("No error message for dropping a column of a check")
+	}
+
+	wantConstraintViolation(t, db.AddColumn("items", ColumnDesc{ColName: "qty",
+		ColType: IntColumn, NotNull: true}, nil), ErrNotNullViolation,
+		"items.qty NOT NULL")
+	if err = db.AddColumn("items", ColumnDesc{ColName: "qty",
+		ColType: IntColumn, NotNull: true}, 1); err != nil {
+		t.Error(err)
+	}
+
+	s, err := db.Describe("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[{name 1 0 false <nil> PLAIN false [] [{2 0 ink pen}]} " +
+		"{price 0 0 true 10 PLAIN false [] [{2 0 3 10}]} " +
+		"{off 0 0 true <nil> PLAIN false [] [{1 1 5 5}]} " +
+		"{qty 0 0 false <nil> PLAIN false [] [{2 0 1 1}]}] " +
+		"[{items_check (price > 0)} " +
+		"{fair (off BETWEEN 0 AND price)}]"
+	if got := fmt.Sprint(s.Columns, " ", s.Checks); got != want {
+		t.Errorf("Want: %v Got: %v", want, got)
+	}
+
+	for _, spec := range []TableSpec{
+		{Columns: []ColumnDesc{{ColName: "n", ColType: IntColumn, Default: "x"}}},
+		{Columns: []ColumnDesc{{ColName: "n", ColType: IntColumn}},
+			Checks: []Check{{Cond: "m > 0"}}},
+		{Columns: []ColumnDesc{{ColName: "n", ColType: IntColumn}},
+			Checks: []Check{{Cond: "n + 1"}}},
+		{Columns: []ColumnDesc{{ColName: "n", ColType: IntColumn}},
+			Checks: []Check{{Name: "c", Cond: "n > 0"}, {Name: "c", Cond: "n < 9"}}},
+	} {
+		if err = db.CreateTableFromSpec("t", spec); err == nil {
+			t.Errorf("No error message for %v", spec)
+		}
+	}
+
+	_, err = db.Exec(`CREATE TABLE orders (id INT PRIMARY KEY,
+	status TEXT DEFAULT 'new' NOT NULL CHECK (status IN ('new', 'paid')),
+	ttl INT DEFAULT ? * 60, qty INT NOT NULL,
+	CONSTRAINT positive CHECK (qty > 0 AND NOT qty > 100))`, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustExec(t, db, "INSERT INTO orders (id, qty) VALUES (1, 1), (2, 5)")
+	mustExec(t, db, "INSERT INTO orders VALUES (3, 'paid', NULL, 100)")
+	_, err = db.Exec("INSERT INTO orders (id, qty) VALUES (4, 1), (5, 101)")
+	wantConstraintViolation(t, err, ErrCheckViolation, "positive")
+	_, err = db.Exec("INSERT INTO orders (id, status, qty) VALUES (4, 'lost', 1)")
+	wantConstraintViolation(t, err, ErrCheckViolation, "orders_check")
+	_, err = db.Exec("INSERT INTO orders (id, status, qty) VALUES (4, NULL, 1)")
+	wantConstraintViolation(t, err, ErrNotNullViolation, "orders.status NOT NULL")
+	_, err = db.Exec("INSERT INTO orders (qty) VALUES (1)")
+	wantConstraintViolation(t, err, ErrNotNullViolation, "orders_pkey")
+	_, err = db.Exec("UPDATE orders SET qty = qty * 50")
+	wantConstraintViolation(t, err, ErrCheckViolation, "positive")
+	checkRows(t, db, "SELECT id, status, ttl, qty FROM orders",
+		"[[1 new 120 1] [2 new 120 5] [3 paid <nil> 100]]")
+
+	mustExec(t, db, "ALTER TABLE orders ADD note TEXT NOT NULL DEFAULT UPPER('none')")
+	mustExec(t, db, "INSERT INTO orders (id, qty) VALUES (4, 1)")
+	checkRows(t, db, "SELECT note FROM orders WHERE id IN (1, 4)", "[[NONE] [NONE]]")
+
+	// The NOT NULL of a column is named after the table, as it is now
+	mustExec(t, db, "ALTER TABLE orders RENAME TO invoices")
+	_, err = db.Exec("UPDATE invoices SET qty = NULL WHERE id = 4")
+	wantConstraintViolation(t, err, ErrNotNullViolation, "invoices.qty NOT NULL")
+	if err == nil || !strings.Contains(err.Error(), "'invoices.qty NOT NULL' on (qty)") {
+		t.Errorf("Want: 'invoices.qty NOT NULL' on (qty) Got: %v", err)
+	}
+}
+
+func TestForeignKeys(t *testing.T) {
+	db := &Keeri{}
+
+	mustExec(t, db, "CREATE TABLE customers (id INT PRIMARY KEY, name TEXT)")
+	mustExec(t, db, `CREATE TABLE orders (id INT PRIMARY KEY,
+	customer INT REFERENCES customers)`)
+	mustExec(t, db, `CREATE TABLE items (order_id INT, line INT, PRIMARY KEY (order_id, line),
+	CONSTRAINT item_order FOREIGN KEY (order_id) REFERENCES orders (id)
+	ON DELETE CASCADE)`)
+	mustExec(t, db, `CREATE TABLE notes (item_order INT, item_line INT, note TEXT,
+	FOREIGN KEY (item_line, item_order) REFERENCES items (line, order_id)
+	ON DELETE SET NULL)`)
+
+	mustExec(t, db, "INSERT INTO customers VALUES (1, 'a'), (2, 'b')")
+	mustExec(t, db, "INSERT INTO orders VALUES (10, 1), (11, 1), (12, NULL)")
+	mustExec(t, db, "INSERT INTO items VALUES (10, 1), (10, 2), (11, 1)")
+	mustExec(t, db, "INSERT INTO notes VALUES (10, 1, 'x'), (10, 2, 'y'), (11, 1, 'z')")
+
+	_, err := db.Exec("INSERT INTO orders VALUES (13, 2), (14, 3)")
+	wantConstraintViolation(t, err, ErrForeignKeyViolation, "orders_customer_fkey")
+	wantConstraintViolation(t, db.Insert("notes", 11, 2, "w"),
+		ErrForeignKeyViolation, "notes_item_line_item_order_fkey")
+	checkRows(t, db, "SELECT COUNT(*) FROM orders", "[[3]]")
+
+	// The rows that are referred to can not be deleted or changed
+	_, err = db.Exec("DELETE FROM customers WHERE name = 'a'")
+	wantConstraintViolation(t, err, ErrForeignKeyViolation, "orders_customer_fkey")
+	_, err = db.Update("customers", map[string]interface{}{"id": 3}, nil)
+	wantConstraintViolation(t, err, ErrForeignKeyViolation, "orders_customer_fkey")
+	wantConstraintViolation(t, db.InsertOrReplace("customers", 1, "c"),
+		ErrForeignKeyViolation, "orders_customer_fkey")
+	wantRowsAffected(t, db, "UPDATE customers SET name = 'c' WHERE id = 1", 1)
+	wantRowsAffected(t, db, "DELETE FROM customers WHERE id = ?", 1, 2)
+	checkRows(t, db, "SELECT id, name FROM customers", "[[1 c]]")
+
+	// The deletes cascade to the items, whose notes lose their items
+	wantRowsAffected(t, db, "DELETE FROM orders WHERE id = 10", 1)
+	checkRows(t, db, "SELECT order_id, line FROM items", "[[11 1]]")
+	checkRows(t, db, "SELECT item_order, item_line, note FROM notes",
+		"[[<nil> <nil> x] [<nil> <nil> y] [11 1 z]]")
+
+	// A delete that fails on a cascaded row deletes nothing
+	if err = db.CreateTableFromSpec("audits", TableSpec{
+		Columns: []ColumnDesc{
+			{ColName: "order_id", ColType: IntColumn, NotNull: true},
+		},
+		ForeignKeys: []ForeignKey{{Columns: []string{"order_id"},
+			RefTable: "orders", OnDelete: SetNull}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, db, "INSERT INTO audits VALUES (11)")
+	if _, err = db.Delete("orders", nil); !errors.Is(err, ErrNotNullViolation) {
+		t.Errorf("Want: ErrNotNullViolation Got: %v", err)
+	}
+	checkRows(t, db, "SELECT id FROM orders", "[[11] [12]]")
+	checkRows(t, db, "SELECT order_id, line FROM items", "[[11 1]]")
+
+	for _, err = range []error{
+		db.DropTable("customers"),
+		db.Truncate("orders", false),
+		db.ReplaceTable("items", ColumnDesc{ColName: "id", ColType: IntColumn}),
+		db.DropColumn("notes", "item_line"),
+		db.CreateTableFromSpec("t", TableSpec{
+			Columns:     []ColumnDesc{{ColName: "c", ColType: StringColumn}},
+			ForeignKeys: []ForeignKey{{Columns: []string{"c"}, RefTable: "customers"}},
+		}),
+		db.CreateTableFromSpec("t", TableSpec{
+			Columns:     []ColumnDesc{{ColName: "c", ColType: StringColumn}},
+			ForeignKeys: []ForeignKey{{Columns: []string{"c"}, RefTable: "nocustomers"}},
+		}),
+		db.CreateTableFromSpec("t", TableSpec{
+			Columns: []ColumnDesc{{ColName: "c", ColType: StringColumn}},
+			ForeignKeys: []ForeignKey{{Columns: []string{"c"},
+				RefTable: "customers", RefColumns: []string{"name"}}},
+		}),
+	} {
+		if err == nil {
+			t.Error("No error message for a table with foreign keys")
+		}
+	}
+
+	// The foreign keys follow the renamed tables and columns
+	if err = db.RenameTable("customers", "clients"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.RenameColumn("clients", "id", "client_id"); err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.Describe("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[{orders_customer_fkey [customer] clients [client_id] RESTRICT}]"
+	if fmt.Sprint(s.ForeignKeys) != want {
+		t.Errorf("Want: %v Got: %v", want, s.ForeignKeys)
+	}
+	wantConstraintViolation(t, db.Insert("orders", 13, 2),
+		ErrForeignKeyViolation, "orders_customer_fkey")
+
+	// The child tables can be dropped before their parents
+	for _, name := range []string{"audits", "notes", "items", "orders", "clients"} {
+		if err = db.DropTable(name); err != nil {
+			t.Error(err)
+		}
+	}
+
+	mustExec(t, db, `CREATE TABLE staff (id INT PRIMARY KEY,
+	manager INT REFERENCES staff ON DELETE CASCADE)`)
+	mustExec(t, db, "INSERT INTO staff VALUES (1, 1), (2, 1), (3, 2), (4, NULL)")
+	_, err = db.Exec("INSERT INTO staff VALUES (5, 6)")
+	wantConstraintViolation(t, err, ErrForeignKeyViolation, "staff_manager_fkey")
+	wantRowsAffected(t, db, "DELETE FROM staff WHERE id IN (1, 3)", 1)
+	checkRows(t, db, "SELECT id FROM staff", "[[4]]")
+}
+
+func TestForeignKeysConcurrency(t *testing.T) {
+	db := &Keeri{}
+
+	for _, sql := range []string{
+		"CREATE TABLE parents (id INT PRIMARY KEY)",
+		"CREATE TABLE children (parent INT REFERENCES parents ON DELETE CASCADE)",
+		"CREATE TABLE toys (parent INT REFERENCES parents ON DELETE SET NULL)",
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The writes to the parents lock the children too, while the writes
+	// to the children lock the parents, always in the same order
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			for id := 0; id < 50; id++ {
+				_ = db.Insert("parents", id)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for id := 0; id < 50; id++ {
+				_ = db.Insert("children", id)
+				_ = db.Insert("toys", id)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for id := 0; id < 50; id += 2 {
+				_, _ = db.Exec("DELETE FROM parents WHERE id = ?", id)
+				_, _ = db.Describe("children")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	rs, err := db.Select("SELECT parent FROM children")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parents, err := db.Select("SELECT id FROM parents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := make(map[int]bool)
+	for _, row := range parents.Rows {
+		live[row[0].(int)] = true
+	}
+	for _, row := range rs.Rows {
+		if id := row[0].(int); !live[id] {
+			t.Errorf("Want: no child of the deleted parent %d", id)
+		}
+	}
+}
+
+func TestAutoIncrementAndSequences(t *testing.T) {
+	db := &Keeri{}
+
+	mustExec(t, db, "CREATE TABLE users (id SERIAL PRIMARY KEY, name TEXT UNIQUE)")
+	row, err := db.InsertReturning("users", nil, "a")
+	if err != nil || fmt.Sprint(row) != "[1 a]" {
+		t.Errorf("Want: [1 a] Got: %v %v", row, err)
+	}
+	if err = db.InsertNamed("users", map[string]interface{}{
+		"name": "b"}); err != nil {
+		t.Error(err)
+	}
+	if err = db.Insert("users", 10, "c"); err != nil {
+		t.Error(err)
+	}
+
+	// The values that were taken by a failed insert are not reused
+	res, err := db.Exec("INSERT INTO users (name) VALUES ('d'), ('a')")
+	if !errors.Is(err, ErrUniqueViolation) {
+		t.Errorf("Want: %v Got: %v", ErrUniqueViolation, err)
+	}
+	res = mustExec(t, db, "INSERT INTO users (name) VALUES ('e'), ('f') RETURNING id")
+	if fmt.Sprint(res.RowsAffected, res.Returning.Columns, res.Returning.Rows) !=
+		"2 [{id 0}] [[13] [14]]" {
+		t.Errorf("Want: 2 rows Got: %v", res.Returning)
+	}
+	res = mustExec(t, db, `INSERT INTO users (name) VALUES ('g'), ('e') ON CONFLICT (name)
+	DO UPDATE SET name = 'h' RETURNING *`)
+	if fmt.Sprint(res.Returning.Rows) != "[[15 g] [13 h]]" {
+		t.Errorf("Want: [[15 g] [13 h]] Got: %v", res.Returning.Rows)
+	}
+	checkRows(t, db, "SELECT id, name FROM users ORDER BY id",
+		"[[1 a] [2 b] [10 c] [13 h] [14 f] [15 g]]")
+
+	if err = db.Truncate("users", true); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, db, "INSERT INTO users (name) VALUES ('a')")
+	checkRows(t, db, "SELECT id FROM users", "[[1]]")
+
+	// The sequences are shared by the tables
+	mustExec(t, db, "CREATE SEQUENCE ids START WITH 100 INCREMENT BY -10")
+	mustExec(t, db, `CREATE TABLE orders (id INT DEFAULT NEXTVAL('ids'),
+	n INT AUTO_INCREMENT)`)
+	mustExec(t, db, "INSERT INTO orders (n) VALUES (NULL), (5), (NULL)")
+	mustExec(t, db, "INSERT INTO orders VALUES (NEXTVAL('ids'), NULL)")
+	if err = db.Insert("orders", NextVal("ids"), nil); err != nil {
+		t.Error(err)
+	}
+	checkRows(t, db, "SELECT id, n FROM orders", "[[100 1] [90 5] [80 6] [70 7] [60 8]]")
+	if v, err := db.NextValue("ids"); v != 50 || err != nil {
+		t.Errorf("Want: 50 Got: %v %v", v, err)
+	}
+
+	if _, err = db.Exec("CREATE SEQUENCE ids"); !errors.Is(err,
+		ErrSequenceExists) {
+		t.Errorf("Want: %v Got: %v", ErrSequenceExists, err)
+	}
+	mustExec(t, db, "CREATE SEQUENCE IF NOT EXISTS ids")
+
+	// A sequence that is the DEFAULT of a column can not be dropped,
+	// and a NEXTVAL is only for the values of an INSERT
+	if _, err = db.Exec("DROP SEQUENCE ids"); !errors.Is(err,
+		ErrSequenceInUse) || !strings.Contains(err.Error(), "orders.id") {
+		t.Errorf("Want: %v of orders.id Got: %v", ErrSequenceInUse, err)
+	}
+	_, err = db.Exec("UPDATE orders SET id = NEXTVAL('ids')")
+	errs := []error{err}
+	for _, query := range []string{
+		"SELECT NEXTVAL('ids') FROM orders",
+		"SELECT n FROM orders WHERE id < NEXTVAL('ids')",
+	} {
+		_, err = db.Select(query)
+		errs = append(errs, err)
+	}
+	for _, err := range errs {
+		if err == nil || !strings.Contains(err.Error(),
+			"NEXTVAL is allowed only") {
+			t.Errorf("Want: NEXTVAL is allowed only... Got: %v", err)
+		}
+	}
+	checkRows(t, db, "SELECT id, n FROM orders", "[[100 1] [90 5] [80 6] [70 7] [60 8]]")
+
+	mustExec(t, db, "ALTER TABLE orders ADD COLUMN m INT DEFAULT NEXTVAL('ids')")
+	mustExec(t, db, "ALTER TABLE orders DROP COLUMN id")
+	if _, err = db.Exec("DROP SEQUENCE ids"); !errors.Is(err,
+		ErrSequenceInUse) || !strings.Contains(err.Error(), "orders.m") {
+		t.Errorf("Want: %v of orders.m Got: %v", ErrSequenceInUse, err)
+	}
+	mustExec(t, db, "ALTER TABLE orders DROP COLUMN m")
+	mustExec(t, db, "DROP SEQUENCE ids")
+	mustExec(t, db, "DROP SEQUENCE IF EXISTS ids")
+	if _, err = db.Exec("INSERT INTO orders VALUES (NEXTVAL('ids'))"); !errors.Is(err,
+		ErrSequenceNotFound) {
+		t.Errorf("Want: %v Got: %v", ErrSequenceNotFound, err)
+	}
+	checkRows(t, db, "SELECT COUNT(*) FROM orders", "[[5]]")
+
+	errs = []error{
+		db.CreateTable("t", ColumnDesc{ColName: "id", ColType: StringColumn,
+			AutoIncrement: true}),
+		db.CreateTable("t", ColumnDesc{ColName: "id", ColType: IntColumn,
+			Default: NextVal("ids")}),
+		db.CreateTable("t", ColumnDesc{ColName: "id", ColType: IntColumn,
+			AutoIncrement: true, Default: 1}),
+		db.AddColumn("users", ColumnDesc{ColName: "n", ColType: IntColumn,
+			AutoIncrement: true}, nil),
+		db.CreateSequence("s", 1, 0),
+	}
+	for _, err := range errs {
+		if err == nil {
+			t.Error("Want: an error Got: nil")
+		}
+	}
+}
+
+func TestDictionaryEncoding(t *testing.T) {
+	db := &Keeri{}
+
+	// The same rows, in a dictionary encoded and in a plain column
+	mustExec(t, db, "CREATE TABLE dict (id INT, s TEXT COLLATE UNICODE ENCODING DICTIONARY)")
+	mustExec(t, db, "CREATE TABLE plain (id INT, s TEXT COLLATE UNICODE ENCODING PLAIN)")
+	values := []interface{}{"b", "a", nil, "Ä", "c", "a", "b", "a"}
+	for _, tbl := range []string{"dict", "plain"} {
+		for k, v := range values {
+			if err := db.Insert(tbl, k, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mustExec(t, db, "UPDATE "+tbl+" SET s = 'd' WHERE id = 4")
+		mustExec(t, db, "DELETE FROM "+tbl+" WHERE id = 0")
+	}
+
+	queries := []string{
+		"SELECT id FROM %s WHERE s = 'a' ORDER BY id",
+		"SELECT id FROM %s WHERE s = 'x' ORDER BY id",
+		"SELECT id FROM %s WHERE s != 'a' ORDER BY id",
+		"SELECT id FROM %s WHERE s IN ('b', 'd') ORDER BY id",
+		"SELECT id FROM %s WHERE s NOT IN ('b', 'd') ORDER BY id",
+		"SELECT id FROM %s WHERE s > 'a' ORDER BY id",
+		"SELECT id FROM %s WHERE s BETWEEN 'a' AND 'b' ORDER BY id",
+		"SELECT id FROM %s WHERE s LIKE 'ä%%' ORDER BY id",
+		"SELECT id FROM %s WHERE s NOT LIKE 'a%%' ORDER BY id",
+		"SELECT id FROM %s WHERE s = 'a' OR UPPER(s) = 'B' ORDER BY id",
+		"SELECT s, COUNT(*) FROM %s GROUP BY s ORDER BY s",
+		"SELECT COUNT(DISTINCT s), MIN(s), MAX(s) FROM %s",
+		"SELECT DISTINCT s FROM %s ORDER BY s",
+	}
+	for _, q := range queries {
+		var got []string
+		for _, tbl := range []string{"dict", "plain"} {
+			rs, err := db.Select(fmt.Sprintf(q, tbl))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, fmt.Sprint(rs.Rows))
+		}
+		if got[0] != got[1] {
+			t.Errorf("%s Want: %v Got: %v", q, got[1], got[0])
+		}
+	}
+
+	rows, err := db.QueryDistinct("dict", []string{"s"}, nil)
+	if err != nil || len(rows) != 5 {
+		t.Errorf("Want: 5 distinct values Got: %v %v", rows, err)
+	}
+
+	// The codes of the values that are not in any row are reused
+	mustExec(t, db, "UPDATE dict SET s = 'e'")
+	mustExec(t, db, "UPDATE dict SET s = 'f'")
+	d := db.tables["dict"].cols["s"].(*dictColumn)
+	if len(d.lookup) != 1 || len(d.values) != 5 {
+		t.Errorf("Want: 1 value in 5 codes Got: %v in %v", d.lookup, d.values)
+	}
+
+	// An AutoEncoding column is encoded once it has enough rows with
+	// few distinct values, and goes back to plain strings when the
+	// values become mostly different
+	mustExec(t, db, "CREATE TABLE auto (s TEXT)")
+	encoding := func(want Encoding) {
+		t.Helper()
+		s, err := db.Describe("auto")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Columns[0].Encoding != want {
+			t.Errorf("Want: %v Got: %v", want, s.Columns[0].Encoding)
+		}
+	}
+	// The cached statement is run across the changes of the encoding
+	count := func(want int) {
+		t.Helper()
+		checkRows(t, db, "SELECT COUNT(*) FROM auto WHERE s = '1'",
+			fmt.Sprintf("[[%d]]", want))
+	}
+	for i := 0; i < dictMinRows; i++ {
+		if i == dictMinRows-1 {
+			encoding(PlainEncoding)
+		}
+		if err = db.Insert("auto", fmt.Sprint(i%4)); err != nil {
+			t.Fatal(err)
+		}
+		if i >= dictMinRows-4 {
+			count((i + 3) / 4)
+		}
+	}
+	encoding(DictionaryEncoding)
+	for i := 0; i < dictMinRows; i++ {
+		if err = db.Insert("auto", fmt.Sprint("v", i)); err != nil {
+			t.Fatal(err)
+		}
+		if i >= dictMinRows-4 {
+			count(256)
+		}
+	}
+	encoding(PlainEncoding)
+	count(256)
+
+	// A column that stays plain does not make the plans again
+	mustExec(t, db, "CREATE TABLE mixed (s TEXT)")
+	query := "SELECT COUNT(*) FROM mixed WHERE s = 'v1'"
+	checkRows(t, db, query, "[[0]]")
+	stmt, err := db.stmts.get(db, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := stmt.plans[0]
+	for i := 0; i < dictMinRows; i++ {
+		if err = db.Insert("mixed", fmt.Sprint("v", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRows(t, db, query, "[[1]]")
+	if len(stmt.plans) != 1 || stmt.plans[0] != p {
+		t.Error("Want: the same plan for an unchanged encoding")
+	}
+}
+
+func TestAppendOnlySegments(t *testing.T) {
+	db := &Keeri{}
+
+	// The same rows, in an append-only and in a plain table
+	cols := "(id INT, run INT, r INT, kind TEXT, name TEXT)"
+	mustExec(t, db, "CREATE TABLE segs "+cols+" APPEND ONLY")
+	mustExec(t, db, "CREATE TABLE plain "+cols)
+	var extra []interface{}
+	insert := func(tbl string, from, to int) {
+		t.Helper()
+		for k := from; k < to; k++ {
+			var r, kind interface{}
+			if k%10 != 3 {
+				r = 1000000 + k*7919%13
+			}
+			if k%17 != 0 {
+				kind = []string{"click", "view", "buy"}[k*k%3]
+			}
+			row := []interface{}{k, k / 300, r, kind,
+				fmt.Sprintf("user-%06d", k)}
+			err := db.Insert(tbl, append(row, extra...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	n := 2*segmentRows + 500
+	insert("segs", 0, n)
+	insert("plain", 0, n)
+
+	queries := []string{
+		"SELECT id FROM %s WHERE id = 1500",
+		"SELECT id FROM %s WHERE id < 5 OR id >= 2545 ORDER BY id",
+		"SELECT id FROM %s WHERE id BETWEEN 1020 AND 1030 ORDER BY id",
+		"SELECT id FROM %s WHERE id IN (5, 1023, 1024, 2100, 9999) ORDER BY id",
+		"SELECT COUNT(*) FROM %s WHERE id NOT IN (5, 1024)",
+		"SELECT COUNT(*), MIN(id), MAX(id) FROM %s WHERE run = 3",
+		"SELECT COUNT(*) FROM %s WHERE run != 3 AND run <= 5",
+		"SELECT COUNT(*) FROM %s WHERE r = 1000005",
+		"SELECT id FROM %s WHERE r > 1000011 AND id < 100 ORDER BY id",
+		"SELECT COUNT(*), SUM(r) FROM %s WHERE r BETWEEN 1000002 AND 1000004",
+		"SELECT COUNT(*) FROM %s WHERE r < 1000000",
+		"SELECT COUNT(*) FROM %s WHERE kind = 'buy'",
+		"SELECT COUNT(*) FROM %s WHERE kind > 'click'",
+		"SELECT COUNT(*) FROM %s WHERE kind LIKE 'v%%'",
+		"SELECT COUNT(*) FROM %s WHERE kind IN ('buy', 'none')",
+		"SELECT id FROM %s WHERE name = 'user-001500'",
+		"SELECT id FROM %s WHERE name < 'user-000003' ORDER BY id",
+		"SELECT id FROM %s WHERE name LIKE 'user-00204%%' ORDER BY id",
+		"SELECT COUNT(*) FROM %s WHERE name != 'user-000007'",
+		"SELECT kind, COUNT(*), COUNT(r), SUM(r) FROM %s " +
+			"GROUP BY kind ORDER BY kind",
+		"SELECT MIN(name), MAX(name), COUNT(DISTINCT kind) FROM %s",
+		"SELECT id, run, r, kind, name FROM %s WHERE id IN (0, 3, 1023) " +
+			"ORDER BY id",
+	}
+	compare := func() {
+		t.Helper()
+		for _, q := range queries {
+			var got []string
+			for _, tbl := range []string{"segs", "plain"} {
+				rs, err := db.Select(fmt.Sprintf(q, tbl))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, fmt.Sprint(rs.Rows))
+			}
+			if got[0] != got[1] {
+				t.Errorf("%s Want: %v Got: %v", q, got[1], got[0])
+			}
+		}
+	}
+	compare()
+
+	// Every column is encoded in the encoding that suits its values
+	s, err := db.Describe("segs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range s.Columns {
+		got = append(got, fmt.Sprintf("%d %s", len(c.Segments),
+			c.Segments[0].Encoding))
+	}
+	want := "[2 DELTA 2 RLE 2 FOR 2 DICTIONARY 2 FRONT]"
+	if !s.AppendOnly || fmt.Sprint(got) != want {
+		t.Errorf("Want: %v Got: %v", want, got)
+	}
+	g := s.Columns[0].Segments[1]
+	if g.Rows != segmentRows || g.Min != segmentRows || g.Max != 2047 {
+		t.Errorf("Want: the rows 1024 to 2047 Got: %v", g)
+	}
+
+	// The rows can not be changed, other than by truncating the table
+	if _, err = db.Exec("UPDATE segs SET r = 1 WHERE id = 1"); !errors.Is(
+		err, ErrAppendOnly) {
+		t.Errorf("Want: %v Got: %v", ErrAppendOnly, err)
+	}
+	if _, err = db.Delete("segs", nil); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf("Want: %v Got: %v", ErrAppendOnly, err)
+	}
+	compare()
+
+	mustExec(t, db, "TRUNCATE segs")
+	mustExec(t, db, "TRUNCATE plain")
+	insert("segs", 0, segmentRows+10)
+	insert("plain", 0, segmentRows+10)
+	compare()
+
+	// The rowIDs continue after the truncated rows, which are in the
+	// first two chunks and leave no segments or zones behind, even for
+	// a column that is added after the table was truncated
+	mustExec(t, db, "ALTER TABLE segs ADD extra INT DEFAULT 7")
+	mustExec(t, db, "ALTER TABLE plain ADD extra INT DEFAULT 7")
+	extra = []interface{}{8}
+	insert("segs", segmentRows+10, 2*segmentRows)
+	insert("plain", segmentRows+10, 2*segmentRows)
+	compare()
+
+	for _, tbl := range []string{"plain", "segs"} {
+		if s, err = db.Describe(tbl); err != nil {
+			t.Fatal(err)
+		}
+		got = nil
+		for _, c := range s.Columns {
+			got = append(got, fmt.Sprintf("%d %d", len(c.Segments),
+				len(c.Zones)))
+		}
+		want = "[2 3 2 3 2 3 2 3 2 3 2 3]"
+		if tbl == "plain" {
+			want = "[0 3 0 3 0 3 0 3 0 3 0 3]"
+		}
+		if fmt.Sprint(got) != want {
+			t.Errorf("%s Want: %v Got: %v", tbl, want, got)
+		}
+	}
+	g = s.Columns[0].Segments[0]
+	if g.Rows != 524 || g.Min != 0 || g.Max != 523 {
+		t.Errorf("Want: the rows 0 to 523 Got: %v", g)
+	}
+	checkRows(t, db, "SELECT COUNT(*), MIN(extra) FROM segs WHERE id < 600",
+		"[[600 7]]")
+	checkRows(t, db, "SELECT COUNT(*) FROM segs WHERE extra = 8", "[[1014]]")
+}
+
+func TestZoneMaps(t *testing.T) {
+	db := &Keeri{}
+	_, err := db.Exec("CREATE TABLE events (ts INT, name TEXT, v INT)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rows are ordered by ts and by name, as in a log of events
+	n := 5*zoneRows + 100
+	ts := make(map[int]int)
+	for k := 0; k < n; k++ {
+		ts[k] = 1000 + 10*k
+		var v interface{}
+		if k%5 != 0 {
+			v = k % 7
+		}
+		err := db.Insert("events", ts[k], fmt.Sprintf("e%05d", k), v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stmt, err := db.Prepare("SELECT COUNT(*), SUM(ts) FROM events WHERE ts >= ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		cond  string
+		match func(k, ts int) bool
+	}{
+		{"ts > 1000 + 10 * 5100", func(k, ts int) bool { return ts > 52000 }},
+		{"ts < 1100", func(k, ts int) bool { return ts < 1100 }},
+		{"ts <= 1100", func(k, ts int) bool { return ts <= 1100 }},
+		{"ts = 31000", func(k, ts int) bool { return ts == 31000 }},
+		{"ts = 31001", func(k, ts int) bool { return false }},
+		{"ts BETWEEN 11230 AND 21230", func(k, ts int) bool {
+			return ts >= 11230 && ts <= 21230
+		}},
+		{"name >= 'e05000'", func(k, ts int) bool { return k >= 5000 }},
+		{"name BETWEEN 'e01000' AND 'e01010'", func(k, ts int) bool {
+			return k >= 1000 && k <= 1010
+		}},
+		{"ts > 50000 AND v = 3", func(k, ts int) bool {
+			return ts > 50000 && k%5 != 0 && k%7 == 3
+		}},
+		{"v < 1", func(k, ts int) bool { return k%5 != 0 && k%7 == 0 }},
+	}
+	check := func() {
+		t.Helper()
+		for _, c := range cases {
+			count, sum := 0, 0
+			for k, v := range ts {
+				if c.match(k, v) {
+					count++
+					sum += v
+				}
+			}
+			want := fmt.Sprint([][]interface{}{{count, sum}})
+			if count == 0 {
+				want = "[[0 <nil>]]"
+			}
+			rs, err := db.Select("SELECT COUNT(*), SUM(ts) FROM events WHERE " +
+				c.cond)
+			if err != nil || fmt.Sprint(rs.Rows) != want {
+				t.Errorf("%s Want: %v Got: %v %v", c.cond, want, rs, err)
+			}
+		}
+
+		// A prepared query skips the blocks by the value of its parameter
+		count, sum := 0, 0
+		for _, v := range ts {
+			if v >= 50000 {
+				count++
+				sum += v
+			}
+		}
+		rs, err := stmt.Query(50000)
+		want := fmt.Sprint([][]interface{}{{count, sum}})
+		if err != nil || fmt.Sprint(rs.Rows) != want {
+			t.Errorf("Want: %v Got: %v %v", want, rs, err)
+		}
+	}
+	check()
+
+	zones := func(col int) []ZoneSchema {
+		t.Helper()
+		s, err := db.Describe("events")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Columns[col].Zones
+	}
+	got := zones(0)
+	want := "[{1024 0 1000 11230} {1024 0 11240 21470} {1024 0 21480 31710} " +
+		"{1024 0 31720 41950} {1024 0 41960 52190} {100 0 52200 53190}]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("Want: %v Got: %v", want, got)
+	}
+	if got := zones(2)[5]; got.Rows != 80 || got.Nulls != 20 {
+		t.Errorf("Want: 80 values and 20 NULLs Got: %v", got)
+	}
+
+	// The zones are widened by the updates, and are emptied
+	// when all the rows of their blocks are deleted
+	_, err = db.Exec("UPDATE events SET ts = 1 WHERE ts = 31000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts[3000] = 1
+	_, err = db.Exec("DELETE FROM events WHERE ts >= 1000 AND ts < 11240")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := 0; k < zoneRows; k++ {
+		delete(ts, k)
+	}
+	check()
+
+	got = zones(0)
+	want = "[{0 0 <nil> <nil>} {1024 0 11240 21470} {1024 0 1 31710}"
+	if !strings.HasPrefix(fmt.Sprint(got), want) {
+		t.Errorf("Want: %v Got: %v", want, got)
+	}
+
+	// A column that is added has the zones of its values
+	if err = db.AddColumn("events", ColumnDesc{ColName: "w",
+		ColType: IntColumn}, 7); err != nil {
+		t.Fatal(err)
+	}
+	if got := zones(3); len(got) != 6 || fmt.Sprint(got[5]) != "{100 0 7 7}" {
+		t.Errorf("Want: {100 0 7 7} Got: %v", got)
+	}
+	rs, err := db.Select("SELECT COUNT(*) FROM events WHERE w = 7")
+	if err != nil || fmt.Sprint(rs.Rows) != fmt.Sprint([][]int{{len(ts)}}) {
+		t.Errorf("Want: %v Got: %v %v", len(ts), rs, err)
+	}
+}
+
+// Builds a table with a string column of the given encoding,
+// whose rows have one of a few distinct values
+func benchmarkStringTable(b *testing.B, encoding Encoding,
+	rows int) *Keeri {
+
+	db := &Keeri{}
+	err := db.CreateTable("events",
+		ColumnDesc{ColName: "id", ColType: IntColumn},
+		ColumnDesc{ColName: "kind", ColType: StringColumn,
+			Encoding: encoding})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < rows; i++ {
+		kind := fmt.Sprintf("event-of-kind-%04d", i%16)
+		if err = db.Insert("events", i, kind); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return db
+}
+
+// Reports the memory taken by the string column, per row
+func BenchmarkStringColumnMemory(b *testing.B) {
+	const rows = 1 << 16
+	for _, encoding := range []Encoding{PlainEncoding, DictionaryEncoding} {
+		b.Run(encoding.String(), func(b *testing.B) {
+			var total uint64
+			for n := 0; n < b.N; n++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				db := benchmarkStringTable(b, encoding, rows)
+				if err := db.DropColumn("events", "id"); err != nil {
+					b.Fatal(err)
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				total += after.HeapAlloc - before.HeapAlloc
+				runtime.KeepAlive(db)
+			}
+			b.ReportMetric(float64(total)/float64(b.N)/rows, "bytes/row")
+		})
+	}
+}
+
+func BenchmarkStringEQ(b *testing.B) {
+	for _, encoding := range []Encoding{PlainEncoding, DictionaryEncoding} {
+		b.Run(encoding.String(), func(b *testing.B) {
+			db := benchmarkStringTable(b, encoding, 1<<16)
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				_, err := db.Select("SELECT COUNT(*) FROM events " +
+					"WHERE kind = 'event-of-kind-0003'")
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Counts the latest rows of a table ordered by time, where the zone maps
+// skip all the blocks but the last one, compared with a condition that
+// can not skip any block
+func BenchmarkZoneMapRange(b *testing.B) {
+	db := &Keeri{}
+	err := db.CreateTable("events",
+		ColumnDesc{ColName: "ts", ColType: IntColumn},
+		ColumnDesc{ColName: "v", ColType: IntColumn})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for k := 0; k < 1<<16; k++ {
+		if err = db.Insert("events", k, k%100); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, cond := range []string{"ts >= 65500", "v >= 99"} {
+		b.Run(cond, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				_, err := db.Select("SELECT COUNT(*) FROM events WHERE " + cond)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
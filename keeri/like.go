@@ -0,0 +1,93 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import (
+	"regexp"
+	"strings"
+)
+
+// A compiled LIKE, ILIKE or REGEXP pattern, that is
+// compiled once per query and matched against every row
+type pattern struct {
+	re *regexp.Regexp
+
+	// LIKE patterns of the form 'abc%' are matched
+	// as a prefix, without using the regexp
+	isPrefix bool
+	prefix   string
+}
+
+func (p *pattern) match(s string) bool {
+	if p.isPrefix {
+		return strings.HasPrefix(s, p.prefix)
+	}
+	return p.re.MatchString(s)
+}
+
+func (p *pattern) String() string {
+	if p.isPrefix {
+		return p.prefix + "%"
+	}
+	return p.re.String()
+}
+
+// Compiles the pattern of the given operator
+func compilePattern(op RelationalOperator, s string) (*pattern, error) {
+	if op == REGEXP || op == NOTREGEXP {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, err
+		}
+		return &pattern{re: re}, nil
+	}
+
+	if op == LIKE || op == NOTLIKE {
+		prefix := strings.TrimSuffix(s, "%")
+		if len(prefix) == len(s)-1 && !strings.ContainsAny(prefix, "%_\\") {
+			return &pattern{isPrefix: true, prefix: prefix}, nil
+		}
+	}
+
+	expr := likeToRegexp(s)
+	if op == ILIKE || op == NOTILIKE {
+		expr = "(?i)" + expr
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &pattern{re: re}, nil
+}
+
+// Converts a LIKE pattern in to an anchored regular expression, where
+// % matches any sequence of characters and _ matches any one character.
+// A \ escapes the character after it, so that \% matches a literal %
+func likeToRegexp(s string) string {
+	expr := "(?s)^"
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			expr += regexp.QuoteMeta(string(r))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			expr += ".*"
+		case r == '_':
+			expr += "."
+		default:
+			expr += regexp.QuoteMeta(string(r))
+		}
+	}
+	if escaped {
+		expr += regexp.QuoteMeta("\\")
+	}
+	return expr + "$"
+}
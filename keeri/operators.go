@@ -17,13 +17,63 @@ const (
 	LTE
 	GT
 	GTE
+	IN
+	NOTIN
+	BETWEEN
+	LIKE
+	NOTLIKE
+	ILIKE
+	NOTILIKE
+	REGEXP
+	NOTREGEXP
 )
 
+func (r RelationalOperator) String() string {
+	switch r {
+	case EQ:
+		return "="
+	case NEQ:
+		return "!="
+	case LT:
+		return "<"
+	case LTE:
+		return "<="
+	case GT:
+		return ">"
+	case GTE:
+		return ">="
+	case IN:
+		return "IN"
+	case NOTIN:
+		return "NOT IN"
+	case BETWEEN:
+		return "BETWEEN"
+	case LIKE:
+		return "LIKE"
+	case NOTLIKE:
+		return "NOT LIKE"
+	case ILIKE:
+		return "ILIKE"
+	case NOTILIKE:
+		return "NOT ILIKE"
+	case REGEXP:
+		return "REGEXP"
+	case NOTREGEXP:
+		return "NOT REGEXP"
+	default:
+		panic("Unknown relational operator")
+	}
+}
+
 type LogicalOperator int
 
 const (
 	OR LogicalOperator = iota
 	AND
+
+	// Negates a ConditionTree that has
+	// exactly one child or one condition
+	NOT
 )
 
 func (l LogicalOperator) String() string {
@@ -32,6 +82,8 @@ func (l LogicalOperator) String() string {
 		return fmt.Sprint("AND")
 	case OR:
 		return fmt.Sprint("OR")
+	case NOT:
+		return fmt.Sprint("NOT")
 	default:
 		panic("Unknown logical operator")
 	}
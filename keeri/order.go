@@ -0,0 +1,87 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A single entry in the ORDER BY clause, naming either a column, an
+// aggregate or, if alias is true, an expression in the SELECT list.
+// An expr is for any other expression, which is named as written.
+// A pos is for an integer, which is the position of a SELECT list
+// item, from 1, and is resolved once the stars are expanded.
+type orderItem struct {
+	name  string
+	desc  bool
+	alias bool
+	expr  Expr
+	pos   int
+}
+
+// A resolved orderItem, with the position of the
+// value in the rows that are to be sorted
+type sortKey struct {
+	pos       int
+	desc      bool
+	collation Collation
+}
+
+// Compares two values of the same column, returning -1, 0 or +1.
+// NULLs, which are nil, sort after all the other values.
+func compareValues(a, b interface{}, collation Collation) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return 1
+		}
+		return -1
+	}
+
+	switch a := a.(type) {
+	case int:
+		b := b.(int)
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+		return 0
+	case float64:
+		b := b.(float64)
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+		return 0
+	case string:
+		return collation.compare(a, b.(string))
+	}
+	panic(fmt.Errorf("Values of type %T can not be ordered", a))
+}
+
+// Sorts the rows, each of which is an []interface{}, by the keys.
+// Rows that are equal in all the keys retain their order.
+func sortRows(rows []interface{}, keys []sortKey) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i].([]interface{}), rows[j].([]interface{})
+		for _, k := range keys {
+			cmp := compareValues(a[k.pos], b[k.pos], k.collation)
+			if k.desc {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+}
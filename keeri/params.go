@@ -0,0 +1,149 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import "fmt"
+
+// Returns all the parameters of the query, in the order
+// of the clauses, which need not be their order in the query
+func queryParams(s *SelectStmt) []*Param {
+	var exprs []Expr
+	for _, i := range s.Items {
+		exprs = append(exprs, i.Expr)
+	}
+	exprs = append(exprs, s.Where)
+	exprs = append(exprs, s.GroupBy...)
+	exprs = append(exprs, s.Having)
+	for _, i := range s.OrderBy {
+		exprs = append(exprs, i.Expr)
+	}
+
+	return exprParams(exprs)
+}
+
+// Returns all the parameters of the expressions, skipping the nils
+func exprParams(exprs []Expr) []*Param {
+	var ret []*Param
+	for _, e := range exprs {
+		if e == nil {
+			continue
+		}
+		walkExpr(e, func(x Expr) {
+			if p, ok := x.(*Param); ok {
+				ret = append(ret, p)
+			}
+		})
+	}
+	return ret
+}
+
+// Binds the args to the parameters of a query. The ?s and the $ns
+// are bound to the args by their position, and there should be exactly
+// as many args as the largest position. The :names are bound from a
+// map[string]interface{}, which should be the only arg.
+func bindParams(params []*Param, args []interface{}) error {
+	if len(params) > 0 && params[0].Name != "" {
+		var named map[string]interface{}
+		if len(args) == 1 {
+			named, _ = args[0].(map[string]interface{})
+		}
+		if named == nil {
+			return fmt.Errorf("Expected a map[string]interface{} with the "+
+				"values of the named parameters, got %d arguments", len(args))
+		}
+
+		for _, p := range params {
+			v, ok := named[p.Name]
+			if !ok {
+				return fmt.Errorf("No value for the parameter ':%s'", p.Name)
+			}
+			if err := p.bind(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	n := 0
+	for _, p := range params {
+		if p.Index > n {
+			n = p.Index
+		}
+	}
+	if len(args) != n {
+		return fmt.Errorf("Expected %d arguments for the parameters, got %d",
+			n, len(args))
+	}
+
+	for _, p := range params {
+		if err := p.bind(args[p.Index-1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sets the value of the parameter, which should be either a
+// string or an integer, where an integer is stored as an int.
+// The value should be of the type of the parameter, if it has
+// been found out from the expression that the parameter is in.
+func (p *Param) bind(v interface{}) error {
+	p.value = nil
+	switch v := v.(type) {
+	case string:
+		p.value = v
+	case int:
+		p.value = v
+	case int8:
+		p.value = int(v)
+	case int16:
+		p.value = int(v)
+	case int32:
+		p.value = int(v)
+	case int64:
+		p.value = int(v)
+	case uint8:
+		p.value = int(v)
+	case uint16:
+		p.value = int(v)
+	case uint32:
+		p.value = int(v)
+	default:
+		return fmt.Errorf("Unsupported type %T for the parameter '%s'",
+			v, formatExpr(p))
+	}
+
+	if p.typed {
+		if _, err := p.valueFor(p.typ, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the value of the parameter, after checking that
+// it is of the colType, with the colName for the errors
+func (p *Param) valueFor(colType ColumnType, colName string) (interface{},
+	error) {
+
+	switch v := p.value.(type) {
+	case int:
+		if colType == IntColumn {
+			return v, nil
+		}
+	case string:
+		if colType == StringColumn {
+			return v, nil
+		}
+	}
+	if colName == "" {
+		return nil, fmt.Errorf("Mismatched type %T of the parameter '%s'",
+			p.value, formatExpr(p))
+	}
+	return nil, fmt.Errorf("Mismatched type %T of the parameter '%s' for "+
+		"the column '%s'", p.value, formatExpr(p), colName)
+}
@@ -8,361 +8,1312 @@ package keeri
 
 import (
 	"fmt"
-	"log"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
-func skipEmptyWords(words []string, pos *int) {
-	for {
-		if *pos >= len(words) {
-			return
-		}
-
-		// This will work as long as the \n \r etc.
-		// on the input SQL string are replaced with
-		// a normal blank space, in the scanner's
-		// scanSQLWords function. If not we will have to
-		// use unicode.IsSpace here. Refer to the history
-		// of this function.
-		if words[*pos] == " " {
-			*pos++
+// A single entry in the SELECT list, which is either a column, an
+// aggregate or an expression. The name is the name of the result
+// column, which is the alias, if given, or the item as written.
+type selectItem struct {
+	colName string
+	agg     *Aggregate
+	expr    Expr
+	name    string
+}
+
+// Returns the expression for the value of the item, if it
+// is either a column or an expression, but not an aggregate
+func (i selectItem) valueExpr() Expr {
+	if i.expr != nil {
+		return i.expr
+	}
+	return &ColumnRef{Name: i.colName}
+}
+
+// The output of the parser for a SELECT query
+type selectQuery struct {
+	distinct bool
+	items    []selectItem
+	from     []JoinTable
+	condTree *ConditionTree
+	groupBy  []string
+	having   *ConditionTree
+
+	// All the parameters, to be bound when the query is run
+	params []*Param
+
+	// The expressions in the GROUP BY, with a nil for every plain
+	// column. The name of an expression in the groupBy is set when
+	// the query is run, after its columns are rewritten.
+	groupExprs []Expr
+
+	orderBy []orderItem
+}
+
+// Calls f with the column name, or with the column of the aggregate
+// if the name is that of an aggregate, like "SUM(col)", and returns
+// the name with the column replaced by the value returned by f
+func rewriteName(name string, f func(string) string) string {
+	agg, ok := aggregateByName(name)
+	if !ok {
+		return f(name)
+	}
+	if agg.ColName != "*" {
+		agg.ColName = f(agg.ColName)
+	}
+	return agg.String()
+}
+
+// Calls f with every column name used in the query and
+// replaces the column name with the value returned by f
+func (q *selectQuery) rewriteColumns(f func(string) string) {
+	for k, i := range q.items {
+		if i.expr != nil {
+			rewriteExprColumns(i.expr, f)
+		} else if i.agg == nil {
+			q.items[k].colName = f(i.colName)
+		} else if i.agg.ColName != "*" {
+			i.agg.ColName = f(i.agg.ColName)
+		}
+	}
+
+	for k := range q.groupBy {
+		if q.groupExprs[k] != nil {
+			rewriteExprColumns(q.groupExprs[k], f)
 		} else {
-			break
+			q.groupBy[k] = f(q.groupBy[k])
+		}
+	}
+
+	for _, t := range []*ConditionTree{q.condTree, q.having} {
+		if t == nil {
+			continue
+		}
+		t.eachCondition(func(c *Condition) {
+			if c.expr != nil {
+				rewriteExprColumns(c.expr, f)
+			} else {
+				c.colDesc.ColName = rewriteName(c.colDesc.ColName, f)
+			}
+		})
+	}
+
+	for k, o := range q.orderBy {
+		if o.expr != nil {
+			rewriteExprColumns(o.expr, f)
+		} else if !o.alias {
+			q.orderBy[k].name = rewriteName(o.name, f)
+		}
+	}
+}
+
+// Calls f with every column name in the expression, including
+// the columns of the aggregates, and replaces the column name
+// with the value returned by f
+func rewriteExprColumns(e Expr, f func(string) string) {
+	walkExpr(e, func(x Expr) {
+		switch x := x.(type) {
+		case *ColumnRef:
+			x.Name = f(x.Name)
+		case *AggregateExpr:
+			if x.ColName != "*" {
+				x.ColName = f(x.ColName)
+			}
+		}
+	})
+}
+
+// Replaces every * in the SELECT list with all the columns of all the
+// tables, and every alias.* with all the columns of that table, in the
+// order in which the columns were created. The tbls are the tables of
+// the query, in the same order as the from.
+func (q *selectQuery) expandStars(tbls []*table) error {
+	var items []selectItem
+	for _, i := range q.items {
+		if i.agg != nil || !isStar(i.colName) {
+			items = append(items, i)
+			continue
+		}
+
+		found := false
+		for k, j := range q.from {
+			if i.colName != "*" && i.colName != j.alias()+".*" {
+				continue
+			}
+			found = true
+
+			tbls[k].dataMetaDataLock.RLock()
+			for _, desc := range tbls[k].colsDesc {
+				colName := desc.ColName
+				if len(q.from) > 1 {
+					colName = j.alias() + "." + desc.ColName
+				}
+				items = append(items, selectItem{
+					colName: colName,
+					name:    desc.ColName,
+				})
+			}
+			tbls[k].dataMetaDataLock.RUnlock()
+		}
+
+		if !found {
+			return fmt.Errorf("Invalid table alias in '%s'", i.colName)
+		}
+	}
+
+	q.items = items
+	return nil
+}
+
+// Replaces every ORDER BY position with the SELECT list item at that
+// position, which is to be done after the stars have been expanded
+func (q *selectQuery) resolvePositions() error {
+	for k, o := range q.orderBy {
+		if o.name != "" || o.expr != nil {
+			continue
+		}
+		if o.pos < 1 || o.pos > len(q.items) {
+			return fmt.Errorf("ORDER BY position %d is not in the "+
+				"SELECT list", o.pos)
+		}
+
+		switch i := q.items[o.pos-1]; {
+		case i.expr != nil:
+			q.orderBy[k] = orderItem{name: exprName(i.expr), desc: o.desc,
+				expr: i.expr}
+		case i.agg != nil:
+			q.orderBy[k] = orderItem{name: i.agg.String(), desc: o.desc}
+		default:
+			q.orderBy[k] = orderItem{name: i.colName, desc: o.desc}
 		}
 	}
+	return nil
 }
 
-// This function takes an incoming SQL string and creates a condition tree
-// out of the WHERE clause nested conditions. However, the conditions will
-// have just the column names resolved but not the column types. The caller
-// of parser should take care of filling the column types in the condTree
-// that is returned, before using it in an eval function.
-// TODO: Probably a good idea to add a 'state' in the CondTree struct, which
-// could be updated after colTypes are resolved and checked in evaluate func
-func parseQuery(sql string) (string, []string, *ConditionTree) {
+// Returns all the aggregates that are needed for the query,
+// from the SELECT list, the HAVING and the ORDER BY clauses
+func (q *selectQuery) aggregates() []Aggregate {
+	var aggs []Aggregate
+	found := make(map[Aggregate]bool)
+
+	add := func(agg Aggregate) {
+		if !found[agg] {
+			found[agg] = true
+			aggs = append(aggs, agg)
+		}
+	}
+
+	for _, i := range q.items {
+		if i.agg != nil {
+			add(*i.agg)
+		}
+	}
+
+	if q.having != nil {
+		q.having.eachCondition(func(c *Condition) {
+			if c.expr == nil {
+				if agg, ok := aggregateByName(c.colDesc.ColName); ok {
+					add(agg)
+				}
+				return
+			}
+			walkExpr(c.expr, func(x Expr) {
+				if a, ok := x.(*AggregateExpr); ok {
+					add(a.Aggregate)
+				}
+			})
+		})
+	}
+
+	for _, i := range q.orderBy {
+		if agg, ok := aggregateByName(i.name); ok {
+			add(agg)
+		}
+	}
+
+	return aggs
+}
 
-	words, err := splitSQL(sql)
+// Returned for a malformed query. Line and Column start from 1 and
+// point at Near, which is the text of the query where the error was
+// found. Near is empty if the error is at the end of the query.
+type ParseError struct {
+	Line   int
+	Column int
+	Near   string
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	if e.Near == "" {
+		return fmt.Sprintf("%s at the end of the query (line %d, column %d)",
+			e.Msg, e.Line, e.Column)
+	}
+	return fmt.Sprintf("%s near '%s' (line %d, column %d)",
+		e.Msg, e.Near, e.Line, e.Column)
+}
+
+// Creates a ParseError for the given byte offset in the sql
+func newParseError(sql string, offset int, near, msg string) *ParseError {
+	line := 1 + strings.Count(sql[:offset], "\n")
+	lineStart := strings.LastIndex(sql[:offset], "\n") + 1
+	return &ParseError{
+		Line:   line,
+		Column: 1 + utf8.RuneCountInString(sql[lineStart:offset]),
+		Near:   near,
+		Msg:    msg,
+	}
+}
+
+// Expressions nested deeper than this are rejected, so that a
+// malformed query can never exhaust the stack of the parser
+const maxExprDepth = 256
+
+// Guards the recursion of the parse functions, which
+// should always call leave once enter is called
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > maxExprDepth {
+		return p.errorf(p.peek(), "Expression nested too deeply")
+	}
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+// A recursive descent parser over the tokens of a query. None
+// of the parse functions panic, the errors are always returned.
+type parser struct {
+	sql   string
+	toks  []token
+	pos   int
+	depth int
+
+	// The number of ?s seen so far, and the first parameter,
+	// so that the positional and the named ones are not mixed
+	nQuestions int
+	firstParam string
+}
+
+// Parses a SELECT query in to its syntax tree. The errors
+// returned for a malformed query are always a *ParseError.
+func ParseSelect(sql string) (*SelectStmt, error) {
+	toks, err := tokenize(sql)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	p := &parser{sql: sql, toks: toks}
+	return p.parseSelect()
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.toks[p.pos]
+	if tok.kind != eofToken {
+		p.pos++
 	}
+	return tok
+}
+
+// Consumes the next token, if it is the given keyword
+func (p *parser) keyword(k string) bool {
+	tok := p.peek()
+	if tok.kind == wordToken && strings.ToUpper(tok.text) == k {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// Consumes the next token, if it is the given symbol
+func (p *parser) symbol(s string) bool {
+	tok := p.peek()
+	if tok.kind == symbolToken && tok.text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(k string) error {
+	if !p.keyword(k) {
+		return p.errorf(p.peek(), "Expected '%s'", k)
+	}
+	return nil
+}
 
-	pos := 0
-	var outCols []string
-	var tableName string
+func (p *parser) expectSymbol(s string) error {
+	if !p.symbol(s) {
+		return p.errorf(p.peek(), "Expected '%s'", s)
+	}
+	return nil
+}
 
-	// Trim any blanks in the prefix of the query
-	skipEmptyWords(words, &pos)
+// Returns a ParseError pointing at the token
+func (p *parser) errorf(tok token, format string, args ...interface{}) error {
+	near := tok.text
+	if tok.kind == stringToken {
+		near = p.sql[tok.offset : tok.offset+len(tok.text)+2]
+	}
+	return newParseError(p.sql, tok.offset, near, fmt.Sprintf(format, args...))
+}
 
-	if strings.ToUpper(words[pos]) != "SELECT" {
-		panic(fmt.Errorf("Expected 'SELECT' Found '%s'", words[pos]))
+// Returns a ParseError pointing at the expression
+func (p *parser) errorAt(e Expr, format string, args ...interface{}) error {
+	for _, tok := range p.toks {
+		if tok.offset == e.Pos() {
+			return p.errorf(tok, format, args...)
+		}
 	}
+	return newParseError(p.sql, e.Pos(), "", fmt.Sprintf(format, args...))
+}
+
+// The words that can not be used as the names of tables or columns
+var reservedWords = map[string]bool{
+	"SELECT": true, "DISTINCT": true, "FROM": true, "WHERE": true,
+	"GROUP": true, "BY": true, "HAVING": true, "ORDER": true,
+	"ASC": true, "DESC": true, "AND": true, "OR": true, "NOT": true,
+	"IN": true, "BETWEEN": true, "LIKE": true, "ILIKE": true,
+	"REGEXP": true, "AS": true, "JOIN": true, "INNER": true,
+	"LEFT": true, "OUTER": true, "ON": true, "CASE": true, "WHEN": true,
+	"THEN": true, "ELSE": true, "END": true,
+}
+
+func isName(tok token) bool {
+	return tok.kind == wordToken && !isNumber(tok.text) &&
+		!strings.HasSuffix(tok.text, ".") &&
+		!reservedWords[strings.ToUpper(tok.text)]
+}
+
+// Returns true for the * of a SELECT *, or
+// for an alias.* that selects all the columns of a table
+func isStar(word string) bool {
+	return word == "*" || strings.HasSuffix(word, ".*")
+}
+
+func isNumber(word string) bool {
+	w := strings.TrimLeft(word, "+-")
+	return w != "" && w[0] >= '0' && w[0] <= '9'
+}
+
+// Parses the name of a table or a column
+func (p *parser) parseName(what string) (token, error) {
+	tok := p.peek()
+	if !isName(tok) {
+		return tok, p.errorf(tok, "Expected %s", what)
+	}
+	p.pos++
+	return tok, nil
+}
+
+// SELECT [DISTINCT] items FROM tables [WHERE expr]
+// [GROUP BY columns] [HAVING expr] [ORDER BY items]
+func (p *parser) parseSelect() (*SelectStmt, error) {
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+
+	s := &SelectStmt{}
+	s.Distinct = p.keyword("DISTINCT")
 
-	// Parse (comma sepearated column names) or (a single column name)
-	// by parsing until the FROM keyword
-	pos++
 	for {
+		e, err := p.parseSelectItem()
+		if err != nil {
+			return nil, err
+		}
+		item := SelectItem{Expr: e}
 
-		// Trim any blanks
-		skipEmptyWords(words, &pos)
+		hasAS := p.keyword("AS")
+		if hasAS || isName(p.peek()) {
+			alias, err := p.parseName("an alias after 'AS'")
+			if err != nil {
+				return nil, err
+			}
+			if c, ok := e.(*ColumnRef); ok && isStar(c.Name) {
+				return nil, p.errorf(alias, "Unexpected alias for '%s'", c.Name)
+			}
+			item.Alias = alias.text
+		}
+		s.Items = append(s.Items, item)
 
-		// TODO: Check if valid column name
-		outCols = append(outCols, words[pos])
-		pos++
+		if !p.symbol(",") {
+			break
+		}
+	}
 
-		// Trim any blanks
-		skipEmptyWords(words, &pos)
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
 
-		if words[pos] == "," {
-			// More than one column needs to be output for this query
-			pos++
-			continue
-		} else {
-			skipEmptyWords(words, &pos)
-			if strings.ToUpper(words[pos]) != "FROM" {
-				panic(fmt.Errorf("Expected 'FROM' Found '%s'", words[pos]))
-			} else {
-				pos++
+	var err error
+	s.From, err = p.parseFrom()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.keyword("WHERE") {
+		if s.Where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.keyword("GROUP") {
+		if err = p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			e, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			s.GroupBy = append(s.GroupBy, e)
+
+			if !p.symbol(",") {
 				break
 			}
 		}
 	}
 
-	// Parse table names
-	// TODO: A lot of changes are needed below to implement joins
-	skipEmptyWords(words, &pos)
-	tableName = words[pos]
-	pos++
+	if p.keyword("HAVING") {
+		if s.Having, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.keyword("ORDER") {
+		if err = p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			e, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+
+			item := OrderByItem{Expr: e}
+			if !p.keyword("ASC") {
+				item.Desc = p.keyword("DESC")
+			}
+			s.OrderBy = append(s.OrderBy, item)
 
-	skipEmptyWords(words, &pos)
-	if pos >= len(words) {
-		// Parsed until the end of the query
-		return tableName, outCols, nil
+			if !p.symbol(",") {
+				break
+			}
+		}
 	}
 
-	// Parsing the conditions
-	if strings.ToUpper(words[pos]) != "WHERE" {
-		panic(fmt.Errorf("Expected 'WHERE' Found '%s'", words[pos]))
+	if tok := p.peek(); tok.kind != eofToken {
+		return nil, p.errorf(tok, "Unexpected '%s'", tok.text)
 	}
 
-	toks := removeRelOpsGenerateSQLToks(words[pos+1:])
-	cTree := generateCondTree(toks, 0, len(toks)-1)
+	return s, nil
+}
+
+// Parses the table names, their aliases and the joins
+func (p *parser) parseFrom() ([]JoinTable, error) {
+
+	// Parses the table name with an optional alias
+	tableRef := func() (JoinTable, error) {
+		tok, err := p.parseName("a table name")
+		if err != nil {
+			return JoinTable{}, err
+		}
+		j := JoinTable{TableName: tok.text}
+
+		if p.keyword("AS") {
+			tok, err = p.parseName("an alias after 'AS'")
+			if err != nil {
+				return JoinTable{}, err
+			}
+			j.Alias = tok.text
+		} else if isName(p.peek()) {
+			j.Alias = p.next().text
+		}
+		return j, nil
+	}
 
-	return tableName, outCols, cTree
+	t, err := tableRef()
+	if err != nil {
+		return nil, err
+	}
+	from := []JoinTable{t}
+
+	for {
+		j := JoinTable{Type: InnerJoin}
+		if p.keyword("LEFT") {
+			j.Type = LeftOuterJoin
+			p.keyword("OUTER")
+			if err = p.expectKeyword("JOIN"); err != nil {
+				return nil, err
+			}
+		} else if p.keyword("INNER") {
+			if err = p.expectKeyword("JOIN"); err != nil {
+				return nil, err
+			}
+		} else if !p.keyword("JOIN") {
+			return from, nil
+		}
+
+		t, err := tableRef()
+		if err != nil {
+			return nil, err
+		}
+		j.TableName, j.Alias = t.TableName, t.Alias
+
+		if err = p.expectKeyword("ON"); err != nil {
+			return nil, err
+		}
+		left, err := p.parseName("a condition of the form " +
+			"'t1.col1 = t2.col2' after 'ON'")
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		right, err := p.parseName("a column name after '='")
+		if err != nil {
+			return nil, err
+		}
+		j.LeftCol, j.RightCol = left.text, right.text
+
+		from = append(from, j)
+	}
 }
 
-// NOTE: Caller must set the op field of the condition,
-// and that is why this is called a 'Partial' function
-func createPartialCondTok(words []string, lhsPos, pos *int) *sqlTokens {
-	if *lhsPos == -1 {
-		panic(fmt.Errorf("No operand found for operator at '%s' ", words[*pos]))
+// Parses the conditions of a WHERE or a HAVING clause, where
+// NOT binds tighter than AND, which binds tighter than OR
+func (p *parser) parseExpr() (Expr, error) {
+	defer p.leave()
+	if err := p.enter(); err != nil {
+		return nil, err
 	}
 
-	*pos++
-	skipEmptyWords(words, pos)
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		if !p.keyword("OR") {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{node{tok.offset}, OR, left, right}
+	}
+}
 
-	cond := &Condition{
-		op: LT,
-		colDesc: ColumnDesc{
-			ColName: words[*lhsPos],
-			ColType: unRecognizedColumn,
-		},
-		value: words[*pos],
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		if !p.keyword("AND") {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{node{tok.offset}, AND, left, right}
 	}
+}
+
+func (p *parser) parseNot() (Expr, error) {
+	tok := p.peek()
+	if p.keyword("NOT") {
+		defer p.leave()
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
 
-	tok := &sqlTokens{
-		CONDITION_PTR_TOK,
-		cond,
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &NotExpr{node{tok.offset}, x}, nil
 	}
-	*lhsPos = -1
 
-	return tok
+	return p.parsePredicate()
+}
+
+// Maps the symbols of the relational operators to the operators
+var relOps = map[string]RelationalOperator{
+	"<":  LT,
+	"<=": LTE,
+	">":  GT,
+	">=": GTE,
+	"=":  EQ,
+	"!=": NEQ,
+	"~":  REGEXP,
 }
 
-// This function removes the relational opera[tors|nds]
-// in the incoming sql words, generates an
-// array of tokens where each relational operator
-// and the operands would have been replaced with
-// a condition object
-func removeRelOpsGenerateSQLToks(words []string) (ret []sqlTokens) {
-
-	lhsPos := -1
-
-	for i := 0; i < len(words); i++ {
-
-		switch words[i] {
-		case "(":
-			ret = append(ret, sqlTokens{LEFT_PARAN_TOK, nil})
-		case ")":
-			ret = append(ret, sqlTokens{RIGHT_PARAN_TOK, nil})
-		case "AND":
-			ret = append(ret, sqlTokens{AND_TOK, nil})
-		case "OR":
-			ret = append(ret, sqlTokens{OR_TOK, nil})
-
-		// Relational Operators
-		case "<":
-			tok := createPartialCondTok(words, &lhsPos, &i)
-			cond := tok.value.(*Condition)
-			cond.op = LT
-			ret = append(ret, *tok)
-		case "<=":
-			tok := createPartialCondTok(words, &lhsPos, &i)
-			cond := tok.value.(*Condition)
-			cond.op = LTE
-			ret = append(ret, *tok)
-		case ">":
-			tok := createPartialCondTok(words, &lhsPos, &i)
-			cond := tok.value.(*Condition)
-			cond.op = GT
-			ret = append(ret, *tok)
-		case ">=":
-			tok := createPartialCondTok(words, &lhsPos, &i)
-			cond := tok.value.(*Condition)
-			cond.op = GTE
-			ret = append(ret, *tok)
-		case "=":
-			tok := createPartialCondTok(words, &lhsPos, &i)
-			cond := tok.value.(*Condition)
-			cond.op = EQ
-			ret = append(ret, *tok)
-		case "!=":
-			tok := createPartialCondTok(words, &lhsPos, &i)
-			cond := tok.value.(*Condition)
-			cond.op = NEQ
-			ret = append(ret, *tok)
-
-		case " ":
-			//Do nothing
+// Maps the pattern matching keywords to
+// their operators and the negated operators
+var patternOps = map[string][2]RelationalOperator{
+	"LIKE":   {LIKE, NOTLIKE},
+	"ILIKE":  {ILIKE, NOTILIKE},
+	"REGEXP": {REGEXP, NOTREGEXP},
+}
 
-		default:
-			// column name operand for a relational operator
-			if lhsPos != -1 {
-				panic(fmt.Errorf("Invalid tokens: %s %s", words[lhsPos], words[i]))
+// Parses a single condition, like col1 > 5 or col2 NOT IN ('a', 'b'),
+// or just a value, which is not a valid condition and will be rejected
+// when the conditions are converted in to a ConditionTree. A value in
+// parentheses can thus be either a condition or a part of a sum.
+func (p *parser) parsePredicate() (Expr, error) {
+	x, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.peek()
+	if op, ok := relOps[tok.text]; ok && tok.kind == symbolToken {
+		p.pos++
+		right, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return &ComparisonExpr{node{tok.offset}, op, x, right}, nil
+	}
+
+	not := p.keyword("NOT")
+	opTok := p.peek()
+	switch {
+	case p.keyword("IN"):
+		op := IN
+		if not {
+			op = NOTIN
+		}
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		var list []Expr
+		for {
+			e, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, e)
+			if !p.symbol(",") {
+				break
 			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return &InExpr{node{tok.offset}, op, x, list}, nil
 
-			lhsPos = i
+	case p.keyword("BETWEEN"):
+		lo, err := p.parseSum()
+		if err != nil {
+			return nil, err
 		}
+		if err = p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		hi, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		var e Expr = &BetweenExpr{node{opTok.offset}, x, lo, hi}
+		if not {
+			e = &NotExpr{node{tok.offset}, e}
+		}
+		return e, nil
+	}
+
+	if ops, ok := patternOps[strings.ToUpper(opTok.text)]; ok &&
+		opTok.kind == wordToken {
+
+		p.pos++
+		op := ops[0]
+		if not {
+			op = ops[1]
+		}
+		right, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return &ComparisonExpr{node{tok.offset}, op, x, right}, nil
+	}
+
+	if not {
+		return nil, p.errorf(opTok, "Expected IN, BETWEEN, LIKE, "+
+			"ILIKE or REGEXP after 'NOT'")
 	}
+	return x, nil
+}
 
-	if lhsPos != -1 {
-		panic(fmt.Errorf("Invalid token: %s", words[lhsPos]))
+// Parses an entry in the SELECT list, which is either
+// a *, an alias.* or a value
+func (p *parser) parseSelectItem() (Expr, error) {
+	tok := p.peek()
+	if p.symbol("*") {
+		return &ColumnRef{node{tok.offset}, "*"}, nil
 	}
 
-	log.Printf("The sqltokens from the sql words are as follows:\n%v\n\n", ret)
+	// The scanner splits an alias.* in to the alias. and the *
+	if tok.kind == wordToken && strings.HasSuffix(tok.text, ".") {
+		star := p.toks[p.pos+1]
+		if star.kind == symbolToken && star.text == "*" &&
+			star.offset == tok.offset+len(tok.text) {
 
-	return
+			p.pos += 2
+			return &ColumnRef{node{tok.offset}, tok.text + "*"}, nil
+		}
+	}
+
+	return p.parseSum()
 }
 
-func generateCondTree(toks []sqlTokens, lo, hi int) *ConditionTree {
+// Parses the + and - operations, which bind looser than * / and %
+func (p *parser) parseSum() (Expr, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		if tok.kind != symbolToken || (tok.text != "+" && tok.text != "-") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &ArithmeticExpr{node{tok.offset}, tok.text, left, right}
+	}
+}
 
-	// Convert all expressions within parantheses into
-	// ConditionTrees and update the toks
-	//
-	// At this stage, toks can have Conditions, ConditionTrees,
-	// Parantheses and LogicalOperators; But no relational operators
+func (p *parser) parseProduct() (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
 	for {
-		openParLoc := -1
-		parenFound := false
-
-		for pos := lo; pos <= hi; pos++ {
-			if toks[pos].tokType == LEFT_PARAN_TOK {
-				openParLoc = pos
-			} else if toks[pos].tokType == RIGHT_PARAN_TOK {
-				if openParLoc == -1 {
-					panic("Mismatched parantheses")
-				}
-				parenFound = true
+		tok := p.peek()
+		if tok.kind != symbolToken ||
+			(tok.text != "*" && tok.text != "/" && tok.text != "%") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &ArithmeticExpr{node{tok.offset}, tok.text, left, right}
+	}
+}
+
+// Parses a value with an optional unary + or -. A minus before a
+// number is a part of the number, so that -5 is still a Literal.
+func (p *parser) parseUnary() (Expr, error) {
+	tok := p.peek()
+	if tok.kind != symbolToken || (tok.text != "-" && tok.text != "+") {
+		return p.parsePrimary()
+	}
+	p.pos++
 
-				cTree := generateCondTree(toks, openParLoc+1, pos-1)
+	defer p.leave()
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
 
-				t := toks[:openParLoc]
-				t = append(t, sqlTokens{CONDITION_TREE_PTR_TOK, cTree})
-				if pos+1 <= hi {
-					t = append(t, toks[pos+1:]...)
-				}
-				toks = t
-				hi -= (pos - openParLoc)
-				break
-			}
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if l, ok := x.(*Literal); ok && !l.Quoted && isNumber(l.Value) &&
+		!strings.HasPrefix(l.Value, "-") && !strings.HasPrefix(l.Value, "+") {
+
+		if tok.text == "-" {
+			return &Literal{node{tok.offset}, "-" + l.Value, false}, nil
 		}
+		return &Literal{node{tok.offset}, l.Value, false}, nil
+	}
+	return &UnaryExpr{node{tok.offset}, tok.text, x}, nil
+}
 
-		if parenFound == false {
-			if openParLoc != -1 {
-				panic("Mismatched parantheses")
+// Parses a column name, a function call, a value or
+// an expression or a condition in parentheses
+func (p *parser) parsePrimary() (Expr, error) {
+	tok := p.peek()
+	switch {
+	case tok.kind == symbolToken && tok.text == "(":
+		p.pos++
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return e, nil
+	case tok.kind == stringToken:
+		p.pos++
+		return &Literal{node{tok.offset}, tok.text, true}, nil
+	case tok.kind == wordToken && isNumber(tok.text):
+		p.pos++
+		return &Literal{node{tok.offset}, tok.text, false}, nil
+	case tok.kind == wordToken && strings.ToUpper(tok.text) == "CASE":
+		return p.parseCase()
+	case tok.kind == wordToken && strings.ToUpper(tok.text) == "NULL":
+		p.pos++
+		return &NullLiteral{node{tok.offset}}, nil
+	case tok.kind == paramToken:
+		return p.parseParam()
+	case isName(tok):
+		p.pos++
+		if p.peek().kind == symbolToken && p.peek().text == "(" {
+			if _, ok := aggregateFuncByName(tok.text); ok {
+				return p.parseAggregate(tok)
 			}
+			return p.parseFuncCall(tok)
+		}
+		return &ColumnRef{node{tok.offset}, tok.text}, nil
+	case tok.kind == eofToken:
+		return nil, p.errorf(tok, "Expected a column name or a value")
+	}
+	return nil, p.errorf(tok, "Unexpected '%s'", tok.text)
+}
+
+// Parses a ?, a $n or a :name. A query can have either the
+// ?s, the $ns or the :names, but not a mix of them.
+func (p *parser) parseParam() (Expr, error) {
+	tok := p.next()
+	if p.firstParam != "" && p.firstParam[0] != tok.text[0] {
+		return nil, p.errorf(tok, "Unexpected '%s' in a query with '%s'",
+			tok.text, p.firstParam)
+	}
+	if p.firstParam == "" {
+		p.firstParam = tok.text
+	}
+
+	param := &Param{node: node{tok.offset}}
+	switch tok.text[0] {
+	case '?':
+		p.nQuestions++
+		param.Index = p.nQuestions
+	case '$':
+		param.Index, _ = strconv.Atoi(tok.text[1:])
+	default:
+		param.Name = tok.text[1:]
+	}
+	return param, nil
+}
+
+// Parses a simple or a searched CASE, up to its END
+func (p *parser) parseCase() (Expr, error) {
+	defer p.leave()
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+
+	c := &CaseExpr{node: node{p.next().offset}}
+
+	var err error
+	if tok := p.peek(); tok.kind != wordToken ||
+		strings.ToUpper(tok.text) != "WHEN" {
+		if c.Operand, err = p.parseSum(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = p.expectKeyword("WHEN"); err != nil {
+		return nil, err
+	}
+	for {
+		var w WhenClause
+		if c.Operand != nil {
+			w.Cond, err = p.parseSum()
+		} else {
+			w.Cond, err = p.parseExpr()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expectKeyword("THEN"); err != nil {
+			return nil, err
+		}
+		if w.Result, err = p.parseSum(); err != nil {
+			return nil, err
+		}
+		c.Whens = append(c.Whens, w)
+
+		if !p.keyword("WHEN") {
 			break
 		}
 	}
 
-	// Handle AND tokens
-	// At this stage, toks[lo:hi] can have only Conditions,
-	// ConditionTrees and LogicalOperators.
-	//
-	// toks[lo:hi] should not have any parantheses
-	for pos := lo; pos < hi; pos++ {
-		if toks[pos].tokType == AND_TOK {
+	if p.keyword("ELSE") {
+		if c.Else, err = p.parseSum(); err != nil {
+			return nil, err
+		}
+	}
+	if err = p.expectKeyword("END"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Parses the arguments of a scalar function call,
+// after the name, which is given as the tok
+func (p *parser) parseFuncCall(tok token) (Expr, error) {
+	name := strings.ToUpper(tok.text)
+	arity, ok := scalarFuncs[name]
+	if !ok && name == "NEXTVAL" {
+		return nil, p.errorf(tok, "NEXTVAL is allowed only as a value of "+
+			"an INSERT or as a DEFAULT")
+	}
+	if !ok {
+		return nil, p.errorf(tok, "Unknown function '%s'", tok.text)
+	}
+
+	defer p.leave()
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	var args []Expr
+	if !p.symbol(")") {
+		for {
+			e, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, e)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(args) < arity[0] || (arity[1] != -1 && len(args) > arity[1]) {
+		return nil, p.errorf(tok, "Wrong number of arguments for %s", name)
+	}
+	return &FuncCall{node{tok.offset}, name, args}, nil
+}
+
+// Parses an aggregate function call of the form FUNC ( [DISTINCT] arg ),
+// after the FUNC, which is given as the tok
+func (p *parser) parseAggregate(tok token) (Expr, error) {
+	f, ok := aggregateFuncByName(tok.text)
+	if !ok {
+		return nil, p.errorf(tok, "Unknown function '%s'", tok.text)
+	}
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+
+	agg := Aggregate{Func: f}
+	agg.Distinct = p.keyword("DISTINCT")
+
+	arg := p.peek()
+	if !p.symbol("*") {
+		if _, err := p.parseName(fmt.Sprintf("an argument for '%s'", f)); err != nil {
+			return nil, err
+		}
+	}
+	agg.ColName = arg.text
 
-			cTree := &ConditionTree{}
-			cTree.op = AND
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
 
-			if pos == lo {
-				panic("Unexpected AND token")
+	return &AggregateExpr{node{tok.offset}, agg}, nil
+}
+
+// Parses the query and converts its syntax tree in to a selectQuery,
+// with ConditionTrees for the WHERE and the HAVING clauses. However,
+// the conditions will have just the column names resolved but not the
+// column types. The caller of parser should take care of filling the
+// column types in the condTree that is returned, before using it in
+// an eval function.
+func parseQuery(sql string) (*selectQuery, error) {
+	toks, err := tokenize(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{sql: sql, toks: toks}
+	s, err := p.parseSelect()
+	if err != nil {
+		return nil, err
+	}
+
+	q := &selectQuery{distinct: s.Distinct, from: s.From,
+		params: queryParams(s)}
+
+	// Maps the aliases to their items
+	aliases := make(map[string]selectItem)
+
+	for _, i := range s.Items {
+		item := selectItem{name: i.Alias}
+		switch e := i.Expr.(type) {
+		case *ColumnRef:
+			item.colName = e.Name
+		case *AggregateExpr:
+			agg := e.Aggregate
+			item.agg = &agg
+		default:
+			if err = p.noAggregates(e, "expressions"); err != nil {
+				return nil, err
 			}
+			item.expr = e
+		}
+		if item.name == "" {
+			item.name = exprName(i.Expr)
+		}
+		if i.Alias != "" {
+			aliases[i.Alias] = item
+		}
+		q.items = append(q.items, item)
+	}
 
-			// LHS of the AND keyword
-			if toks[pos-1].tokType == CONDITION_PTR_TOK {
-				cTree.conditions = append(cTree.conditions, toks[pos-1].value.(*Condition))
-			} else if toks[pos-1].tokType == CONDITION_TREE_PTR_TOK {
-				cTree.children = append(cTree.children, toks[pos-1].value.(*ConditionTree))
-			} else {
-				panic("Malformed Query: Unexepected token before AND keyword")
+	if s.Where != nil {
+		if err = p.noAggregates(s.Where, "WHERE"); err != nil {
+			return nil, err
+		}
+		if q.condTree, err = p.condTree(s.Where, "WHERE"); err != nil {
+			return nil, err
+		}
+	}
+
+	// An expression in the GROUP BY can also be given by its alias
+	for _, e := range s.GroupBy {
+		if err = p.noAggregates(e, "GROUP BY"); err != nil {
+			return nil, err
+		}
+		if c, ok := e.(*ColumnRef); ok {
+			if item, ok := aliases[c.Name]; !ok || item.expr == nil {
+				q.groupBy = append(q.groupBy, c.Name)
+				q.groupExprs = append(q.groupExprs, nil)
+				continue
+			}
+			e = aliases[c.Name].expr
+		}
+		q.groupBy = append(q.groupBy, exprName(e))
+		q.groupExprs = append(q.groupExprs, e)
+	}
+
+	if s.Having != nil {
+		if q.having, err = p.condTree(s.Having, "HAVING"); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, i := range s.OrderBy {
+		// An integer is the position of a SELECT list item
+		if l, ok := i.Expr.(*Literal); ok && !l.Quoted {
+			if n, err := strconv.Atoi(l.Value); err == nil {
+				q.orderBy = append(q.orderBy, orderItem{pos: n, desc: i.Desc})
+				continue
 			}
+		}
 
-			if (pos + 1) > hi {
-				panic("Malformed Query: No token found after AND keyword")
+		switch i.Expr.(type) {
+		case *ColumnRef, *AggregateExpr:
+		default:
+			if err = p.noAggregates(i.Expr, "expressions"); err != nil {
+				return nil, err
 			}
+			q.orderBy = append(q.orderBy, orderItem{name: exprName(i.Expr),
+				desc: i.Desc, expr: i.Expr})
+			continue
+		}
+
+		name, err := p.columnName(i.Expr, "ORDER BY")
+		if err != nil {
+			return nil, err
+		}
 
-			// RHS of the AND keyword
-			if toks[pos+1].tokType == CONDITION_PTR_TOK {
-				cTree.conditions = append(cTree.conditions, toks[pos+1].value.(*Condition))
-			} else if toks[pos+1].tokType == CONDITION_TREE_PTR_TOK {
-				cTree.children = append(cTree.children, toks[pos+1].value.(*ConditionTree))
+		o := orderItem{name: name, desc: i.Desc}
+		if item, ok := aliases[name]; ok {
+			if item.expr != nil {
+				o.alias = true
+			} else if item.agg != nil {
+				o.name = item.agg.String()
 			} else {
-				panic("Malformed Query: Unexepected token after AND keyword")
+				o.name = item.colName
 			}
+		}
+		q.orderBy = append(q.orderBy, o)
+	}
 
-			// Insert the new cTree in place of the AND keyword
-			// and the tokens on either side
-			t := toks[:pos-1]
-			t = append(t, sqlTokens{CONDITION_TREE_PTR_TOK, cTree})
-			if pos+2 <= hi {
-				t = append(t, toks[pos+2:]...)
-			}
-			toks = t
+	return q, nil
+}
+
+// Returns the name of a result column that has no alias, which is
+// the expression as SQL, without the outermost parentheses
+func exprName(e Expr) string {
+	name := formatExpr(e)
+	switch e.(type) {
+	case *ArithmeticExpr, *UnaryExpr:
+		name = name[1 : len(name)-1]
+	}
+	return name
+}
 
-			// Two tokens are removed in the toks
-			hi -= 2
+// Returns an error if the expression has any aggregates
+func (p *parser) noAggregates(e Expr, where string) error {
+	var err error
+	walkExpr(e, func(x Expr) {
+		if _, ok := x.(*AggregateExpr); ok && err == nil {
+			err = p.errorAt(x, "Aggregates are not allowed in %s", where)
+		}
+	})
+	return err
+}
 
-			// This is needed to retain pos in the same position,
-			// as the for loop 3rd statement will also increment pos
-			pos--
+// Returns the name of the column, or the name of the aggregate as
+// returned by Aggregate.String(), which is how the aggregates are
+// referred to in the conditions of a HAVING clause
+func (p *parser) columnName(e Expr, clause string) (string, error) {
+	switch e := e.(type) {
+	case *ColumnRef:
+		return e.Name, nil
+	case *AggregateExpr:
+		if clause == "WHERE" {
+			return "", p.errorAt(e, "Aggregates are not allowed in WHERE")
 		}
+		return e.Aggregate.String(), nil
 	}
+	return "", p.errorAt(e, "Expected a column name")
+}
 
-	// Handle OR tokens
-	// At this stage, toks[lo:hi] can have only Conditions,
-	// ConditionTrees and LogicalOperators.
-	//
-	// toks[lo:hi] should not have any parantheses
-	for pos := lo; pos < hi; pos++ {
-		if toks[pos].tokType == OR_TOK {
+// Returns true if the condition is over a single column, or over
+// an aggregate in a HAVING clause, and has only literal values or
+// parameters, like col1 > 5, as such conditions are evaluated directly
+// over the column, instead of being evaluated as expressions
+func isColumnCondition(x Expr, values []Expr, clause string) bool {
+	switch x.(type) {
+	case *ColumnRef:
+	case *AggregateExpr:
+		if clause != "HAVING" {
+			return false
+		}
+	default:
+		return false
+	}
 
-			cTree := &ConditionTree{}
-			cTree.op = OR
+	for _, v := range values {
+		switch v.(type) {
+		case *Literal, *Param:
+		default:
+			return false
+		}
+	}
+	return true
+}
 
-			if pos == lo {
-				panic("Unexpected OR token")
-			}
+// Converts the conditions of a WHERE or a HAVING clause
+// in to a ConditionTree, which always has an operator
+func (p *parser) condTree(e Expr, clause string) (*ConditionTree, error) {
+	t, c, err := p.lower(e, clause)
+	if c != nil {
+		// A lone condition, without any logical operators
+		t = &ConditionTree{op: AND, conditions: []*Condition{c}}
+	}
+	return t, err
+}
+
+// Converts the expression in to either a ConditionTree or a single
+// Condition. A chain of the same logical operator, like a AND b AND c,
+// becomes a single ConditionTree, so that it is evaluated in one go.
+func (p *parser) lower(e Expr, clause string) (*ConditionTree, *Condition, error) {
+
+	newCondition := func(op RelationalOperator, x Expr,
+		values []Expr) (*ConditionTree, *Condition, error) {
+
+		cond := &Condition{
+			op: op,
+			colDesc: ColumnDesc{
+				ColType: unRecognizedColumn,
+			},
+		}
+
+		if !isColumnCondition(x, values, clause) {
+			cond.expr = e
+			return nil, cond, nil
+		}
+
+		cond.colDesc.ColName, _ = p.columnName(x, clause)
 
-			// LHS of the AND keyword
-			if toks[pos-1].tokType == CONDITION_PTR_TOK {
-				cTree.conditions = append(cTree.conditions, toks[pos-1].value.(*Condition))
-			} else if toks[pos-1].tokType == CONDITION_TREE_PTR_TOK {
-				cTree.children = append(cTree.children, toks[pos-1].value.(*ConditionTree))
+		// The literals are kept as strings, to be converted to the
+		// type of the column, while the parameters are kept as they
+		// are, as their values are already typed
+		var list []interface{}
+		for _, v := range values {
+			if l, ok := v.(*Literal); ok {
+				list = append(list, l.Value)
 			} else {
-				panic("Malformed Query: Unexepected token before OR keyword")
+				list = append(list, v)
 			}
+		}
+		if op == IN || op == NOTIN || op == BETWEEN {
+			cond.raw = list
+		} else {
+			cond.raw = list[0]
+		}
+		return nil, cond, nil
+	}
 
-			if (pos + 1) > hi {
-				panic("Malformed Query: No token found after OR keyword")
-			}
+	switch e := e.(type) {
+	case *BinaryExpr, *NotExpr:
+		t := &ConditionTree{op: NOT}
+		operands := []Expr{}
+		if b, ok := e.(*BinaryExpr); ok {
+			t.op = b.Op
+			operands = append(operands, b.Left, b.Right)
+		} else {
+			operands = append(operands, e.(*NotExpr).X)
+		}
 
-			// RHS of the AND keyword
-			if toks[pos+1].tokType == CONDITION_PTR_TOK {
-				cTree.conditions = append(cTree.conditions, toks[pos+1].value.(*Condition))
-			} else if toks[pos+1].tokType == CONDITION_TREE_PTR_TOK {
-				cTree.children = append(cTree.children, toks[pos+1].value.(*ConditionTree))
+		for _, x := range operands {
+			chi, c, err := p.lower(x, clause)
+			if err != nil {
+				return nil, nil, err
+			}
+			if c != nil {
+				t.conditions = append(t.conditions, c)
+			} else if b, ok := x.(*BinaryExpr); ok && b.Op == t.op {
+				t.conditions = append(t.conditions, chi.conditions...)
+				t.children = append(t.children, chi.children...)
 			} else {
-				panic("Malformed Query: Unexepected token after OR keyword")
+				t.children = append(t.children, chi)
 			}
+		}
+		return t, nil, nil
 
-			// Insert the new cTree in place of the AND keyword
-			// and the tokens on either side
-			t := toks[:pos-1]
-			t = append(t, sqlTokens{CONDITION_TREE_PTR_TOK, cTree})
-			if pos+2 <= hi {
-				t = append(t, toks[pos+2:]...)
-			}
-			toks = t
+	case *ComparisonExpr:
+		return newCondition(e.Op, e.Left, []Expr{e.Right})
 
-			// Two tokens are removed in the toks
-			hi -= 2
+	case *InExpr:
+		return newCondition(e.Op, e.X, e.List)
 
-			// This is needed to retain pos in the same position,
-			// as the for loop 3rd statement will also increment pos
-			pos--
-		}
+	case *BetweenExpr:
+		return newCondition(BETWEEN, e.X, []Expr{e.Lo, e.Hi})
 	}
 
-	return toks[lo].value.(*ConditionTree)
+	return nil, nil, p.errorAt(e, "Expected a condition")
 }
@@ -0,0 +1,226 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseSelect(t *testing.T) {
+	s, err := ParseSelect(`SELECT DISTINCT c.name, COUNT(*) FROM customers c
+	LEFT JOIN orders o ON o.customer = c.id
+	WHERE NOT c.id IN (1, 2) AND (c.name LIKE 'a%' OR c.id BETWEEN 5 AND 10)
+	GROUP BY c.name HAVING COUNT(*) > 1 ORDER BY c.name DESC`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.Distinct || len(s.Items) != 2 || len(s.From) != 2 ||
+		len(s.GroupBy) != 1 || len(s.OrderBy) != 1 || !s.OrderBy[0].Desc {
+		t.Fatalf("Unexpected syntax tree: %+v", s)
+	}
+
+	if agg, ok := s.Items[1].Expr.(*AggregateExpr); !ok ||
+		agg.Aggregate.String() != "COUNT(*)" {
+		t.Errorf("Want: COUNT(*) Got: %+v", s.Items[1].Expr)
+	}
+
+	and, ok := s.Where.(*BinaryExpr)
+	if !ok || and.Op != AND {
+		t.Fatalf("Want: AND Got: %+v", s.Where)
+	}
+	if _, ok := and.Left.(*NotExpr); !ok {
+		t.Errorf("Want: NOT Got: %+v", and.Left)
+	}
+	if or, ok := and.Right.(*BinaryExpr); !ok || or.Op != OR {
+		t.Errorf("Want: OR Got: %+v", and.Right)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		query string
+		want  ParseError
+	}{
+		{"SELEC col1 FROM table1",
+			ParseError{1, 1, "SELEC", "Expected 'SELECT'"}},
+		{"SELECT col1 FROM table1 WHERE (col1 = 1",
+			ParseError{1, 40, "", "Expected ')'"}},
+		{"SELECT col1 FROM table1\nWHERE col1 = 1)",
+			ParseError{2, 15, ")", "Unexpected ')'"}},
+		{"SELECT col1 FROM table1\n  WHERE col2 = 'abc",
+			ParseError{2, 16, "'abc", "quote not closed"}},
+		{"SELECT col1 FROM table1 WHERE col1 ! 1",
+			ParseError{1, 36, "!", "Unexpected token '!'"}},
+		{"SELECT col1 FROM table1 WHERE col1 + 1",
+			ParseError{1, 36, "+", "Expected a condition"}},
+		{"SELECT col1 FROM table1 WHERE col1 = (1 + 2",
+			ParseError{1, 44, "", "Expected ')'"}},
+		{"SELECT LOWER(col2, col1) FROM table1",
+			ParseError{1, 8, "LOWER", "Wrong number of arguments for LOWER"}},
+		{"SELECT CASE WHEN col1 > 1 THEN 1 FROM table1",
+			ParseError{1, 34, "FROM", "Expected 'END'"}},
+		{"SELECT col1 FROM table1 WHERE col1 = $0",
+			ParseError{1, 38, "$0", "Invalid parameter '$0'"}},
+		{"SELECT col1 FROM table1 WHERE col1 = ? AND col2 = :name",
+			ParseError{1, 51, ":name", "Unexpected ':name' in a query with '?'"}},
+		{"SELECT col1 FROM table1 WHERE COUNT(*) > 1",
+			ParseError{1, 31, "COUNT", "Aggregates are not allowed in WHERE"}},
+		{"SELECT FOO(col1) FROM table1",
+			ParseError{1, 8, "FOO", "Unknown function 'FOO'"}},
+		{"SELECT NEXTVAL('s') FROM table1",
+			ParseError{1, 8, "NEXTVAL",
+				"NEXTVAL is allowed only as a value of an INSERT or as a DEFAULT"}},
+		{"SELECT col1 FROM table1 WHERE col1 NOT = 1",
+			ParseError{1, 40, "=",
+				"Expected IN, BETWEEN, LIKE, ILIKE or REGEXP after 'NOT'"}},
+	}
+
+	for _, i := range cases {
+		t.Log(i.query)
+		_, err := parseQuery(i.query)
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Want: a *ParseError Got: %v", err)
+			continue
+		}
+		if *pe != i.want {
+			t.Errorf("Want: %+v Got: %+v", i.want, *pe)
+		}
+	}
+}
+
+func TestParseExecErrors(t *testing.T) {
+	cases := []struct {
+		sql  string
+		want ParseError
+	}{
+		{"MERGE INTO t", ParseError{1, 1, "MERGE",
+			"Expected CREATE, DROP, ALTER, TRUNCATE, INSERT, UPDATE or DELETE"}},
+		{"DELETE t WHERE id = 1", ParseError{1, 8, "t", "Expected 'FROM'"}},
+		{"CREATE TABLE t (id INT REFERENCES p ON UPDATE CASCADE)",
+			ParseError{1, 40, "UPDATE", "Expected 'DELETE'"}},
+		{"CREATE TABLE t (id INT REFERENCES p ON DELETE NOTHING)",
+			ParseError{1, 47, "NOTHING", "Expected RESTRICT, CASCADE or SET NULL"}},
+		{"CREATE TABLE t (id INT, FOREIGN KEY (id) p)", ParseError{1, 42, "p",
+			"Expected 'REFERENCES'"}},
+		{"CREATE TABLE t (id INT PRIMARY KEY, PRIMARY KEY (id))",
+			ParseError{1, 37, "PRIMARY", "Duplicate primary key"}},
+		{"CREATE TABLE t (id INT, UNIQUE (id, id))", ParseError{1, 37, "id",
+			"Duplicate column 'id'"}},
+		{"INSERT INTO t VALUES (1) ON CONFLICT DO SOMETHING", ParseError{1, 41,
+			"SOMETHING", "Expected 'UPDATE'"}},
+		{"INSERT INTO t VALUES (1) ON CONFLICT DO UPDATE SET n = COUNT(*)",
+			ParseError{1, 56, "COUNT", "Aggregates are not allowed in SET"}},
+		{"UPDATE t SET a = 1, a = 2", ParseError{1, 21, "a",
+			"Duplicate column 'a'"}},
+		{"UPDATE t SET a = 1 WHERE", ParseError{1, 25, "",
+			"Expected a column name or a value"}},
+		{"CREATE TABLE t (id FLOAT)", ParseError{1, 20, "FLOAT",
+			"Expected a column type"}},
+		{"CREATE TABLE t (id INT, id TEXT)", ParseError{1, 25, "id",
+			"Duplicate column 'id'"}},
+		{"CREATE TABLE t (id INT COLLATE UNICODE)", ParseError{1, 32, "UNICODE",
+			"Unexpected collation for an integer column"}},
+		{"CREATE TABLE a.t (id INT)", ParseError{1, 14, "a.t",
+			"Unexpected '.' in a table name"}},
+		{"DROP TABLE IF t", ParseError{1, 15, "t", "Expected 'EXISTS'"}},
+		{"ALTER TABLE t MODIFY id INT", ParseError{1, 15, "MODIFY",
+			"Expected ADD, DROP or RENAME"}},
+		{"ALTER TABLE t ADD COLUMN n INT DEFAULT 1 + n", ParseError{1, 44, "n",
+			"Unexpected column 'n' in DEFAULT"}},
+		{"ALTER TABLE t ADD COLUMN n INT PRIMARY KEY", ParseError{1, 32,
+			"PRIMARY", "Unexpected 'PRIMARY'"}},
+		{"CREATE TABLE t (id INT NOT 1)", ParseError{1, 28, "1",
+			"Expected 'NULL'"}},
+		{"CREATE TABLE t (id INT CHECK (COUNT(id) > 1))", ParseError{1, 31,
+			"COUNT", "Aggregates are not allowed in CHECK"}},
+		{"CREATE TABLE t (id INT CHECK (id > ?))", ParseError{1, 36, "?",
+			"Unexpected parameter in CHECK"}},
+		{"CREATE TABLE t (id INT, CONSTRAINT positive (id > 0))",
+			ParseError{1, 45, "(", "Expected CHECK or FOREIGN KEY"}},
+		{"CREATE TABLE t (id INT) APPEND", ParseError{1, 31, "",
+			"Expected 'ONLY'"}},
+		{"ALTER TABLE t RENAME id x", ParseError{1, 25, "x", "Expected 'TO'"}},
+		{"TRUNCATE TABLE t RESTART", ParseError{1, 25, "",
+			"Expected 'IDENTITY'"}},
+		{"INSERT INTO t VALUES (1, id)", ParseError{1, 26, "id",
+			"Expected a value"}},
+		{"INSERT INTO t VALUES (1) x", ParseError{1, 26, "x", "Unexpected 'x'"}},
+		{"INSERT INTO t VALUES (NEXTVAL(s))", ParseError{1, 31, "s",
+			"Expected the name of a sequence"}},
+		{"INSERT INTO t VALUES (1) RETURNING t.id", ParseError{1, 36, "t.id",
+			"Unexpected '.' in a column name"}},
+		{"CREATE SEQUENCE s START 'a'", ParseError{1, 25, "'a'",
+			"Expected an integer"}},
+		{"CREATE SEQUENCE s INCREMENT BY 0", ParseError{1, 19, "INCREMENT",
+			"The INCREMENT can not be 0"}},
+		{"DROP SEQUENCE IF s", ParseError{1, 18, "s", "Expected 'EXISTS'"}},
+	}
+
+	for _, i := range cases {
+		t.Log(i.sql)
+		_, err := parseExec(i.sql)
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Want: a *ParseError Got: %v", err)
+			continue
+		}
+		if *pe != i.want {
+			t.Errorf("Want: %+v Got: %+v", i.want, *pe)
+		}
+	}
+}
+
+// Malformed queries should only ever return errors
+func FuzzSelect(f *testing.F) {
+	for _, query := range []string{
+		"SELECT col1, col2 FROM table1 WHERE col2='STRDATA1'",
+		"SELECT col1 FROM table1 WHERE (col1 > 18 AND col2='  f ' OR col1 != 2)",
+		"SELECT COUNT(*), SUM(col1), MAX( col2 ) FROM table1 WHERE col1 > 1",
+		"SELECT col2, COUNT(DISTINCT col1) FROM table1 GROUP BY col2 HAVING COUNT(*) > 1",
+		"SELECT DISTINCT col2 FROM table1 ORDER BY col2 DESC",
+		"SELECT a.col1, b.col3 FROM table1 a LEFT JOIN table1 b ON a.col1 = b.col1",
+		"SELECT col1 FROM table1 WHERE NOT col2 IN ('a', 'b') OR col1 BETWEEN 1 AND 5",
+		"SELECT col1 FROM table1 WHERE col2 NOT LIKE 'a%' AND col2 ~ '^[a-z]'",
+		"SELECT col3 FROM table1 WHERE col3 = 1",
+		"SELECT *, col1 AS c FROM table1 ORDER BY c",
+		"SELECT col1 * 2 AS d, UPPER(col2) FROM table1 WHERE col1 % 3 = 1 ORDER BY d",
+		"SELECT SUBSTR(col2, 2, 2), COALESCE(col2, 'x') FROM table1 WHERE -col1 < ABS(col1 - 5)",
+		"SELECT CASE col2 WHEN 'a' THEN 1 ELSE col1 END AS k, COUNT(*) FROM table1 GROUP BY k",
+		"SELECT col1 FROM table1 ORDER BY CASE WHEN col1 > 2 AND NOT col2 = 'x' THEN col1 END DESC",
+		"SELECT col1 FROM table1 WHERE col1 > ? AND col2 IN (?, 'x')",
+		"SELECT col1 + $1 FROM table1 WHERE col2 LIKE $2 ORDER BY $1",
+		"SELECT col1 FROM table1 WHERE col1 = :id",
+		"SELECT col1 FROM table1 WHERE col1 ! 1",
+		"SELECT col1 FROM table1 WHERE col2 = 'abc",
+	} {
+		f.Add(query)
+	}
+
+	db := &Keeri{}
+	_ = db.CreateTable("table1",
+		ColumnDesc{ColName: "col1", ColType: IntColumn},
+		ColumnDesc{ColName: "col2", ColType: StringColumn},
+		ColumnDesc{ColName: "col3", ColType: CustomColumn})
+	for i := 0; i < 10; i++ {
+		_ = db.Insert("table1", i, fmt.Sprint("str", i%3), point{i, i})
+	}
+
+	f.Fuzz(func(t *testing.T, query string) {
+		_, _ = db.Select(query)
+		_, _ = db.Select(query, 1, "str1")
+		_, _ = db.Select(query, map[string]interface{}{"id": 2})
+
+		if _, err := ParseSelect(query); err != nil {
+			if _, ok := err.(*ParseError); !ok {
+				t.Errorf("Want: a *ParseError Got: %v", err)
+			}
+		}
+	})
+}
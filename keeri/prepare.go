@@ -0,0 +1,289 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Number of the statements prepared for the Select calls,
+// that are kept for the queries that are run again
+const stmtCacheSize = 128
+
+// Returned by runPlan when the columns of the table of the
+// plan have changed since it was made, and it is made again
+var errStalePlan = errors.New("Stale plan")
+
+// A SELECT query that is parsed and resolved against its tables only
+// once, and can then be run any number of times with different args.
+// A Stmt is safe for concurrent use. It is prepared again on its own,
+// if any of its tables is replaced or has its columns changed.
+type Stmt struct {
+	db  *Keeri
+	sql string
+
+	// The plans that are not being run. A plan keeps the state of a
+	// run, like the bound parameters, so every run takes a plan for
+	// itself, and a new plan is made if none are left.
+	plans     []*plan
+	plansLock sync.Mutex
+}
+
+// A query that is parsed and resolved against its tables
+type plan struct {
+	q *selectQuery
+
+	// The tables in the FROM, with their versions when
+	// the query was resolved against them
+	tbls     []*table
+	versions []uint64
+
+	// The table that the query is run over, which is nil for a join,
+	// as the rows are joined every time that the query is run, with
+	// the needed columns
+	tbl    *table
+	needed []string
+
+	// The conditions of the WHERE of a join that use the columns of
+	// only one table, by the position of the table, which filter the
+	// rows of the table before they are joined
+	pushed []*ConditionTree
+}
+
+// Prepares the SELECT query, to be run with Stmt.Query
+func (db *Keeri) Prepare(sql string) (*Stmt, error) {
+	p, err := db.newPlan(sql)
+	if err != nil {
+		return nil, err
+	}
+	return &Stmt{db: db, sql: sql, plans: []*plan{p}}, nil
+}
+
+// Binds the args to the parameters of the query, the same way
+// as Select does, and runs the query
+func (s *Stmt) Query(args ...interface{}) (*ResultSet, error) {
+	for {
+		p, err := s.takePlan()
+		if err != nil {
+			return nil, err
+		}
+
+		rs, err := s.db.runPlan(p, args)
+		if err == errStalePlan {
+			continue
+		}
+		s.putPlan(p)
+		return rs, err
+	}
+}
+
+// Returns a plan that is not being run and is still
+// valid for the tables, or prepares a new plan
+func (s *Stmt) takePlan() (*plan, error) {
+	s.plansLock.Lock()
+	for len(s.plans) > 0 {
+		p := s.plans[len(s.plans)-1]
+		s.plans = s.plans[:len(s.plans)-1]
+		if s.db.isCurrent(p) {
+			s.plansLock.Unlock()
+			return p, nil
+		}
+	}
+	s.plansLock.Unlock()
+
+	return s.db.newPlan(s.sql)
+}
+
+func (s *Stmt) putPlan(p *plan) {
+	s.plansLock.Lock()
+	s.plans = append(s.plans, p)
+	s.plansLock.Unlock()
+}
+
+// Returns true if none of the tables of the plan
+// have been replaced or had their columns changed
+func (db *Keeri) isCurrent(p *plan) bool {
+	db.tblNamesLock.RLock()
+	defer db.tblNamesLock.RUnlock()
+
+	for i, j := range p.q.from {
+		if db.tables[j.TableName] != p.tbls[i] {
+			return false
+		}
+	}
+
+	for i, t := range p.tbls {
+		t.dataMetaDataLock.RLock()
+		version := t.version
+		t.dataMetaDataLock.RUnlock()
+		if version != p.versions[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses the query and resolves it against its tables
+func (db *Keeri) newPlan(sql string) (p *plan, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			p = nil
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+
+	q, err := parseQuery(sql)
+	if err != nil {
+		return nil, err
+	}
+	condTree := q.condTree
+
+	p = &plan{q: q}
+	if p.tbls, err = db.fromTables(q); err != nil {
+		return nil, err
+	}
+
+	// The versions are read before the query is resolved, so that
+	// any change to the columns while resolving makes the plan stale
+	for _, t := range p.tbls {
+		t.dataMetaDataLock.RLock()
+		p.versions = append(p.versions, t.version)
+		t.dataMetaDataLock.RUnlock()
+	}
+
+	if p.needed, err = resolveColumns(q, p.tbls); err != nil {
+		return nil, err
+	}
+
+	if len(p.tbls) == 1 {
+		p.tbl = p.tbls[0]
+		if condTree != nil {
+			p.tbl.dataMetaDataLock.RLock()
+			defer p.tbl.dataMetaDataLock.RUnlock()
+			resolveColDetails(p.tbl, condTree)
+		}
+	} else if q.condTree != nil {
+		q.condTree, p.pushed = pushDownConditions(q.from, q.condTree)
+	}
+	return p, nil
+}
+
+// Binds the args and runs the query of the plan
+func (db *Keeri) runPlan(p *plan, args []interface{}) (ret *ResultSet,
+	err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			ret = nil
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+
+	q := p.q
+	if err = bindParams(q.params, args); err != nil {
+		return nil, err
+	}
+
+	tbl := p.tbl
+	if tbl == nil {
+		tbl, err = db.joinTables(q.from, p.needed, p.pushed)
+		if err != nil {
+			return nil, err
+		}
+		if q.condTree != nil {
+			resolveColDetails(tbl, q.condTree)
+		}
+	} else {
+		// The conditions are resolved against the columns of the table,
+		// which may have been replaced since the plan was checked
+		tbl.dataMetaDataLock.RLock()
+		defer tbl.dataMetaDataLock.RUnlock()
+		if tbl.version != p.versions[0] {
+			return nil, errStalePlan
+		}
+		if q.condTree != nil {
+			bindConditions(q.condTree)
+		}
+	}
+
+	rows, err := selectRows(tbl, q)
+	if err != nil {
+		return nil, err
+	}
+
+	cols, err := resultColumns(tbl, q)
+	if err != nil {
+		return nil, err
+	}
+
+	ret = &ResultSet{Columns: cols}
+	for _, row := range rows {
+		ret.Rows = append(ret.Rows, row.([]interface{}))
+	}
+	return ret, nil
+}
+
+// An LRU cache of the statements prepared for the Select
+// calls, keyed by the SQL text of their queries
+type stmtCache struct {
+	lock sync.Mutex
+
+	// The *Stmts, with the most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// Returns the cached statement for the query,
+// preparing and caching it if it is not cached
+func (c *stmtCache) get(db *Keeri, sql string) (*Stmt, error) {
+	c.lock.Lock()
+	if e, ok := c.entries[sql]; ok {
+		c.lru.MoveToFront(e)
+		c.lock.Unlock()
+		return e.Value.(*Stmt), nil
+	}
+	c.lock.Unlock()
+
+	s, err := db.Prepare(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.entries == nil {
+		c.lru = list.New()
+		c.entries = make(map[string]*list.Element)
+	}
+
+	// The query may have been prepared by another call meanwhile
+	if e, ok := c.entries[sql]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*Stmt), nil
+	}
+
+	c.entries[sql] = c.lru.PushFront(s)
+	if c.lru.Len() > stmtCacheSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*Stmt).sql)
+	}
+	return s, nil
+}
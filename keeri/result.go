@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import "fmt"
+
+// A column in the result of a query. The Name is the alias given in
+// the query, or the column or the aggregate, like "col1" or "COUNT(*)",
+// or else the expression as it is parsed, with the names of the
+// functions in upper case, a space around every operator, and the
+// operations inside others in parentheses, so that abs(price-3) is
+// "ABS((price - 3))" and a+b*2 is "a + (b * 2)". A column of a
+// SELECT * is named after the column of the table, without any
+// qualification.
+type ResultColumn struct {
+	Name string
+
+	// The type of the values. An AVG, which returns
+	// a float64, is reported as a CustomColumn.
+	Type ColumnType
+}
+
+// The result of a query. Every row has one value for
+// every column, in the same order as the Columns.
+type ResultSet struct {
+	Columns []ResultColumn
+	Rows    [][]interface{}
+}
+
+// Returns the position of the named column in the
+// Columns, or -1 if there is no such column
+func (r *ResultSet) ColumnIndex(name string) int {
+	for i, c := range r.Columns {
+		if c.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the columns of the result of the query, which
+// has to be run over the tbl, after expanding the stars.
+// Not threadsafe. Caller should have acquired readlock
+func resultColumns(tbl *table, q *selectQuery) ([]ResultColumn, error) {
+	var cols []ResultColumn
+	for _, i := range q.items {
+		if i.agg != nil {
+			a, err := newAggregator(tbl, *i.agg)
+			if err != nil {
+				return nil, err
+			}
+			cols = append(cols, ResultColumn{i.name, a.resultType()})
+			continue
+		}
+
+		if i.expr != nil {
+			ev, err := compileExpr(tbl, i.expr)
+			if err != nil {
+				return nil, err
+			}
+			cols = append(cols, ResultColumn{i.name, ev.colType()})
+			continue
+		}
+
+		desc, ok := tbl.colDesc(i.colName)
+		if !ok {
+			return nil, fmt.Errorf("Invalid column name: %s", i.colName)
+		}
+		cols = append(cols, ResultColumn{i.name, desc.ColType})
+	}
+	return cols, nil
+}
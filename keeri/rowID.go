@@ -33,3 +33,35 @@ func sortAndDeDup(arr []rowID) []rowID {
 
 	return ret
 }
+
+// Returns the rowIDs that are in both a and b, which should be sorted
+func intersect(a, b []rowID) []rowID {
+	var ret []rowID
+	j := 0
+	for _, id := range a {
+		for j < len(b) && b[j] < id {
+			j++
+		}
+		if j < len(b) && b[j] == id {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+// Returns the rowIDs in all that are not in rows.
+// Both all and rows should be sorted.
+func complement(all, rows []rowID) []rowID {
+	var ret []rowID
+	j := 0
+	for _, id := range all {
+		for j < len(rows) && rows[j] < id {
+			j++
+		}
+		if j < len(rows) && rows[j] == id {
+			continue
+		}
+		ret = append(ret, id)
+	}
+	return ret
+}
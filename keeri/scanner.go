@@ -10,6 +10,7 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -18,7 +19,8 @@ import (
 func isDelim(r rune) bool {
 	return unicode.IsSpace(r) || (r == ',') || (r == '<') || (r == '>') ||
 		(r == '=') || (r == '"') || (r == '\'') || (r == '(') || (r == ')' ||
-		(r == '!'))
+		(r == '!') || (r == '~') || (r == '+') || (r == '-') || (r == '*') ||
+		(r == '/') || (r == '%') || (r == '?'))
 }
 
 func scanSQLWords(data []byte, atEOF bool) (advance int,
@@ -40,34 +42,39 @@ func scanSQLWords(data []byte, atEOF bool) (advance int,
 							return j + innerWidth, data[1 : j+innerWidth-1], nil
 						}
 					}
+					if !atEOF {
+						// The closing quote may be in the data yet to be read
+						return 0, nil, nil
+					}
 					return 0, nil, errors.New("quote not closed")
 				} else if r == '>' || r == '<' {
+					if len(data) < 2 && !atEOF {
+						return 0, nil, nil
+					}
 					l, iw := utf8.DecodeRune(data[1:])
 					if l == '=' {
 						// assert width == 1 && iw == 1 && start == 0
 						return 1 + iw, data[start : width+iw], nil
 					}
 				} else if r == '!' {
-					// Should we call utf8.DecodeRune similar to the <= >= handling ?
-					if data[1] != '=' {
+					if len(data) < 2 && !atEOF {
+						return 0, nil, nil
+					}
+					if len(data) < 2 || data[1] != '=' {
 						return 0, nil, errors.New("Unexpected token '!'")
 					}
 					return 2, data[0:2], nil
 				} else if unicode.IsSpace(r) {
 					// Eliminate all styles of whitespace with
-					// a simple blank whitespace, to make the
-					// skipEmptyWords function in parser simple.
-					//
-					// Refer to its history to know what to do
-					// if we dont do this simplification here.
+					// a simple blank whitespace, so that the
+					// callers need to check for just the blank.
 					return width, []byte(" "), nil
 				}
 				return width, data[start:width], nil
 			}
 
-			// The below (i+width-1) will be valid only until
-			// all the delimiters are only 1 character wide
-			return i + width - 1, data[start:i], nil
+			// The delimiter is left to be scanned as the next word
+			return i, data[start:i], nil
 		}
 	}
 
@@ -100,3 +107,109 @@ func splitSQL(input string) ([]string, error) {
 
 	return ret, nil
 }
+
+// The kinds of the tokens returned by tokenize
+type tokenKind int
+
+const (
+	// A keyword, a name or a number
+	wordToken tokenKind = iota
+
+	// A quoted string, whose text is without the quotes
+	stringToken
+
+	// An operator, a parenthesis, a comma or a *
+	symbolToken
+
+	// A parameter, which is a ?, a $n or a :name
+	paramToken
+
+	// The end of the query
+	eofToken
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	offset int
+}
+
+// Splits the sql string into tokens, skipping the whitespace. Every
+// token has its byte offset in the sql, for the errors to point at.
+// The last token is always an eofToken.
+func tokenize(sql string) ([]token, error) {
+	data := []byte(sql)
+
+	var toks []token
+	for offset := 0; offset < len(data); {
+		advance, word, err := scanSQLWords(data[offset:], true)
+		if err != nil {
+			return nil, newParseError(sql, offset, nearText(sql, offset),
+				err.Error())
+		}
+		if advance <= 0 {
+			break
+		}
+
+		r, _ := utf8.DecodeRune(data[offset:])
+		switch {
+		case unicode.IsSpace(r):
+		case r == '\'' || r == '"':
+			toks = append(toks, token{stringToken, string(word), offset})
+		case r == '?' || r == '$' || r == ':':
+			if !isParam(string(word)) {
+				return nil, newParseError(sql, offset, string(word),
+					fmt.Sprintf("Invalid parameter '%s'", word))
+			}
+			toks = append(toks, token{paramToken, string(word), offset})
+		case isDelim(r):
+			toks = append(toks, token{symbolToken, string(word), offset})
+		default:
+			toks = append(toks, token{wordToken, string(word), offset})
+		}
+		offset += advance
+	}
+
+	return append(toks, token{eofToken, "", len(sql)}), nil
+}
+
+// Returns true for a ?, for a $ followed by a positive
+// number, and for a : followed by a name
+func isParam(word string) bool {
+	if word == "?" {
+		return true
+	}
+	if len(word) < 2 {
+		return false
+	}
+
+	name := word[1:]
+	switch word[0] {
+	case '$':
+		n, err := strconv.Atoi(name)
+		return err == nil && n > 0
+	case ':':
+		for i, r := range name {
+			if !(r == '_' || unicode.IsLetter(r) || i > 0 && unicode.IsDigit(r)) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Returns the text of the sql from the offset until the
+// next whitespace, to be shown as the Near of an error
+func nearText(sql string, offset int) string {
+	const maxRunes = 16
+
+	near := []rune{}
+	for _, r := range sql[offset:] {
+		if unicode.IsSpace(r) || len(near) == maxRunes {
+			break
+		}
+		near = append(near, r)
+	}
+	return string(near)
+}
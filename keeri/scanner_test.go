@@ -39,6 +39,12 @@ func Test_splitSQL(t *testing.T) {
 				" ", "OR", " ", "status", "!=", "s", " ", "AND", " ", "(",
 				"col1", " ", "<=", " ", "2", " ", "OR", " ", "col2", " ", ">=",
 				"1", ")", " ", ")"}},
+
+		{"Query with positional and named parameters",
+			"SELECT col1 FROM table1 WHERE col1>? AND col2 IN ($2,:name)",
+			[]string{"SELECT", " ", "col1", " ", "FROM", " ", "table1", " ",
+				"WHERE", " ", "col1", ">", "?", " ", "AND", " ", "col2", " ",
+				"IN", " ", "(", "$2", ",", ":name", ")"}},
 	}
 
 	for _, i := range cases {
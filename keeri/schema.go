@@ -0,0 +1,311 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The prefix of the names of the virtual tables which describe the
+// tables of the database, and can be queried with Select like any
+// other table. The rows of a virtual table are built every time that
+// a query over it is run, so they always show the current tables.
+//
+// information_schema.tables has one row per table, with the columns
+// table_name, table_type, column_count and row_count.
+//
+// information_schema.columns has one row per column, with the columns
+// table_name, column_name, ordinal_position, data_type, collation_name,
+// which is NULL for the columns that are not strings, and is_nullable.
+const infoSchemaPrefix = "information_schema."
+
+// The description of a table, as returned by Describe
+type TableSchema struct {
+	Name        string
+	Columns     []ColumnSchema
+	Indexes     []IndexSchema
+	Checks      []Check
+	ForeignKeys []ForeignKey
+	AppendOnly  bool
+
+	// Number of the rows in the table
+	RowCount int
+}
+
+// The description of a column of a table
+type ColumnSchema struct {
+	Name      string
+	Type      ColumnType
+	Collation Collation
+	Nullable  bool
+	Default   interface{}
+
+	// The encoding in which the values are stored now, which is either
+	// PlainEncoding or DictionaryEncoding, for an AutoEncoding column
+	Encoding Encoding
+
+	AutoIncrement bool
+
+	// The sealed segments of an int or a string column of an
+	// AppendOnly table, in the order of their rows
+	Segments []SegmentSchema
+
+	// The zones of the blocks of 1024 rows of an int or a string
+	// column, in the order of their rows, that the conditions use
+	// to skip the blocks that have none of the values they look for
+	Zones []ZoneSchema
+}
+
+// The summary of the values of a block of rows of a column
+type ZoneSchema struct {
+	// Number of the rows that have a value,
+	// and of the rows that have a NULL
+	Rows  int
+	Nulls int
+
+	// The smallest and the largest of the values, which are nil if no
+	// row has a value. Cover the values of the rows, but can be wider
+	// after the rows are updated or deleted, other than in a segment.
+	Min, Max interface{}
+}
+
+// The description of a sealed segment of a column
+type SegmentSchema struct {
+	ZoneSchema
+
+	// RLE, FOR or DELTA for an int column,
+	// and DICTIONARY or FRONT for a string column
+	Encoding string
+
+	// Number of the bytes taken by the encoded values
+	Bytes int
+}
+
+// The description of an index over the columns of a table
+type IndexSchema struct {
+	Name    string
+	Columns []string
+	Unique  bool
+}
+
+// The names of the column types, as shown in information_schema
+var typeNames = map[ColumnType]string{
+	IntColumn:    "INT",
+	StringColumn: "TEXT",
+	CustomColumn: "CUSTOM",
+}
+
+// Returns the names of all the tables, in sorted order. The
+// virtual tables of information_schema are not included.
+func (db *Keeri) Tables() []string {
+	db.tblNamesLock.RLock()
+	defer db.tblNamesLock.RUnlock()
+
+	names := make([]string, 0, len(db.tables))
+	for name := range db.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the columns, the constraints and the number of rows of the table
+func (db *Keeri) Describe(tableName string) (TableSchema, error) {
+	tbl, err := db.lookupTable(tableName)
+	if err != nil {
+		return TableSchema{}, err
+	}
+
+	tbl.dataMetaDataLock.RLock()
+	defer tbl.dataMetaDataLock.RUnlock()
+	return tbl.schema(tableName), nil
+}
+
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) schema(name string) TableSchema {
+	s := TableSchema{
+		Name:       name,
+		AppendOnly: t.appendOnly,
+		RowCount:   len(t.liveRows),
+	}
+	for _, i := range t.colsDesc {
+		var segments []SegmentSchema
+		if c, ok := t.cols[i.ColName].(*segmentedColumn); ok {
+			for _, g := range c.segments {
+				segments = append(segments, SegmentSchema{
+					ZoneSchema: g.zone.schema(),
+					Encoding:   g.encoding(),
+					Bytes:      g.size(),
+				})
+			}
+		}
+		var zones []ZoneSchema
+		if z := t.zones[i.ColName]; z != nil {
+			for _, b := range z.blocks {
+				zones = append(zones, b.schema())
+			}
+		}
+		s.Columns = append(s.Columns, ColumnSchema{
+			Name:      i.ColName,
+			Type:      i.ColType,
+			Collation: i.Collation,
+			Nullable:  !i.NotNull && !t.inPrimaryKey(i.ColName),
+			Default:   i.Default,
+			Encoding:  t.encodingOf(i),
+
+			AutoIncrement: i.AutoIncrement,
+			Segments:      segments,
+			Zones:         zones,
+		})
+	}
+	for _, x := range t.indexes {
+		s.Indexes = append(s.Indexes, IndexSchema{
+			Name:    x.name,
+			Columns: append([]string{}, x.cols...),
+			Unique:  true,
+		})
+	}
+	for _, c := range t.checks {
+		s.Checks = append(s.Checks, Check{Name: c.name, Cond: formatExpr(c.cond)})
+	}
+	for _, fk := range t.foreignKeys {
+		s.ForeignKeys = append(s.ForeignKeys, ForeignKey{
+			Name:       fk.name,
+			Columns:    append([]string{}, fk.cols...),
+			RefTable:   fk.parentName,
+			RefColumns: append([]string{}, fk.parentCols...),
+			OnDelete:   fk.onDelete,
+		})
+	}
+	return s
+}
+
+// Returns the schemas of all the tables, in the order of their names
+func (db *Keeri) schemas() []TableSchema {
+	db.tblNamesLock.RLock()
+	defer db.tblNamesLock.RUnlock()
+
+	names := make([]string, 0, len(db.tables))
+	for name := range db.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var ret []TableSchema
+	for _, name := range names {
+		t := db.tables[name]
+		t.dataMetaDataLock.RLock()
+		ret = append(ret, t.schema(name))
+		t.dataMetaDataLock.RUnlock()
+	}
+	return ret
+}
+
+// Builds a temporary table with the rows of the virtual table,
+// returning a nil table if there is no such virtual table
+func (db *Keeri) infoSchemaTable(tableName string) (*table, error) {
+	var descs []ColumnDesc
+	var rows [][]interface{}
+
+	switch strings.TrimPrefix(tableName, infoSchemaPrefix) {
+	case "tables":
+		descs = []ColumnDesc{
+			{ColName: "table_name", ColType: StringColumn},
+			{ColName: "table_type", ColType: StringColumn},
+			{ColName: "column_count", ColType: IntColumn},
+			{ColName: "row_count", ColType: IntColumn},
+		}
+		for _, s := range db.schemas() {
+			rows = append(rows, []interface{}{s.Name, "BASE TABLE",
+				len(s.Columns), s.RowCount})
+		}
+
+	case "columns":
+		descs = []ColumnDesc{
+			{ColName: "table_name", ColType: StringColumn},
+			{ColName: "column_name", ColType: StringColumn},
+			{ColName: "ordinal_position", ColType: IntColumn},
+			{ColName: "data_type", ColType: StringColumn},
+			{ColName: "collation_name", ColType: StringColumn},
+			{ColName: "is_nullable", ColType: StringColumn},
+		}
+		for _, s := range db.schemas() {
+			for k, c := range s.Columns {
+				var collation interface{}
+				if c.Type == StringColumn {
+					collation = collationName(c.Collation)
+				}
+				nullable := "NO"
+				if c.Nullable {
+					nullable = "YES"
+				}
+				rows = append(rows, []interface{}{s.Name, c.Name, k + 1,
+					typeNames[c.Type], collation, nullable})
+			}
+		}
+
+	default:
+		return nil, nil
+	}
+
+	tmp, err := newTable(descs)
+	if err != nil {
+		return nil, err
+	}
+	for n, row := range rows {
+		id := rowID(n + 1)
+		for k, desc := range descs {
+			if row[k] != nil {
+				setColumnValue(desc.ColType, tmp.cols[desc.ColName], id, row[k])
+			}
+		}
+		tmp.liveRows[id] = true
+	}
+	tmp.rowCounter = rowID(len(rows))
+	return tmp, nil
+}
+
+// Returns the name of the collation, as used in CREATE TABLE
+func collationName(c Collation) string {
+	for name, i := range collations {
+		if i == c {
+			return name
+		}
+	}
+	return fmt.Sprint(int(c))
+}
+
+// Returns the tables with the given names, where the virtual tables
+// of information_schema are built for the query that is being run
+func (db *Keeri) lookupTables(names []string) ([]*table, error) {
+	tbls := make([]*table, len(names))
+
+	db.tblNamesLock.RLock()
+	for i, name := range names {
+		tbls[i] = db.tables[name]
+	}
+	db.tblNamesLock.RUnlock()
+
+	for i, name := range names {
+		if tbls[i] != nil {
+			continue
+		}
+		if strings.HasPrefix(name, infoSchemaPrefix) {
+			t, err := db.infoSchemaTable(name)
+			if err != nil {
+				return nil, err
+			}
+			tbls[i] = t
+		}
+		if tbls[i] == nil {
+			return nil, fmt.Errorf("%w: '%s'", ErrTableNotFound, name)
+		}
+	}
+	return tbls, nil
+}
@@ -0,0 +1,672 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// Returned when a row of an append-only table would be updated or deleted
+var ErrAppendOnly = errors.New("Table is append-only")
+
+// The number of rows in a segment of a column of an append-only table
+const segmentRows = 1024
+
+// The values of an int or a string column of an append-only table. The
+// rowIDs of the table are cut in to chunks of segmentRows, and the values
+// of a chunk are sealed in to a compressed segment, that never changes,
+// once the table has the last row of the chunk. The values of the rows
+// after the last segment are in the tail, which is stored like any column.
+// Not threadsafe. Protected by the dataMetaDataLock of the table.
+type segmentedColumn struct {
+	// The number of the chunks before the first segment, which had
+	// only the rows deleted by a Truncate, and are not sealed
+	base int
+
+	segments []*segment
+	tail     interface{}
+}
+
+// A sealed chunk of the values of a column, with the zone of its values,
+// whose min and max are exact. Every row has a value in the encoding,
+// where a row without a value has the value of the row before it, so
+// that the runs and the deltas are kept.
+type segment struct {
+	zone
+
+	first   rowID
+	present []uint64
+
+	ints intEncoding
+	strs strEncoding
+}
+
+// Creates the storage for the column of the table, where the int and
+// the string columns of an append-only table are sealed in to segments
+func (t *table) newColumnData(desc ColumnDesc) (interface{}, error) {
+	data, err := newColumnData(desc)
+	if err != nil || !t.appendOnly || desc.ColType == CustomColumn {
+		return data, err
+	}
+	return &segmentedColumn{tail: data}, nil
+}
+
+// Starts the segments of the column after the chunks of the rows that
+// were deleted by the last Truncate of the table, if it is segmented.
+// Not threadsafe. Caller should have acquired writelock
+func (t *table) skipTruncated(data interface{}) {
+	if s, ok := data.(*segmentedColumn); ok {
+		s.base = int(t.truncated / segmentRows)
+	}
+}
+
+// Returns the value of the given row, with ok set
+// to false if the row has no value in the column
+func (s *segmentedColumn) get(colType ColumnType, id rowID) (interface{},
+	bool) {
+
+	k := int((id - 1) / segmentRows)
+	if k >= s.sealed() {
+		return columnValue(colType, s.tail, id)
+	}
+	if k < s.base {
+		return nil, false
+	}
+	g := s.segments[k-s.base]
+	pos := int(id - g.first)
+	if !g.has(pos) {
+		return nil, false
+	}
+	if g.ints != nil {
+		return g.ints.get(pos), true
+	}
+	return g.strs.get(pos), true
+}
+
+// Returns the number of the chunks before the tail
+func (s *segmentedColumn) sealed() int {
+	return s.base + len(s.segments)
+}
+
+// Returns the tail, which holds the value of the given row,
+// that can not be in a segment, as the segments never change
+func (s *segmentedColumn) tailFor(id rowID) interface{} {
+	if int((id-1)/segmentRows) < s.sealed() {
+		panic("Write to a sealed segment")
+	}
+	return s.tail
+}
+
+// Seals the complete chunks of rows of the int and the string columns
+// of an append-only table, that is, all the chunks up to the last rowID,
+// and starts a new tail for every column that is sealed,
+// as the maps do not give back their memory when their values are deleted.
+// Not threadsafe. Caller should have acquired writelock
+func (t *table) seal() {
+	if !t.appendOnly {
+		return
+	}
+
+	last := t.curRowID()
+	for _, desc := range t.colsDesc {
+		s, ok := t.cols[desc.ColName].(*segmentedColumn)
+		if !ok || rowID(s.sealed()+1)*segmentRows > last {
+			continue
+		}
+
+		for rowID(s.sealed()+1)*segmentRows <= last {
+			first := rowID(s.sealed())*segmentRows + 1
+			s.segments = append(s.segments,
+				newSegment(desc, first, s.tail, t.liveRows))
+		}
+
+		tail, _ := newColumnData(desc)
+		for id := rowID(s.sealed())*segmentRows + 1; id <= last; id++ {
+			if v, ok := columnValue(desc.ColType, s.tail, id); ok {
+				setColumnValue(desc.ColType, tail, id, v)
+			}
+		}
+		s.tail = tail
+	}
+}
+
+// Builds the segment of the segmentRows rows from the first, out of the
+// values of the rows in the data, in the encoding that takes the least
+// memory, with the min and the max as the column's collation orders them
+func newSegment(desc ColumnDesc, first rowID, data interface{},
+	live map[rowID]bool) *segment {
+
+	g := &segment{first: first, present: make([]uint64, segmentRows/64)}
+
+	ints := make([]int, segmentRows)
+	strs := make([]string, segmentRows)
+	for pos := 0; pos < segmentRows; pos++ {
+		v, ok := columnValue(desc.ColType, data, first+rowID(pos))
+		if !ok {
+			if live[first+rowID(pos)] {
+				g.nulls++
+			}
+			if pos > 0 {
+				ints[pos], strs[pos] = ints[pos-1], strs[pos-1]
+			}
+			continue
+		}
+
+		// The rows before the first value take the first value
+		if g.count == 0 {
+			for k := 0; k < pos; k++ {
+				ints[k], strs[k] = ints[pos], strs[pos]
+			}
+		}
+		g.present[pos/64] |= 1 << uint(pos%64)
+		g.count++
+		g.widen(desc.Collation, v)
+
+		if desc.ColType == IntColumn {
+			ints[pos] = v.(int)
+		} else {
+			strs[pos] = v.(string)
+		}
+	}
+
+	if desc.ColType == IntColumn {
+		g.ints = newRLE(ints)
+		for _, e := range []intEncoding{newFOR(ints), newDelta(ints)} {
+			if e.size() < g.ints.size() {
+				g.ints = e
+			}
+		}
+		return g
+	}
+
+	g.strs = newDictEncoding(strs)
+	if e := newFrontEncoding(strs); e.size() < g.strs.size() {
+		g.strs = e
+	}
+	return g
+}
+
+// Returns true if the row at the position has a value
+func (g *segment) has(pos int) bool {
+	return g.present[pos/64]&(1<<uint(pos%64)) != 0
+}
+
+// Returns the name of the encoding of the segment
+func (g *segment) encoding() string {
+	if g.ints != nil {
+		return g.ints.name()
+	}
+	return g.strs.name()
+}
+
+// Returns the number of bytes taken by the values of the segment
+func (g *segment) size() int {
+	if g.ints != nil {
+		return g.ints.size()
+	}
+	return g.strs.size()
+}
+
+// Evaluates a condition over a segmented column, skipping the segments
+// whose zone maps show that none of their values can match it, and
+// evaluating it on the compressed values where the encoding allows it.
+// Not threadsafe. Caller should have acquired readlock
+func evaluateSegmented(i *Condition, s *segmentedColumn) []rowID {
+	var ret []rowID
+	for _, g := range s.segments {
+		if g.skips(i) {
+			continue
+		}
+		emit := func(pos int) {
+			if g.has(pos) {
+				ret = append(ret, g.first+rowID(pos))
+			}
+		}
+		if g.ints != nil {
+			g.filterInts(i, emit)
+		} else {
+			g.filterStrs(i, emit)
+		}
+	}
+
+	// The tail has fewer rows than a segment, and is scanned whole
+	c := *i
+	c.colData = s.tail
+	c.zones = nil
+	return append(ret, evaluateCondition(&c)...)
+}
+
+// Calls emit with the positions whose values match the condition, where
+// a range is compared once for every run of an RLE, and directly with
+// the bit-packed values of a FOR, and any other condition is evaluated
+// once for every run of an RLE, or for every value of the other encodings
+func (g *segment) filterInts(i *Condition, emit func(pos int)) {
+	var match func(v int) bool
+	lo, hi, isRange := intRange(i)
+	switch {
+	case isRange:
+		match = func(v int) bool { return v >= lo && v <= hi }
+	case i.op == NEQ:
+		match = func(v int) bool { return v != i.value.(int) }
+	case i.op == IN:
+		match = func(v int) bool { return i.value.(map[int]bool)[v] }
+	case i.op == NOTIN:
+		match = func(v int) bool { return !i.value.(map[int]bool)[v] }
+	default:
+		panic("Unsupported relational operation for int")
+	}
+
+	switch e := g.ints.(type) {
+	case *rleEncoding:
+		start := 0
+		for k, v := range e.values {
+			if match(v) {
+				for pos := start; pos < e.ends[k]; pos++ {
+					emit(pos)
+				}
+			}
+			start = e.ends[k]
+		}
+		return
+
+	case *forEncoding:
+		if !isRange {
+			break
+		}
+		// The range is clipped to the zone map, and taken
+		// in to the frame of reference of the packed values
+		if lo < g.min.(int) {
+			lo = g.min.(int)
+		}
+		if hi > g.max.(int) {
+			hi = g.max.(int)
+		}
+		from := uint64(lo) - uint64(e.base)
+		to := uint64(hi) - uint64(e.base)
+		for pos := 0; pos < segmentRows; pos++ {
+			if u := e.packed.get(pos); u >= from && u <= to {
+				emit(pos)
+			}
+		}
+		return
+	}
+
+	values := make([]int, segmentRows)
+	g.ints.decode(values)
+	for pos, v := range values {
+		if match(v) {
+			emit(pos)
+		}
+	}
+}
+
+// Calls emit with the positions whose values match the condition, which
+// is evaluated once for every value in the dictionary of a DICTIONARY,
+// and once for every value of a FRONT, over a map of the values, where
+// the rowIDs are the codes of the dictionary, or the positions
+func (g *segment) filterStrs(i *Condition, emit func(pos int)) {
+	c := *i
+	c.zones = nil
+	if e, ok := g.strs.(*dictEncoding); ok {
+		byCode := make(map[rowID]string, len(e.dict))
+		for code, v := range e.dict {
+			byCode[rowID(code)] = v
+		}
+		c.colData = byCode
+		matches := make([]bool, len(e.dict))
+		for _, code := range evaluateCondition(&c) {
+			matches[code] = true
+		}
+		for pos := 0; pos < segmentRows; pos++ {
+			if matches[e.codes.get(pos)] {
+				emit(pos)
+			}
+		}
+		return
+	}
+
+	values := make([]string, segmentRows)
+	g.strs.decode(values)
+	byPos := make(map[rowID]string, g.count)
+	for pos, v := range values {
+		if g.has(pos) {
+			byPos[rowID(pos)] = v
+		}
+	}
+	c.colData = byPos
+	for _, pos := range evaluateCondition(&c) {
+		emit(int(pos))
+	}
+}
+
+// The values of an int column in a segment, with a value for every row
+type intEncoding interface {
+	name() string
+	size() int
+	get(pos int) int
+	decode(out []int)
+}
+
+// Unsigned integers of the same number of bits, packed one after another
+type bitPacked struct {
+	width uint
+	words []uint64
+}
+
+func packBits(values []uint64, width uint) bitPacked {
+	b := bitPacked{width: width}
+	if width == 0 {
+		return b
+	}
+	b.words = make([]uint64, (len(values)*int(width)+63)/64)
+	for i, v := range values {
+		at := uint(i) * width
+		w, off := at/64, at%64
+		b.words[w] |= v << off
+		if off+width > 64 {
+			b.words[w+1] |= v >> (64 - off)
+		}
+	}
+	return b
+}
+
+func (b *bitPacked) get(i int) uint64 {
+	if b.width == 0 {
+		return 0
+	}
+	at := uint(i) * b.width
+	w, off := at/64, at%64
+	v := b.words[w] >> off
+	if off+b.width > 64 {
+		v |= b.words[w+1] << (64 - off)
+	}
+	if b.width < 64 {
+		v &= 1<<b.width - 1
+	}
+	return v
+}
+
+// Run-length encoding, as the values of the runs,
+// with the position after the end of every run
+type rleEncoding struct {
+	values []int
+	ends   []int
+}
+
+func newRLE(values []int) *rleEncoding {
+	e := &rleEncoding{}
+	for pos, v := range values {
+		if n := len(e.values); n > 0 && e.values[n-1] == v {
+			e.ends[n-1] = pos + 1
+			continue
+		}
+		e.values = append(e.values, v)
+		e.ends = append(e.ends, pos+1)
+	}
+	return e
+}
+
+func (e *rleEncoding) name() string {
+	return "RLE"
+}
+
+func (e *rleEncoding) size() int {
+	return 16 * len(e.values)
+}
+
+func (e *rleEncoding) get(pos int) int {
+	k := sort.Search(len(e.ends), func(k int) bool { return e.ends[k] > pos })
+	return e.values[k]
+}
+
+func (e *rleEncoding) decode(out []int) {
+	start := 0
+	for k, v := range e.values {
+		for pos := start; pos < e.ends[k]; pos++ {
+			out[pos] = v
+		}
+		start = e.ends[k]
+	}
+}
+
+// Frame of reference encoding, as the difference of every value
+// from the min of the values, packed in to as few bits as possible
+type forEncoding struct {
+	base   int
+	packed bitPacked
+}
+
+func newFOR(values []int) *forEncoding {
+	min, max := values[0], values[0]
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+
+	// The differences are taken as unsigned, so that they never overflow
+	diffs := make([]uint64, len(values))
+	for pos, v := range values {
+		diffs[pos] = uint64(v) - uint64(min)
+	}
+	width := uint(bits.Len64(uint64(max) - uint64(min)))
+	return &forEncoding{min, packBits(diffs, width)}
+}
+
+func (e *forEncoding) name() string {
+	return "FOR"
+}
+
+func (e *forEncoding) size() int {
+	return 8 + 8*len(e.packed.words)
+}
+
+func (e *forEncoding) get(pos int) int {
+	return int(uint64(e.base) + e.packed.get(pos))
+}
+
+func (e *forEncoding) decode(out []int) {
+	for pos := range out {
+		out[pos] = e.get(pos)
+	}
+}
+
+// The number of values between the absolute values of a delta encoding
+const deltaRun = 64
+
+// Delta encoding, as the difference of every value from the value before
+// it, zigzag encoded so that the small negative differences take as few
+// bits as the small positive ones, and packed, with the absolute value
+// of every deltaRun-th value, so that a value is found without adding up
+// all the differences before it
+type deltaEncoding struct {
+	starts []int
+	packed bitPacked
+}
+
+func newDelta(values []int) *deltaEncoding {
+	e := &deltaEncoding{}
+	deltas := make([]uint64, len(values))
+	var width uint
+	for pos, v := range values {
+		if pos%deltaRun == 0 {
+			e.starts = append(e.starts, v)
+			continue
+		}
+		d := int64(uint64(v) - uint64(values[pos-1]))
+		deltas[pos] = uint64(d<<1) ^ uint64(d>>63)
+		if w := uint(bits.Len64(deltas[pos])); w > width {
+			width = w
+		}
+	}
+	e.packed = packBits(deltas, width)
+	return e
+}
+
+func (e *deltaEncoding) name() string {
+	return "DELTA"
+}
+
+func (e *deltaEncoding) size() int {
+	return 8*len(e.starts) + 8*len(e.packed.words)
+}
+
+// Returns the difference of the value at the position from the one before
+func (e *deltaEncoding) delta(pos int) uint64 {
+	u := e.packed.get(pos)
+	return uint64(int64(u>>1) ^ -int64(u&1))
+}
+
+func (e *deltaEncoding) get(pos int) int {
+	v := uint64(e.starts[pos/deltaRun])
+	for k := pos - pos%deltaRun + 1; k <= pos; k++ {
+		v += e.delta(k)
+	}
+	return int(v)
+}
+
+func (e *deltaEncoding) decode(out []int) {
+	var v uint64
+	for pos := range out {
+		if pos%deltaRun == 0 {
+			v = uint64(e.starts[pos/deltaRun])
+		} else {
+			v += e.delta(pos)
+		}
+		out[pos] = int(v)
+	}
+}
+
+// The values of a string column in a segment, with a value for every row
+type strEncoding interface {
+	name() string
+	size() int
+	get(pos int) string
+	decode(out []string)
+}
+
+// The bytes taken by a string, other than its characters
+const stringHeader = 16
+
+// Dictionary encoding, as the distinct values, with
+// the bit-packed code of the value of every row
+type dictEncoding struct {
+	dict  []string
+	codes bitPacked
+}
+
+func newDictEncoding(values []string) *dictEncoding {
+	e := &dictEncoding{}
+	lookup := make(map[string]uint64)
+	codes := make([]uint64, len(values))
+	for pos, v := range values {
+		code, ok := lookup[v]
+		if !ok {
+			code = uint64(len(e.dict))
+			lookup[v] = code
+			e.dict = append(e.dict, v)
+		}
+		codes[pos] = code
+	}
+	e.codes = packBits(codes, uint(bits.Len64(uint64(len(e.dict)-1))))
+	return e
+}
+
+func (e *dictEncoding) name() string {
+	return "DICTIONARY"
+}
+
+func (e *dictEncoding) size() int {
+	n := 8 * len(e.codes.words)
+	for _, v := range e.dict {
+		n += stringHeader + len(v)
+	}
+	return n
+}
+
+func (e *dictEncoding) get(pos int) string {
+	return e.dict[e.codes.get(pos)]
+}
+
+func (e *dictEncoding) decode(out []string) {
+	for pos := range out {
+		out[pos] = e.get(pos)
+	}
+}
+
+// The number of values between the values of a front coding
+// that are stored in full, without a prefix of the value before
+const frontRun = 16
+
+// Front coding, as the length of the prefix that every value shares
+// with the value before it, with the rest of the value, which is
+// concatenated with the rest of the values, in the order of the rows
+type frontEncoding struct {
+	prefixes []uint16
+	ends     []uint32
+	data     []byte
+}
+
+func newFrontEncoding(values []string) *frontEncoding {
+	e := &frontEncoding{
+		prefixes: make([]uint16, len(values)),
+		ends:     make([]uint32, len(values)),
+	}
+	for pos, v := range values {
+		n := 0
+		if pos%frontRun != 0 {
+			prev := values[pos-1]
+			for n < len(v) && n < len(prev) && n < math.MaxUint16 &&
+				v[n] == prev[n] {
+				n++
+			}
+		}
+		e.prefixes[pos] = uint16(n)
+		e.data = append(e.data, v[n:]...)
+		e.ends[pos] = uint32(len(e.data))
+	}
+	return e
+}
+
+func (e *frontEncoding) name() string {
+	return "FRONT"
+}
+
+func (e *frontEncoding) size() int {
+	return 6*len(e.ends) + len(e.data)
+}
+
+// Returns the rest of the value at the position, after its prefix
+func (e *frontEncoding) suffix(pos int) []byte {
+	start := uint32(0)
+	if pos > 0 {
+		start = e.ends[pos-1]
+	}
+	return e.data[start:e.ends[pos]]
+}
+
+func (e *frontEncoding) get(pos int) string {
+	var v []byte
+	for k := pos - pos%frontRun; k <= pos; k++ {
+		v = append(v[:e.prefixes[k]], e.suffix(k)...)
+	}
+	return string(v)
+}
+
+func (e *frontEncoding) decode(out []string) {
+	var v []byte
+	for pos := range out {
+		v = append(v[:e.prefixes[pos]], e.suffix(pos)...)
+		out[pos] = string(v)
+	}
+}
@@ -0,0 +1,172 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// Returned when a sequence is created with
+	// the name of an existing sequence
+	ErrSequenceExists = errors.New("Sequence already exists")
+
+	// Returned when there is no sequence with the given name
+	ErrSequenceNotFound = errors.New("Sequence not found")
+
+	// Returned when a sequence is dropped while
+	// it is the Default of a column
+	ErrSequenceInUse = errors.New("Sequence is in use")
+)
+
+// The Default of an IntColumn, or a value given to Insert or InsertNamed,
+// that is replaced by the next value of the named sequence in every row
+// that is inserted, like NEXTVAL('name') in SQL
+type NextVal string
+
+// A counter that is shared by all the tables, whose values are never
+// given out twice, even when the statement that took them fails
+type sequence struct {
+	next      int
+	increment int
+}
+
+// Creates a sequence, whose first value is the start, and every next
+// value is the previous one plus the increment, which can be negative
+// but not 0. Returns ErrSequenceExists if there is a sequence with the
+// same name. The tables and the sequences have different names.
+func (db *Keeri) CreateSequence(name string, start, increment int) error {
+	if increment == 0 {
+		return errors.New("The increment of a sequence can not be 0")
+	}
+
+	db.seqLock.Lock()
+	defer db.seqLock.Unlock()
+
+	if _, ok := db.sequences[name]; ok {
+		return fmt.Errorf("%w: '%s'", ErrSequenceExists, name)
+	}
+	if db.sequences == nil {
+		db.sequences = make(map[string]*sequence)
+	}
+	db.sequences[name] = &sequence{next: start, increment: increment}
+	return nil
+}
+
+// Drops the sequence. Returns ErrSequenceInUse if it is the Default of
+// a column, which should be dropped first. The inserts that are given
+// a NextVal of the sequence fail after it is dropped, with
+// ErrSequenceNotFound.
+func (db *Keeri) DropSequence(name string) error {
+	// All the tables are locked, so that no column
+	// takes the sequence as its Default meanwhile
+	db.tblNamesLock.RLock()
+	defer db.tblNamesLock.RUnlock()
+
+	modes := make(map[*table]bool)
+	for _, t := range db.tables {
+		modes[t] = false
+	}
+	defer lockTables(modes)()
+
+	for tableName, t := range db.tables {
+		for _, desc := range t.colsDesc {
+			if desc.Default == NextVal(name) {
+				return fmt.Errorf("%w: '%s' is the Default of '%s.%s'",
+					ErrSequenceInUse, name, tableName, desc.ColName)
+			}
+		}
+	}
+
+	db.seqLock.Lock()
+	defer db.seqLock.Unlock()
+
+	if _, ok := db.sequences[name]; !ok {
+		return fmt.Errorf("%w: '%s'", ErrSequenceNotFound, name)
+	}
+	delete(db.sequences, name)
+	return nil
+}
+
+// Returns the next value of the sequence, or ErrSequenceNotFound
+func (db *Keeri) NextValue(name string) (int, error) {
+	db.seqLock.Lock()
+	defer db.seqLock.Unlock()
+
+	s, ok := db.sequences[name]
+	if !ok {
+		return 0, fmt.Errorf("%w: '%s'", ErrSequenceNotFound, name)
+	}
+	v := s.next
+	s.next += s.increment
+	return v, nil
+}
+
+// Returns an error if the Default of the column can not be stored in it,
+// where a NextVal should be for an IntColumn, and of an existing sequence
+func (db *Keeri) checkDefault(desc ColumnDesc) error {
+	n, ok := desc.Default.(NextVal)
+	if !ok {
+		if desc.AutoIncrement && desc.Default != nil {
+			return fmt.Errorf("The AutoIncrement column '%s' can not have "+
+				"a Default", desc.ColName)
+		}
+		return checkColumnValue(desc, desc.Default)
+	}
+	if desc.ColType != IntColumn || desc.AutoIncrement {
+		return fmt.Errorf("Mismatched type %T of the value for the column "+
+			"'%s'", desc.Default, desc.ColName)
+	}
+
+	db.seqLock.Lock()
+	defer db.seqLock.Unlock()
+	if _, ok = db.sequences[string(n)]; !ok {
+		return fmt.Errorf("%w: '%s'", ErrSequenceNotFound, string(n))
+	}
+	return nil
+}
+
+// Replaces every NextVal in the row, for an IntColumn of the table, with
+// the next value of its sequence, leaving it as it is for the other
+// columns, where it is then rejected like any value of the wrong type
+func (db *Keeri) nextValues(t *table, row []interface{}) error {
+	for k, v := range row {
+		n, ok := v.(NextVal)
+		if !ok || t.colsDesc[k].ColType != IntColumn {
+			continue
+		}
+		var err error
+		if row[k], err = db.NextValue(string(n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sets every AutoIncrement column of the row that is NULL to the
+// value after the largest one that the column has had, starting from 1,
+// and keeps track of the values that are given to the column.
+// Not threadsafe. Caller should have acquired writelock
+func (t *table) fillAutoIncrements(row []interface{}) {
+	for k, desc := range t.colsDesc {
+		if !desc.AutoIncrement {
+			continue
+		}
+		if t.autoIncrements == nil {
+			t.autoIncrements = make(map[string]int)
+		}
+
+		if row[k] == nil {
+			t.autoIncrements[desc.ColName]++
+			row[k] = t.autoIncrements[desc.ColName]
+		} else if v, ok := row[k].(int); ok &&
+			v > t.autoIncrements[desc.ColName] {
+			t.autoIncrements[desc.ColName] = v
+		}
+	}
+}
@@ -7,9 +7,11 @@
 package keeri
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"sync"
+	"sync/atomic"
 )
 
 // All possible datatypes for the columns
@@ -28,6 +30,26 @@ const (
 type ColumnDesc struct {
 	ColName string
 	ColType ColumnType
+
+	// Used only by the string columns. Defaults to BinaryCollation
+	Collation Collation
+
+	// Used only by the string columns. Defaults to AutoEncoding
+	Encoding Encoding
+
+	// A NotNull column can not have a NULL in any row
+	NotNull bool
+
+	// The value of the column in a row that is inserted without it,
+	// like with InsertNamed, which should be of the type of the column.
+	// Defaults to a NULL. The Default of an IntColumn can also be
+	// a NextVal, for the next value of a sequence.
+	Default interface{}
+
+	// An AutoIncrement IntColumn takes the value after the largest
+	// one that it has had in every row that is inserted with a NULL
+	// in it, starting from 1. It can not have a Default.
+	AutoIncrement bool
 }
 
 // maps column name to column-struct pointer
@@ -44,6 +66,10 @@ type columnList map[string]interface{}
 type column map[rowID]interface{}
 
 type table struct {
+	// The name of the table, for the errors of its constraints, which
+	// is empty for the temporary tables. Changed only while holding both
+	// the tblNamesLock of the db and the writelock of the table
+	name string
 
 	// both the fields below will have to have
 	// use a single instance of a readlock
@@ -58,6 +84,255 @@ type table struct {
 
 	rowCounter     rowID
 	rowCounterLock sync.RWMutex
+
+	// rowIDs of all the rows that were inserted successfully.
+	// Protected by the dataMetaDataLock
+	liveRows map[rowID]bool
+
+	// Incremented on every change to the columns, so that the
+	// prepared queries over the table are prepared again.
+	// Protected by the dataMetaDataLock
+	version uint64
+
+	// The indexes of the primary key and the unique constraints.
+	// Protected by the dataMetaDataLock
+	indexes []*index
+
+	// The CHECK constraints. Protected by the dataMetaDataLock
+	checks []*check
+
+	// The zone maps of the int and the string columns, which the
+	// temporary tables do not have. Protected by the dataMetaDataLock
+	zones map[string]*zoneMap
+
+	// The last rowID when the table was truncated without resetting
+	// its rowIDs, as no segments or zones are kept for the rows up to
+	// it, which are never used again. Protected by the dataMetaDataLock
+	truncated rowID
+
+	// The largest value of every AutoIncrement column, which
+	// is 0 when it has none. Protected by the dataMetaDataLock
+	autoIncrements map[string]int
+
+	// The foreign keys of the table, and the foreign keys that refer to
+	// it. Changed only while holding both the tblNamesLock of the db and
+	// the writelock of the table, while the columns of a foreign key are
+	// changed only while holding the writelocks of both its tables.
+	foreignKeys []*foreignKey
+	refs        []*foreignKey
+
+	// Orders the locks of the tables, in the order they were created
+	seq uint64
+
+	// The rows of an append-only table are never updated or deleted,
+	// and its columns are sealed in to segments
+	appendOnly bool
+}
+
+// The seq of the last table that was created
+var tableSeq uint64
+
+// Creates a new table, with the storage for the given columns
+func newTable(cols []ColumnDesc) (*table, error) {
+	dbCols := make(map[string]interface{})
+	for _, col := range cols {
+		data, err := newColumnData(col)
+		if err != nil {
+			return nil, err
+		}
+		dbCols[col.ColName] = data
+	}
+
+	t := &table{
+		cols:       dbCols,
+		colsDesc:   cols,
+		rowCounter: rowID(0),
+		liveRows:   make(map[rowID]bool),
+		seq:        atomic.AddUint64(&tableSeq, 1),
+	}
+	return t, nil
+}
+
+// Creates the storage for the values of the column, where
+// the string columns are stored as plain strings, unless
+// they have the DictionaryEncoding
+func newColumnData(desc ColumnDesc) (interface{}, error) {
+	switch desc.ColType {
+	case IntColumn:
+		return make(map[rowID]int), nil
+	case StringColumn:
+		if desc.Encoding == DictionaryEncoding {
+			return newDictColumn(), nil
+		}
+		return make(map[rowID]string), nil
+	case CustomColumn:
+		return make(map[rowID]interface{}), nil
+	}
+	return nil, errors.New("Invalid column type specified")
+}
+
+// Returns the description of the column with the given name.
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) colDesc(colName string) (ColumnDesc, bool) {
+	for _, i := range t.colsDesc {
+		if i.ColName == colName {
+			return i, true
+		}
+	}
+	return ColumnDesc{}, false
+}
+
+// Returns the position of the column in the colsDesc, or -1.
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) colPos(colName string) int {
+	for k, i := range t.colsDesc {
+		if i.ColName == colName {
+			return k
+		}
+	}
+	return -1
+}
+
+// Returns the value of a column in the given row, with ok
+// set to false if the column has no value in the row.
+// Not threadsafe. Caller should have acquired readlock
+func columnValue(colType ColumnType, colData interface{},
+	id rowID) (v interface{}, ok bool) {
+
+	if s, isSegmented := colData.(*segmentedColumn); isSegmented {
+		return s.get(colType, id)
+	}
+	switch colType {
+	case IntColumn:
+		v, ok = colData.(map[rowID]int)[id]
+	case StringColumn:
+		v, ok = stringValue(colData, id)
+	case CustomColumn:
+		v, ok = colData.(map[rowID]interface{})[id]
+	}
+	if !ok {
+		return nil, false
+	}
+	return v, true
+}
+
+// Sets the value of a column in the given row, where
+// the value should be of the type of the column.
+// Not threadsafe. Caller should have acquired writelock
+func setColumnValue(colType ColumnType, colData interface{}, id rowID,
+	v interface{}) {
+
+	if s, ok := colData.(*segmentedColumn); ok {
+		colData = s.tailFor(id)
+	}
+	switch colType {
+	case IntColumn:
+		colData.(map[rowID]int)[id] = v.(int)
+	case StringColumn:
+		if d, ok := colData.(*dictColumn); ok {
+			d.set(id, v.(string))
+			break
+		}
+		colData.(map[rowID]string)[id] = v.(string)
+	case CustomColumn:
+		colData.(map[rowID]interface{})[id] = v
+	}
+}
+
+// Deletes the value of a column in the given row, making it a NULL.
+// Not threadsafe. Caller should have acquired writelock
+func deleteColumnValue(colType ColumnType, colData interface{}, id rowID) {
+	if s, ok := colData.(*segmentedColumn); ok {
+		colData = s.tailFor(id)
+	}
+	switch colType {
+	case IntColumn:
+		delete(colData.(map[rowID]int), id)
+	case StringColumn:
+		if d, ok := colData.(*dictColumn); ok {
+			d.delete(id)
+			break
+		}
+		delete(colData.(map[rowID]string), id)
+	case CustomColumn:
+		delete(colData.(map[rowID]interface{}), id)
+	}
+}
+
+// Returns the values of all the columns in the given row, in the
+// order of the columns, with a nil for a NULL.
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) row(id rowID) []interface{} {
+	row := make([]interface{}, len(t.colsDesc))
+	for k, desc := range t.colsDesc {
+		row[k], _ = columnValue(desc.ColType, t.cols[desc.ColName], id)
+	}
+	return row
+}
+
+// Returns a row with the values of the given columns, and the
+// Default of every other column, in the order of the columns.
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) namedRow(values map[string]interface{}) ([]interface{},
+	error) {
+
+	row := make([]interface{}, len(t.colsDesc))
+	for k, desc := range t.colsDesc {
+		row[k] = desc.Default
+	}
+	for colName, v := range values {
+		k := t.colPos(colName)
+		if k < 0 {
+			return nil, fmt.Errorf("Invalid column name: %s", colName)
+		}
+		row[k] = v
+	}
+	return row, nil
+}
+
+// Stores the row, which has a value or a nil for every column, in place
+// of the live row with the same rowID, if any, and updates the indexes.
+// The row should have been checked against the constraints already.
+// Not threadsafe. Caller should have acquired writelock
+func (t *table) putRow(id rowID, row []interface{}) {
+	if t.liveRows[id] {
+		t.unindexRow(id)
+		t.unzoneRow(id)
+	}
+
+	for k, desc := range t.colsDesc {
+		if row[k] != nil {
+			setColumnValue(desc.ColType, t.cols[desc.ColName], id, row[k])
+			continue
+		}
+		deleteColumnValue(desc.ColType, t.cols[desc.ColName], id)
+	}
+	t.liveRows[id] = true
+	t.indexRow(id, row)
+	t.zoneRow(id, row)
+}
+
+// Removes the row and its values from the table and from the indexes.
+// Not threadsafe. Caller should have acquired writelock
+func (t *table) removeRow(id rowID) {
+	if !t.liveRows[id] {
+		return
+	}
+
+	// A row of only NULLs is never indexed
+	t.putRow(id, make([]interface{}, len(t.colsDesc)))
+	t.unzoneRow(id)
+	delete(t.liveRows, id)
+}
+
+// Returns the sorted rowIDs of all the live rows in the table.
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) liveRowIDs() []rowID {
+	rows := make([]rowID, 0, len(t.liveRows))
+	for id := range t.liveRows {
+		rows = append(rows, id)
+	}
+	return sortAndDeDup(rows)
 }
 
 func (t *table) newRowID() rowID {
@@ -94,11 +369,11 @@ func (t *table) String() string {
 		for _, j := range t.colsDesc {
 			switch j.ColType {
 			case IntColumn:
-				col := t.cols[j.ColName].(map[rowID]int)
-				s += strconv.Itoa(col[i])
+				v, _ := intValue(t.cols[j.ColName], i)
+				s += strconv.Itoa(v)
 			case StringColumn:
-				col := t.cols[j.ColName].(map[rowID]string)
-				s += col[i]
+				v, _ := stringValue(t.cols[j.ColName], i)
+				s += v
 			case CustomColumn:
 				col := t.cols[j.ColName].(map[rowID]interface{})
 				s += fmt.Sprintf("%s", col[i])
@@ -0,0 +1,343 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sets the columns to the values, in all the rows that match the cTree,
+// or in all the rows if the cTree is nil, where a nil value is a NULL.
+// Returns the number of rows updated. If any of the rows would violate
+// a constraint, a *ConstraintError is returned and no rows are updated.
+func (db *Keeri) Update(tableName string, values map[string]interface{},
+	cTree *ConditionTree) (int, error) {
+
+	tbl, unlock, err := db.lockForWrite(tableName)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	positions := make(map[int]interface{})
+	for colName, v := range values {
+		k := tbl.colPos(colName)
+		if k < 0 {
+			return 0, fmt.Errorf("Invalid column name: %s", colName)
+		}
+		if err = checkColumnValue(tbl.colsDesc[k], v); err != nil {
+			return 0, err
+		}
+		positions[k] = v
+	}
+
+	ids, err := tbl.matchingRows(cTree)
+	if err != nil {
+		return 0, err
+	}
+
+	w := &rowWriter{t: tbl}
+	for _, id := range ids {
+		row := tbl.row(id)
+		for k, v := range positions {
+			row[k] = v
+		}
+		if err = w.update(id, row); err != nil {
+			w.rollback()
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+// Deletes the rows that match the cTree, or all the rows if the cTree is
+// nil, and returns the number of rows deleted. The rows of the other
+// tables that refer to the deleted rows are deleted or updated, as their
+// foreign keys say, but are not counted. If any of the rows can not be
+// deleted, a *ConstraintError is returned and no rows are deleted.
+func (db *Keeri) Delete(tableName string, cTree *ConditionTree) (int, error) {
+	tbl, unlock, err := db.lockForWrite(tableName)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	ids, err := tbl.matchingRows(cTree)
+	if err != nil {
+		return 0, err
+	}
+
+	w := &rowWriter{t: tbl}
+	n := 0
+	for _, id := range ids {
+		// A row may have been deleted through a foreign key to the table
+		if !tbl.liveRows[id] {
+			continue
+		}
+		if err = w.remove(id); err != nil {
+			w.rollback()
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Returns the rowIDs of the rows that match the cTree, after resolving
+// it against the table, or of all the rows if the cTree is nil.
+// Not threadsafe. Caller should have acquired readlock
+func (t *table) matchingRows(cTree *ConditionTree) (ids []rowID, err error) {
+	if cTree == nil {
+		return t.liveRowIDs(), nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			ids = nil
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+
+	resolveColDetails(t, cTree)
+	return cTree.evaluate(t), nil
+}
+
+// Compiles the value of a SET in to an evaluator, whose values are of
+// the type of the column, where a nil e is a NULL, for a nil evaluator.
+// Not threadsafe. Caller should have acquired readlock
+func compileValue(tbl *table, desc ColumnDesc, e Expr) (evaluator, error) {
+	var ev evaluator
+	var err error
+	switch e := e.(type) {
+	case nil:
+		return nil, nil
+	case *Literal:
+		ev, err = compileLiteral(e, desc.ColType)
+	case *Param:
+		ev, err = compileParam(e, desc.ColType)
+	default:
+		ev, err = compileExpr(tbl, e)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ev.colType() != desc.ColType {
+		return nil, fmt.Errorf("Mismatched type of the value for the "+
+			"column '%s'", desc.ColName)
+	}
+	return ev, nil
+}
+
+// Compiles the SET of an UPDATE or of an ON CONFLICT DO UPDATE over
+// the src table, for the columns of the tbl, returning the positions
+// of the columns in the tbl, with the evaluators of their values
+func compileSet(tbl, src *table, cols []string, values []Expr) ([]int,
+	[]evaluator, error) {
+
+	positions := make([]int, len(cols))
+	evals := make([]evaluator, len(cols))
+	for k, colName := range cols {
+		positions[k] = tbl.colPos(colName)
+		if positions[k] < 0 {
+			return nil, nil, fmt.Errorf("Invalid column name: %s", colName)
+		}
+
+		var err error
+		desc := tbl.colsDesc[positions[k]]
+		if evals[k], err = compileValue(src, desc, values[k]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return positions, evals, nil
+}
+
+// Updates the rows matching the WHERE of the UPDATE, where the values
+// of the SET are evaluated over the rows before any of them is updated,
+// and returns the number of rows updated
+func (db *Keeri) execUpdate(s *updateStmt) (int, error) {
+	tbl, unlock, err := db.lockForWrite(s.table)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	positions, evals, err := compileSet(tbl, tbl, s.cols, s.values)
+	if err != nil {
+		return 0, err
+	}
+	ids, err := tbl.matchingRows(s.where)
+	if err != nil {
+		return 0, err
+	}
+
+	var rows [][]interface{}
+	vecs := make([]vector, len(evals))
+	for lo := 0; lo < len(ids); lo += exprBatchSize {
+		hi := lo + exprBatchSize
+		if hi > len(ids) {
+			hi = len(ids)
+		}
+		batch := ids[lo:hi]
+
+		for k, ev := range evals {
+			if ev != nil {
+				ev.eval(batch, &vecs[k])
+			}
+		}
+
+		for i, id := range batch {
+			row := tbl.row(id)
+			for k, ev := range evals {
+				row[positions[k]] = nil
+				if ev != nil {
+					row[positions[k]] = vecs[k].value(i)
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	w := &rowWriter{t: tbl}
+	for i, row := range rows {
+		if err = w.update(ids[i], row); err != nil {
+			w.rollback()
+			return 0, err
+		}
+	}
+	return len(rows), nil
+}
+
+// Handles the rows of an INSERT that have the same values as an
+// existing row, in the unique constraint of the ON CONFLICT, or in any
+// unique constraint if the ON CONFLICT has no columns. The existing
+// row is either left as it is, for a DO NOTHING, or is updated with
+// the SET of the DO UPDATE, where excluded.col is the value of col in
+// the row that was to be inserted. A DO UPDATE fails the INSERT if it
+// would update a row that the INSERT has already inserted or updated.
+// Not threadsafe. Caller should have acquired writelock
+type conflictHandler struct {
+	w      *rowWriter
+	target *index
+
+	// The rows that have been inserted or updated, for a DO UPDATE
+	affected map[rowID]bool
+
+	// A temporary table holding the existing row and the row that was
+	// to be inserted, that the SET is compiled over, with the columns
+	// of the table, followed by the same columns named excluded.col
+	src       *table
+	positions []int
+	evals     []evaluator
+}
+
+func newConflictHandler(w *rowWriter, tableName string,
+	s *insertStmt) (*conflictHandler, error) {
+
+	h := &conflictHandler{w: w}
+	tbl := w.t
+
+	var err error
+	if s.conflictCols != nil {
+		if h.target, err = tbl.indexOn(s.conflictCols); err != nil {
+			return nil, err
+		}
+	}
+	if !s.doUpdate {
+		return h, nil
+	}
+	h.affected = make(map[rowID]bool)
+
+	descs := append([]ColumnDesc{}, tbl.colsDesc...)
+	for _, i := range tbl.colsDesc {
+		i.ColName = "excluded." + i.ColName
+		descs = append(descs, i)
+	}
+	if h.src, err = newTable(descs); err != nil {
+		return nil, err
+	}
+
+	// The columns can also be qualified by the name of the table
+	for _, e := range s.setValues {
+		if e == nil {
+			continue
+		}
+		rewriteExprColumns(e, func(name string) string {
+			alias, colName := splitQualifiedName(name)
+			switch {
+			case strings.EqualFold(alias, "excluded"):
+				return "excluded." + colName
+			case alias == tableName:
+				return colName
+			}
+			return name
+		})
+	}
+
+	h.positions, h.evals, err = compileSet(tbl, h.src, s.setCols, s.setValues)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Inserts the row, or handles its conflict with an existing row,
+// returning the rowID of the row that was inserted or updated, or
+// false if the row was neither inserted nor updated
+func (h *conflictHandler) insert(row []interface{}) (rowID, bool, error) {
+	tbl := h.w.t
+
+	var other rowID
+	found := false
+	if h.target != nil {
+		var err error
+		if other, found, err = tbl.duplicateRow(h.target, 0, row); err != nil {
+			return 0, false, err
+		}
+	}
+
+	if !found {
+		id, err := h.w.insert(row)
+		var ce *ConstraintError
+		if err == nil && h.affected != nil {
+			h.affected[id] = true
+		}
+		if err == nil || h.target != nil || !errors.As(err, &ce) ||
+			!errors.Is(err, ErrUniqueViolation) {
+			return id, err == nil, err
+		}
+		other = ce.row
+	}
+
+	if h.src == nil {
+		return 0, false, nil
+	}
+	if h.affected[other] {
+		return 0, false, errors.New("ON CONFLICT DO UPDATE cannot affect " +
+			"row a second time")
+	}
+	h.affected[other] = true
+
+	old := tbl.row(other)
+	h.src.putRow(1, append(append([]interface{}{}, old...), row...))
+
+	var vec vector
+	for k, ev := range h.evals {
+		old[h.positions[k]] = nil
+		if ev != nil {
+			ev.eval([]rowID{1}, &vec)
+			old[h.positions[k]] = vec.value(0)
+		}
+	}
+	return other, true, h.w.update(other, old)
+}
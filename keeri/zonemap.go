@@ -0,0 +1,287 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+//
+// Copyright Sankar சங்கர் <sankar.curiosity@gmail.com>
+
+package keeri
+
+import "math"
+
+// The number of rows in a block of a zone map
+const zoneRows = 1024
+
+// A summary of the values of a block of rows of a column, with the
+// number of the rows that have a value, and of the live rows that have
+// a NULL. The min and the max are nil if no row of the block has a value.
+type zone struct {
+	min, max interface{}
+
+	count int
+	nulls int
+}
+
+// The zones of the blocks of zoneRows rows of an int or a string column
+// of a table, where the block k has the rowIDs from (base+k)*zoneRows+1,
+// as no zones are kept for the blocks that had only the rows deleted by
+// a Truncate. The min and the max of a block are widened by the values
+// that are inserted or updated, and are not narrowed when a value is
+// updated or deleted, until the block has no values, so that they may
+// be wider than the values of the block, but never narrower.
+// Not threadsafe. Protected by the dataMetaDataLock of the table.
+type zoneMap struct {
+	collation Collation
+	base      int
+	blocks    []zone
+}
+
+// Creates the zone maps of the int and the string columns
+func newZoneMaps(cols []ColumnDesc) map[string]*zoneMap {
+	zones := make(map[string]*zoneMap)
+	for _, desc := range cols {
+		if z := newZoneMap(desc); z != nil {
+			zones[desc.ColName] = z
+		}
+	}
+	return zones
+}
+
+// Returns an empty zone map for an int or a string column, or nil
+func newZoneMap(desc ColumnDesc) *zoneMap {
+	if desc.ColType != IntColumn && desc.ColType != StringColumn {
+		return nil
+	}
+	return &zoneMap{collation: desc.Collation}
+}
+
+// Returns the zone of the block of the given row
+func (z *zoneMap) block(id rowID) *zone {
+	k := int((id-1)/zoneRows) - z.base
+	for len(z.blocks) <= k {
+		z.blocks = append(z.blocks, zone{})
+	}
+	return &z.blocks[k]
+}
+
+// Adds the value of a live row, which is nil for a NULL, to its zone
+func (z *zoneMap) add(id rowID, v interface{}) {
+	b := z.block(id)
+	if v == nil {
+		b.nulls++
+		return
+	}
+	b.count++
+	b.widen(z.collation, v)
+}
+
+// Removes the value of a live row, which is nil for a NULL, from its zone
+func (z *zoneMap) remove(id rowID, v interface{}) {
+	b := z.block(id)
+	if v == nil {
+		b.nulls--
+		return
+	}
+	if b.count--; b.count == 0 {
+		b.min, b.max = nil, nil
+	}
+}
+
+// Widens the min and the max of the zone to cover the value, which is an
+// int or a string, where the strings are ordered by the given collation
+func (b *zone) widen(c Collation, v interface{}) {
+	if n, ok := v.(int); ok {
+		if b.min == nil || n < b.min.(int) {
+			b.min = n
+		}
+		if b.max == nil || n > b.max.(int) {
+			b.max = n
+		}
+		return
+	}
+
+	str := v.(string)
+	if b.min == nil || c.compare(str, b.min.(string)) < 0 {
+		b.min = str
+	}
+	if b.max == nil || c.compare(str, b.max.(string)) > 0 {
+		b.max = str
+	}
+}
+
+func (b *zone) schema() ZoneSchema {
+	return ZoneSchema{Rows: b.count, Nulls: b.nulls, Min: b.min, Max: b.max}
+}
+
+// Adds the values of the row, which has a value or a nil
+// for every column, to the zone maps of the table.
+// Not threadsafe. Caller should have acquired writelock
+func (t *table) zoneRow(id rowID, row []interface{}) {
+	for k, desc := range t.colsDesc {
+		if z := t.zones[desc.ColName]; z != nil {
+			z.add(id, row[k])
+		}
+	}
+}
+
+// Removes the values of the live row from the zone maps of the table,
+// before they are replaced. Not threadsafe. Caller should have acquired
+// writelock
+func (t *table) unzoneRow(id rowID) {
+	for _, desc := range t.colsDesc {
+		if z := t.zones[desc.ColName]; z != nil {
+			v, _ := columnValue(desc.ColType, t.cols[desc.ColName], id)
+			z.remove(id, v)
+		}
+	}
+}
+
+// Builds the zone map of a column out of the values of the live rows
+// in its data. Not threadsafe. Caller should have acquired readlock
+func (t *table) buildZoneMap(desc ColumnDesc, data interface{}) *zoneMap {
+	z := newZoneMap(desc)
+	if z == nil {
+		return nil
+	}
+	z.base = int(t.truncated / zoneRows)
+	for id := range t.liveRows {
+		v, _ := columnValue(desc.ColType, data, id)
+		z.add(id, v)
+	}
+	return z
+}
+
+// Returns the range of the values that match a condition over an int
+// column, with ok set to false if the condition is not a range. The
+// range is empty, with lo > hi, if no value can match the condition.
+func intRange(i *Condition) (lo, hi int, ok bool) {
+	switch i.op {
+	case EQ:
+		v := i.value.(int)
+		return v, v, true
+	case LT:
+		v := i.value.(int)
+		if v == math.MinInt {
+			return 0, -1, true
+		}
+		return math.MinInt, v - 1, true
+	case LTE:
+		return math.MinInt, i.value.(int), true
+	case GT:
+		v := i.value.(int)
+		if v == math.MaxInt {
+			return 0, -1, true
+		}
+		return v + 1, math.MaxInt, true
+	case GTE:
+		return i.value.(int), math.MaxInt, true
+	case BETWEEN:
+		r := i.value.([2]int)
+		return r[0], r[1], true
+	}
+	return 0, 0, false
+}
+
+// Returns true if the zone shows that none of
+// the values of its block can match the condition
+func (b *zone) skips(i *Condition) bool {
+	// A NULL never matches a condition
+	if b.count == 0 {
+		return true
+	}
+
+	if i.colDesc.ColType == IntColumn {
+		min, max := b.min.(int), b.max.(int)
+		if lo, hi, ok := intRange(i); ok {
+			return lo > hi || hi < min || lo > max
+		}
+		if i.op == IN {
+			for v := range i.value.(map[int]bool) {
+				if v >= min && v <= max {
+					return false
+				}
+			}
+			return true
+		}
+		return false
+	}
+
+	c := i.colDesc.Collation
+	min, max := b.min.(string), b.max.(string)
+	switch i.op {
+	case EQ:
+		v := i.value.(string)
+		return c.compare(v, min) < 0 || c.compare(v, max) > 0
+	case LT:
+		return c.compare(min, i.value.(string)) >= 0
+	case LTE:
+		return c.compare(min, i.value.(string)) > 0
+	case GT:
+		return c.compare(max, i.value.(string)) <= 0
+	case GTE:
+		return c.compare(max, i.value.(string)) < 0
+	case BETWEEN:
+		r := i.value.([2]string)
+		return c.compare(max, r[0]) < 0 || c.compare(min, r[1]) > 0
+	}
+	return false
+}
+
+// Evaluates a comparison or a BETWEEN over the rows of the blocks whose
+// zones show that some of their values may match it, skipping the other
+// blocks, with ok set to false for the other conditions, and when so
+// many of the blocks may match that scanning the whole column is faster.
+// Not threadsafe. Caller should have acquired readlock
+func (z *zoneMap) evaluate(i *Condition) (ret []rowID, ok bool) {
+	switch i.op {
+	case EQ, LT, LTE, GT, GTE, BETWEEN:
+	default:
+		return nil, false
+	}
+
+	var blocks []int
+	for k := range z.blocks {
+		if !z.blocks[k].skips(i) {
+			blocks = append(blocks, k)
+		}
+	}
+
+	// Looking up the rows of a block takes a few times longer than
+	// scanning them, and the blocks may have rows that are not live
+	if len(blocks)*4 > len(z.blocks) {
+		return nil, false
+	}
+
+	var match func(id rowID) bool
+	if i.colDesc.ColType == IntColumn {
+		lo, hi, _ := intRange(i)
+		match = func(id rowID) bool {
+			v, ok := intValue(i.colData, id)
+			return ok && v >= lo && v <= hi
+		}
+	} else {
+		c := i.colDesc.Collation
+		match = func(id rowID) bool {
+			v, ok := stringValue(i.colData, id)
+			switch {
+			case !ok:
+				return false
+			case i.op == EQ:
+				return v == i.value.(string)
+			case i.op == BETWEEN:
+				r := i.value.([2]string)
+				return c.compare(v, r[0]) >= 0 && c.compare(v, r[1]) <= 0
+			}
+			return matchesOrder(c.compare(v, i.value.(string)), i.op)
+		}
+	}
+
+	for _, k := range blocks {
+		first := rowID(z.base+k)*zoneRows + 1
+		for id := first; id < first+zoneRows; id++ {
+			if match(id) {
+				ret = append(ret, id)
+			}
+		}
+	}
+	return ret, true
+}